@@ -1,23 +1,190 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/storage/commitlog"
+	"github.com/gophercast/gophercast/internal/transport/gateway"
+	"github.com/gophercast/gophercast/internal/transport/grpc"
+	"github.com/gophercast/gophercast/internal/transport/mqtt"
+	"github.com/gophercast/gophercast/internal/transport/resp"
+	"github.com/gophercast/gophercast/internal/transport/tcp"
+	"github.com/gophercast/gophercast/internal/transport/websocket"
 )
 
 func main() {
+	dataDir := flag.String("data-dir", "", "directory for durable topic logs (durability is disabled when empty)")
+	syncPolicy := flag.String("sync", "always", "when durable logs are flushed to disk: always, interval, or never")
+	durable := flag.String("durable", "", "comma-separated list of durable topics")
+	retain := flag.String("retain", "", "comma-separated list of topics that retain their last message")
+	addr := flag.String("addr", tcp.DefaultAddr, "TCP address to listen on")
+	httpAddr := flag.String("http", "", "address for the HTTP gateway (disabled when empty)")
+	respAddr := flag.String("resp", "", "address for the Redis-compatible RESP listener, such as "+resp.DefaultAddr+" (disabled when empty)")
+	respSeparator := flag.String("resp-separator", "", "character in Redis channel names that maps to the topic separator, such as :")
+	grpcAddr := flag.String("grpc", "", "address for the gRPC listener, such as "+grpc.DefaultAddr+" (disabled when empty)")
+	mqttAddr := flag.String("mqtt", "", "address for the MQTT listener, such as "+mqtt.DefaultAddr+" (disabled when empty)")
+	flag.Parse()
+
 	fmt.Println("Starting GopherCast Broker...")
 
 	// Create broker
-	b := broker.NewBroker()
+	var opts []broker.Option
+	if *dataDir != "" {
+		policy, err := commitlog.ParseSyncPolicy(*syncPolicy)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts = append(opts, broker.WithDataDir(*dataDir, commitlog.WithSyncPolicy(policy)))
+	}
+
+	b := broker.NewBroker(opts...)
 	defer b.Close()
 
-	fmt.Println("GopherCast Broker is running. Press Ctrl+C to stop.")
-	fmt.Println("Note: This is a demonstration. Real usage involves importing the broker in your code.")
+	// Configure durable topics
+	if *durable != "" {
+		for _, name := range strings.Split(*durable, ",") {
+			t, err := topic.New(strings.TrimSpace(name))
+			if err != nil {
+				fmt.Printf("Error creating topic %q: %v\n", name, err)
+				os.Exit(1)
+			}
+			if err := b.ConfigureTopic(t, broker.Durable()); err != nil {
+				fmt.Printf("Error configuring durable topic %s: %v\n", t.String(), err)
+				os.Exit(1)
+			}
+			fmt.Printf("Durable topic: %s\n", t.String())
+		}
+	}
+
+	// Configure retaining topics
+	if *retain != "" {
+		for _, name := range strings.Split(*retain, ",") {
+			t, err := topic.New(strings.TrimSpace(name))
+			if err != nil {
+				fmt.Printf("Error creating topic %q: %v\n", name, err)
+				os.Exit(1)
+			}
+			if err := b.ConfigureTopic(t, broker.Retain()); err != nil {
+				fmt.Printf("Error configuring retained topic %s: %v\n", t.String(), err)
+				os.Exit(1)
+			}
+			fmt.Printf("Retained topic: %s\n", t.String())
+		}
+	}
+
+	// Publish scheduled messages now that topics are configured
+	if err := b.StartScheduler(); err != nil {
+		fmt.Printf("Error loading scheduled messages: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Listen for clients
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Printf("Error listening on %s: %v\n", *addr, err)
+		os.Exit(1)
+	}
+
+	server := tcp.NewServer(b)
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, tcp.ErrServerClosed) {
+			fmt.Printf("Error serving clients: %v\n", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Serve the HTTP gateway
+	var httpServer *http.Server
+	var wsHandler *websocket.Handler
+	if *httpAddr != "" {
+		gw := gateway.New(b)
+		defer gw.Close()
+
+		wsHandler = websocket.NewHandler(b)
+		gw.Handle("GET /ws", wsHandler)
+
+		httpServer = &http.Server{Addr: *httpAddr, Handler: gw}
+		go func() {
+			if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				fmt.Printf("Error serving HTTP: %v\n", err)
+				os.Exit(1)
+			}
+		}()
+		fmt.Printf("HTTP gateway is listening on %s (WebSocket at /ws)\n", *httpAddr)
+	}
+
+	// Serve gRPC clients over unencrypted HTTP/2
+	var grpcServer *grpc.Server
+	var grpcHTTPServer *http.Server
+	if *grpcAddr != "" {
+		grpcListener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			fmt.Printf("Error listening on %s: %v\n", *grpcAddr, err)
+			os.Exit(1)
+		}
+
+		grpcServer = grpc.NewServer(b)
+		grpcHTTPServer = &http.Server{Handler: grpcServer, Protocols: new(http.Protocols)}
+		grpcHTTPServer.Protocols.SetUnencryptedHTTP2(true)
+		go func() {
+			if err := grpcHTTPServer.Serve(grpcListener); !errors.Is(err, http.ErrServerClosed) {
+				fmt.Printf("Error serving gRPC: %v\n", err)
+				os.Exit(1)
+			}
+		}()
+		fmt.Printf("gRPC listener is listening on %s\n", grpcListener.Addr())
+	}
+
+	// Serve MQTT clients
+	var mqttServer *mqtt.Server
+	if *mqttAddr != "" {
+		mqttListener, err := net.Listen("tcp", *mqttAddr)
+		if err != nil {
+			fmt.Printf("Error listening on %s: %v\n", *mqttAddr, err)
+			os.Exit(1)
+		}
+
+		mqttServer = mqtt.NewServer(b)
+		go func() {
+			if err := mqttServer.Serve(mqttListener); !errors.Is(err, mqtt.ErrServerClosed) {
+				fmt.Printf("Error serving MQTT: %v\n", err)
+				os.Exit(1)
+			}
+		}()
+		fmt.Printf("MQTT listener is listening on %s\n", mqttListener.Addr())
+	}
+
+	// Serve Redis clients
+	var respServer *resp.Server
+	if *respAddr != "" {
+		respListener, err := net.Listen("tcp", *respAddr)
+		if err != nil {
+			fmt.Printf("Error listening on %s: %v\n", *respAddr, err)
+			os.Exit(1)
+		}
+
+		respServer = resp.NewServer(b, resp.WithChannelSeparator(*respSeparator))
+		go func() {
+			if err := respServer.Serve(respListener); !errors.Is(err, resp.ErrServerClosed) {
+				fmt.Printf("Error serving RESP: %v\n", err)
+				os.Exit(1)
+			}
+		}()
+		fmt.Printf("RESP listener is listening on %s\n", respListener.Addr())
+	}
+
+	fmt.Printf("GopherCast Broker is listening on %s. Press Ctrl+C to stop.\n", listener.Addr())
 
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
@@ -25,4 +192,19 @@ func main() {
 	<-quit
 
 	fmt.Println("\nShutting down broker...")
+	server.Close()
+	if httpServer != nil {
+		httpServer.Close()
+		wsHandler.Close()
+	}
+	if grpcServer != nil {
+		grpcServer.Close()
+		grpcHTTPServer.Close()
+	}
+	if mqttServer != nil {
+		mqttServer.Close()
+	}
+	if respServer != nil {
+		respServer.Close()
+	}
 }
@@ -1,23 +1,40 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"time"
 
-	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/client"
 	"github.com/gophercast/gophercast/internal/domain/message"
 	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/tcp"
 )
 
 func main() {
+	addr := flag.String("addr", "localhost"+tcp.DefaultAddr, "broker address")
+	topicName := flag.String("topic", "users.created", "topic to publish to")
+	flag.Parse()
+
 	fmt.Println("Starting Publisher Example...")
 
-	// Create broker (in real use, this would be shared)
-	b := broker.NewBroker()
-	defer b.Close()
+	// Connect to the broker started with cmd/broker
+	c, err := client.Dial(*addr,
+		client.WithStateHandler(func(from, to client.State) {
+			fmt.Printf("Connection %s -> %s\n", from, to)
+		}),
+		client.WithErrorHandler(func(err error) {
+			fmt.Printf("Error: %v\n", err)
+		}),
+	)
+	if err != nil {
+		fmt.Printf("Error connecting to broker: %v\n", err)
+		return
+	}
+	defer c.Close()
 
 	// Create topic
-	usersTopic, err := topic.New("users.created")
+	usersTopic, err := topic.New(*topicName)
 	if err != nil {
 		fmt.Printf("Error creating topic: %v\n", err)
 		return
@@ -35,7 +52,10 @@ func main() {
 
 		// Create and publish message
 		msg := message.NewMessage(usersTopic, data)
-		b.Publish(msg)
+		if err := c.Publish(msg); err != nil {
+			fmt.Printf("Error publishing: %v\n", err)
+			continue
+		}
 
 		fmt.Printf("Published: %s with data: %v\n", msg.String(), data)
 
@@ -43,8 +63,11 @@ func main() {
 		time.Sleep(500 * time.Millisecond)
 	}
 
-	fmt.Println("\nAll messages published!")
+	// Make sure the broker has everything before disconnecting
+	if err := c.Flush(5 * time.Second); err != nil {
+		fmt.Printf("Error flushing: %v\n", err)
+		return
+	}
 
-	// Keep running for a bit to let subscribers receive
-	time.Sleep(2 * time.Second)
+	fmt.Println("\nAll messages published!")
 }
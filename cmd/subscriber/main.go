@@ -1,32 +1,58 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
-	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/client"
 	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/tcp"
 )
 
 func main() {
+	addr := flag.String("addr", "localhost"+tcp.DefaultAddr, "broker address")
+	pattern := flag.String("topic", "users.created", "topic or pattern to subscribe to")
+	group := flag.String("group", "", "consumer group to join")
+	flag.Parse()
+
 	fmt.Println("Starting Subscriber Example...")
 
-	// Create broker (in real use, this would be shared)
-	b := broker.NewBroker()
-	defer b.Close()
+	// Connect to the broker started with cmd/broker
+	c, err := client.Dial(*addr,
+		client.WithStateHandler(func(from, to client.State) {
+			fmt.Printf("Connection %s -> %s\n", from, to)
+		}),
+		client.WithErrorHandler(func(err error) {
+			fmt.Printf("Error: %v\n", err)
+		}),
+	)
+	if err != nil {
+		fmt.Printf("Error connecting to broker: %v\n", err)
+		return
+	}
+	defer c.Close()
 
 	// Create topic to subscribe to
-	usersTopic, err := topic.New("users.created")
+	usersTopic, err := topic.NewPattern(*pattern)
 	if err != nil {
 		fmt.Printf("Error creating topic: %v\n", err)
 		return
 	}
 
 	// Subscribe to topic
-	sub := b.Subscribe(usersTopic)
-	defer b.Unsubscribe(sub.ID())
+	var opts []client.SubscribeOption
+	if *group != "" {
+		opts = append(opts, client.WithGroup(*group))
+	}
+	sub, err := c.Subscribe(usersTopic, opts...)
+	if err != nil {
+		fmt.Printf("Error subscribing: %v\n", err)
+		return
+	}
+	defer c.Unsubscribe(sub.ID())
 
 	fmt.Printf("Subscribed to topic: %s\n", usersTopic.String())
 	fmt.Println("Waiting for messages... Press Ctrl+C to stop.")
@@ -0,0 +1,545 @@
+// Package client connects to a broker served over TCP by cmd/broker. Its API mirrors
+// broker.Broker, and it reconnects with exponential backoff when the connection is
+// lost, restoring subscriptions and sending publishes that were buffered meanwhile.
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/wire"
+)
+
+// State is the client's connection state.
+type State int
+
+const (
+	// Connecting means the first connection attempt is in progress.
+	Connecting State = iota
+
+	// Connected means frames flow to and from the broker.
+	Connected
+
+	// Reconnecting means the connection was lost and the client is dialing again.
+	// Publishes are buffered in this state.
+	Reconnecting
+
+	// Closed means the client was closed or gave up reconnecting.
+	Closed
+)
+
+// String returns the state's name.
+func (s State) String() string {
+	switch s {
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Closed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// ErrClosed is returned when using a closed client.
+	ErrClosed = errors.New("client is closed")
+
+	// ErrBufferFull is returned when publishing while disconnected and the publish
+	// buffer is full.
+	ErrBufferFull = errors.New("client publish buffer is full")
+
+	// ErrUnknownSubscription is returned when unsubscribing an ID the client does not know.
+	ErrUnknownSubscription = errors.New("unknown subscription")
+
+	// ErrNotConnected is returned by Flush while the client is reconnecting.
+	ErrNotConnected = errors.New("client is not connected")
+
+	// ErrFlushTimeout is returned when the broker does not answer Flush in time.
+	ErrFlushTimeout = errors.New("flush timed out")
+)
+
+// BrokerError is an error the broker reported with an ERR frame.
+type BrokerError struct {
+	Message string
+}
+
+func (e *BrokerError) Error() string {
+	return "broker: " + e.Message
+}
+
+// Client is a connection to a remote broker. It is safe for concurrent use.
+type Client struct {
+	addr string
+
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	maxReconnects int
+	publishBuffer int
+	pingInterval  time.Duration
+	dialTimeout   time.Duration
+	stateHandlers []StateHandler
+	errorHandlers []ErrorHandler
+
+	mu      sync.Mutex // guards the fields below and serializes writes to conn
+	conn    net.Conn
+	writer  *bufio.Writer
+	state   State
+	subs    map[string]*Subscription // sid -> subscription
+	nextSID uint64
+	pending [][]byte        // encoded publishes waiting for a connection
+	pongs   []chan struct{} // one per PING in flight, nil for keepalives
+
+	transitions []transition // state changes not yet passed to the handlers
+	notifyMu    sync.Mutex   // keeps handler calls in order
+
+	lastRead   atomic.Int64 // unix nanoseconds of the last frame read
+	delivering atomic.Bool  // the reader is waiting for a subscriber to make room
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+type transition struct {
+	from, to State
+}
+
+// Dial connects to the broker at addr. It fails if the first connection attempt
+// fails; after that, lost connections are re-established in the background.
+func Dial(addr string, opts ...Option) (*Client, error) {
+	c := &Client{
+		addr:          addr,
+		minBackoff:    DefaultMinBackoff,
+		maxBackoff:    DefaultMaxBackoff,
+		publishBuffer: DefaultPublishBuffer,
+		pingInterval:  DefaultPingInterval,
+		dialTimeout:   DefaultDialTimeout,
+		state:         Connecting,
+		subs:          make(map[string]*Subscription),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, c.dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial broker at %s: %w", addr, err)
+	}
+
+	c.mu.Lock()
+	c.attachLocked(conn)
+	c.mu.Unlock()
+	c.notify()
+
+	go c.run(conn)
+
+	return c, nil
+}
+
+// State returns the current connection state.
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// Publish sends a message to the broker. While the client is reconnecting the
+// message is buffered and sent once the connection is restored.
+// Returns ErrBufferFull if the buffer is full, or ErrClosed.
+func (c *Client) Publish(msg message.Message) error {
+	if msg.Topic().IsWildcard() {
+		return fmt.Errorf("publish to %s: wildcard patterns cannot be published to", msg.Topic())
+	}
+	payload, err := message.Encode(msg)
+	if err != nil {
+		return err
+	}
+	frame, err := wire.AppendFrame(nil, wire.Frame{Op: wire.OpPub, Topic: msg.Topic().String(), Payload: payload})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case Closed:
+		return ErrClosed
+	case Connected:
+		if err := c.writeLocked(frame); err == nil {
+			return nil
+		}
+		// The write failed, so the connection is going down; keep the
+		// message for the next one
+	}
+
+	if len(c.pending) >= c.publishBuffer {
+		return ErrBufferFull
+	}
+	c.pending = append(c.pending, frame)
+	return nil
+}
+
+// Subscribe subscribes to a topic or pattern on the broker. The subscription is
+// restored automatically after a reconnect. Returns ErrClosed if the client is closed.
+func (c *Client) Subscribe(t topic.Topic, opts ...SubscribeOption) (*Subscription, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == Closed {
+		return nil, ErrClosed
+	}
+
+	c.nextSID++
+	sub := newSubscription(strconv.FormatUint(c.nextSID, 10), t, opts...)
+	c.subs[sub.id] = sub
+
+	if c.state == Connected {
+		// On failure the subscription is sent again after reconnecting
+		c.writeFrameLocked(sub.frame())
+	}
+
+	return sub, nil
+}
+
+// Unsubscribe cancels a subscription and closes its message channel.
+func (c *Client) Unsubscribe(subscriptionID string) error {
+	c.mu.Lock()
+	sub, ok := c.subs[subscriptionID]
+	if !ok {
+		c.mu.Unlock()
+		return ErrUnknownSubscription
+	}
+	delete(c.subs, subscriptionID)
+	if c.state == Connected {
+		c.writeFrameLocked(wire.Frame{Op: wire.OpUnsub, SID: subscriptionID})
+	}
+	c.mu.Unlock()
+
+	sub.close()
+	return nil
+}
+
+// Flush waits until the broker has processed every frame sent so far, by sending a
+// PING and waiting for its PONG. After Flush returns nil, earlier subscriptions are
+// active and earlier publishes have been delivered to the broker.
+func (c *Client) Flush(timeout time.Duration) error {
+	pong := make(chan struct{})
+
+	c.mu.Lock()
+	switch c.state {
+	case Closed:
+		c.mu.Unlock()
+		return ErrClosed
+	case Connected:
+	default:
+		c.mu.Unlock()
+		return ErrNotConnected
+	}
+	c.pongs = append(c.pongs, pong)
+	err := c.writeFrameLocked(wire.Frame{Op: wire.OpPing})
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-pong:
+		return nil
+	case <-timer.C:
+		return ErrFlushTimeout
+	case <-c.done:
+		return ErrClosed
+	}
+}
+
+// Close disconnects from the broker and closes every subscription.
+// Publishes still buffered for a reconnect are discarded.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.state == Closed {
+		c.mu.Unlock()
+		<-c.stopped
+		return nil
+	}
+	c.closeLocked()
+	c.mu.Unlock()
+	c.notify()
+
+	<-c.stopped
+	return nil
+}
+
+// closeLocked moves to the Closed state and releases everything the client holds.
+func (c *Client) closeLocked() {
+	c.setStateLocked(Closed)
+	close(c.done)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	for _, sub := range c.subs {
+		sub.close()
+	}
+	c.subs = make(map[string]*Subscription)
+	c.pending = nil
+}
+
+// run reads from the connection until it fails, then reconnects, until Close.
+func (c *Client) run(conn net.Conn) {
+	defer close(c.stopped)
+
+	for {
+		err := c.serve(conn)
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		c.reportError(fmt.Errorf("connection to %s lost: %w", c.addr, err))
+
+		c.mu.Lock()
+		c.setStateLocked(Reconnecting)
+		c.mu.Unlock()
+		c.notify()
+
+		conn = c.reconnect()
+		if conn == nil {
+			return
+		}
+	}
+}
+
+// serve reads frames from one connection and pings the broker until the
+// connection fails.
+func (c *Client) serve(conn net.Conn) error {
+	c.lastRead.Store(time.Now().UnixNano())
+
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+	go c.ping(conn, stopPing)
+
+	reader := wire.NewReader(conn, 0)
+	for {
+		f, err := reader.ReadFrame()
+		var protocolErr *wire.ProtocolError
+		if errors.As(err, &protocolErr) {
+			c.reportError(err)
+			continue
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		c.lastRead.Store(time.Now().UnixNano())
+
+		switch f.Op {
+		case wire.OpMsg:
+			c.dispatch(f)
+		case wire.OpPing:
+			c.mu.Lock()
+			if c.conn == conn {
+				c.writeFrameLocked(wire.Frame{Op: wire.OpPong})
+			}
+			c.mu.Unlock()
+		case wire.OpPong:
+			c.mu.Lock()
+			if c.conn == conn && len(c.pongs) > 0 {
+				if pong := c.pongs[0]; pong != nil {
+					close(pong)
+				}
+				c.pongs = c.pongs[1:]
+			}
+			c.mu.Unlock()
+		case wire.OpErr:
+			c.reportError(&BrokerError{Message: f.Message})
+		}
+	}
+}
+
+// ping sends PING frames and closes the connection if the broker stops answering.
+func (c *Client) ping(conn net.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		// A reader held up by a slow subscriber is not a silent broker
+		if !c.delivering.Load() && time.Since(time.Unix(0, c.lastRead.Load())) > 2*c.pingInterval {
+			conn.Close()
+			return
+		}
+
+		c.mu.Lock()
+		if c.conn == conn {
+			c.pongs = append(c.pongs, nil)
+			c.writeFrameLocked(wire.Frame{Op: wire.OpPing})
+		}
+		c.mu.Unlock()
+	}
+}
+
+// dispatch hands a received message to its subscription.
+func (c *Client) dispatch(f wire.Frame) {
+	msg, err := message.Decode(f.Payload)
+	if err != nil {
+		c.reportError(err)
+		return
+	}
+
+	c.mu.Lock()
+	sub, ok := c.subs[f.SID]
+	c.mu.Unlock()
+
+	// Messages for a subscription that was just cancelled are dropped
+	if ok {
+		c.delivering.Store(true)
+		sub.deliver(msg)
+		c.delivering.Store(false)
+		c.lastRead.Store(time.Now().UnixNano())
+	}
+}
+
+// reconnect dials with exponential backoff until it succeeds, the client is closed,
+// or the attempt limit is reached. On success the subscriptions are restored and
+// buffered publishes are sent before the client reports Connected.
+func (c *Client) reconnect() net.Conn {
+	delay := c.minBackoff
+
+	for attempt := 1; c.maxReconnects == 0 || attempt <= c.maxReconnects; attempt++ {
+		// Full jitter keeps many clients from reconnecting in lockstep
+		wait := delay/2 + rand.N(delay/2+1)
+		select {
+		case <-time.After(wait):
+		case <-c.done:
+			return nil
+		}
+
+		conn, err := net.DialTimeout("tcp", c.addr, c.dialTimeout)
+		if err != nil {
+			c.reportError(fmt.Errorf("reconnect to %s (attempt %d): %w", c.addr, attempt, err))
+			delay = min(delay*2, c.maxBackoff)
+			continue
+		}
+
+		c.mu.Lock()
+		if c.state == Closed {
+			c.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		c.attachLocked(conn)
+		c.mu.Unlock()
+		c.notify()
+
+		return conn
+	}
+
+	c.reportError(fmt.Errorf("giving up on %s after %d reconnect attempts", c.addr, c.maxReconnects))
+	c.mu.Lock()
+	if c.state != Closed {
+		c.closeLocked()
+	}
+	c.mu.Unlock()
+	c.notify()
+	return nil
+}
+
+// attachLocked makes conn the current connection, restores the subscriptions,
+// flushes buffered publishes and moves to Connected.
+func (c *Client) attachLocked(conn net.Conn) {
+	c.conn = conn
+	c.writer = bufio.NewWriter(conn)
+	c.pongs = nil // PINGs sent on the old connection are never answered
+
+	for _, sub := range c.subs {
+		buf, _ := wire.AppendFrame(nil, sub.frame())
+		c.writer.Write(buf)
+	}
+	for _, frame := range c.pending {
+		c.writer.Write(frame)
+	}
+	c.pending = nil
+
+	// A failed flush surfaces as a read error and another reconnect
+	conn.SetWriteDeadline(time.Now().Add(DefaultWriteTimeout))
+	c.writer.Flush()
+
+	c.setStateLocked(Connected)
+}
+
+// writeFrameLocked encodes and writes a frame to the current connection.
+func (c *Client) writeFrameLocked(f wire.Frame) error {
+	buf, err := wire.AppendFrame(nil, f)
+	if err != nil {
+		return err
+	}
+	return c.writeLocked(buf)
+}
+
+// writeLocked writes an encoded frame to the current connection. A failed write
+// closes the connection so that the reader notices and reconnects.
+func (c *Client) writeLocked(frame []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(DefaultWriteTimeout))
+	c.writer.Write(frame)
+	if err := c.writer.Flush(); err != nil {
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// setStateLocked records a state change for notify to report.
+func (c *Client) setStateLocked(s State) {
+	if c.state == s {
+		return
+	}
+	c.transitions = append(c.transitions, transition{from: c.state, to: s})
+	c.state = s
+}
+
+// notify passes recorded state changes to the state handlers. It is called without
+// c.mu held so that handlers may use the client.
+func (c *Client) notify() {
+	c.notifyMu.Lock()
+	defer c.notifyMu.Unlock()
+
+	c.mu.Lock()
+	transitions := c.transitions
+	c.transitions = nil
+	c.mu.Unlock()
+
+	for _, t := range transitions {
+		for _, handler := range c.stateHandlers {
+			handler(t.from, t.to)
+		}
+	}
+}
+
+func (c *Client) reportError(err error) {
+	for _, handler := range c.errorHandlers {
+		handler(err)
+	}
+}
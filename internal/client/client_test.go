@@ -0,0 +1,269 @@
+package client_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/client"
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/tcp"
+)
+
+// serve starts a TCP server for the broker on addr and returns a function that stops it.
+func serve(t *testing.T, b *broker.Broker, addr string) (string, func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	s := tcp.NewServer(b)
+	go s.Serve(l)
+
+	var once sync.Once
+	stop := func() { once.Do(func() { s.Close() }) }
+	t.Cleanup(stop)
+	return l.Addr().String(), stop
+}
+
+func receive(t *testing.T, sub *client.Subscription) message.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-sub.MessageChannel():
+		if !ok {
+			t.Fatal("message channel closed")
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return message.Message{}
+}
+
+// waitForState waits until the client reports the state.
+func waitForState(t *testing.T, c *client.Client, want client.State) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for c.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("State() = %v, want %v", c.State(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClientPublishSubscribe(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	addr, _ := serve(t, b, "127.0.0.1:0")
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+
+	orders, _ := topic.New("orders.created")
+	pattern, _ := topic.NewPattern("orders.*")
+	sub, err := c.Subscribe(pattern)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	if err := c.Flush(time.Second); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	b.Publish(message.NewMessage(orders, "from local"))
+	if got := receive(t, sub); got.Data() != "from local" {
+		t.Errorf("received %v, want from local", got.Data())
+	}
+
+	sent := message.NewMessage(orders, "from client", message.WithCorrelationID("req-1"))
+	if err := c.Publish(sent); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	got := receive(t, sub)
+	if got.ID() != sent.ID() || got.CorrelationID() != "req-1" {
+		t.Errorf("received %s (%q), want %s (req-1)", got.ID(), got.CorrelationID(), sent.ID())
+	}
+
+	if err := c.Unsubscribe(sub.ID()); err != nil {
+		t.Fatalf("Unsubscribe() error = %v", err)
+	}
+	if _, ok := <-sub.MessageChannel(); ok {
+		t.Error("message channel should be closed after Unsubscribe")
+	}
+	if err := c.Unsubscribe(sub.ID()); !errors.Is(err, client.ErrUnknownSubscription) {
+		t.Errorf("second Unsubscribe() error = %v, want ErrUnknownSubscription", err)
+	}
+}
+
+func TestClientReconnectRestoresSubscriptionsAndFlushesPublishes(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	addr, stop := serve(t, b, "127.0.0.1:0")
+
+	var mu sync.Mutex
+	var states []client.State
+	c, err := client.Dial(addr,
+		client.WithBackoff(10*time.Millisecond, 50*time.Millisecond),
+		client.WithStateHandler(func(from, to client.State) {
+			mu.Lock()
+			states = append(states, to)
+			mu.Unlock()
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+
+	orders, _ := topic.New("orders")
+	sub, _ := c.Subscribe(orders)
+	if err := c.Flush(time.Second); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	// Lose the connection; the broker itself keeps running
+	stop()
+	waitForState(t, c, client.Reconnecting)
+
+	if err := c.Publish(message.NewMessage(orders, "buffered")); err != nil {
+		t.Fatalf("Publish() while reconnecting error = %v", err)
+	}
+	if err := c.Flush(time.Second); !errors.Is(err, client.ErrNotConnected) {
+		t.Errorf("Flush() while reconnecting error = %v, want ErrNotConnected", err)
+	}
+
+	// Bring the server back on the same address
+	serve(t, b, addr)
+	waitForState(t, c, client.Connected)
+
+	// The restored subscription receives the buffered publish
+	if got := receive(t, sub); got.Data() != "buffered" {
+		t.Errorf("received %v, want buffered", got.Data())
+	}
+
+	c.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	want := []client.State{client.Connected, client.Reconnecting, client.Connected, client.Closed}
+	if len(states) != len(want) {
+		t.Fatalf("state changes = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("state changes = %v, want %v", states, want)
+			break
+		}
+	}
+}
+
+func TestClientPublishBufferLimit(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	addr, stop := serve(t, b, "127.0.0.1:0")
+
+	c, err := client.Dial(addr, client.WithPublishBuffer(2), client.WithBackoff(time.Hour, time.Hour))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+
+	stop()
+	waitForState(t, c, client.Reconnecting)
+
+	orders, _ := topic.New("orders")
+	for i := 0; i < 2; i++ {
+		if err := c.Publish(message.NewMessage(orders, i)); err != nil {
+			t.Fatalf("Publish() %d error = %v", i, err)
+		}
+	}
+	if err := c.Publish(message.NewMessage(orders, 2)); !errors.Is(err, client.ErrBufferFull) {
+		t.Errorf("Publish() beyond the buffer error = %v, want ErrBufferFull", err)
+	}
+}
+
+func TestClientGivesUpAfterMaxReconnectAttempts(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	addr, stop := serve(t, b, "127.0.0.1:0")
+
+	c, err := client.Dial(addr,
+		client.WithBackoff(time.Millisecond, time.Millisecond),
+		client.WithMaxReconnectAttempts(3),
+	)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	orders, _ := topic.New("orders")
+	sub, _ := c.Subscribe(orders)
+
+	stop()
+	waitForState(t, c, client.Closed)
+
+	if _, ok := <-sub.MessageChannel(); ok {
+		t.Error("message channel should be closed once the client gives up")
+	}
+	if err := c.Publish(message.NewMessage(orders, "late")); !errors.Is(err, client.ErrClosed) {
+		t.Errorf("Publish() after giving up error = %v, want ErrClosed", err)
+	}
+	c.Close()
+}
+
+func TestClientReportsBrokerErrors(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	s := tcp.NewServer(b, tcp.WithMaxPayload(16))
+	go s.Serve(l)
+	defer s.Close()
+
+	errs := make(chan error, 10)
+	c, err := client.Dial(l.Addr().String(), client.WithErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+
+	// The broker answers an oversized payload with ERR
+	orders, _ := topic.New("orders")
+	c.Publish(message.NewMessage(orders, "a payload that is larger than sixteen bytes"))
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case err := <-errs:
+			var brokerErr *client.BrokerError
+			if errors.As(err, &brokerErr) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a BrokerError")
+		}
+	}
+}
+
+func TestClientDialFailure(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	if _, err := client.Dial(addr, client.WithDialTimeout(time.Second)); err == nil {
+		t.Error("Dial() to a closed port should fail")
+	}
+}
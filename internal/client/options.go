@@ -0,0 +1,124 @@
+package client
+
+import (
+	"time"
+)
+
+const (
+	// DefaultMinBackoff is the delay before the first reconnect attempt.
+	DefaultMinBackoff = 100 * time.Millisecond
+
+	// DefaultMaxBackoff caps the delay between reconnect attempts.
+	DefaultMaxBackoff = 10 * time.Second
+
+	// DefaultPublishBuffer is how many publishes are held while disconnected.
+	DefaultPublishBuffer = 1024
+
+	// DefaultPingInterval is how often the client checks that the broker is alive.
+	DefaultPingInterval = 30 * time.Second
+
+	// DefaultDialTimeout bounds each connection attempt.
+	DefaultDialTimeout = 5 * time.Second
+
+	// DefaultWriteTimeout bounds each write to the broker.
+	DefaultWriteTimeout = 10 * time.Second
+
+	// DefaultSubscriptionBuffer is how many received messages a subscription holds
+	// before the client stops reading from the broker.
+	DefaultSubscriptionBuffer = 200
+)
+
+// StateHandler is called when the client's connection state changes.
+// Handlers are called one at a time, in the order the changes happened.
+type StateHandler func(from, to State)
+
+// ErrorHandler is called with errors that happen in the background, such as a failed
+// reconnect attempt or an ERR frame sent by the broker.
+type ErrorHandler func(err error)
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithBackoff sets the delay before the first reconnect attempt and the cap it doubles up to.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		if min > 0 {
+			c.minBackoff = min
+		}
+		if max >= c.minBackoff {
+			c.maxBackoff = max
+		}
+	}
+}
+
+// WithMaxReconnectAttempts limits how many consecutive reconnect attempts are made
+// before the client gives up and closes. Zero, the default, retries forever.
+func WithMaxReconnectAttempts(n int) Option {
+	return func(c *Client) {
+		c.maxReconnects = n
+	}
+}
+
+// WithPublishBuffer sets how many publishes are held while disconnected.
+// Publishing beyond the limit returns ErrBufferFull. Zero disables buffering.
+func WithPublishBuffer(n int) Option {
+	return func(c *Client) {
+		if n >= 0 {
+			c.publishBuffer = n
+		}
+	}
+}
+
+// WithPingInterval sets how often the client pings the broker. A connection that
+// has been silent for two intervals is treated as lost.
+func WithPingInterval(d time.Duration) Option {
+	return func(c *Client) {
+		if d > 0 {
+			c.pingInterval = d
+		}
+	}
+}
+
+// WithDialTimeout bounds each connection attempt.
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		if d > 0 {
+			c.dialTimeout = d
+		}
+	}
+}
+
+// WithStateHandler registers a callback for connection state changes.
+func WithStateHandler(handler StateHandler) Option {
+	return func(c *Client) {
+		c.stateHandlers = append(c.stateHandlers, handler)
+	}
+}
+
+// WithErrorHandler registers a callback for background errors.
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(c *Client) {
+		c.errorHandlers = append(c.errorHandlers, handler)
+	}
+}
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(*Subscription)
+
+// WithGroup makes the subscription a member of a consumer group on the broker.
+func WithGroup(name string) SubscribeOption {
+	return func(s *Subscription) {
+		s.group = name
+	}
+}
+
+// WithBufferSize sets how many received messages the subscription holds. When the
+// buffer is full the client stops reading from the broker, and the broker's overflow
+// policy applies.
+func WithBufferSize(n int) SubscribeOption {
+	return func(s *Subscription) {
+		if n >= 0 {
+			s.bufferSize = n
+		}
+	}
+}
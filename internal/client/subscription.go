@@ -0,0 +1,91 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/wire"
+)
+
+// Subscription receives messages from a remote broker.
+type Subscription struct {
+	id         string
+	topic      topic.Topic
+	group      string
+	bufferSize int
+	messages   chan message.Message
+
+	mu        sync.RWMutex // held for reading while delivering, for writing while closing
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSubscription(id string, t topic.Topic, opts ...SubscribeOption) *Subscription {
+	s := &Subscription{
+		id:         id,
+		topic:      t,
+		bufferSize: DefaultSubscriptionBuffer,
+		done:       make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.messages = make(chan message.Message, s.bufferSize)
+	return s
+}
+
+// ID returns the subscription identifier, for use with Client.Unsubscribe.
+func (s *Subscription) ID() string {
+	return s.id
+}
+
+// Topic returns the topic or pattern subscribed to.
+func (s *Subscription) Topic() topic.Topic {
+	return s.topic
+}
+
+// Group returns the consumer group the subscription belongs to, or "" if none.
+func (s *Subscription) Group() string {
+	return s.group
+}
+
+// MessageChannel returns the channel for receiving messages.
+// It is closed when the subscription is cancelled or the client is closed.
+func (s *Subscription) MessageChannel() <-chan message.Message {
+	return s.messages
+}
+
+// frame returns the SUB frame that registers the subscription with the broker.
+func (s *Subscription) frame() wire.Frame {
+	return wire.Frame{Op: wire.OpSub, Topic: s.topic.String(), SID: s.id, Group: s.group}
+}
+
+// deliver waits for room in the message channel, or for the subscription to close.
+func (s *Subscription) deliver(msg message.Message) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.messages <- msg:
+	case <-s.done:
+	}
+}
+
+// close releases a waiting deliver and closes the message channel.
+func (s *Subscription) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.mu.Lock()
+		s.closed = true
+		close(s.messages)
+		s.mu.Unlock()
+	})
+}
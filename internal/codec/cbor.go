@@ -0,0 +1,407 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// CBOR encodes values in the Concise Binary Object Representation (RFC 8949).
+// Structs are encoded as maps keyed by their json tag names, and time.Time is
+// written as an RFC 3339 string with tag 0. Indefinite-length items are accepted
+// when decoding.
+type CBOR struct{}
+
+// CBOR major types.
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+)
+
+// CBOR tags understood by the decoder.
+const (
+	cborTagDateTime = 0 // RFC 3339 string
+	cborTagEpoch    = 1 // seconds since the epoch, integer or float
+)
+
+// cborIndefinite is the additional information value for indefinite-length items.
+const cborIndefinite = 31
+
+// cborBreak ends an indefinite-length item.
+const cborBreak = 0xff
+
+// ContentType returns "application/cbor".
+func (CBOR) ContentType() string {
+	return ContentTypeCBOR
+}
+
+// Marshal encodes v as CBOR.
+func (CBOR) Marshal(v interface{}) ([]byte, error) {
+	w := &cborWriter{}
+	if err := walk(w, reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+// Unmarshal decodes CBOR data into v.
+func (CBOR) Unmarshal(data []byte, v interface{}) error {
+	r := &cborReader{data: data}
+	value, err := r.read(0)
+	if err != nil {
+		return err
+	}
+	if r.pos != len(data) {
+		return fmt.Errorf("codec: %d trailing bytes after CBOR value", len(data)-r.pos)
+	}
+	return decodeInto(value, v)
+}
+
+// cborWriter appends CBOR-encoded values to buf.
+type cborWriter struct {
+	buf []byte
+}
+
+// head writes an item's initial byte and argument in the shortest form.
+func (w *cborWriter) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		w.buf = append(w.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, major|26), uint32(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, major|27), n)
+	}
+}
+
+func (w *cborWriter) writeNil() {
+	w.buf = append(w.buf, 0xf6)
+}
+
+func (w *cborWriter) writeBool(b bool) {
+	if b {
+		w.buf = append(w.buf, 0xf5)
+	} else {
+		w.buf = append(w.buf, 0xf4)
+	}
+}
+
+func (w *cborWriter) writeInt(i int64) {
+	if i >= 0 {
+		w.head(cborUnsigned, uint64(i))
+	} else {
+		w.head(cborNegative, uint64(-1-i))
+	}
+}
+
+func (w *cborWriter) writeUint(u uint64) {
+	w.head(cborUnsigned, u)
+}
+
+func (w *cborWriter) writeFloat32(f float32) {
+	w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xfa), math.Float32bits(f))
+}
+
+func (w *cborWriter) writeFloat64(f float64) {
+	w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xfb), math.Float64bits(f))
+}
+
+func (w *cborWriter) writeString(s string) {
+	w.head(cborText, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *cborWriter) writeBytes(b []byte) {
+	w.head(cborBytes, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *cborWriter) writeArrayHeader(n int) {
+	w.head(cborArray, uint64(n))
+}
+
+func (w *cborWriter) writeMapHeader(n int) {
+	w.head(cborMap, uint64(n))
+}
+
+func (w *cborWriter) writeTime(t time.Time) {
+	w.head(cborTag, cborTagDateTime)
+	w.writeString(t.Format(time.RFC3339Nano))
+}
+
+// cborReader decodes CBOR data into generic values.
+type cborReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *cborReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.pos {
+		return nil, errShortData
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// head reads an item's major type, additional information and argument.
+func (r *cborReader) head() (major byte, info byte, arg uint64, err error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		data, err := r.next(size)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, c := range data {
+			arg = arg<<8 | uint64(c)
+		}
+		return major, info, arg, nil
+	case info == cborIndefinite:
+		return major, info, 0, nil
+	}
+	return 0, 0, 0, fmt.Errorf("codec: invalid CBOR additional information %d", info)
+}
+
+// length converts an argument to a length that fits in the remaining data.
+func (r *cborReader) length(arg uint64) (int, error) {
+	if arg > uint64(len(r.data)-r.pos) {
+		return 0, errShortData
+	}
+	return int(arg), nil
+}
+
+// atBreak consumes a break byte if one is next.
+func (r *cborReader) atBreak() (bool, error) {
+	if r.pos >= len(r.data) {
+		return false, errShortData
+	}
+	if r.data[r.pos] == cborBreak {
+		r.pos++
+		return true, nil
+	}
+	return false, nil
+}
+
+func (r *cborReader) read(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("codec: value nested deeper than %d levels", maxDepth)
+	}
+	major, info, arg, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == cborIndefinite
+
+	switch major {
+	case cborUnsigned, cborNegative:
+		if indefinite {
+			break
+		}
+		if major == cborUnsigned {
+			if arg <= math.MaxInt64 {
+				return int64(arg), nil
+			}
+			return arg, nil
+		}
+		if arg > math.MaxInt64 {
+			return nil, fmt.Errorf("codec: CBOR negative integer overflows int64")
+		}
+		return -1 - int64(arg), nil
+
+	case cborBytes, cborText:
+		data, err := r.readChunks(major, indefinite, arg)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(data), nil
+		}
+		return data, nil
+
+	case cborArray:
+		var items []interface{}
+		if !indefinite {
+			n, err := r.length(arg)
+			if err != nil {
+				return nil, err
+			}
+			items = make([]interface{}, 0, n)
+		}
+		for i := 0; indefinite || uint64(i) < arg; i++ {
+			if indefinite {
+				if done, err := r.atBreak(); err != nil || done {
+					return items, err
+				}
+			}
+			item, err := r.read(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		if items == nil {
+			items = []interface{}{}
+		}
+		return items, nil
+
+	case cborMap:
+		entries := make(map[string]interface{})
+		if !indefinite {
+			if _, err := r.length(arg); err != nil {
+				return nil, err
+			}
+		}
+		for i := 0; indefinite || uint64(i) < arg; i++ {
+			if indefinite {
+				if done, err := r.atBreak(); err != nil || done {
+					return entries, err
+				}
+			}
+			key, err := r.read(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.read(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			entries[mapKey(key)] = value
+		}
+		return entries, nil
+
+	case cborTag:
+		if indefinite {
+			break
+		}
+		value, err := r.read(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return cborTagged(arg, value)
+
+	case cborSimple:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			return halfToFloat(uint16(arg)), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), nil
+		case 27:
+			return math.Float64frombits(arg), nil
+		}
+	}
+
+	return nil, fmt.Errorf("codec: unsupported CBOR item (major type %d, info %d)", major, info)
+}
+
+// readChunks reads a byte or text string, joining the chunks of an indefinite-length one.
+func (r *cborReader) readChunks(major byte, indefinite bool, arg uint64) ([]byte, error) {
+	if !indefinite {
+		n, err := r.length(arg)
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), data...), nil
+	}
+
+	data := []byte{}
+	for {
+		if done, err := r.atBreak(); err != nil || done {
+			return data, err
+		}
+		chunkMajor, info, arg, err := r.head()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || info == cborIndefinite {
+			return nil, fmt.Errorf("codec: invalid chunk in indefinite-length CBOR string")
+		}
+		n, err := r.length(arg)
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+}
+
+// cborTagged interprets a tagged value. Date/time tags become time.Time and other
+// tags are ignored in favour of the value they enclose.
+func cborTagged(tag uint64, value interface{}) (interface{}, error) {
+	switch tag {
+	case cborTagDateTime:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("codec: CBOR date/time tag on %T", value)
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case cborTagEpoch:
+		switch n := value.(type) {
+		case int64:
+			return time.Unix(n, 0), nil
+		case float64:
+			sec, frac := math.Modf(n)
+			return time.Unix(int64(sec), int64(frac*1e9)), nil
+		}
+		return nil, fmt.Errorf("codec: CBOR epoch tag on %T", value)
+	}
+	return value, nil
+}
+
+// halfToFloat converts an IEEE 754 half-precision float.
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
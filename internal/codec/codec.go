@@ -0,0 +1,121 @@
+// Package codec converts message payloads to and from bytes so they can be written to
+// disk or sent over the network. Codecs are registered by content type; the content
+// type is recorded in a message header so the receiving side can pick the same codec.
+//
+// The JSON, MessagePack, CBOR and protobuf codecs are implemented with the standard
+// library only. Values decoded without a target type use the generic types
+// map[string]interface{}, []interface{}, string, []byte, bool, int64, uint64, float64,
+// time.Time and nil.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+)
+
+// Content types of the built-in codecs.
+const (
+	ContentTypeJSON        = "application/json"
+	ContentTypeMessagePack = "application/msgpack"
+	ContentTypeCBOR        = "application/cbor"
+	ContentTypeProtobuf    = "application/protobuf"
+	ContentTypeOctetStream = "application/octet-stream"
+)
+
+// ErrUnknownContentType is returned when no codec is registered for a content type.
+var ErrUnknownContentType = errors.New("codec: unknown content type")
+
+// Codec encodes values to bytes and decodes them back.
+type Codec interface {
+	// ContentType returns the MIME type the codec produces, such as "application/json".
+	ContentType() string
+
+	// Marshal encodes v.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data into the value pointed to by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Registry maps content types to codecs. It is safe for concurrent use.
+type Registry struct {
+	mu     sync.RWMutex
+	codecs map[string]Codec
+}
+
+// NewRegistry creates a registry holding the given codecs.
+func NewRegistry(codecs ...Codec) *Registry {
+	r := &Registry{codecs: make(map[string]Codec)}
+	for _, c := range codecs {
+		r.Register(c)
+	}
+	return r
+}
+
+// Register adds a codec under its content type, replacing any codec already registered for it.
+func (r *Registry) Register(c Codec) {
+	r.RegisterAlias(c.ContentType(), c)
+}
+
+// RegisterAlias adds a codec under an additional content type, such as "application/x-msgpack".
+func (r *Registry) RegisterAlias(contentType string, c Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codecs[normalize(contentType)] = c
+}
+
+// Lookup returns the codec for a content type. Parameters such as "; charset=utf-8"
+// are ignored. Returns ErrUnknownContentType if no codec is registered.
+func (r *Registry) Lookup(contentType string) (Codec, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.codecs[normalize(contentType)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownContentType, contentType)
+	}
+	return c, nil
+}
+
+// ContentTypes returns the content types with a registered codec.
+func (r *Registry) ContentTypes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	types := make([]string, 0, len(r.codecs))
+	for contentType := range r.codecs {
+		types = append(types, contentType)
+	}
+	return types
+}
+
+// normalize strips parameters and lower-cases a content type.
+func normalize(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// Default is the registry used by the message package. It holds the built-in codecs.
+var Default = newDefaultRegistry()
+
+func newDefaultRegistry() *Registry {
+	r := NewRegistry(JSON{}, MessagePack{}, CBOR{}, Protobuf{})
+	r.RegisterAlias("application/x-msgpack", MessagePack{})
+	r.RegisterAlias("application/x-protobuf", Protobuf{})
+	return r
+}
+
+// Register adds a codec to the Default registry.
+func Register(c Codec) {
+	Default.Register(c)
+}
+
+// Lookup returns the codec for a content type from the Default registry.
+func Lookup(contentType string) (Codec, error) {
+	return Default.Lookup(contentType)
+}
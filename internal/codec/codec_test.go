@@ -0,0 +1,326 @@
+package codec_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/codec"
+)
+
+type order struct {
+	ID       string            `json:"id"`
+	Quantity int               `json:"quantity"`
+	Price    float64           `json:"price"`
+	Paid     bool              `json:"paid"`
+	Tags     []string          `json:"tags,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	Raw      []byte            `json:"raw,omitempty"`
+	PlacedAt time.Time         `json:"placed_at"`
+	Note     *string           `json:"note"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	note := "leave at door"
+	want := order{
+		ID:       "o-1",
+		Quantity: -3,
+		Price:    19.99,
+		Paid:     true,
+		Tags:     []string{"gift", "express"},
+		Meta:     map[string]string{"region": "eu"},
+		Raw:      []byte{0, 1, 2, 255},
+		PlacedAt: time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC),
+		Note:     &note,
+	}
+
+	for _, c := range []codec.Codec{codec.JSON{}, codec.MessagePack{}, codec.CBOR{}} {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			data, err := c.Marshal(want)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			var got order
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !got.PlacedAt.Equal(want.PlacedAt) {
+				t.Errorf("PlacedAt = %v, want %v", got.PlacedAt, want.PlacedAt)
+			}
+			got.PlacedAt = want.PlacedAt
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCodecGenericDecode(t *testing.T) {
+	input := map[string]interface{}{
+		"name":   "gopher",
+		"count":  42,
+		"ratio":  0.5,
+		"nested": []interface{}{"a", true, nil},
+	}
+
+	for _, c := range []codec.Codec{codec.MessagePack{}, codec.CBOR{}} {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			data, err := c.Marshal(input)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			var got interface{}
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			want := map[string]interface{}{
+				"name":   "gopher",
+				"count":  int64(42),
+				"ratio":  0.5,
+				"nested": []interface{}{"a", true, nil},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Unmarshal() = %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestCodecIntegerSizes(t *testing.T) {
+	values := []int64{0, 1, 23, 24, 127, 128, 255, 256, 65535, 65536, -1, -32, -33, -128, -129, -32768, -32769, 1 << 40, -1 << 40}
+
+	for _, c := range []codec.Codec{codec.MessagePack{}, codec.CBOR{}} {
+		for _, want := range values {
+			data, err := c.Marshal(want)
+			if err != nil {
+				t.Fatalf("%s: Marshal(%d) error = %v", c.ContentType(), want, err)
+			}
+			var got int64
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatalf("%s: Unmarshal(%d) error = %v", c.ContentType(), want, err)
+			}
+			if got != want {
+				t.Errorf("%s: round trip of %d = %d", c.ContentType(), want, got)
+			}
+		}
+	}
+}
+
+func TestCodecKnownEncodings(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec codec.Codec
+		value interface{}
+		want  []byte
+	}{
+		{"msgpack fixmap", codec.MessagePack{}, map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{"msgpack negative fixint", codec.MessagePack{}, -5, []byte{0xfb}},
+		{"msgpack nil", codec.MessagePack{}, nil, []byte{0xc0}},
+		{"cbor array", codec.CBOR{}, []int{1, 2, 3}, []byte{0x83, 0x01, 0x02, 0x03}},
+		{"cbor negative", codec.CBOR{}, -500, []byte{0x39, 0x01, 0xf3}},
+		{"cbor text", codec.CBOR{}, "IETF", []byte{0x64, 'I', 'E', 'T', 'F'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.codec.Marshal(tt.value)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Marshal() = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCBORDecodeForeignItems(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{"indefinite array", []byte{0x9f, 0x01, 0x02, 0xff}, []interface{}{int64(1), int64(2)}},
+		{"indefinite text", []byte{0x7f, 0x62, 'a', 'b', 0x61, 'c', 0xff}, "abc"},
+		{"indefinite map", []byte{0xbf, 0x61, 'k', 0xf5, 0xff}, map[string]interface{}{"k": true}},
+		{"half float", []byte{0xf9, 0x3e, 0x00}, 1.5},
+		{"epoch tag", []byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}, time.Unix(1363896240, 0)},
+		{"unknown tag", []byte{0xd8, 0x20, 0x63, 'u', 'r', 'l'}, "url"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got interface{}
+			if err := (codec.CBOR{}).Unmarshal(tt.data, &got); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodecRejectsMalformedInput(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec codec.Codec
+		data  []byte
+	}{
+		{"msgpack truncated string", codec.MessagePack{}, []byte{0xa5, 'a'}},
+		{"msgpack huge array", codec.MessagePack{}, []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{"msgpack trailing bytes", codec.MessagePack{}, []byte{0x01, 0x02}},
+		{"msgpack invalid byte", codec.MessagePack{}, []byte{0xc1}},
+		{"cbor truncated", codec.CBOR{}, []byte{0x19, 0x01}},
+		{"cbor huge map", codec.CBOR{}, []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"cbor unterminated", codec.CBOR{}, []byte{0x9f, 0x01}},
+		{"json trailing data", codec.JSON{}, []byte(`{"a":1} garbage`)},
+		{"json two values", codec.JSON{}, []byte(`1 2`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got interface{}
+			if err := tt.codec.Unmarshal(tt.data, &got); err == nil {
+				t.Errorf("Unmarshal() = %#v, want error", got)
+			}
+		})
+	}
+}
+
+func TestCodecTypeMismatch(t *testing.T) {
+	data, err := (codec.MessagePack{}).Marshal(map[string]interface{}{"quantity": "lots"})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	var got order
+	if err := (codec.MessagePack{}).Unmarshal(data, &got); err == nil {
+		t.Error("Unmarshal() of string into int field succeeded, want error")
+	}
+}
+
+// point is a hand-written protobuf message with one varint field.
+type point struct {
+	X uint8
+}
+
+func (p point) Marshal() ([]byte, error) { return []byte{0x08, p.X}, nil }
+
+func (p *point) Unmarshal(data []byte) error {
+	if len(data) != 2 || data[0] != 0x08 {
+		return errors.New("bad point")
+	}
+	p.X = data[1]
+	return nil
+}
+
+func TestProtobufCodec(t *testing.T) {
+	c := codec.Protobuf{}
+
+	data, err := c.Marshal(point{X: 7})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	var got point
+	if err := c.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if got.X != 7 {
+		t.Errorf("X = %d, want 7", got.X)
+	}
+
+	if _, err := c.Marshal(struct{}{}); err == nil {
+		t.Error("Marshal() of a non-protobuf value succeeded, want error")
+	}
+}
+
+// reflectPoint stands in for a message generated by google.golang.org/protobuf,
+// which has no Marshal or Unmarshal methods.
+type reflectPoint struct {
+	X uint8
+}
+
+func TestProtobufCodecFuncs(t *testing.T) {
+	c := codec.Protobuf{
+		MarshalFunc: func(v interface{}) ([]byte, error) {
+			p, ok := v.(*reflectPoint)
+			if !ok {
+				return nil, errors.New("not a point")
+			}
+			return []byte{0x08, p.X}, nil
+		},
+		UnmarshalFunc: func(data []byte, v interface{}) error {
+			p, ok := v.(*reflectPoint)
+			if !ok || len(data) != 2 {
+				return errors.New("bad point")
+			}
+			p.X = data[1]
+			return nil
+		},
+	}
+
+	data, err := c.Marshal(&reflectPoint{X: 7})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	var got reflectPoint
+	if err := c.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if got.X != 7 {
+		t.Errorf("X = %d, want 7", got.X)
+	}
+
+	// Types the codec handles itself do not reach the funcs
+	if data, err := c.Marshal(point{X: 9}); err != nil || data[1] != 9 {
+		t.Errorf("Marshal(point) = %v, %v, want the point's own encoding", data, err)
+	}
+}
+
+func TestRegistryLookup(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+		wantErr     bool
+	}{
+		{"application/json", codec.ContentTypeJSON, false},
+		{"application/json; charset=utf-8", codec.ContentTypeJSON, false},
+		{"Application/MsgPack", codec.ContentTypeMessagePack, false},
+		{"application/x-msgpack", codec.ContentTypeMessagePack, false},
+		{"application/cbor", codec.ContentTypeCBOR, false},
+		{"application/x-protobuf", codec.ContentTypeProtobuf, false},
+		{"text/plain", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			c, err := codec.Lookup(tt.contentType)
+			if tt.wantErr {
+				if !errors.Is(err, codec.ErrUnknownContentType) {
+					t.Errorf("Lookup() error = %v, want ErrUnknownContentType", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Lookup() error = %v", err)
+			}
+			if c.ContentType() != tt.want {
+				t.Errorf("ContentType() = %q, want %q", c.ContentType(), tt.want)
+			}
+		})
+	}
+
+	r := codec.NewRegistry()
+	if _, err := r.Lookup(codec.ContentTypeJSON); err == nil {
+		t.Error("empty registry found a codec")
+	}
+	r.Register(codec.JSON{})
+	if _, err := r.Lookup(codec.ContentTypeJSON); err != nil {
+		t.Errorf("Lookup() after Register error = %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package codec
+
+import (
+	"encoding/json"
+)
+
+// JSON encodes values with encoding/json.
+// Numbers decoded without a target type become float64, as with encoding/json.
+type JSON struct{}
+
+// ContentType returns "application/json".
+func (JSON) ContentType() string {
+	return ContentTypeJSON
+}
+
+// Marshal encodes v as JSON.
+func (JSON) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes JSON into v. Data after the first JSON value is an error.
+func (JSON) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,398 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// MessagePack encodes values in the MessagePack format (https://msgpack.org).
+// Structs are encoded as maps keyed by their json tag names, and time.Time uses the
+// timestamp extension type.
+type MessagePack struct{}
+
+// msgpackTimestamp is the extension type reserved for timestamps.
+const msgpackTimestamp = -1
+
+var errShortData = errors.New("codec: unexpected end of data")
+
+// ContentType returns "application/msgpack".
+func (MessagePack) ContentType() string {
+	return ContentTypeMessagePack
+}
+
+// Marshal encodes v as MessagePack.
+func (MessagePack) Marshal(v interface{}) ([]byte, error) {
+	w := &msgpackWriter{}
+	if err := walk(w, reflect.ValueOf(v), 0); err != nil {
+		return nil, err
+	}
+	return w.buf, nil
+}
+
+// Unmarshal decodes MessagePack data into v.
+func (MessagePack) Unmarshal(data []byte, v interface{}) error {
+	r := &msgpackReader{data: data}
+	value, err := r.read(0)
+	if err != nil {
+		return err
+	}
+	if r.pos != len(data) {
+		return fmt.Errorf("codec: %d trailing bytes after MessagePack value", len(data)-r.pos)
+	}
+	return decodeInto(value, v)
+}
+
+// msgpackWriter appends MessagePack-encoded values to buf.
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) writeNil() {
+	w.buf = append(w.buf, 0xc0)
+}
+
+func (w *msgpackWriter) writeBool(b bool) {
+	if b {
+		w.buf = append(w.buf, 0xc3)
+	} else {
+		w.buf = append(w.buf, 0xc2)
+	}
+}
+
+func (w *msgpackWriter) writeInt(i int64) {
+	switch {
+	case i >= 0:
+		w.writeUint(uint64(i))
+	case i >= -32:
+		w.buf = append(w.buf, byte(i))
+	case i >= math.MinInt8:
+		w.buf = append(w.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xd2), uint32(i))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xd3), uint64(i))
+	}
+}
+
+func (w *msgpackWriter) writeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		w.buf = append(w.buf, byte(u))
+	case u <= math.MaxUint8:
+		w.buf = append(w.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xce), uint32(u))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xcf), u)
+	}
+}
+
+func (w *msgpackWriter) writeFloat32(f float32) {
+	w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xca), math.Float32bits(f))
+}
+
+func (w *msgpackWriter) writeFloat64(f float64) {
+	w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xcb), math.Float64bits(f))
+}
+
+func (w *msgpackWriter) writeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		w.buf = append(w.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xda), uint16(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xdb), uint32(n))
+	}
+	w.buf = append(w.buf, s...)
+}
+
+func (w *msgpackWriter) writeBytes(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xc5), uint16(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xc6), uint32(n))
+	}
+	w.buf = append(w.buf, b...)
+}
+
+func (w *msgpackWriter) writeArrayHeader(n int) {
+	switch {
+	case n < 16:
+		w.buf = append(w.buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xdc), uint16(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xdd), uint32(n))
+	}
+}
+
+func (w *msgpackWriter) writeMapHeader(n int) {
+	switch {
+	case n < 16:
+		w.buf = append(w.buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xde), uint16(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xdf), uint32(n))
+	}
+}
+
+// writeTime uses the smallest of the 32, 64 and 96-bit timestamp layouts that fits.
+func (w *msgpackWriter) writeTime(t time.Time) {
+	sec := t.Unix()
+	nsec := uint64(t.Nanosecond())
+	ext := byte(0xff) // int8(msgpackTimestamp)
+
+	switch {
+	case sec >= 0 && sec <= math.MaxUint32 && nsec == 0:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xd6, ext), uint32(sec))
+	case sec >= 0 && sec < 1<<34:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xd7, ext), nsec<<34|uint64(sec))
+	default:
+		w.buf = append(w.buf, 0xc7, 12, ext)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(nsec))
+		w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(sec))
+	}
+}
+
+// msgpackReader decodes MessagePack data into generic values.
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.pos {
+		return nil, errShortData
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *msgpackReader) uint(size int) (uint64, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// length reads a size-byte length prefix.
+func (r *msgpackReader) length(size int) (int, error) {
+	n, err := r.uint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(r.data)) {
+		return 0, errShortData
+	}
+	return int(n), nil
+}
+
+func (r *msgpackReader) read(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("codec: value nested deeper than %d levels", maxDepth)
+	}
+	head, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	b := head[0]
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return r.readMap(int(b&0x0f), depth)
+	case b&0xf0 == 0x90:
+		return r.readArray(int(b&0x0f), depth)
+	case b&0xe0 == 0xa0:
+		return r.readString(int(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.length(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), data...), nil
+
+	case 0xc7, 0xc8, 0xc9:
+		n, err := r.length(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return r.readExt(n)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return r.readExt(1 << (b - 0xd4))
+
+	case 0xca:
+		bits, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(bits))), nil
+	case 0xcb:
+		bits, err := r.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := r.uint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+		return u, nil
+
+	case 0xd0:
+		u, err := r.uint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := r.uint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := r.uint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := r.uint(8)
+		return int64(u), err
+
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.length(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.readString(n)
+	case 0xdc, 0xdd:
+		n, err := r.length(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.readArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := r.length(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.readMap(n, depth)
+	}
+
+	return nil, fmt.Errorf("codec: invalid MessagePack type byte 0x%02x", b)
+}
+
+func (r *msgpackReader) readString(n int) (interface{}, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (r *msgpackReader) readArray(n int, depth int) (interface{}, error) {
+	// Every element takes at least one byte, which bounds the allocation
+	if n > len(r.data)-r.pos {
+		return nil, errShortData
+	}
+	items := make([]interface{}, n)
+	for i := range items {
+		item, err := r.read(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+func (r *msgpackReader) readMap(n int, depth int) (interface{}, error) {
+	if n > len(r.data)-r.pos {
+		return nil, errShortData
+	}
+	entries := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := r.read(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := r.read(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		entries[mapKey(key)] = value
+	}
+	return entries, nil
+}
+
+// readExt decodes an extension value. Timestamps become time.Time and other
+// extension types are returned as their raw data.
+func (r *msgpackReader) readExt(n int) (interface{}, error) {
+	typ, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(typ[0]) != msgpackTimestamp {
+		return append([]byte(nil), data...), nil
+	}
+
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(data[:4])
+		sec := binary.BigEndian.Uint64(data[4:])
+		return time.Unix(int64(sec), int64(nsec)), nil
+	}
+	return nil, fmt.Errorf("codec: invalid MessagePack timestamp length %d", n)
+}
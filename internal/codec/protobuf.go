@@ -0,0 +1,88 @@
+package codec
+
+import (
+	"fmt"
+)
+
+// ProtoMarshaler is implemented by protobuf messages that can encode themselves to the
+// protobuf wire format, such as those generated by gogo/protobuf or vtprotobuf.
+type ProtoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// ProtoUnmarshaler is implemented by protobuf messages that can decode themselves from
+// the protobuf wire format.
+type ProtoUnmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+// Protobuf encodes values that marshal themselves to the protobuf wire format.
+// Marshal accepts a ProtoMarshaler or already-encoded []byte, and Unmarshal accepts a
+// ProtoUnmarshaler, a *[]byte, or a *interface{} (which receives the raw bytes,
+// since protobuf data cannot be decoded without its schema).
+//
+// Messages generated by google.golang.org/protobuf do not have Marshal and Unmarshal
+// methods. To encode them, register a Protobuf with MarshalFunc and UnmarshalFunc set
+// to proto.Marshal and proto.Unmarshal, which keeps this package free of the dependency:
+//
+//	codec.Register(codec.Protobuf{
+//		MarshalFunc: func(v interface{}) ([]byte, error) {
+//			m, ok := v.(proto.Message)
+//			if !ok {
+//				return nil, fmt.Errorf("%T is not a proto.Message", v)
+//			}
+//			return proto.Marshal(m)
+//		},
+//		UnmarshalFunc: func(data []byte, v interface{}) error {
+//			m, ok := v.(proto.Message)
+//			if !ok {
+//				return fmt.Errorf("%T is not a proto.Message", v)
+//			}
+//			return proto.Unmarshal(data, m)
+//		},
+//	})
+type Protobuf struct {
+	// MarshalFunc, if set, encodes values that are neither ProtoMarshaler nor []byte.
+	MarshalFunc func(v interface{}) ([]byte, error)
+
+	// UnmarshalFunc, if set, decodes into targets that are not ProtoUnmarshaler,
+	// *[]byte or *interface{}.
+	UnmarshalFunc func(data []byte, v interface{}) error
+}
+
+// ContentType returns "application/protobuf".
+func (Protobuf) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+// Marshal encodes v to the protobuf wire format.
+func (p Protobuf) Marshal(v interface{}) ([]byte, error) {
+	switch value := v.(type) {
+	case ProtoMarshaler:
+		return value.Marshal()
+	case []byte:
+		return value, nil
+	}
+	if p.MarshalFunc != nil {
+		return p.MarshalFunc(v)
+	}
+	return nil, fmt.Errorf("codec: protobuf cannot marshal %T: it does not implement ProtoMarshaler and no MarshalFunc is set", v)
+}
+
+// Unmarshal decodes protobuf wire-format data into v.
+func (p Protobuf) Unmarshal(data []byte, v interface{}) error {
+	switch target := v.(type) {
+	case ProtoUnmarshaler:
+		return target.Unmarshal(data)
+	case *[]byte:
+		*target = append([]byte(nil), data...)
+		return nil
+	case *interface{}:
+		*target = append([]byte(nil), data...)
+		return nil
+	}
+	if p.UnmarshalFunc != nil {
+		return p.UnmarshalFunc(data, v)
+	}
+	return fmt.Errorf("codec: protobuf cannot unmarshal into %T: it does not implement ProtoUnmarshaler and no UnmarshalFunc is set", v)
+}
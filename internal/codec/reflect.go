@@ -0,0 +1,462 @@
+package codec
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDepth limits how deeply nested a value may be, so that hostile input cannot
+// exhaust the stack.
+const maxDepth = 512
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// valueWriter is implemented by the binary formats. walk drives it from a Go value.
+type valueWriter interface {
+	writeNil()
+	writeBool(b bool)
+	writeInt(i int64)
+	writeUint(u uint64)
+	writeFloat32(f float32)
+	writeFloat64(f float64)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeArrayHeader(n int)
+	writeMapHeader(n int)
+	writeTime(t time.Time)
+}
+
+// walk writes v using the same mapping as encoding/json: structs become maps keyed by
+// their json tag names, and []byte is written as binary data.
+func walk(w valueWriter, v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("codec: value nested deeper than %d levels", maxDepth)
+	}
+	if !v.IsValid() {
+		w.writeNil()
+		return nil
+	}
+	if v.Type() == timeType {
+		w.writeTime(v.Interface().(time.Time))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		return walk(w, v.Elem(), depth+1)
+
+	case reflect.Bool:
+		w.writeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.writeUint(v.Uint())
+	case reflect.Float32:
+		w.writeFloat32(float32(v.Float()))
+	case reflect.Float64:
+		w.writeFloat64(v.Float())
+	case reflect.String:
+		w.writeString(v.String())
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			w.writeBytes(b)
+			return nil
+		}
+		w.writeArrayHeader(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := walk(w, v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if v.IsNil() {
+			w.writeNil()
+			return nil
+		}
+		keys := v.MapKeys()
+		// Sort string keys so the same value always encodes to the same bytes
+		if v.Type().Key().Kind() == reflect.String {
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		}
+		w.writeMapHeader(len(keys))
+		for _, key := range keys {
+			if err := walk(w, key, depth+1); err != nil {
+				return err
+			}
+			if err := walk(w, v.MapIndex(key), depth+1); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		var fields []structField
+		for _, f := range cachedFields(v.Type()) {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+				continue
+			}
+			fields = append(fields, f)
+		}
+		w.writeMapHeader(len(fields))
+		for _, f := range fields {
+			fv, _ := fieldByIndex(v, f.index)
+			w.writeString(f.name)
+			if err := walk(w, fv, depth+1); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("codec: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// structField describes an encoded struct field.
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // reflect.Type -> []structField
+
+// cachedFields returns the encoded fields of a struct type, following json tags.
+// Fields of embedded structs without a tag are promoted, as in encoding/json.
+func cachedFields(t reflect.Type) []structField {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]structField)
+	}
+	fields := typeFields(t, nil)
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+func typeFields(t reflect.Type, index []int) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		fieldIndex := append(append([]int(nil), index...), i)
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, typeFields(ft, fieldIndex)...)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, structField{
+			name:      name,
+			index:     fieldIndex,
+			omitEmpty: strings.Contains(opts, "omitempty"),
+		})
+	}
+	return fields
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but reports false instead of
+// panicking when an embedded pointer is nil.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// fieldByIndexAlloc is like fieldByIndex but allocates nil embedded pointers.
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+// decodeInto stores a generic decoded value in the value pointed to by target.
+// The binary formats decode to generic values first and then use decodeInto, so
+// both share the mapping from generic values to Go types.
+func decodeInto(src interface{}, target interface{}) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("codec: Unmarshal needs a non-nil pointer, got %T", target)
+	}
+	return assign(rv.Elem(), src)
+}
+
+// assign stores src in dst, converting between compatible types.
+func assign(dst reflect.Value, src interface{}) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	if dst.Kind() == reflect.Interface && dst.NumMethod() == 0 {
+		dst.Set(reflect.ValueOf(src))
+		return nil
+	}
+	if dst.Kind() == reflect.Pointer {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return assign(dst.Elem(), src)
+	}
+	if dst.Type() == timeType {
+		switch value := src.(type) {
+		case time.Time:
+			dst.Set(reflect.ValueOf(value))
+			return nil
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return fmt.Errorf("codec: cannot decode %q into time.Time: %w", value, err)
+			}
+			dst.Set(reflect.ValueOf(t))
+			return nil
+		}
+		return mismatch(src, dst)
+	}
+
+	switch dst.Kind() {
+	case reflect.Bool:
+		if b, ok := src.(bool); ok {
+			dst.SetBool(b)
+			return nil
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := toInt(src)
+		if !ok || dst.OverflowInt(i) {
+			return mismatch(src, dst)
+		}
+		dst.SetInt(i)
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, ok := toUint(src)
+		if !ok || dst.OverflowUint(u) {
+			return mismatch(src, dst)
+		}
+		dst.SetUint(u)
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		f, ok := toFloat(src)
+		if !ok || dst.OverflowFloat(f) {
+			return mismatch(src, dst)
+		}
+		dst.SetFloat(f)
+		return nil
+
+	case reflect.String:
+		switch value := src.(type) {
+		case string:
+			dst.SetString(value)
+			return nil
+		case []byte:
+			dst.SetString(string(value))
+			return nil
+		}
+
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			switch value := src.(type) {
+			case []byte:
+				dst.SetBytes(append([]byte(nil), value...))
+				return nil
+			case string:
+				dst.SetBytes([]byte(value))
+				return nil
+			}
+		}
+		items, ok := src.([]interface{})
+		if !ok {
+			break
+		}
+		slice := reflect.MakeSlice(dst.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := assign(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		dst.Set(slice)
+		return nil
+
+	case reflect.Array:
+		if b, ok := src.([]byte); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			reflect.Copy(dst, reflect.ValueOf(b))
+			return nil
+		}
+		items, ok := src.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < dst.Len(); i++ {
+			var item interface{}
+			if i < len(items) {
+				item = items[i]
+			}
+			if err := assign(dst.Index(i), item); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		entries, ok := src.(map[string]interface{})
+		if !ok || dst.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMapWithSize(dst.Type(), len(entries)))
+		}
+		for k, item := range entries {
+			elem := reflect.New(dst.Type().Elem()).Elem()
+			if err := assign(elem, item); err != nil {
+				return err
+			}
+			dst.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), elem)
+		}
+		return nil
+
+	case reflect.Struct:
+		entries, ok := src.(map[string]interface{})
+		if !ok {
+			break
+		}
+		fields := cachedFields(dst.Type())
+		for k, item := range entries {
+			f, ok := lookupField(fields, k)
+			if !ok {
+				continue
+			}
+			if err := assign(fieldByIndexAlloc(dst, f.index), item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return mismatch(src, dst)
+}
+
+// lookupField finds the field for a key, preferring an exact match and falling back
+// to a case-insensitive one, as in encoding/json.
+func lookupField(fields []structField, key string) (structField, bool) {
+	for _, f := range fields {
+		if f.name == key {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, key) {
+			return f, true
+		}
+	}
+	return structField{}, false
+}
+
+func mismatch(src interface{}, dst reflect.Value) error {
+	return fmt.Errorf("codec: cannot decode %T into %s", src, dst.Type())
+}
+
+func toInt(src interface{}) (int64, bool) {
+	switch n := src.(type) {
+	case int64:
+		return n, true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case float64:
+		return int64(n), n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64
+	}
+	return 0, false
+}
+
+func toUint(src interface{}) (uint64, bool) {
+	switch n := src.(type) {
+	case int64:
+		return uint64(n), n >= 0
+	case uint64:
+		return n, true
+	case float64:
+		return uint64(n), n == math.Trunc(n) && n >= 0 && n < math.MaxUint64
+	}
+	return 0, false
+}
+
+func toFloat(src interface{}) (float64, bool) {
+	switch n := src.(type) {
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// mapKey converts a decoded map key to a string. Generic maps are keyed by string,
+// so keys of other types are formatted.
+func mapKey(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
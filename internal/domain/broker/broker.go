@@ -1,100 +1,356 @@
 package broker
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/gophercast/gophercast/internal/domain/message"
 	"github.com/gophercast/gophercast/internal/domain/subscription"
 	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/storage/commitlog"
+)
+
+var (
+	// ErrNoDataDir is returned when configuring a durable topic on a broker without a data directory.
+	ErrNoDataDir = errors.New("broker has no data directory")
+
+	// ErrWildcardTopic is returned when a wildcard pattern is used where a concrete topic is required.
+	ErrWildcardTopic = errors.New("wildcard patterns cannot be configured or published to")
+
+	// ErrGroupStrategyConflict is returned when a subscription joins a consumer group
+	// with a different strategy from the group's other members.
+	ErrGroupStrategyConflict = errors.New("consumer group uses a different strategy")
+
+	// ErrBrokerClosed is returned when publishing or subscribing after Close.
+	ErrBrokerClosed = errors.New("broker is closed")
 )
 
 // Broker is the central hub that manages topics and routes messages to subscribers.
 // It is safe for concurrent use by multiple goroutines.
 type Broker struct {
-	subscriptions map[string][]*subscription.Subscription // topic name -> subscriptions
+	subscriptions map[string]*subscription.Subscription // subscription ID -> subscription
+	trie          *subscriptionTrie                     // topic pattern -> subscriptions
+	topics        map[string]*topicConfig               // topic name -> configuration
 	mutex         sync.RWMutex
+	closed        bool
+
+	replayMutex sync.Mutex // serializes reading and replaying dead letters
+
+	retained      map[string]*retainedTopic // topic name -> retained messages
+	retainedMutex sync.Mutex
+
+	schedule *scheduler // messages waiting for PublishAt or PublishAfter
+
+	expiredHandlers []ExpiredHandler
+
+	dataDir    string
+	logOptions []commitlog.Option
 }
 
 // NewBroker creates a new message broker.
-func NewBroker() *Broker {
-	return &Broker{
-		subscriptions: make(map[string][]*subscription.Subscription),
+func NewBroker(opts ...Option) *Broker {
+	b := &Broker{
+		subscriptions: make(map[string]*subscription.Subscription),
+		trie:          newSubscriptionTrie(),
+		topics:        make(map[string]*topicConfig),
+		retained:      make(map[string]*retainedTopic),
 	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	b.schedule = newScheduler(b.publishScheduled, b.schedulePath())
+
+	return b
+}
+
+// ConfigureTopic applies options to a topic, such as making it durable.
+// Options accumulate across calls. Configuring a durable topic opens its log and
+// recovers any messages stored by a previous run.
+func (b *Broker) ConfigureTopic(t topic.Topic, opts ...TopicOption) error {
+	if t.IsWildcard() {
+		return ErrWildcardTopic
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Configure a copy, since publishers read the current config without the lock
+	cfg := &topicConfig{}
+	if current, ok := b.topics[t.String()]; ok {
+		*cfg = *current
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if cfg.durable && cfg.log == nil {
+		log, err := b.openTopicLog(t.String())
+		if err != nil {
+			return err
+		}
+		cfg.log = log
+	}
+
+	b.topics[t.String()] = cfg
+	return nil
 }
 
 // Subscribe creates a new subscription for the given topic.
+// The topic may be a pattern created with topic.NewPattern, in which case the
+// subscription receives messages from every topic the pattern matches.
+// Options configure the subscription's buffer size, overflow policy and consumer group.
+// On a durable topic, a start position other than the latest replays stored messages
+// before following new ones. Otherwise, messages retained by matching topics are
+// delivered before live messages.
 // Returns the subscription which includes a channel for receiving messages.
-func (b *Broker) Subscribe(t topic.Topic) *subscription.Subscription {
+// After Close, or if the subscription joins a consumer group with a different group
+// strategy from its other members, the returned subscription is already closed;
+// use SubscribeContext to learn why.
+func (b *Broker) Subscribe(t topic.Topic, opts ...subscription.Option) *subscription.Subscription {
+	sub, err := b.subscribe(t, opts)
+	if err != nil {
+		sub = subscription.NewSubscription(t, opts...)
+		sub.Close()
+	}
+	return sub
+}
+
+// SubscribeContext is like Subscribe but unsubscribes when ctx ends. It returns
+// ErrBrokerClosed after Close, ErrGroupStrategyConflict if the subscription's group
+// strategy differs from its group's, and ctx.Err() if ctx has already ended.
+func (b *Broker) SubscribeContext(ctx context.Context, t topic.Topic, opts ...subscription.Option) (*subscription.Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sub, err := b.subscribe(t, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.Unsubscribe(sub.ID())
+		case <-sub.Done():
+		}
+	}()
+	return sub, nil
+}
+
+// subscribe registers a new subscription, or returns ErrBrokerClosed or
+// ErrGroupStrategyConflict.
+func (b *Broker) subscribe(t topic.Topic, opts []subscription.Option) (*subscription.Subscription, error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	sub := subscription.NewSubscription(t)
-	topicName := t.String()
+	if b.closed {
+		return nil, ErrBrokerClosed
+	}
 
-	b.subscriptions[topicName] = append(b.subscriptions[topicName], sub)
+	cfg, ok := b.topics[t.String()]
 
-	return sub
+	// Topic defaults come first so the caller's options can override them
+	var subOpts []subscription.Option
+	if ok && cfg.deadLetter {
+		subOpts = append(subOpts, subscription.WithMaxDeliver(cfg.maxDeliveries))
+	}
+	subOpts = append(subOpts, opts...)
+	subOpts = append(subOpts, subscription.WithDropHandler(b.handleDrop))
+
+	sub := subscription.NewSubscription(t, subOpts...)
+	b.subscriptions[sub.ID()] = sub
+
+	// Replaying subscriptions read the topic's log instead of receiving live fanout.
+	// Consumer group members always share the live stream.
+	if ok && cfg.log != nil && sub.Group() == "" && sub.StartPosition().Kind != subscription.StartLatest {
+		go b.replay(sub, cfg.log, cfg.log.NextOffset())
+		return sub, nil
+	}
+
+	// Retained messages are queued before the subscription can receive live ones
+	if sub.Group() == "" {
+		b.sendRetained(sub)
+	}
+	if err := b.trie.insert(sub); err != nil {
+		delete(b.subscriptions, sub.ID())
+		sub.Close()
+		return nil, err
+	}
+
+	return sub, nil
 }
 
 // Unsubscribe removes a subscription from the broker.
 // The subscription will no longer receive messages.
+// When a consumer group member leaves, messages still waiting in its queue are
+// handed to the remaining members so that nothing in flight is lost.
 func (b *Broker) Unsubscribe(subscriptionID string) {
 	b.mutex.Lock()
-	defer b.mutex.Unlock()
 
-	// Find and remove the subscription from all topics
-	for topicName, subs := range b.subscriptions {
-		for i, sub := range subs {
-			if sub.ID() == subscriptionID {
-				// Close the subscription
-				sub.Close()
+	sub, ok := b.subscriptions[subscriptionID]
+	if !ok {
+		b.mutex.Unlock()
+		return
+	}
 
-				// Remove from slice
-				b.subscriptions[topicName] = append(subs[:i], subs[i+1:]...)
+	// Remove the subscription from the index so it stops receiving messages
+	group, _ := b.trie.remove(sub)
+	delete(b.subscriptions, subscriptionID)
+	b.mutex.Unlock()
 
-				// If no more subscriptions for this topic, remove the topic
-				if len(b.subscriptions[topicName]) == 0 {
-					delete(b.subscriptions, topicName)
-				}
+	if group == nil {
+		sub.Close()
+		return
+	}
 
-				return
-			}
-		}
+	// Rebalance: redistribute undelivered messages outside the lock, since
+	// delivery may wait on a member's Block policy
+	for _, msg := range sub.Drain() {
+		b.deliverToGroup(group, msg)
 	}
 }
 
-// Publish sends a message to all subscribers of the message's topic.
-// Distribution is done concurrently using goroutines to avoid blocking.
-// Messages sent to topics with no subscribers are dropped.
+// PublishResult reports what happened to a published message.
+type PublishResult struct {
+	// Matched is how many subscriptions and consumer groups the message was routed to.
+	// A consumer group counts once, since one member receives the message.
+	Matched int
+
+	// Delivered is how many of them queued the message.
+	Delivered int
+
+	// Dropped is how many of them dropped the message, because a buffer was full,
+	// a slow consumer was disconnected or a subscription was closed.
+	Dropped int
+}
+
+// Publish sends a message to all subscribers whose topic or pattern matches the message's topic.
+// The message is placed in each subscription's dispatch queue, where a per-subscription
+// worker delivers it, so messages from one publisher arrive in order at every subscriber.
+// Publish only waits when a subscription uses the Block overflow policy and its queue is full.
+// Messages to durable topics are appended to the topic's log first, and the last
+// message of a retaining topic is kept for future subscribers.
+// Each matching consumer group receives one copy, delivered to one of its members.
+// Expired messages are discarded instead of delivered, whether they expire before
+// publishing or while waiting in a subscription's queue.
+// Other messages sent to topics with no subscribers, or to wildcard patterns, are dropped.
+// Use PublishContext to learn what happened to the message.
 func (b *Broker) Publish(msg message.Message) {
+	b.PublishContext(context.Background(), msg)
+}
+
+// PublishContext publishes a message like Publish and reports how many subscribers
+// it reached. It returns ErrWildcardTopic for wildcard topics and ErrBrokerClosed
+// after Close. If ctx ends while the message is being handed to subscribers, the
+// remaining subscribers are skipped and ctx.Err() is returned with the counts so far.
+// A failure to append to a durable topic's log is returned after the message has
+// been delivered to the live subscribers. A message that has already expired is
+// reported as expired and not delivered, and subscription.ErrExpired is returned.
+func (b *Broker) PublishContext(ctx context.Context, msg message.Message) (PublishResult, error) {
+	if err := ctx.Err(); err != nil {
+		return PublishResult{}, err
+	}
+	// A republished delivery starts afresh rather than continuing its old attempts
+	msg = msg.WithDelivery(nil, 0)
+	if msg.Topic().IsWildcard() {
+		return PublishResult{}, ErrWildcardTopic
+	}
+
 	b.mutex.RLock()
-	subs := b.subscriptions[msg.Topic().String()]
+	if b.closed {
+		b.mutex.RUnlock()
+		return PublishResult{}, ErrBrokerClosed
+	}
+	cfg := b.topics[msg.Topic().String()]
+	msg = withDefaultTTL(cfg, msg)
+	if msg.Expired(time.Now()) {
+		b.mutex.RUnlock()
+		b.handleExpired(msg)
+		return PublishResult{}, subscription.ErrExpired
+	}
+	matched := b.trie.match(msg.Topic())
+	if cfg != nil && cfg.retain {
+		b.retain(cfg, msg)
+	}
 	b.mutex.RUnlock()
 
-	// If no subscribers, message is dropped
-	if len(subs) == 0 {
-		return
+	var logErr error
+	if cfg != nil && cfg.log != nil {
+		encoded, err := message.Encode(msg)
+		if err == nil {
+			_, err = cfg.log.Append(encoded)
+		}
+		if err != nil {
+			logErr = fmt.Errorf("append to durable topic %s: %w", msg.Topic().String(), err)
+		}
+	}
+
+	// Every subscriber gets a copy, and each group gets one for a single member
+	result := PublishResult{Matched: len(matched.subs) + len(matched.groups)}
+	count := func(err error) {
+		if err == nil {
+			result.Delivered++
+		} else {
+			result.Dropped++
+		}
 	}
+	for _, sub := range matched.subs {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		count(b.deliver(sub, msg))
+	}
+	for _, group := range matched.groups {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		count(b.deliverToGroup(group, msg))
+	}
+
+	return result, logErr
+}
 
-	// Send to all subscribers concurrently
-	for _, sub := range subs {
-		go sub.SendMessage(msg)
+// deliver sends a message to a single subscription and removes the subscription
+// if its overflow policy disconnected it. Returns the error from SendMessage.
+func (b *Broker) deliver(sub *subscription.Subscription, msg message.Message) error {
+	err := sub.SendMessage(msg)
+	if errors.Is(err, subscription.ErrSlowConsumer) {
+		b.Unsubscribe(sub.ID())
 	}
+	return err
 }
 
-// Close closes all subscriptions and shuts down the broker.
-// After closing, the broker should not be used.
+// Close closes all subscriptions and topic logs and shuts down the broker.
+// Afterwards PublishContext and SubscribeContext return ErrBrokerClosed.
 func (b *Broker) Close() {
+	// Stop the scheduler first; it publishes without holding the broker lock
+	b.schedule.close()
+
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
+	b.closed = true
+
 	// Close all subscriptions
-	for _, subs := range b.subscriptions {
-		for _, sub := range subs {
-			sub.Close()
+	for _, sub := range b.subscriptions {
+		sub.Close()
+	}
+
+	// Close the logs of durable topics
+	for _, cfg := range b.topics {
+		if cfg.log != nil {
+			cfg.log.Close()
 		}
 	}
 
-	// Clear the subscriptions map
-	b.subscriptions = make(map[string][]*subscription.Subscription)
+	// Reset the subscription index
+	b.subscriptions = make(map[string]*subscription.Subscription)
+	b.trie = newSubscriptionTrie()
+	b.topics = make(map[string]*topicConfig)
 }
@@ -1,12 +1,22 @@
 package broker_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gophercast/gophercast/internal/domain/broker"
 	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
 	"github.com/gophercast/gophercast/internal/domain/topic"
 )
 
@@ -230,3 +240,1867 @@ func TestBrokerConcurrentPublish(t *testing.T) {
 	}
 	mu.Unlock()
 }
+
+func TestBrokerWildcardSubscribe(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	single, _ := topic.NewPattern("users.*")
+	descendants, _ := topic.NewPattern("users.>")
+	created, _ := topic.New("users.created")
+	nested, _ := topic.New("users.created.v2")
+	orders, _ := topic.New("orders.created")
+
+	singleSub := b.Subscribe(single)
+	descendantsSub := b.Subscribe(descendants)
+
+	b.Publish(message.NewMessage(created, "created"))
+	b.Publish(message.NewMessage(nested, "nested"))
+	b.Publish(message.NewMessage(orders, "order"))
+
+	if got := countMessages(singleSub, 100*time.Millisecond); got != 1 {
+		t.Errorf("users.* received %d messages, want 1", got)
+	}
+	if got := countMessages(descendantsSub, 100*time.Millisecond); got != 2 {
+		t.Errorf("users.> received %d messages, want 2", got)
+	}
+}
+
+func TestBrokerWildcardUnsubscribe(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	pattern, _ := topic.NewPattern("users.*")
+	created, _ := topic.New("users.created")
+
+	sub := b.Subscribe(pattern)
+	b.Unsubscribe(sub.ID())
+
+	b.Publish(message.NewMessage(created, "created"))
+
+	// Channel is closed and should not yield any message
+	select {
+	case msg, ok := <-sub.MessageChannel():
+		if ok {
+			t.Errorf("Should not receive message after unsubscribe, got: %v", msg.Data())
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Channel should be closed after unsubscribe")
+	}
+}
+
+func TestBrokerPublishToPatternIsDropped(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	pattern, _ := topic.NewPattern("users.*")
+	sub := b.Subscribe(pattern)
+
+	b.Publish(message.NewMessage(pattern, "pattern"))
+
+	select {
+	case msg := <-sub.MessageChannel():
+		t.Errorf("Publishing to a pattern should be dropped, got: %v", msg.Data())
+	case <-time.After(100 * time.Millisecond):
+		// Expected: no message received
+	}
+}
+
+func BenchmarkBrokerPublishManyPatterns(b *testing.B) {
+	br := broker.NewBroker()
+	defer br.Close()
+
+	for i := 0; i < 5000; i++ {
+		pattern, _ := topic.NewPattern(fmt.Sprintf("tenant-%d.*.events", i))
+		br.Subscribe(pattern)
+	}
+
+	target, _ := topic.New("tenant-42.users.events")
+	msg := message.NewMessage(target, "event")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		br.Publish(msg)
+	}
+}
+
+func TestBrokerSubscribeDisconnectsSlowConsumer(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	topicObj, _ := topic.New("users")
+	sub := b.Subscribe(topicObj,
+		subscription.WithBufferSize(1),
+		subscription.WithOverflowPolicy(subscription.Disconnect),
+	)
+
+	// One message is held by the worker, one fills the queue, and the rest overflow
+	for i := 0; i < 3; i++ {
+		b.Publish(message.NewMessage(topicObj, "test"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := <-sub.MessageChannel(); ok {
+		t.Error("Channel should be closed after slow consumer disconnect")
+	}
+	if sub.Dropped() == 0 {
+		t.Error("Dropped() should count the message that triggered the disconnect")
+	}
+}
+
+// countMessages reads from the subscription until no message arrives within the wait.
+func countMessages(sub *subscription.Subscription, wait time.Duration) int {
+	count := 0
+	for {
+		select {
+		case _, ok := <-sub.MessageChannel():
+			if !ok {
+				return count
+			}
+			count++
+		case <-time.After(wait):
+			return count
+		}
+	}
+}
+
+// fanoutSubscriber is a subscriber under benchmark. Send hands it one message and
+// close releases it; every message sent must eventually arrive on messages or be
+// reported to the dropped callback given when it was created.
+type fanoutSubscriber struct {
+	messages <-chan message.Message
+	send     func(msg message.Message)
+	close    func()
+}
+
+// benchmarkFanout publishes b.N messages to ten draining subscribers and waits until
+// every copy has been received or dropped. Drops are reported as drops/op.
+func benchmarkFanout(b *testing.B, newSubscriber func(dropped func()) fanoutSubscriber) {
+	topicObj, _ := topic.New("users")
+
+	var settled sync.WaitGroup
+	var drops atomic.Int64
+	dropped := func() {
+		drops.Add(1)
+		settled.Done()
+	}
+
+	subs := make([]fanoutSubscriber, 10)
+	for i := range subs {
+		subs[i] = newSubscriber(dropped)
+		go func(messages <-chan message.Message) {
+			for range messages {
+				settled.Done()
+			}
+		}(subs[i].messages)
+	}
+
+	msg := message.NewMessage(topicObj, "test")
+	settled.Add(b.N * len(subs))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, sub := range subs {
+			sub.send(msg)
+		}
+	}
+	settled.Wait()
+	b.StopTimer()
+
+	b.ReportMetric(float64(drops.Load())/float64(b.N), "drops/op")
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+// BenchmarkFanoutDispatchQueue measures the current design: the publisher enqueues into
+// each subscription's dispatch queue and the per-subscription worker delivers.
+func BenchmarkFanoutDispatchQueue(b *testing.B) {
+	topicObj, _ := topic.New("users")
+	benchmarkFanout(b, func(dropped func()) fanoutSubscriber {
+		sub := subscription.NewSubscription(topicObj,
+			subscription.WithDropHandler(func(message.Message, error) { dropped() }),
+		)
+		return fanoutSubscriber{
+			messages: sub.MessageChannel(),
+			send:     func(msg message.Message) { sub.SendMessage(msg) },
+			close:    sub.Close,
+		}
+	})
+}
+
+// baselineSubscription reproduces the subscription of the original design: a channel
+// buffered to 200 messages, written with a non-blocking send under a mutex, so a
+// message is dropped when the buffer is full.
+type baselineSubscription struct {
+	ch      chan message.Message
+	mu      sync.Mutex
+	dropped func()
+}
+
+func (s *baselineSubscription) send(msg message.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case s.ch <- msg:
+	default:
+		s.dropped()
+	}
+}
+
+// BenchmarkFanoutGoroutinePerSend measures the original design, in which Publish
+// started a goroutine for every subscriber that sent to its buffered channel.
+func BenchmarkFanoutGoroutinePerSend(b *testing.B) {
+	benchmarkFanout(b, func(dropped func()) fanoutSubscriber {
+		sub := &baselineSubscription{
+			ch:      make(chan message.Message, subscription.DefaultBufferSize),
+			dropped: dropped,
+		}
+		return fanoutSubscriber{
+			messages: sub.ch,
+			send:     func(msg message.Message) { go sub.send(msg) },
+			close:    func() { close(sub.ch) },
+		}
+	})
+}
+
+func TestBrokerConfigureDurableTopicRequiresDataDir(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	topicObj, _ := topic.New("orders")
+	if err := b.ConfigureTopic(topicObj, broker.Durable()); err != broker.ErrNoDataDir {
+		t.Errorf("ConfigureTopic() error = %v, want %v", err, broker.ErrNoDataDir)
+	}
+
+	pattern, _ := topic.NewPattern("orders.*")
+	if err := b.ConfigureTopic(pattern, broker.Durable()); err != broker.ErrWildcardTopic {
+		t.Errorf("ConfigureTopic() error = %v, want %v", err, broker.ErrWildcardTopic)
+	}
+}
+
+func TestBrokerDurableTopicSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	topicObj, _ := topic.New("orders")
+
+	// Publish with no subscribers, then shut down
+	b := broker.NewBroker(broker.WithDataDir(dir))
+	if err := b.ConfigureTopic(topicObj, broker.Durable()); err != nil {
+		t.Fatalf("ConfigureTopic() error = %v", err)
+	}
+	for _, data := range []string{"first", "second", "third"} {
+		b.Publish(message.NewMessage(topicObj, data))
+	}
+	b.Close()
+
+	b = broker.NewBroker(broker.WithDataDir(dir))
+	defer b.Close()
+	if err := b.ConfigureTopic(topicObj, broker.Durable()); err != nil {
+		t.Fatalf("ConfigureTopic() after restart error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		position subscription.StartPosition
+		want     []string
+	}{
+		{"earliest", subscription.FromEarliest(), []string{"first", "second", "third", "live"}},
+		{"offset", subscription.FromOffset(2), []string{"third", "live"}},
+		{"latest", subscription.FromLatest(), []string{"live"}},
+	}
+
+	subs := make([]*subscription.Subscription, len(tests))
+	for i, tt := range tests {
+		subs[i] = b.Subscribe(topicObj, subscription.WithStartPosition(tt.position))
+	}
+
+	// Let replaying subscriptions catch up, then publish a live message
+	time.Sleep(50 * time.Millisecond)
+	b.Publish(message.NewMessage(topicObj, "live"))
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, want := range tt.want {
+				select {
+				case msg := <-subs[i].MessageChannel():
+					if msg.Data() != want {
+						t.Errorf("received %v, want %v", msg.Data(), want)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("timed out waiting for %v", want)
+				}
+			}
+		})
+	}
+}
+
+func TestBrokerDurableTopicStartFromTime(t *testing.T) {
+	b := broker.NewBroker(broker.WithDataDir(t.TempDir()))
+	defer b.Close()
+
+	topicObj, _ := topic.New("orders")
+	b.ConfigureTopic(topicObj, broker.Durable())
+
+	b.Publish(message.NewMessage(topicObj, "old"))
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	b.Publish(message.NewMessage(topicObj, "new"))
+
+	sub := b.Subscribe(topicObj, subscription.WithStartPosition(subscription.FromTime(cutoff)))
+
+	select {
+	case msg := <-sub.MessageChannel():
+		if msg.Data() != "new" {
+			t.Errorf("received %v, want new", msg.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
+
+func TestBrokerConsumerGroupRoundRobin(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	topicObj, _ := topic.New("jobs")
+
+	members := []*subscription.Subscription{
+		b.Subscribe(topicObj, subscription.WithGroup("workers")),
+		b.Subscribe(topicObj, subscription.WithGroup("workers")),
+		b.Subscribe(topicObj, subscription.WithGroup("workers")),
+	}
+	observer := b.Subscribe(topicObj)
+
+	for i := 0; i < 30; i++ {
+		b.Publish(message.NewMessage(topicObj, i))
+	}
+
+	total := 0
+	for i, member := range members {
+		got := countMessages(member, 100*time.Millisecond)
+		if got != 10 {
+			t.Errorf("member %d received %d messages, want 10", i, got)
+		}
+		total += got
+	}
+	if total != 30 {
+		t.Errorf("group received %d messages, want 30", total)
+	}
+	if got := countMessages(observer, 100*time.Millisecond); got != 30 {
+		t.Errorf("non-group subscriber received %d messages, want 30", got)
+	}
+}
+
+func TestBrokerConsumerGroupStickyByKey(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	topicObj, _ := topic.New("orders")
+	byCustomer := subscription.StickyByKey(func(msg message.Message) string {
+		return msg.Data().(string)
+	})
+
+	members := []*subscription.Subscription{
+		b.Subscribe(topicObj, subscription.WithGroup("billing"), subscription.WithGroupStrategy(byCustomer)),
+		b.Subscribe(topicObj, subscription.WithGroup("billing"), subscription.WithGroupStrategy(byCustomer)),
+		b.Subscribe(topicObj, subscription.WithGroup("billing"), subscription.WithGroupStrategy(byCustomer)),
+	}
+
+	owners := make(map[string]string) // customer -> member ID
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, member := range members {
+		wg.Add(1)
+		go func(sub *subscription.Subscription) {
+			defer wg.Done()
+			for {
+				select {
+				case msg := <-sub.MessageChannel():
+					mu.Lock()
+					customer := msg.Data().(string)
+					if owner, ok := owners[customer]; ok && owner != sub.ID() {
+						t.Errorf("customer %s delivered to %s and %s", customer, owner, sub.ID())
+					}
+					owners[customer] = sub.ID()
+					mu.Unlock()
+				case <-time.After(100 * time.Millisecond):
+					return
+				}
+			}
+		}(member)
+	}
+
+	for i := 0; i < 50; i++ {
+		b.Publish(message.NewMessage(topicObj, fmt.Sprintf("customer-%d", i%5)))
+	}
+	wg.Wait()
+
+	if len(owners) != 5 {
+		t.Errorf("received %d distinct customers, want 5", len(owners))
+	}
+}
+
+func TestBrokerConsumerGroupRebalanceKeepsInFlight(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	topicObj, _ := topic.New("jobs")
+
+	leaving := b.Subscribe(topicObj, subscription.WithGroup("workers"))
+	staying := b.Subscribe(topicObj, subscription.WithGroup("workers"))
+
+	// Neither member reads, so half of the messages wait in each queue
+	for i := 0; i < 10; i++ {
+		b.Publish(message.NewMessage(topicObj, i))
+	}
+
+	b.Unsubscribe(leaving.ID())
+
+	if got := countMessages(staying, 100*time.Millisecond); got != 10 {
+		t.Errorf("remaining member received %d messages, want 10", got)
+	}
+}
+
+func TestBrokerConsumerGroupSkipsFullMember(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	topicObj, _ := topic.New("jobs")
+
+	var dropped atomic.Int64
+	full := b.Subscribe(topicObj, subscription.WithGroup("workers"), subscription.WithBufferSize(1),
+		subscription.WithDropHandler(func(message.Message, error) { dropped.Add(1) }))
+	roomy := b.Subscribe(topicObj, subscription.WithGroup("workers"))
+
+	// Nobody reads: the small member holds one message in its worker and one in its queue
+	for i := 0; i < 10; i++ {
+		if _, err := b.PublishContext(context.Background(), message.NewMessage(topicObj, i)); err != nil {
+			t.Fatalf("PublishContext() error = %v", err)
+		}
+	}
+
+	total := countMessages(full, 100*time.Millisecond) + countMessages(roomy, 100*time.Millisecond)
+	if total != 10 {
+		t.Errorf("group received %d messages, want 10", total)
+	}
+	if dropped.Load() != 0 {
+		t.Errorf("full member dropped %d messages, want 0", dropped.Load())
+	}
+}
+
+func TestBrokerConsumerGroupStrategyConflict(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	topicObj, _ := topic.New("orders")
+	byData := subscription.StickyByKey(func(msg message.Message) string { return fmt.Sprint(msg.Data()) })
+	byID := subscription.StickyByKey(func(msg message.Message) string { return msg.ID() })
+
+	ctx := context.Background()
+	if _, err := b.SubscribeContext(ctx, topicObj, subscription.WithGroup("billing"), subscription.WithGroupStrategy(byData)); err != nil {
+		t.Fatalf("SubscribeContext() error = %v", err)
+	}
+	if _, err := b.SubscribeContext(ctx, topicObj, subscription.WithGroup("billing"), subscription.WithGroupStrategy(byData)); err != nil {
+		t.Errorf("SubscribeContext() with the same strategy error = %v", err)
+	}
+
+	for name, opts := range map[string][]subscription.Option{
+		"round-robin": {subscription.WithGroup("billing")},
+		"other key":   {subscription.WithGroup("billing"), subscription.WithGroupStrategy(byID)},
+	} {
+		if _, err := b.SubscribeContext(ctx, topicObj, opts...); !errors.Is(err, broker.ErrGroupStrategyConflict) {
+			t.Errorf("SubscribeContext() with %s strategy error = %v, want ErrGroupStrategyConflict", name, err)
+		}
+	}
+	if sub := b.Subscribe(topicObj, subscription.WithGroup("billing")); !isClosed(sub) {
+		t.Error("Subscribe() with a conflicting strategy should return a closed subscription")
+	}
+}
+
+// isClosed reports whether a subscription has been closed.
+func isClosed(sub *subscription.Subscription) bool {
+	select {
+	case <-sub.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestBrokerDeadLetterAfterMaxDeliveries(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	orders, _ := topic.New("orders")
+	dlq, _ := topic.New("orders.dlq")
+	b.ConfigureTopic(orders, broker.DeadLetterAfter(2))
+
+	sub := b.Subscribe(orders, subscription.WithManualAck())
+	dlqSub := b.Subscribe(dlq)
+
+	original := message.NewMessage(orders, "poison", message.WithContentType("application/json"))
+	b.Publish(original)
+
+	// Fail both deliveries
+	for i := 0; i < 2; i++ {
+		msg := <-sub.MessageChannel()
+		msg.Nack(0)
+	}
+
+	select {
+	case msg := <-dlqSub.MessageChannel():
+		if msg.ID() != original.ID() || msg.Data() != "poison" {
+			t.Errorf("dead letter = %v %v, want the original ID and payload", msg.ID(), msg.Data())
+		}
+		if _, err := message.Encode(msg); err != nil {
+			t.Errorf("Encode() of the dead letter error = %v", err)
+		}
+
+		letter, err := broker.ParseDeadLetter(msg)
+		if err != nil {
+			t.Fatalf("ParseDeadLetter() error = %v", err)
+		}
+		if letter.Message.Topic().String() != "orders" || letter.Message.Header(broker.HeaderDeadLetterTopic) != "" {
+			t.Errorf("Message = %v with headers %v, want the original on orders", letter.Message, letter.Message.Headers())
+		}
+		if letter.OriginalTopic != "orders" {
+			t.Errorf("OriginalTopic = %v, want orders", letter.OriginalTopic)
+		}
+		if letter.Failures != 2 {
+			t.Errorf("Failures = %d, want 2", letter.Failures)
+		}
+		if letter.LastError == "" || letter.FirstFailure.IsZero() {
+			t.Errorf("LastError = %q, FirstFailure = %v, want both set", letter.LastError, letter.FirstFailure)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was not moved to the dead-letter topic")
+	}
+}
+
+func TestBrokerDeadLetterRejectAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	orders, _ := topic.New("orders")
+	dlq, _ := topic.New("orders.failed")
+
+	open := func() *broker.Broker {
+		b := broker.NewBroker(broker.WithDataDir(dir))
+		b.ConfigureTopic(orders, broker.DeadLetterAfter(5), broker.DeadLetterTopic(dlq))
+		b.ConfigureTopic(dlq, broker.Durable())
+		return b
+	}
+
+	b := open()
+	sub := b.Subscribe(orders, subscription.WithManualAck())
+
+	original := message.NewMessage(orders, []byte("poison"), message.WithContentType("application/octet-stream"))
+	b.Publish(original)
+
+	msg := <-sub.MessageChannel()
+	msg.Reject(errors.New("invalid order"))
+
+	// Wait for the dead letter to be stored
+	deadline := time.Now().Add(time.Second)
+	for letters, _ := b.DeadLetters(dlq); len(letters) == 0 && time.Now().Before(deadline); letters, _ = b.DeadLetters(dlq) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Dead letters survive a restart
+	b.Close()
+	b = open()
+	defer func() { b.Close() }()
+
+	letters, err := b.DeadLetters(dlq)
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("DeadLetters() returned %d letters, %v, want 1", len(letters), err)
+	}
+	if letters[0].LastError != "invalid order" || letters[0].Failures != 1 {
+		t.Errorf("dead letter = %+v, want rejected after 1 delivery", letters[0])
+	}
+
+	sub = b.Subscribe(orders, subscription.WithManualAck())
+	n, err := b.ReplayDeadLetters(dlq)
+	if err != nil || n != 1 {
+		t.Fatalf("ReplayDeadLetters() = %d, %v, want 1, nil", n, err)
+	}
+
+	select {
+	case replayed := <-sub.MessageChannel():
+		if replayed.ID() != original.ID() || string(replayed.Data().([]byte)) != "poison" {
+			t.Errorf("replayed = %v %v, want the original ID and payload", replayed.ID(), replayed.Data())
+		}
+		if replayed.Header(broker.HeaderDeadLetterTopic) != "" {
+			t.Errorf("replayed headers = %v, want no dead-letter headers", replayed.Headers())
+		}
+		if replayed.DeliveryAttempt() != 1 {
+			t.Errorf("replayed DeliveryAttempt() = %d, want 1", replayed.DeliveryAttempt())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dead letter was not replayed to the source topic")
+	}
+
+	// Replayed letters are not replayed again, even after a restart
+	b.Close()
+	b = open()
+	if letters, err := b.DeadLetters(dlq); err != nil || len(letters) != 0 {
+		t.Errorf("DeadLetters() after replay = %d letters, %v, want none", len(letters), err)
+	}
+	if n, err := b.ReplayDeadLetters(dlq); err != nil || n != 0 {
+		t.Errorf("second ReplayDeadLetters() = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestBrokerDeadLetterDropsExpiry(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	orders, _ := topic.New("orders")
+	dlq, _ := topic.New("orders.dlq")
+	b.ConfigureTopic(orders, broker.DeadLetterAfter(1))
+
+	sub := b.Subscribe(orders, subscription.WithManualAck())
+	dlqSub := b.Subscribe(dlq)
+
+	b.Publish(message.NewMessage(orders, "poison", message.WithTTL(50*time.Millisecond)))
+	msg := <-sub.MessageChannel()
+
+	// Give up on the message after it has expired
+	time.Sleep(100 * time.Millisecond)
+	msg.Reject(errors.New("too slow"))
+
+	select {
+	case letter := <-dlqSub.MessageChannel():
+		if _, ok := letter.ExpiresAt(); ok {
+			t.Errorf("dead letter headers = %v, want no expiry", letter.Headers())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expired message was not moved to the dead-letter topic")
+	}
+}
+
+func TestBrokerDeadLettersRequireDurableTopic(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	dlq, _ := topic.New("orders.dlq")
+	if _, err := b.DeadLetters(dlq); !errors.Is(err, broker.ErrNotDurable) {
+		t.Errorf("DeadLetters() error = %v, want ErrNotDurable", err)
+	}
+	if _, err := b.ReplayDeadLetters(dlq); !errors.Is(err, broker.ErrNotDurable) {
+		t.Errorf("ReplayDeadLetters() error = %v, want ErrNotDurable", err)
+	}
+}
+
+func TestBrokerRepublishResetsDelivery(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	jobs, _ := topic.New("jobs")
+	sub := b.Subscribe(jobs, subscription.WithManualAck(), subscription.WithMaxDeliver(2))
+
+	b.Publish(message.NewMessage(jobs, "job"))
+	msg := <-sub.MessageChannel()
+	msg.Nack(0)
+	msg = <-sub.MessageChannel()
+
+	// Republish the second attempt; the copy starts at the first attempt
+	b.Publish(msg)
+	var forwarded message.Message
+	select {
+	case forwarded = <-sub.MessageChannel():
+	case <-time.After(time.Second):
+		t.Fatal("republished message was not delivered")
+	}
+	if forwarded.DeliveryAttempt() != 1 {
+		t.Errorf("republished DeliveryAttempt() = %d, want 1", forwarded.DeliveryAttempt())
+	}
+	if err := forwarded.Ack(); err != nil {
+		t.Fatalf("Ack() of the republished copy error = %v", err)
+	}
+
+	// Settling the copy left the original pending
+	if err := msg.Ack(); err != nil {
+		t.Errorf("Ack() of the original error = %v", err)
+	}
+}
+
+func TestBrokerPreservesHeaders(t *testing.T) {
+	b := broker.NewBroker(broker.WithDataDir(t.TempDir()))
+	defer b.Close()
+
+	orders, _ := topic.New("orders")
+	dlq, _ := topic.New("orders.dlq")
+	b.ConfigureTopic(orders, broker.Durable(), broker.DeadLetterAfter(1))
+
+	live := b.Subscribe(orders, subscription.WithManualAck())
+	dlqSub := b.Subscribe(dlq)
+
+	b.Publish(message.NewMessage(orders, "order", message.WithCorrelationID("req-42")))
+
+	// Live delivery
+	msg := <-live.MessageChannel()
+	if msg.CorrelationID() != "req-42" {
+		t.Errorf("live CorrelationID() = %q, want req-42", msg.CorrelationID())
+	}
+
+	// Replay from the durable log
+	replayed := b.Subscribe(orders, subscription.WithStartPosition(subscription.FromEarliest()))
+	select {
+	case msg := <-replayed.MessageChannel():
+		if msg.CorrelationID() != "req-42" {
+			t.Errorf("replayed CorrelationID() = %q, want req-42", msg.CorrelationID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for replay")
+	}
+
+	// Dead-letter topic
+	msg.Reject(errors.New("bad order"))
+	select {
+	case letter := <-dlqSub.MessageChannel():
+		if letter.CorrelationID() != "req-42" {
+			t.Errorf("dead letter CorrelationID() = %q, want req-42", letter.CorrelationID())
+		}
+		if letter.Header(broker.HeaderDeadLetterTopic) != "orders" {
+			t.Errorf("dead letter original topic header = %q, want orders", letter.Header(broker.HeaderDeadLetterTopic))
+		}
+		if letter.Header(broker.HeaderDeadLetterLastError) != "bad order" {
+			t.Errorf("dead letter last error header = %q, want bad order", letter.Header(broker.HeaderDeadLetterLastError))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for dead letter")
+	}
+}
+
+type orderPlaced struct {
+	ID       string  `json:"id"`
+	Quantity int     `json:"quantity"`
+	Total    float64 `json:"total"`
+}
+
+func TestTypedPublishSubscribe(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	orders, err := broker.NewTypedTopic[orderPlaced]("orders.placed")
+	if err != nil {
+		t.Fatalf("NewTypedTopic() error = %v", err)
+	}
+	sub := broker.Subscribe(b, orders)
+
+	want := orderPlaced{ID: "o-1", Quantity: 2, Total: 9.5}
+	broker.Publish(b, orders, want, message.WithCorrelationID("req-1"))
+
+	select {
+	case d := <-sub.Deliveries():
+		if d.Err != nil {
+			t.Fatalf("delivery error = %v", d.Err)
+		}
+		if d.Value != want {
+			t.Errorf("Value = %+v, want %+v", d.Value, want)
+		}
+		if d.Message.CorrelationID() != "req-1" {
+			t.Errorf("CorrelationID() = %q, want req-1", d.Message.CorrelationID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+
+	b.Unsubscribe(sub.ID())
+	if _, ok := <-sub.Deliveries(); ok {
+		t.Error("Deliveries() should be closed after Unsubscribe")
+	}
+}
+
+func TestTypedSubscribeConversions(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	orders, _ := broker.NewTypedTopic[orderPlaced]("orders.placed")
+	sub := broker.Subscribe(b, orders)
+
+	tests := []struct {
+		name    string
+		data    interface{}
+		want    orderPlaced
+		wantErr bool
+	}{
+		{"generic map", map[string]interface{}{"id": "o-2", "quantity": 1.0}, orderPlaced{ID: "o-2", Quantity: 1}, false},
+		{"json bytes", []byte(`{"id":"o-3","total":4}`), orderPlaced{ID: "o-3", Total: 4}, false},
+		{"wrong type", "not an order", orderPlaced{}, true},
+		{"fractional quantity", map[string]interface{}{"quantity": 1.5}, orderPlaced{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Untyped publishers share the topic with typed subscribers
+			b.Publish(message.NewMessage(orders.Topic(), tt.data))
+
+			select {
+			case d := <-sub.Deliveries():
+				if tt.wantErr {
+					if !errors.Is(d.Err, broker.ErrTypeMismatch) {
+						t.Errorf("Err = %v, want ErrTypeMismatch", d.Err)
+					}
+					return
+				}
+				if d.Err != nil {
+					t.Fatalf("Err = %v", d.Err)
+				}
+				if d.Value != tt.want {
+					t.Errorf("Value = %+v, want %+v", d.Value, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for delivery")
+			}
+		})
+	}
+}
+
+func TestTypedSubscribeDurableReplay(t *testing.T) {
+	b := broker.NewBroker(broker.WithDataDir(t.TempDir()))
+	defer b.Close()
+
+	counts, _ := broker.NewTypedTopic[int]("counts")
+	if err := b.ConfigureTopic(counts.Topic(), broker.Durable()); err != nil {
+		t.Fatalf("ConfigureTopic() error = %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		broker.Publish(b, counts, i)
+	}
+
+	// Replayed messages carry generic JSON values that are converted back to int
+	sub := broker.Subscribe(b, counts, subscription.WithStartPosition(subscription.FromEarliest()))
+	for want := 1; want <= 3; want++ {
+		select {
+		case d := <-sub.Deliveries():
+			if d.Err != nil || d.Value != want {
+				t.Errorf("delivery = %v, %v, want %d", d.Value, d.Err, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %d", want)
+		}
+	}
+}
+
+func TestBrokerDurableTopicStartAfterMessage(t *testing.T) {
+	b := broker.NewBroker(broker.WithDataDir(t.TempDir()))
+	defer b.Close()
+
+	orders, _ := topic.New("orders")
+	if err := b.ConfigureTopic(orders, broker.Durable()); err != nil {
+		t.Fatalf("ConfigureTopic() error = %v", err)
+	}
+	var ids []string
+	for _, data := range []string{"first", "second", "third"} {
+		msg := message.NewMessage(orders, data)
+		ids = append(ids, msg.ID())
+		b.Publish(msg)
+	}
+
+	tests := []struct {
+		name string
+		id   string
+		want string
+	}{
+		{"known id", ids[1], "third"},
+		{"unknown id starts from latest", "missing", "later"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := b.Subscribe(orders, subscription.WithStartPosition(subscription.AfterMessage(tt.id)))
+			defer b.Unsubscribe(sub.ID())
+
+			if tt.want == "later" {
+				b.Publish(message.NewMessage(orders, "later"))
+			}
+
+			select {
+			case msg := <-sub.MessageChannel():
+				if msg.Data() != tt.want {
+					t.Errorf("first message = %v, want %v", msg.Data(), tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for message")
+			}
+		})
+	}
+}
+
+// respondWith answers every request on the topic with the value returned by reply,
+// until the broker is closed.
+func respondWith(b *broker.Broker, t topic.Topic, reply func(req message.Message) interface{}) {
+	sub := b.Subscribe(t)
+	go func() {
+		for req := range sub.MessageChannel() {
+			b.Respond(req, reply(req))
+		}
+	}()
+}
+
+func TestBrokerRequestReply(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	double, _ := topic.New("math.double")
+	respondWith(b, double, func(req message.Message) interface{} {
+		return req.Data().(int) * 2
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	req := message.NewMessage(double, 21)
+	reply, err := b.Request(ctx, req)
+	if err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if reply.Data() != 42 {
+		t.Errorf("reply = %v, want 42", reply.Data())
+	}
+	if reply.CorrelationID() != req.ID() {
+		t.Errorf("reply correlation ID = %q, want the request ID %q", reply.CorrelationID(), req.ID())
+	}
+}
+
+func TestBrokerRequestContextEnds(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	nobody, _ := topic.New("nobody.listens")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := b.Request(ctx, message.NewMessage(nobody, "hello")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Request() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestBrokerRequestBrokerClosesWhileWaiting(t *testing.T) {
+	nobody, _ := topic.New("nobody.listens")
+
+	tests := []struct {
+		name    string
+		request func(b *broker.Broker) error
+	}{
+		{"request", func(b *broker.Broker) error {
+			_, err := b.Request(context.Background(), message.NewMessage(nobody, "hello"))
+			return err
+		}},
+		{"request many", func(b *broker.Broker) error {
+			_, err := b.RequestMany(context.Background(), message.NewMessage(nobody, "hello"), 0, time.Second)
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := broker.NewBroker()
+			time.AfterFunc(20*time.Millisecond, b.Close)
+
+			if err := tt.request(b); !errors.Is(err, broker.ErrBrokerClosed) {
+				t.Errorf("error = %v, want %v", err, broker.ErrBrokerClosed)
+			}
+		})
+	}
+}
+
+func TestBrokerRequestMany(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	census, _ := topic.New("census")
+	for i := 0; i < 3; i++ {
+		i := i
+		respondWith(b, census, func(message.Message) interface{} { return i })
+	}
+
+	tests := []struct {
+		name    string
+		n       int
+		timeout time.Duration
+		want    int
+	}{
+		{"stops at n", 2, time.Second, 2},
+		{"gathers until timeout", 0, 50 * time.Millisecond, 3},
+		{"partial on timeout", 5, 50 * time.Millisecond, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replies, err := b.RequestMany(context.Background(), message.NewMessage(census, "count"), tt.n, tt.timeout)
+			if err != nil {
+				t.Fatalf("RequestMany() error = %v", err)
+			}
+			if len(replies) != tt.want {
+				t.Errorf("got %d replies, want %d", len(replies), tt.want)
+			}
+		})
+	}
+}
+
+func TestBrokerRespondErrors(t *testing.T) {
+	orders, _ := topic.New("orders")
+	inbox, _ := topic.New("inbox.test")
+
+	tests := []struct {
+		name  string
+		req   message.Message
+		close bool
+		want  error
+	}{
+		{
+			name: "no reply-to",
+			req:  message.NewMessage(orders, "request"),
+			want: broker.ErrNoReplyTo,
+		},
+		{
+			name:  "broker closed",
+			req:   message.NewMessage(orders, "request", message.WithReplyTo(inbox)),
+			close: true,
+			want:  broker.ErrBrokerClosed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := broker.NewBroker()
+			defer b.Close()
+			if tt.close {
+				b.Close()
+			}
+
+			if err := b.Respond(tt.req, "reply"); !errors.Is(err, tt.want) {
+				t.Errorf("Respond() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBrokerRetain(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	flags, _ := topic.New("config.flags")
+	if err := b.ConfigureTopic(flags, broker.Retain()); err != nil {
+		t.Fatalf("ConfigureTopic() error = %v", err)
+	}
+	b.Publish(message.NewMessage(flags, "v1"))
+	b.Publish(message.NewMessage(flags, "v2"))
+
+	pattern, _ := topic.NewPattern("config.>")
+	sub := b.Subscribe(pattern)
+	b.Publish(message.NewMessage(flags, "v3"))
+
+	for _, want := range []string{"v2", "v3"} {
+		select {
+		case msg := <-sub.MessageChannel():
+			if msg.Data() != want {
+				t.Errorf("received %v, want %v", msg.Data(), want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+
+	// Group members share the live stream and get no retained messages
+	member := b.Subscribe(flags, subscription.WithGroup("workers"))
+	select {
+	case msg := <-member.MessageChannel():
+		t.Errorf("group member received retained %v", msg.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.ClearRetained(flags)
+	if retained := b.Retained(flags); len(retained) != 0 {
+		t.Errorf("Retained() after ClearRetained = %v, want none", retained)
+	}
+	late := b.Subscribe(flags)
+	select {
+	case msg := <-late.MessageChannel():
+		t.Errorf("received %v after ClearRetained", msg.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBrokerRetainDoesNotBlockSubscribe(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	devices, _ := topic.New("devices.state")
+	b.ConfigureTopic(devices, broker.RetainByKey(func(msg message.Message) string { return msg.Header("device") }))
+	for _, device := range []string{"a", "b", "c", "d", "e"} {
+		b.Publish(message.NewMessage(devices, device, message.WithHeader("device", device)))
+	}
+
+	// More retained messages than the buffer holds are queued without waiting for space
+	start := time.Now()
+	sub := b.Subscribe(devices,
+		subscription.WithBufferSize(1),
+		subscription.WithOverflowPolicy(subscription.Block),
+		subscription.WithBlockTimeout(time.Second),
+	)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Subscribe() took %v, want it not to wait for the subscriber", elapsed)
+	}
+	b.Publish(message.NewMessage(devices, "live", message.WithHeader("device", "f")))
+
+	var got []interface{}
+	for len(got) < 6 {
+		select {
+		case msg := <-sub.MessageChannel():
+			got = append(got, msg.Data())
+		case <-time.After(time.Second):
+			t.Fatalf("received %v, want all retained messages then live", got)
+		}
+	}
+	if fmt.Sprint(got) != "[a b c d e live]" {
+		t.Errorf("received %v, want [a b c d e live]", got)
+	}
+	if sub.Dropped() != 0 {
+		t.Errorf("Dropped() = %d, want 0", sub.Dropped())
+	}
+}
+
+func TestBrokerRetainByKey(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	devices, _ := topic.New("devices.state")
+	byDevice := func(msg message.Message) string { return msg.Header("device") }
+	if err := b.ConfigureTopic(devices, broker.RetainByKey(byDevice)); err != nil {
+		t.Fatalf("ConfigureTopic() error = %v", err)
+	}
+	for _, p := range []struct{ device, state string }{
+		{"a", "off"}, {"b", "on"}, {"a", "on"}, {"c", "off"},
+	} {
+		b.Publish(message.NewMessage(devices, p.device+"="+p.state, message.WithHeader("device", p.device)))
+	}
+	b.ClearRetained(devices, "c")
+
+	var got []interface{}
+	for _, msg := range b.Retained(devices) {
+		got = append(got, msg.Data())
+	}
+	if want := []interface{}{"b=on", "a=on"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Retained() = %v, want %v", got, want)
+	}
+
+	sub := b.Subscribe(devices)
+	for _, want := range []string{"b=on", "a=on"} {
+		select {
+		case msg := <-sub.MessageChannel():
+			if msg.Data() != want {
+				t.Errorf("received %v, want %v", msg.Data(), want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+}
+
+func TestBrokerPublishContext(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	orders, _ := topic.New("orders")
+	all, _ := topic.NewPattern(">")
+	b.Subscribe(orders)
+	b.Subscribe(all)
+	b.Subscribe(orders, subscription.WithGroup("billing"))
+	b.Subscribe(orders, subscription.WithGroup("billing"))
+
+	result, err := b.PublishContext(context.Background(), message.NewMessage(orders, "o-1"))
+	if err != nil {
+		t.Fatalf("PublishContext() error = %v", err)
+	}
+	if want := (broker.PublishResult{Matched: 3, Delivered: 3}); result != want {
+		t.Errorf("PublishContext() = %+v, want %+v", result, want)
+	}
+
+	// Only the ">" pattern matches another topic
+	payments, _ := topic.New("payments")
+	if result, err := b.PublishContext(context.Background(), message.NewMessage(payments, "p-1")); err != nil || result.Matched != 1 {
+		t.Errorf("PublishContext() = %+v, %v, want 1 match", result, err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		msg  message.Message
+		want error
+	}{
+		{"wildcard", context.Background(), message.NewMessage(all, "x"), broker.ErrWildcardTopic},
+		{"canceled", canceled, message.NewMessage(orders, "x"), context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := b.PublishContext(tt.ctx, tt.msg); !errors.Is(err, tt.want) {
+				t.Errorf("PublishContext() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBrokerPublishContextCountsDrops(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	orders, _ := topic.New("orders")
+	b.Subscribe(orders, subscription.WithBufferSize(1))
+
+	// The worker holds one message and the queue one more; the rest are dropped
+	var delivered, dropped int
+	for i := 0; i < 5; i++ {
+		result, err := b.PublishContext(context.Background(), message.NewMessage(orders, i))
+		if err != nil {
+			t.Fatalf("PublishContext() error = %v", err)
+		}
+		delivered += result.Delivered
+		dropped += result.Dropped
+	}
+	if delivered+dropped != 5 || dropped < 3 {
+		t.Errorf("delivered %d and dropped %d, want at least 3 of 5 dropped", delivered, dropped)
+	}
+}
+
+func TestBrokerSubscribeContext(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	orders, _ := topic.New("orders")
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := b.SubscribeContext(ctx, orders)
+	if err != nil {
+		t.Fatalf("SubscribeContext() error = %v", err)
+	}
+
+	cancel()
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("subscription still open after its context ended")
+	}
+	if result, _ := b.PublishContext(context.Background(), message.NewMessage(orders, "x")); result.Matched != 0 {
+		t.Errorf("Matched = %d after the context ended, want 0", result.Matched)
+	}
+
+	if _, err := b.SubscribeContext(ctx, orders); !errors.Is(err, context.Canceled) {
+		t.Errorf("SubscribeContext() with an ended context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestBrokerClosedErrors(t *testing.T) {
+	b := broker.NewBroker()
+	orders, _ := topic.New("orders")
+	b.Close()
+
+	if _, err := b.PublishContext(context.Background(), message.NewMessage(orders, "x")); !errors.Is(err, broker.ErrBrokerClosed) {
+		t.Errorf("PublishContext() error = %v, want %v", err, broker.ErrBrokerClosed)
+	}
+	if _, err := b.SubscribeContext(context.Background(), orders); !errors.Is(err, broker.ErrBrokerClosed) {
+		t.Errorf("SubscribeContext() error = %v, want %v", err, broker.ErrBrokerClosed)
+	}
+	if _, err := b.Request(context.Background(), message.NewMessage(orders, "x")); !errors.Is(err, broker.ErrBrokerClosed) {
+		t.Errorf("Request() error = %v, want %v", err, broker.ErrBrokerClosed)
+	}
+
+	sub := b.Subscribe(orders)
+	select {
+	case <-sub.Done():
+	default:
+		t.Error("Subscribe() after Close should return a closed subscription")
+	}
+}
+
+func TestBrokerHandle(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	jobs, _ := topic.New("jobs")
+	dlq, _ := topic.New("jobs.dlq")
+	if err := b.ConfigureTopic(jobs, broker.DeadLetterAfter(5)); err != nil {
+		t.Fatalf("ConfigureTopic() error = %v", err)
+	}
+	dead := b.Subscribe(dlq)
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	handled := make(chan string, 10)
+	h, err := b.Handle(jobs, func(ctx context.Context, msg message.Message) error {
+		mu.Lock()
+		attempts[msg.Data().(string)]++
+		n := attempts[msg.Data().(string)]
+		mu.Unlock()
+
+		switch msg.Data() {
+		case "flaky":
+			if n < 3 {
+				return errors.New("try again")
+			}
+		case "broken":
+			return broker.Permanent(errors.New("cannot parse"))
+		}
+		handled <- msg.Data().(string)
+		return nil
+	}, broker.WithNackDelay(time.Millisecond))
+	if err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	defer h.Stop()
+
+	for _, data := range []string{"ok", "flaky", "broken"} {
+		b.Publish(message.NewMessage(jobs, data))
+	}
+
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case data := <-handled:
+			got[data] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timed out; handled %v", got)
+		}
+	}
+	select {
+	case msg := <-dead.MessageChannel():
+		if msg.Data() != "broken" {
+			t.Errorf("dead letter = %v, want broken", msg.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the rejected message")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts["flaky"] != 3 || attempts["broken"] != 1 {
+		t.Errorf("attempts = %v, want flaky 3 and broken 1", attempts)
+	}
+}
+
+func TestBrokerHandleRetryKeepsMessage(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	jobs, _ := topic.New("jobs")
+	var calls atomic.Int32
+	h, err := b.Handle(jobs, func(ctx context.Context, msg message.Message) error {
+		if calls.Add(1) < 3 {
+			return errors.New("try again")
+		}
+		return nil
+	},
+		broker.WithHandlerSubscription(subscription.WithAckWait(50*time.Millisecond)),
+		broker.Retry(3, 20*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	defer h.Stop()
+
+	// The retries wait longer in total than the ack wait
+	b.Publish(message.NewMessage(jobs, "job"))
+	time.Sleep(250 * time.Millisecond)
+
+	if n := calls.Load(); n != 3 {
+		t.Errorf("handler called %d times, want 3 with no redelivery", n)
+	}
+}
+
+func TestBrokerHandleConcurrency(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	jobs, _ := topic.New("jobs")
+	const workers = 4
+	var running sync.WaitGroup
+	running.Add(workers)
+	release := make(chan struct{})
+	h, err := b.Handle(jobs, func(ctx context.Context, msg message.Message) error {
+		running.Done()
+		<-release
+		return nil
+	}, broker.WithConcurrency(workers))
+	if err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+
+	for i := 0; i < workers; i++ {
+		b.Publish(message.NewMessage(jobs, i))
+	}
+
+	// Every message is in its handler at the same time
+	allRunning := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(allRunning)
+	}()
+	select {
+	case <-allRunning:
+	case <-time.After(time.Second):
+		t.Fatalf("fewer than %d handlers ran concurrently", workers)
+	}
+
+	close(release)
+	h.Stop()
+}
+
+func TestBrokerHandleStop(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	jobs, _ := topic.New("jobs")
+	started := make(chan struct{})
+	var canceled bool
+	h, err := b.Handle(jobs, func(ctx context.Context, msg message.Message) error {
+		close(started)
+		<-ctx.Done()
+		canceled = true
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+
+	b.Publish(message.NewMessage(jobs, "long job"))
+	<-started
+	h.Stop()
+
+	if !canceled {
+		t.Error("Stop() returned before the running call saw its context cancelled")
+	}
+
+	b.Close()
+	noop := func(context.Context, message.Message) error { return nil }
+	if _, err := b.Handle(jobs, noop); !errors.Is(err, broker.ErrBrokerClosed) {
+		t.Errorf("Handle() after Close error = %v, want %v", err, broker.ErrBrokerClosed)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	orders, _ := topic.New("orders")
+	msg := message.NewMessage(orders, "o-1")
+	errFailed := errors.New("failed")
+
+	t.Run("recover", func(t *testing.T) {
+		h := broker.Recover()(func(context.Context, message.Message) error {
+			panic("boom")
+		})
+		var panicErr *broker.PanicError
+		if err := h(context.Background(), msg); !errors.As(err, &panicErr) || panicErr.Value != "boom" {
+			t.Errorf("error = %v, want a PanicError for boom", err)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			err       error
+			wantCalls int
+		}{
+			{"until attempts are used up", errFailed, 3},
+			{"not permanent errors", broker.Permanent(errFailed), 1},
+			{"not successes", nil, 1},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				calls := 0
+				h := broker.Retry(3, time.Millisecond)(func(context.Context, message.Message) error {
+					calls++
+					return tt.err
+				})
+				if err := h(context.Background(), msg); !errors.Is(err, tt.err) {
+					t.Errorf("error = %v, want %v", err, tt.err)
+				}
+				if calls != tt.wantCalls {
+					t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+				}
+			})
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		h := broker.Timeout(10 * time.Millisecond)(func(ctx context.Context, msg message.Message) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		if err := h(context.Background(), msg); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		var m broker.HandlerMetrics
+		results := []error{nil, errFailed, nil}
+		h := broker.Metrics(&m)(func(context.Context, message.Message) error {
+			err := results[0]
+			results = results[1:]
+			return err
+		})
+		for range 3 {
+			h(context.Background(), msg)
+		}
+		stats := m.Snapshot()
+		if stats.Succeeded != 2 || stats.Failed != 1 || stats.InFlight != 0 {
+			t.Errorf("Snapshot() = %+v, want 2 succeeded and 1 failed", stats)
+		}
+	})
+
+	t.Run("logging", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		h := broker.Logging(logger)(func(context.Context, message.Message) error { return errFailed })
+		h(context.Background(), msg)
+
+		out := buf.String()
+		for _, want := range []string{"level=ERROR", "topic=orders", "id=" + msg.ID(), "error=failed"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("log %q does not contain %q", out, want)
+			}
+		}
+	})
+
+	t.Run("order", func(t *testing.T) {
+		var calls []string
+		trace := func(name string) broker.Middleware {
+			return func(next broker.HandlerFunc) broker.HandlerFunc {
+				return func(ctx context.Context, msg message.Message) error {
+					calls = append(calls, name)
+					return next(ctx, msg)
+				}
+			}
+		}
+
+		b := broker.NewBroker()
+		defer b.Close()
+		done := make(chan struct{})
+		h, _ := b.Handle(orders, func(context.Context, message.Message) error {
+			close(done)
+			return nil
+		}, trace("outer"), trace("inner"))
+		defer h.Stop()
+
+		b.Publish(msg)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the handler")
+		}
+		if fmt.Sprint(calls) != "[outer inner]" {
+			t.Errorf("middleware ran in order %v, want [outer inner]", calls)
+		}
+	})
+}
+
+func TestBrokerPublishAfter(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+
+	reminders, _ := topic.New("reminders")
+	sub := b.Subscribe(reminders)
+
+	later := message.NewMessage(reminders, "later")
+	sooner := message.NewMessage(reminders, "sooner")
+	cancelled := message.NewMessage(reminders, "cancelled")
+	start := time.Now()
+	b.PublishAfter(later, 100*time.Millisecond)
+	b.PublishAfter(sooner, 50*time.Millisecond)
+	b.PublishAfter(cancelled, 75*time.Millisecond)
+
+	if err := b.PublishAfter(sooner, time.Second); !errors.Is(err, broker.ErrAlreadyScheduled) {
+		t.Errorf("PublishAfter() twice error = %v, want ErrAlreadyScheduled", err)
+	}
+	pattern, _ := topic.NewPattern("reminders.*")
+	if err := b.PublishAt(message.NewMessage(pattern, "x"), time.Now()); !errors.Is(err, broker.ErrWildcardTopic) {
+		t.Errorf("PublishAt(pattern) error = %v, want ErrWildcardTopic", err)
+	}
+
+	scheduled := b.Scheduled()
+	if len(scheduled) != 3 || scheduled[0].Message.ID() != sooner.ID() || scheduled[2].Message.ID() != later.ID() {
+		t.Fatalf("Scheduled() = %v, want sooner, cancelled, later", scheduled)
+	}
+	if err := b.CancelScheduled(cancelled.ID()); err != nil {
+		t.Fatalf("CancelScheduled() error = %v", err)
+	}
+	if err := b.CancelScheduled(cancelled.ID()); !errors.Is(err, broker.ErrNotScheduled) {
+		t.Errorf("CancelScheduled() twice error = %v, want ErrNotScheduled", err)
+	}
+
+	for _, want := range []struct {
+		data  string
+		delay time.Duration
+	}{{"sooner", 50 * time.Millisecond}, {"later", 100 * time.Millisecond}} {
+		select {
+		case msg := <-sub.MessageChannel():
+			if msg.Data() != want.data {
+				t.Errorf("received %v, want %v", msg.Data(), want.data)
+			}
+			if elapsed := time.Since(start); elapsed < want.delay {
+				t.Errorf("%v published after %v, want at least %v", want.data, elapsed, want.delay)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want.data)
+		}
+	}
+	if scheduled := b.Scheduled(); len(scheduled) != 0 {
+		t.Errorf("Scheduled() after publishing = %v, want none", scheduled)
+	}
+}
+
+func TestBrokerScheduledSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	reminders, _ := topic.New("reminders")
+
+	b := broker.NewBroker(broker.WithDataDir(dir))
+	b.StartScheduler()
+	due := message.NewMessage(reminders, "due", message.WithHeader("user", "42"))
+	future := message.NewMessage(reminders, "future")
+	b.PublishAfter(due, 50*time.Millisecond)
+	b.PublishAfter(future, time.Hour)
+	b.Close()
+
+	if err := b.PublishAfter(message.NewMessage(reminders, "x"), time.Second); !errors.Is(err, broker.ErrBrokerClosed) {
+		t.Errorf("PublishAfter() after Close error = %v, want ErrBrokerClosed", err)
+	}
+
+	// The due message falls due while no broker is running
+	time.Sleep(100 * time.Millisecond)
+
+	b = broker.NewBroker(broker.WithDataDir(dir))
+	defer b.Close()
+	if scheduled := b.Scheduled(); len(scheduled) != 2 {
+		t.Fatalf("Scheduled() after restart = %v, want 2 messages", scheduled)
+	}
+
+	sub := b.Subscribe(reminders)
+	select {
+	case msg := <-sub.MessageChannel():
+		t.Fatalf("received %v before StartScheduler", msg.Data())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.StartScheduler()
+	select {
+	case msg := <-sub.MessageChannel():
+		if msg.ID() != due.ID() || msg.Data() != "due" || msg.Header("user") != "42" {
+			t.Errorf("received %v %v, want the due message", msg.ID(), msg.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the due message")
+	}
+
+	scheduled := b.Scheduled()
+	if len(scheduled) != 1 || scheduled[0].Message.ID() != future.ID() {
+		t.Errorf("Scheduled() = %v, want the future message", scheduled)
+	}
+}
+
+func TestBrokerScheduleDataDirs(t *testing.T) {
+	reminders, _ := topic.New("reminders")
+
+	tests := []struct {
+		name string
+		opts []broker.Option
+		data interface{}
+	}{
+		// Without a journal, anything Publish accepts can be scheduled
+		{"no data directory", nil, make(chan int)},
+		{"data directory not created yet", []broker.Option{broker.WithDataDir(filepath.Join(t.TempDir(), "new", "dir"))}, "reminder"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := broker.NewBroker(tt.opts...)
+			defer b.Close()
+			if err := b.StartScheduler(); err != nil {
+				t.Fatalf("StartScheduler() error = %v", err)
+			}
+
+			if err := b.PublishAfter(message.NewMessage(reminders, tt.data), time.Hour); err != nil {
+				t.Errorf("PublishAfter() error = %v", err)
+			}
+			if scheduled := b.Scheduled(); len(scheduled) != 1 {
+				t.Errorf("Scheduled() = %v, want 1 message", scheduled)
+			}
+		})
+	}
+}
+
+func TestBrokerScheduleJournal(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "scheduled.journal")
+	reminders, _ := topic.New("reminders")
+
+	b := broker.NewBroker(broker.WithDataDir(dir))
+	if err := b.StartScheduler(); err != nil {
+		t.Fatalf("StartScheduler() error = %v", err)
+	}
+	kept := message.NewMessage(reminders, "kept")
+	b.PublishAfter(kept, time.Hour)
+
+	// Cancelled messages are compacted away rather than growing the journal
+	for i := 0; i < 2000; i++ {
+		msg := message.NewMessage(reminders, i)
+		if err := b.PublishAfter(msg, time.Hour); err != nil {
+			t.Fatalf("PublishAfter() error = %v", err)
+		}
+		if err := b.CancelScheduled(msg.ID()); err != nil {
+			t.Fatalf("CancelScheduled() error = %v", err)
+		}
+	}
+	b.Close()
+
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > 2100 {
+		t.Errorf("journal holds %d records for 4001 changes, want it compacted", lines)
+	}
+
+	// A record torn by a crash is ignored
+	if err := os.WriteFile(journal, append(data, `{"at":"2030-01-01T00:00:00Z","mess`...), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	b = broker.NewBroker(broker.WithDataDir(dir))
+	if err := b.StartScheduler(); err != nil {
+		t.Fatalf("StartScheduler() after a torn record error = %v", err)
+	}
+	if scheduled := b.Scheduled(); len(scheduled) != 1 || scheduled[0].Message.ID() != kept.ID() {
+		t.Errorf("Scheduled() = %v, want the kept message", scheduled)
+	}
+	b.PublishAfter(message.NewMessage(reminders, "after crash"), time.Hour)
+	b.Close()
+
+	b = broker.NewBroker(broker.WithDataDir(dir))
+	if scheduled := b.Scheduled(); len(scheduled) != 2 {
+		t.Errorf("Scheduled() after appending past a torn record = %v, want 2 messages", scheduled)
+	}
+	b.Close()
+
+	// Damage in the middle of the journal is reported and the file left alone
+	corrupt := []byte("not json\n" + string(data))
+	if err := os.WriteFile(journal, corrupt, 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	b = broker.NewBroker(broker.WithDataDir(dir))
+	defer b.Close()
+	if err := b.StartScheduler(); !errors.Is(err, broker.ErrCorruptSchedule) {
+		t.Errorf("StartScheduler() error = %v, want ErrCorruptSchedule", err)
+	}
+	if err := b.PublishAfter(message.NewMessage(reminders, "x"), time.Hour); !errors.Is(err, broker.ErrCorruptSchedule) {
+		t.Errorf("PublishAfter() error = %v, want ErrCorruptSchedule", err)
+	}
+	if after, _ := os.ReadFile(journal); !bytes.Equal(after, corrupt) {
+		t.Error("corrupt journal was modified")
+	}
+}
+
+func TestBrokerExpiry(t *testing.T) {
+	quotes, _ := topic.New("quotes")
+	audit, _ := topic.New("quotes.expired")
+
+	var mu sync.Mutex
+	var expired []string
+	b := broker.NewBroker(broker.WithExpiredHandler(func(msg message.Message) {
+		mu.Lock()
+		expired = append(expired, msg.Data().(string))
+		mu.Unlock()
+	}))
+	defer b.Close()
+
+	if err := b.ConfigureTopic(quotes, broker.DefaultTTL(20*time.Millisecond), broker.ExpiredTopic(audit), broker.Retain()); err != nil {
+		t.Fatalf("ConfigureTopic() error = %v", err)
+	}
+	auditSub := b.Subscribe(audit)
+
+	// Expired before publishing
+	stale := message.NewMessage(quotes, "stale", message.WithExpiry(time.Now().Add(-time.Second)))
+	if _, err := b.PublishContext(context.Background(), stale); !errors.Is(err, subscription.ErrExpired) {
+		t.Errorf("PublishContext(expired) error = %v, want ErrExpired", err)
+	}
+
+	// Expires in a slow subscriber's queue under the topic's default TTL; its own
+	// expiry keeps "long" deliverable
+	sub := b.Subscribe(quotes)
+	b.Publish(message.NewMessage(quotes, "held"))
+	b.Publish(message.NewMessage(quotes, "short"))
+	b.Publish(message.NewMessage(quotes, "long", message.WithTTL(time.Hour)))
+	time.Sleep(50 * time.Millisecond)
+
+	for _, want := range []string{"held", "long"} {
+		select {
+		case msg := <-sub.MessageChannel():
+			if msg.Data() != want {
+				t.Errorf("received %v, want %v", msg.Data(), want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+
+	for _, want := range []string{"stale", "short"} {
+		select {
+		case msg := <-auditSub.MessageChannel():
+			if msg.Data() != want || msg.Header(broker.HeaderExpiredTopic) != "quotes" || msg.Header(broker.HeaderExpiredID) == "" {
+				t.Errorf("expired topic received %v with headers %v, want %v", msg.Data(), msg.Headers(), want)
+			}
+			if _, ok := msg.ExpiresAt(); ok {
+				t.Errorf("expired topic received %v with an expiry", msg.Data())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for expired %v", want)
+		}
+	}
+	mu.Lock()
+	if fmt.Sprint(expired) != "[stale short]" {
+		t.Errorf("expired handler saw %v, want [stale short]", expired)
+	}
+	mu.Unlock()
+
+	// Only the unexpired retained message remains
+	if retained := b.Retained(quotes); len(retained) != 1 || retained[0].Data() != "long" {
+		t.Errorf("Retained() = %v, want long", retained)
+	}
+}
+
+func TestBrokerReplaySkipsExpired(t *testing.T) {
+	var mu sync.Mutex
+	var expired []string
+	b := broker.NewBroker(broker.WithDataDir(t.TempDir()), broker.WithExpiredHandler(func(msg message.Message) {
+		mu.Lock()
+		expired = append(expired, msg.Data().(string))
+		mu.Unlock()
+	}))
+	defer b.Close()
+
+	quotes, _ := topic.New("quotes")
+	if err := b.ConfigureTopic(quotes, broker.Durable()); err != nil {
+		t.Fatalf("ConfigureTopic() error = %v", err)
+	}
+
+	b.Publish(message.NewMessage(quotes, "stale", message.WithTTL(20*time.Millisecond)))
+	b.Publish(message.NewMessage(quotes, "fresh", message.WithTTL(time.Hour)))
+	time.Sleep(50 * time.Millisecond)
+
+	sub := b.Subscribe(quotes, subscription.WithStartPosition(subscription.FromEarliest()))
+	select {
+	case msg := <-sub.MessageChannel():
+		if msg.Data() != "fresh" {
+			t.Errorf("replayed %v, want fresh", msg.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for replay")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(expired) != 0 {
+		t.Errorf("expired handler saw %v during replay, want nothing", expired)
+	}
+}
@@ -0,0 +1,256 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/storage/commitlog"
+)
+
+// DeadLetterSuffix is appended to a topic name to form its default dead-letter topic.
+const DeadLetterSuffix = ".dlq"
+
+// Headers added to messages published to a dead-letter topic. A dead letter otherwise
+// keeps the original message's ID, payload and headers.
+const (
+	HeaderDeadLetterTopic        = "dead-letter-original-topic"
+	HeaderDeadLetterFailures     = "dead-letter-failures"
+	HeaderDeadLetterLastError    = "dead-letter-last-error"
+	HeaderDeadLetterFirstFailure = "dead-letter-first-failure"
+)
+
+// deadLetterCursorDir is the directory, under the data directory, recording how far
+// each dead-letter topic has been replayed.
+const deadLetterCursorDir = "dead-letters"
+
+// ErrNotDurable is returned when reading the dead letters of a topic that is not durable.
+var ErrNotDurable = errors.New("topic is not durable")
+
+// DeadLetter describes a message on a dead-letter topic, as recorded in its headers.
+type DeadLetter struct {
+	Message       message.Message // the original message, on its original topic
+	OriginalTopic string
+	Failures      int    // how many times the message was delivered
+	LastError     string // the rejection reason, or why delivery stopped
+	FirstFailure  time.Time
+}
+
+// ParseDeadLetter reads the headers of a message received from a dead-letter topic.
+// The returned Message has no dead-letter headers and no expiry, which it may have been
+// given by the dead-letter topic's DefaultTTL. Returns an error if the message does not name its original topic.
+func ParseDeadLetter(msg message.Message) (DeadLetter, error) {
+	original, err := topic.New(msg.Header(HeaderDeadLetterTopic))
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("message %s is not a dead letter: %w", msg.ID(), err)
+	}
+	failures, _ := strconv.Atoi(msg.Header(HeaderDeadLetterFailures))
+	firstFailure, _ := time.Parse(time.RFC3339Nano, msg.Header(HeaderDeadLetterFirstFailure))
+
+	return DeadLetter{
+		Message: msg.WithDelivery(nil, 0).WithTopic(original).With(
+			message.WithoutHeader(HeaderDeadLetterTopic),
+			message.WithoutHeader(HeaderDeadLetterFailures),
+			message.WithoutHeader(HeaderDeadLetterLastError),
+			message.WithoutHeader(HeaderDeadLetterFirstFailure),
+			message.WithoutHeader(message.HeaderExpiresAt),
+		),
+		OriginalTopic: original.String(),
+		Failures:      failures,
+		LastError:     msg.Header(HeaderDeadLetterLastError),
+		FirstFailure:  firstFailure,
+	}, nil
+}
+
+// DeadLetterAfter moves messages on the topic to its dead-letter topic once they have
+// been delivered maxDeliveries times without acknowledgement, or as soon as a subscriber
+// rejects them. It applies to subscriptions in manual ack mode. The dead-letter topic
+// defaults to the topic name with DeadLetterSuffix appended; make it durable to keep
+// dead letters for DeadLetters and ReplayDeadLetters.
+func DeadLetterAfter(maxDeliveries int) TopicOption {
+	return func(c *topicConfig) {
+		c.deadLetter = true
+		c.maxDeliveries = maxDeliveries
+	}
+}
+
+// DeadLetterTopic sets the topic dead letters are published to.
+func DeadLetterTopic(t topic.Topic) TopicOption {
+	return func(c *topicConfig) {
+		c.deadLetterTopic = t
+	}
+}
+
+// DeadLetters returns the dead letters stored in a durable dead-letter topic that have
+// not been replayed, oldest first. Messages on the topic without dead-letter headers
+// are skipped. Returns ErrWildcardTopic, ErrBrokerClosed, ErrNotDurable, or an error
+// reading the topic's log.
+func (b *Broker) DeadLetters(dlq topic.Topic) ([]DeadLetter, error) {
+	b.replayMutex.Lock()
+	defer b.replayMutex.Unlock()
+
+	letters, _, _, err := b.readDeadLetters(dlq)
+	return letters, err
+}
+
+// ReplayDeadLetters republishes the dead letters returned by DeadLetters to their
+// original topics, with their dead-letter headers removed and their delivery count
+// reset. The dead-letter topic keeps its messages, but the broker records how far it
+// has been replayed, across restarts, so that each letter is replayed once.
+// Returns how many messages were replayed, and the errors of DeadLetters or of saving
+// the replay position.
+func (b *Broker) ReplayDeadLetters(dlq topic.Topic) (int, error) {
+	b.replayMutex.Lock()
+	defer b.replayMutex.Unlock()
+
+	letters, offsets, end, err := b.readDeadLetters(dlq)
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for i, letter := range letters {
+		_, err := b.PublishContext(context.Background(), letter.Message)
+		if errors.Is(err, subscription.ErrExpired) {
+			// Reported as expired by PublishContext
+			continue
+		}
+		if err != nil {
+			// Resume from this letter next time
+			if saveErr := b.saveDeadLetterCursor(dlq, offsets[i]); saveErr != nil {
+				return replayed, saveErr
+			}
+			return replayed, err
+		}
+		replayed++
+	}
+
+	return replayed, b.saveDeadLetterCursor(dlq, end)
+}
+
+// readDeadLetters reads the dead letters after a dead-letter topic's replay position,
+// with the offset of each and the offset following the last record read.
+// It must be called with replayMutex held.
+func (b *Broker) readDeadLetters(dlq topic.Topic) ([]DeadLetter, []uint64, uint64, error) {
+	if dlq.IsWildcard() {
+		return nil, nil, 0, ErrWildcardTopic
+	}
+
+	b.mutex.RLock()
+	closed := b.closed
+	cfg, ok := b.topics[dlq.String()]
+	b.mutex.RUnlock()
+	if closed {
+		return nil, nil, 0, ErrBrokerClosed
+	}
+	if !ok || cfg.log == nil {
+		return nil, nil, 0, ErrNotDurable
+	}
+
+	offset, err := b.loadDeadLetterCursor(dlq)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if oldest := cfg.log.OldestOffset(); offset < oldest {
+		offset = oldest
+	}
+
+	var letters []DeadLetter
+	var offsets []uint64
+	end := cfg.log.NextOffset()
+	for ; offset < end; offset++ {
+		record, err := cfg.log.Read(offset)
+		if errors.Is(err, commitlog.ErrOffsetOutOfRange) {
+			// Removed by retention since the oldest offset was read
+			continue
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		msg, err := message.Decode(record.Data)
+		if err != nil {
+			continue
+		}
+		letter, err := ParseDeadLetter(msg)
+		if err != nil {
+			continue
+		}
+		letters = append(letters, letter)
+		offsets = append(offsets, offset)
+	}
+	return letters, offsets, end, nil
+}
+
+// deadLetterCursorPath returns the file recording how far a dead-letter topic has been replayed.
+func (b *Broker) deadLetterCursorPath(dlq topic.Topic) string {
+	return filepath.Join(b.dataDir, deadLetterCursorDir, dlq.String())
+}
+
+// loadDeadLetterCursor returns the offset replay of a dead-letter topic resumes from.
+// A missing file means nothing has been replayed.
+func (b *Broker) loadDeadLetterCursor(dlq topic.Topic) (uint64, error) {
+	path := b.deadLetterCursorPath(dlq)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("read %s: %w", path, err)
+	}
+	return offset, nil
+}
+
+// saveDeadLetterCursor records the offset replay of a dead-letter topic resumes from.
+func (b *Broker) saveDeadLetterCursor(dlq topic.Topic, offset uint64) error {
+	return writeFileAtomic(b.deadLetterCursorPath(dlq), []byte(strconv.FormatUint(offset, 10)+"\n"))
+}
+
+// handleDrop is registered on every subscription. It reports expired messages and moves
+// messages that failed delivery to the dead-letter topic of their topic, if one is configured.
+func (b *Broker) handleDrop(msg message.Message, reason error) {
+	if errors.Is(reason, subscription.ErrExpired) {
+		b.handleExpired(msg)
+		return
+	}
+
+	var failure *subscription.DeliveryError
+	if !errors.As(reason, &failure) {
+		return
+	}
+
+	b.mutex.RLock()
+	cfg, ok := b.topics[msg.Topic().String()]
+	b.mutex.RUnlock()
+	if !ok || !cfg.deadLetter {
+		return
+	}
+
+	dlq := cfg.deadLetterTopic
+	if dlq.String() == "" {
+		dlq, _ = topic.New(msg.Topic().String() + DeadLetterSuffix)
+	}
+
+	// The dead letter keeps the original payload, ID and headers, so it encodes like
+	// the original and can be replayed as it was. Its expiry is removed, as for
+	// expired messages, so that it is not discarded before anyone can inspect it.
+	b.Publish(msg.WithTopic(dlq).With(
+		message.WithoutHeader(message.HeaderExpiresAt),
+		message.WithHeader(HeaderDeadLetterTopic, msg.Topic().String()),
+		message.WithHeader(HeaderDeadLetterFailures, strconv.Itoa(failure.Deliveries)),
+		message.WithHeader(HeaderDeadLetterLastError, failure.Err.Error()),
+		message.WithHeader(HeaderDeadLetterFirstFailure, failure.FirstFailure.Format(time.RFC3339Nano)),
+	))
+}
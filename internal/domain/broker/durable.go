@@ -0,0 +1,117 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/storage/commitlog"
+)
+
+// openTopicLog opens the log for a durable topic under the broker's data directory.
+// Topic names are used as directory names, so a name that would not stay inside the
+// topics directory is rejected even though topic.New does not accept such names.
+func (b *Broker) openTopicLog(topicName string) (*commitlog.Log, error) {
+	if b.dataDir == "" {
+		return nil, ErrNoDataDir
+	}
+	if topicName == "" || topicName == "." || topicName == ".." || strings.ContainsAny(topicName, `/\`) {
+		return nil, fmt.Errorf("durable topic %q: name cannot be used as a directory", topicName)
+	}
+	return commitlog.Open(filepath.Join(b.dataDir, "topics", topicName), b.logOptions...)
+}
+
+// resumeScanLimit caps how many records offsetAfterMessage reads looking for a message
+// ID, so that resuming with an unknown or very old ID costs a bounded amount of work.
+const resumeScanLimit = 10000
+
+// startOffset resolves a subscription's start position to an offset in the log.
+// latest is the log's next offset when the subscription was created.
+func startOffset(log *commitlog.Log, position subscription.StartPosition, latest uint64) uint64 {
+	switch position.Kind {
+	case subscription.StartEarliest:
+		return log.OldestOffset()
+	case subscription.StartOffset:
+		return position.Offset
+	case subscription.StartTime:
+		return log.OffsetForTime(position.Time)
+	case subscription.StartAfterMessage:
+		return offsetAfterMessage(log, position.MessageID, latest)
+	default:
+		return latest
+	}
+}
+
+// offsetAfterMessage finds the offset following the message with the given ID among
+// the resumeScanLimit records before latest. The log is scanned from the newest
+// record, since resuming clients are usually only a little behind. If the ID is not
+// found, latest is returned, so the subscription continues with new messages rather
+// than replaying the whole log.
+func offsetAfterMessage(log *commitlog.Log, id string, latest uint64) uint64 {
+	oldest := log.OldestOffset()
+	if latest > resumeScanLimit && latest-resumeScanLimit > oldest {
+		oldest = latest - resumeScanLimit
+	}
+	for offset := latest; offset > oldest; offset-- {
+		record, err := log.Read(offset - 1)
+		if err != nil {
+			break
+		}
+		if recordID, err := message.PeekID(record.Data); err == nil && recordID == id {
+			return offset
+		}
+	}
+	return latest
+}
+
+// replay feeds a subscription from a durable topic's log, starting at the subscription's
+// start position and then following new appends, until the subscription or the log is
+// closed. latest is the log's next offset when the subscription was created; the start
+// position is resolved here rather than by the subscriber, since finding a message ID
+// reads the log.
+// Messages wait for queue space instead of being dropped, since the log holds the backlog.
+// Records that have expired are skipped without being reported.
+func (b *Broker) replay(sub *subscription.Subscription, log *commitlog.Log, latest uint64) {
+	offset := startOffset(log, sub.StartPosition(), latest)
+	for {
+		// Obtain the change channel before reading so an append in between is not missed
+		changed := log.Changed()
+
+		record, err := log.Read(offset)
+		if errors.Is(err, commitlog.ErrOffsetOutOfRange) {
+			if oldest := log.OldestOffset(); offset < oldest {
+				offset = oldest
+				continue
+			}
+
+			select {
+			case <-changed:
+				continue
+			case <-sub.Done():
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		offset++
+
+		msg, err := message.Decode(record.Data)
+		if err != nil {
+			continue
+		}
+		// Expired records were reported when they expired on the live stream, so
+		// replaying them would report them again
+		if msg.Expired(time.Now()) {
+			continue
+		}
+		if err := sub.SendMessageBlocking(msg); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// Headers added to messages published to an expired-message topic, alongside the
+// original message's headers other than its expiry.
+const (
+	HeaderExpiredTopic = "expired-original-topic"
+	HeaderExpiredID    = "expired-original-id"
+	HeaderExpiredAt    = "expired-at"
+)
+
+// ExpiredHandler is called for every expired message the broker discards.
+// It is called synchronously from the publishing or delivering goroutine and must not block.
+type ExpiredHandler func(msg message.Message)
+
+// WithExpiredHandler registers a callback invoked for every expired message the broker
+// discards, for example to audit stale messages. A message that expires in the queues
+// of several subscriptions is reported once for each of them.
+func WithExpiredHandler(handler ExpiredHandler) Option {
+	return func(b *Broker) {
+		b.expiredHandlers = append(b.expiredHandlers, handler)
+	}
+}
+
+// DefaultTTL sets how long messages published to the topic stay deliverable, unless
+// they carry their own expiry set with message.WithTTL or message.WithExpiry.
+// Subscriptions discard messages that expire before they are received.
+func DefaultTTL(ttl time.Duration) TopicOption {
+	return func(c *topicConfig) {
+		c.ttl = ttl
+	}
+}
+
+// ExpiredTopic publishes messages on the topic that expire before delivery to another
+// topic, with their expiry removed and headers naming the original topic, ID and expiry.
+func ExpiredTopic(t topic.Topic) TopicOption {
+	return func(c *topicConfig) {
+		c.expiredTopic = t
+	}
+}
+
+// withDefaultTTL returns the message with the topic's default TTL applied, if the
+// topic has one and the message has no expiry of its own.
+func withDefaultTTL(cfg *topicConfig, msg message.Message) message.Message {
+	if cfg == nil || cfg.ttl <= 0 {
+		return msg
+	}
+	if _, ok := msg.ExpiresAt(); ok {
+		return msg
+	}
+	return msg.With(message.WithTTL(cfg.ttl))
+}
+
+// handleExpired reports a discarded expired message to the expired handlers and the
+// topic's expired-message topic, if any.
+func (b *Broker) handleExpired(msg message.Message) {
+	msg = msg.WithDelivery(nil, 0)
+	for _, handler := range b.expiredHandlers {
+		handler(msg)
+	}
+
+	b.mutex.RLock()
+	cfg, ok := b.topics[msg.Topic().String()]
+	b.mutex.RUnlock()
+	if !ok || cfg.expiredTopic.String() == "" {
+		return
+	}
+
+	headers := msg.Headers()
+	delete(headers, message.HeaderExpiresAt)
+	expiresAt, _ := msg.ExpiresAt()
+	b.Publish(message.NewMessage(cfg.expiredTopic, msg.Data(),
+		message.WithHeaders(headers),
+		message.WithHeader(HeaderExpiredTopic, msg.Topic().String()),
+		message.WithHeader(HeaderExpiredID, msg.ID()),
+		message.WithHeader(HeaderExpiredAt, expiresAt.Format(time.RFC3339Nano)),
+	))
+}
@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+)
+
+// consumerGroup is a set of subscriptions on the same topic or pattern that share
+// one stream of messages. Each message is delivered to exactly one member.
+type consumerGroup struct {
+	name     string
+	strategy subscription.GroupStrategy
+
+	mu      sync.Mutex
+	members []*subscription.Subscription
+	next    uint64 // round-robin position
+}
+
+func newConsumerGroup(name string, strategy subscription.GroupStrategy) *consumerGroup {
+	return &consumerGroup{name: name, strategy: strategy}
+}
+
+// add registers a member.
+func (g *consumerGroup) add(sub *subscription.Subscription) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members = append(g.members, sub)
+}
+
+// remove unregisters a member and returns how many members remain.
+func (g *consumerGroup) remove(sub *subscription.Subscription) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, member := range g.members {
+		if member.ID() == sub.ID() {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	return len(g.members)
+}
+
+// pick chooses the member that should receive the message, skipping members in exclude.
+// Returns nil if no eligible member remains.
+func (g *consumerGroup) pick(msg message.Message, exclude map[string]bool) *subscription.Subscription {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	candidates := make([]*subscription.Subscription, 0, len(g.members))
+	for _, member := range g.members {
+		if !exclude[member.ID()] {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	key, keyed := g.strategy.Key(msg)
+	if !keyed {
+		member := candidates[g.next%uint64(len(candidates))]
+		g.next++
+		return member
+	}
+
+	// Rendezvous hashing: the member with the highest score for the key wins, so a
+	// membership change only moves the keys owned by the member that left or joined
+	var best *subscription.Subscription
+	var bestScore uint64
+	for _, member := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(member.ID()))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = member, score
+		}
+	}
+	return best
+}
+
+// deliverToGroup sends the message to one member. With round-robin, a member whose
+// queue is full is passed over for the next member with room, so one slow member does
+// not drop messages the others could take; a keyed strategy keeps the member that
+// owns the key. Members closed by a concurrent unsubscribe are skipped. When no
+// member has room, the first one chosen applies its overflow policy.
+// Returns the error from the member that took or dropped the message, or
+// subscription.ErrClosed if no member remains.
+func (b *Broker) deliverToGroup(g *consumerGroup, msg message.Message) error {
+	tried := make(map[string]bool)
+	var full []*subscription.Subscription
+	for {
+		member := g.pick(msg, tried)
+		if member == nil {
+			break
+		}
+
+		err := member.TrySendMessage(msg)
+		if err != subscription.ErrBufferFull && err != subscription.ErrClosed {
+			return err
+		}
+		tried[member.ID()] = true
+		if err == subscription.ErrBufferFull {
+			full = append(full, member)
+			if g.strategy.Keyed() {
+				break
+			}
+		}
+	}
+
+	// Every member is full or closed: let a full member's overflow policy decide
+	for _, member := range full {
+		err := member.SendMessage(msg)
+		switch err {
+		case subscription.ErrSlowConsumer:
+			b.Unsubscribe(member.ID())
+			return err
+		case subscription.ErrClosed:
+			continue
+		default:
+			return err
+		}
+	}
+	return subscription.ErrClosed
+}
@@ -0,0 +1,199 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+const (
+	// DefaultHandlerConcurrency is how many messages a handler processes at once.
+	// One worker keeps messages in order.
+	DefaultHandlerConcurrency = 1
+
+	// DefaultNackDelay is how long a message that failed handling waits before it is
+	// redelivered.
+	DefaultNackDelay = time.Second
+)
+
+// HandlerFunc processes one message. Returning nil acknowledges the message;
+// returning an error nacks it for redelivery, unless the error is wrapped with
+// Permanent, in which case the message is rejected and moved to the topic's
+// dead-letter topic, if any. The context is cancelled when the handler is stopped.
+type HandlerFunc func(ctx context.Context, msg message.Message) error
+
+// Middleware wraps a HandlerFunc to add behavior around it, such as logging.
+// Middleware is also a HandlerOption, so it can be passed straight to Handle.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// HandlerOption configures a handler registered with Handle.
+type HandlerOption interface {
+	applyHandler(*handlerConfig)
+}
+
+// handlerConfig holds the settings applied by HandlerOptions.
+type handlerConfig struct {
+	concurrency int
+	nackDelay   time.Duration
+	subOptions  []subscription.Option
+	middleware  []Middleware
+}
+
+type handlerOptionFunc func(*handlerConfig)
+
+func (f handlerOptionFunc) applyHandler(c *handlerConfig) {
+	f(c)
+}
+
+func (m Middleware) applyHandler(c *handlerConfig) {
+	c.middleware = append(c.middleware, m)
+}
+
+// WithConcurrency sets how many messages the handler processes at once.
+// Values below 1 are treated as 1. With more than one worker, messages may
+// complete out of order.
+func WithConcurrency(n int) HandlerOption {
+	return handlerOptionFunc(func(c *handlerConfig) {
+		if n < 1 {
+			n = 1
+		}
+		c.concurrency = n
+	})
+}
+
+// WithNackDelay sets how long a message that failed handling waits before it is redelivered.
+func WithNackDelay(d time.Duration) HandlerOption {
+	return handlerOptionFunc(func(c *handlerConfig) {
+		c.nackDelay = d
+	})
+}
+
+// WithHandlerSubscription sets options for the handler's subscription, such as a
+// consumer group, buffer size or ack wait. Manual acknowledgement is always enabled.
+func WithHandlerSubscription(opts ...subscription.Option) HandlerOption {
+	return handlerOptionFunc(func(c *handlerConfig) {
+		c.subOptions = append(c.subOptions, opts...)
+	})
+}
+
+// PermanentError marks a handler error that redelivery cannot fix.
+type PermanentError struct {
+	Err error
+}
+
+// Error returns the underlying error's message.
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err so that the message being handled is rejected rather than
+// redelivered, and so that Retry gives up at once. Returns nil for a nil error.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// isPermanent reports whether err was wrapped with Permanent.
+func isPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// Handler is a handler registered with Handle.
+type Handler struct {
+	broker *Broker
+	sub    *subscription.Subscription
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Handle subscribes to a topic or pattern and calls h for every message from a pool
+// of worker goroutines, so consumers do not have to write their own receive loops.
+// Options set the pool size and subscription, and middleware wraps h; the first
+// middleware given is the outermost. The subscription uses manual acknowledgement,
+// and the error h returns decides whether each message is acked, nacked or rejected.
+// It returns ErrBrokerClosed after Close, or ErrGroupStrategyConflict if the
+// handler's consumer group uses a different strategy.
+func (b *Broker) Handle(t topic.Topic, h HandlerFunc, opts ...HandlerOption) (*Handler, error) {
+	cfg := handlerConfig{
+		concurrency: DefaultHandlerConcurrency,
+		nackDelay:   DefaultNackDelay,
+	}
+	for _, opt := range opts {
+		opt.applyHandler(&cfg)
+	}
+	for i := len(cfg.middleware) - 1; i >= 0; i-- {
+		h = cfg.middleware[i](h)
+	}
+
+	subOpts := append(cfg.subOptions, subscription.WithManualAck())
+	sub, err := b.subscribe(t, subOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := &Handler{broker: b, sub: sub, cancel: cancel}
+
+	// Cancel in-flight work when the subscription ends, for example on Close
+	go func() {
+		<-sub.Done()
+		cancel()
+	}()
+
+	handler.wg.Add(cfg.concurrency)
+	for i := 0; i < cfg.concurrency; i++ {
+		go handler.work(ctx, h, cfg.nackDelay)
+	}
+	return handler, nil
+}
+
+// work is a worker goroutine. It handles messages until the subscription is closed.
+func (h *Handler) work(ctx context.Context, handle HandlerFunc, nackDelay time.Duration) {
+	defer h.wg.Done()
+
+	for {
+		select {
+		case msg, ok := <-h.sub.MessageChannel():
+			if !ok {
+				return
+			}
+			err := handle(ctx, msg)
+			switch {
+			case err == nil:
+				msg.Ack()
+			case isPermanent(err):
+				msg.Reject(err)
+			default:
+				msg.Nack(nackDelay)
+			}
+		case <-h.sub.Done():
+			return
+		}
+	}
+}
+
+// Subscription returns the handler's subscription.
+func (h *Handler) Subscription() *subscription.Subscription {
+	return h.sub
+}
+
+// Stop unsubscribes the handler, cancels the context passed to running calls and
+// waits for them to return.
+func (h *Handler) Stop() {
+	h.broker.Unsubscribe(h.sub.ID())
+	h.cancel()
+	h.wg.Wait()
+}
@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+)
+
+// PanicError is the error Recover returns for a handler that panicked.
+type PanicError struct {
+	Value interface{} // the value passed to panic
+	Stack []byte      // the panicking goroutine's stack
+}
+
+// Error describes the panic.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.Value)
+}
+
+// Recover turns a panic in the handler into a *PanicError, so the message is nacked
+// and the worker keeps running.
+func Recover() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg message.Message) (err error) {
+			defer func() {
+				if v := recover(); v != nil {
+					err = &PanicError{Value: v, Stack: debug.Stack()}
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Logging logs every handled message: failures at error level and successes at
+// debug level, with the message's topic, ID, delivery attempt and handling time.
+// A nil logger uses slog.Default.
+func Logging(logger *slog.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg message.Message) error {
+			l := logger
+			if l == nil {
+				l = slog.Default()
+			}
+
+			start := time.Now()
+			err := next(ctx, msg)
+			attrs := []slog.Attr{
+				slog.String("topic", msg.Topic().String()),
+				slog.String("id", msg.ID()),
+				slog.Int("attempt", msg.DeliveryAttempt()),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if err != nil {
+				l.LogAttrs(ctx, slog.LevelError, "message handling failed", append(attrs, slog.Any("error", err))...)
+			} else {
+				l.LogAttrs(ctx, slog.LevelDebug, "message handled", attrs...)
+			}
+			return err
+		}
+	}
+}
+
+// Timeout gives each call a context that is cancelled after d. The handler must
+// watch the context; one that ignores it keeps its worker busy until it returns.
+func Timeout(d time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg message.Message) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Retry calls the handler up to attempts times while it fails, waiting backoff
+// before the first retry and doubling the wait after each one. Errors wrapped with
+// Permanent are returned at once, as is the context's error if it ends while waiting.
+// Retrying in place keeps the message with this worker: the message's ack deadline
+// is extended with InProgress before and after each wait, so each single wait must
+// be shorter than the subscription's ack wait. If the message has been redelivered
+// by then, or once the attempts are used up, the handler's error is returned and
+// the message is nacked as usual.
+func Retry(attempts int, backoff time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg message.Message) error {
+			wait := backoff
+			for attempt := 1; ; attempt++ {
+				err := next(ctx, msg)
+				if err == nil || isPermanent(err) || attempt >= attempts {
+					return err
+				}
+
+				if msg.InProgress() != nil {
+					return err
+				}
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
+				if msg.InProgress() != nil {
+					return err
+				}
+				wait *= 2
+			}
+		}
+	}
+}
+
+// HandlerMetrics counts what a handler did. The zero value is ready to use, and one
+// HandlerMetrics may be shared by several handlers.
+type HandlerMetrics struct {
+	succeeded atomic.Uint64
+	failed    atomic.Uint64
+	inFlight  atomic.Int64
+	duration  atomic.Int64 // total handling time in nanoseconds
+}
+
+// HandlerStats is a snapshot of HandlerMetrics.
+type HandlerStats struct {
+	Succeeded     uint64
+	Failed        uint64
+	InFlight      int64
+	TotalDuration time.Duration
+}
+
+// Snapshot returns the current counts.
+func (m *HandlerMetrics) Snapshot() HandlerStats {
+	return HandlerStats{
+		Succeeded:     m.succeeded.Load(),
+		Failed:        m.failed.Load(),
+		InFlight:      m.inFlight.Load(),
+		TotalDuration: time.Duration(m.duration.Load()),
+	}
+}
+
+// Metrics records every call in m.
+func Metrics(m *HandlerMetrics) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg message.Message) error {
+			m.inFlight.Add(1)
+			start := time.Now()
+			err := next(ctx, msg)
+			m.duration.Add(int64(time.Since(start)))
+			m.inFlight.Add(-1)
+
+			if err != nil {
+				m.failed.Add(1)
+			} else {
+				m.succeeded.Add(1)
+			}
+			return err
+		}
+	}
+}
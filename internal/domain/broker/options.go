@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/storage/commitlog"
+)
+
+// Option configures a Broker.
+type Option func(*Broker)
+
+// WithDataDir sets the directory where durable topics store their logs.
+// Each durable topic gets its own subdirectory. The log options apply to every topic log.
+func WithDataDir(dir string, opts ...commitlog.Option) Option {
+	return func(b *Broker) {
+		b.dataDir = dir
+		b.logOptions = opts
+	}
+}
+
+// TopicOption configures how the broker treats a single topic.
+type TopicOption func(*topicConfig)
+
+// topicConfig holds the per-topic settings applied with ConfigureTopic.
+// A config is not modified once the broker stores it; ConfigureTopic replaces it with
+// an updated copy, so holders of the old one may read it without the broker's lock.
+type topicConfig struct {
+	durable bool
+	log     *commitlog.Log // open when durable
+
+	deadLetter      bool
+	maxDeliveries   int
+	deadLetterTopic topic.Topic // zero value means the default name
+
+	retain    bool
+	retainKey func(message.Message) string // nil to retain one message
+
+	ttl          time.Duration // default TTL, zero for none
+	expiredTopic topic.Topic   // zero value means expired messages are not republished
+}
+
+// Durable stores every message published to the topic in an append-only log under
+// the broker's data directory, whether or not anyone is subscribed. Subscribers can
+// replay stored messages with subscription.WithStartPosition.
+func Durable() TopicOption {
+	return func(c *topicConfig) {
+		c.durable = true
+	}
+}
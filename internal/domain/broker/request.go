@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// InboxPrefix is the first segment of the reply topics created by Request and RequestMany.
+const InboxPrefix = "inbox"
+
+// ErrNoReplyTo is returned by Respond when the request has no valid reply-to header.
+var ErrNoReplyTo = errors.New("message has no reply-to topic")
+
+// Request publishes msg with a reply-to header naming a new inbox topic and waits for
+// the first reply published there, usually with Respond. It returns ctx.Err() if the
+// context ends first and ErrBrokerClosed if the broker is closed before a reply arrives.
+// Any reply-to header already set on msg is replaced.
+func (b *Broker) Request(ctx context.Context, msg message.Message) (message.Message, error) {
+	sub, inbox := b.subscribeInbox(1)
+	defer b.Unsubscribe(sub.ID())
+
+	if _, err := b.PublishContext(ctx, msg.With(message.WithReplyTo(inbox))); err != nil {
+		return message.Message{}, err
+	}
+
+	select {
+	case reply, ok := <-sub.MessageChannel():
+		if !ok {
+			return message.Message{}, ErrBrokerClosed
+		}
+		return reply, nil
+	case <-sub.Done():
+		return message.Message{}, ErrBrokerClosed
+	case <-ctx.Done():
+		return message.Message{}, ctx.Err()
+	}
+}
+
+// RequestMany publishes msg like Request and gathers replies from several responders.
+// It returns when n replies have arrived, or when the timeout elapses with the replies
+// gathered so far; n <= 0 gathers until the timeout. Errors are reported as by
+// Request, along with the replies gathered before the error.
+func (b *Broker) RequestMany(ctx context.Context, msg message.Message, n int, timeout time.Duration) ([]message.Message, error) {
+	size := n
+	if size <= 0 {
+		size = subscription.DefaultBufferSize
+	}
+	sub, inbox := b.subscribeInbox(size)
+	defer b.Unsubscribe(sub.ID())
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	if _, err := b.PublishContext(ctx, msg.With(message.WithReplyTo(inbox))); err != nil {
+		return nil, err
+	}
+
+	var replies []message.Message
+	for n <= 0 || len(replies) < n {
+		select {
+		case reply, ok := <-sub.MessageChannel():
+			if !ok {
+				return replies, ErrBrokerClosed
+			}
+			replies = append(replies, reply)
+		case <-timer.C:
+			return replies, nil
+		case <-sub.Done():
+			return replies, ErrBrokerClosed
+		case <-ctx.Done():
+			return replies, ctx.Err()
+		}
+	}
+	return replies, nil
+}
+
+// Respond publishes a reply to the topic named by req's reply-to header. The reply
+// carries req's correlation ID, or its ID if it has none, so responses can be matched
+// to requests. Options set further headers on the reply. It returns ErrNoReplyTo
+// if req has no valid reply-to header, and ErrBrokerClosed after Close.
+func (b *Broker) Respond(req message.Message, data interface{}, opts ...message.Option) error {
+	if req.ReplyTo() == "" {
+		return ErrNoReplyTo
+	}
+	replyTo, err := topic.New(req.ReplyTo())
+	if err != nil {
+		return ErrNoReplyTo
+	}
+
+	correlationID := req.CorrelationID()
+	if correlationID == "" {
+		correlationID = req.ID()
+	}
+	opts = append([]message.Option{message.WithCorrelationID(correlationID)}, opts...)
+	_, err = b.PublishContext(context.Background(), message.NewMessage(replyTo, data, opts...))
+	return err
+}
+
+// subscribeInbox subscribes to a new, randomly named inbox topic.
+func (b *Broker) subscribeInbox(bufferSize int) (*subscription.Subscription, topic.Topic) {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	inbox, _ := topic.New(InboxPrefix + topic.Separator + hex.EncodeToString(bytes))
+	return b.Subscribe(inbox, subscription.WithBufferSize(bufferSize)), inbox
+}
@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// Retain keeps the last message published to the topic. Every new subscription whose
+// topic or pattern matches receives it before any live message, so subscribers learn
+// the current state without waiting for the next publish. Consumer group members and
+// subscriptions replaying a durable topic do not receive retained messages.
+func Retain() TopicOption {
+	return func(c *topicConfig) {
+		c.retain = true
+		c.retainKey = nil
+	}
+}
+
+// RetainByKey is like Retain but keeps the last message for every key, as returned by
+// the key function, so that a topic can carry the state of many entities.
+func RetainByKey(key func(message.Message) string) TopicOption {
+	return func(c *topicConfig) {
+		c.retain = true
+		c.retainKey = key
+	}
+}
+
+// retainedTopic holds the messages retained for a topic, by retain key.
+type retainedTopic struct {
+	topic    topic.Topic
+	messages map[string]message.Message
+}
+
+// Retained returns the messages retained for a topic, oldest first. Expired messages
+// are not returned.
+func (b *Broker) Retained(t topic.Topic) []message.Message {
+	b.retainedMutex.Lock()
+	defer b.retainedMutex.Unlock()
+
+	r, ok := b.retained[t.String()]
+	if !ok {
+		return nil
+	}
+
+	var retained []message.Message
+	now := time.Now()
+	for _, msg := range r.messages {
+		if !msg.Expired(now) {
+			retained = append(retained, msg)
+		}
+	}
+	sortByPublishTime(retained)
+	return retained
+}
+
+// ClearRetained removes the messages retained for a topic. With keys, only the
+// messages retained for those keys are removed.
+func (b *Broker) ClearRetained(t topic.Topic, keys ...string) {
+	b.retainedMutex.Lock()
+	defer b.retainedMutex.Unlock()
+
+	if len(keys) == 0 {
+		delete(b.retained, t.String())
+		return
+	}
+	if r, ok := b.retained[t.String()]; ok {
+		for _, key := range keys {
+			delete(r.messages, key)
+		}
+	}
+}
+
+// retain stores a message published to a retaining topic. It is called while the
+// publisher holds the broker's read lock, so a concurrent Subscribe either sees the
+// message as retained or receives it live, never neither.
+func (b *Broker) retain(cfg *topicConfig, msg message.Message) {
+	var key string
+	if cfg.retainKey != nil {
+		key = cfg.retainKey(msg)
+	}
+
+	b.retainedMutex.Lock()
+	defer b.retainedMutex.Unlock()
+
+	r, ok := b.retained[msg.Topic().String()]
+	if !ok {
+		r = &retainedTopic{topic: msg.Topic(), messages: make(map[string]message.Message)}
+		b.retained[msg.Topic().String()] = r
+	}
+	r.messages[key] = msg
+}
+
+// sendRetained queues the retained messages matching a new subscription's topic or
+// pattern, oldest first. It is called with the broker's lock held, before the
+// subscription starts receiving live messages, so it preloads them rather than
+// waiting for queue space or applying the overflow policy. Expired messages are skipped.
+func (b *Broker) sendRetained(sub *subscription.Subscription) {
+	b.retainedMutex.Lock()
+	var matched []message.Message
+	now := time.Now()
+	for _, r := range b.retained {
+		if !sub.Topic().Matches(r.topic) {
+			continue
+		}
+		for _, msg := range r.messages {
+			if !msg.Expired(now) {
+				matched = append(matched, msg)
+			}
+		}
+	}
+	b.retainedMutex.Unlock()
+
+	sortByPublishTime(matched)
+	sub.Preload(matched...)
+}
+
+// sortByPublishTime orders messages by publish time.
+func sortByPublishTime(messages []message.Message) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].PublishedAt().Before(messages[j].PublishedAt())
+	})
+}
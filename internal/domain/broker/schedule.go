@@ -0,0 +1,525 @@
+package broker
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+)
+
+const (
+	// scheduleFile is the name of the journal of scheduled messages in the data directory.
+	scheduleFile = "scheduled.journal"
+
+	// scheduleCompactRecords is how many records the journal may hold before it is
+	// compacted, as long as more than half of them are obsolete.
+	scheduleCompactRecords = 1024
+)
+
+var (
+	// ErrAlreadyScheduled is returned when scheduling a message whose ID is already scheduled.
+	ErrAlreadyScheduled = errors.New("message is already scheduled")
+
+	// ErrNotScheduled is returned when cancelling a message that is not scheduled,
+	// for example because it has already been published.
+	ErrNotScheduled = errors.New("message is not scheduled")
+
+	// ErrCorruptSchedule is returned by StartScheduler, PublishAt and CancelScheduled
+	// when the saved schedule could not be read.
+	ErrCorruptSchedule = errors.New("saved schedule is corrupt")
+)
+
+// ScheduledMessage is a message waiting to be published.
+type ScheduledMessage struct {
+	Message message.Message
+	At      time.Time
+}
+
+// PublishAt publishes the message at the given time, or straight away if the time has
+// passed. Until then it can be listed with Scheduled and cancelled with CancelScheduled.
+// With a data directory, scheduled messages are saved so that they survive a restart,
+// and are published only once StartScheduler has been called.
+// Returns ErrWildcardTopic, ErrAlreadyScheduled, ErrBrokerClosed, the error loading the
+// saved schedule, or an error saving the message.
+func (b *Broker) PublishAt(msg message.Message, at time.Time) error {
+	if msg.Topic().IsWildcard() {
+		return ErrWildcardTopic
+	}
+	return b.schedule.add(&scheduledEntry{msg: msg, at: at})
+}
+
+// PublishAfter publishes the message once d has elapsed. See PublishAt.
+func (b *Broker) PublishAfter(msg message.Message, d time.Duration) error {
+	return b.PublishAt(msg, time.Now().Add(d))
+}
+
+// StartScheduler starts publishing scheduled messages when they fall due. A broker
+// without a data directory starts its scheduler itself. With a data directory, messages
+// scheduled by a previous run are loaded by NewBroker but not published until
+// StartScheduler is called, so that topics can be configured first; messages that
+// fell due while the broker was down are then published at once.
+//
+// If NewBroker could not read the saved schedule, StartScheduler returns the error,
+// wrapping ErrCorruptSchedule if the file is damaged, and the scheduler does not start.
+// PublishAt and CancelScheduled return the same error, so the file is left untouched
+// for inspection rather than overwritten.
+func (b *Broker) StartScheduler() error {
+	return b.schedule.start()
+}
+
+// Scheduled returns the messages waiting to be published, earliest first.
+func (b *Broker) Scheduled() []ScheduledMessage {
+	return b.schedule.list()
+}
+
+// CancelScheduled cancels the scheduled message with the given ID.
+// Returns ErrNotScheduled if no such message is waiting, the error loading the saved
+// schedule, or an error saving the cancellation.
+func (b *Broker) CancelScheduled(id string) error {
+	return b.schedule.cancel(id)
+}
+
+// scheduledEntry is a message in the scheduler's heap.
+type scheduledEntry struct {
+	msg   message.Message
+	at    time.Time
+	index int // position in the heap
+}
+
+// scheduleHeap orders entries by due time.
+type scheduleHeap []*scheduledEntry
+
+func (h scheduleHeap) Len() int { return len(h) }
+
+func (h scheduleHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduleHeap) Push(x interface{}) {
+	entry := x.(*scheduledEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// scheduler holds scheduled messages in a heap and publishes each when it falls due,
+// using one timer armed for the earliest entry. With a path, every change is appended
+// to a journal, which is rewritten with only the live entries once it is mostly
+// obsolete records.
+type scheduler struct {
+	publish func(message.Message) error
+	path    string // journal file, empty when scheduled messages are not saved
+
+	mu      sync.Mutex
+	heap    scheduleHeap
+	byID    map[string]*scheduledEntry // message ID -> waiting entry
+	firing  map[string]*scheduledEntry // message ID -> entry being published, kept in the journal until published
+	timer   *time.Timer
+	started bool // whether due entries are published; see Broker.StartScheduler
+	closed  bool
+	err     error // why the journal could not be loaded; the scheduler refuses to run
+
+	journal *os.File // open for appending, nil until the first write after loading or compacting
+	records int      // records in the journal
+	damaged bool     // a failed append may have left a partial record; compact before appending
+}
+
+// newScheduler creates a scheduler and loads the journal at path, if any.
+// Without a path the scheduler starts at once; with one it waits for start.
+// A journal that cannot be read is left as it is and the error kept for start.
+func newScheduler(publish func(message.Message) error, path string) *scheduler {
+	s := &scheduler{
+		publish: publish,
+		path:    path,
+		byID:    make(map[string]*scheduledEntry),
+		firing:  make(map[string]*scheduledEntry),
+	}
+	if path == "" {
+		s.started = true
+		return s
+	}
+
+	entries, records, torn, err := loadSchedule(path)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	for _, entry := range entries {
+		heap.Push(&s.heap, entry)
+		s.byID[entry.msg.ID()] = entry
+	}
+	s.records = records
+	// A record torn by a crash must not be followed by new ones
+	s.damaged = torn
+	return s
+}
+
+// start begins publishing entries as they fall due, unless the journal could not be loaded.
+func (s *scheduler) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.started = true
+	s.arm()
+	return nil
+}
+
+// add schedules an entry and saves it.
+func (s *scheduler) add(entry *scheduledEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrBrokerClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+	id := entry.msg.ID()
+	if _, ok := s.byID[id]; ok {
+		return ErrAlreadyScheduled
+	}
+	if _, ok := s.firing[id]; ok {
+		return ErrAlreadyScheduled
+	}
+
+	// Add the entry first so that a compaction during save keeps it
+	heap.Push(&s.heap, entry)
+	s.byID[id] = entry
+	if s.path != "" {
+		record, err := addRecord(entry)
+		if err == nil {
+			err = s.save(record)
+		}
+		if err != nil {
+			heap.Remove(&s.heap, entry.index)
+			delete(s.byID, id)
+			return err
+		}
+	}
+	s.arm()
+	return nil
+}
+
+// cancel removes a waiting entry and saves the removal.
+func (s *scheduler) cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	entry, ok := s.byID[id]
+	if !ok {
+		return ErrNotScheduled
+	}
+	// Remove the entry first so that a compaction during save drops it
+	heap.Remove(&s.heap, entry.index)
+	delete(s.byID, id)
+	if err := s.save(journalRecord{Remove: id}); err != nil {
+		heap.Push(&s.heap, entry)
+		s.byID[id] = entry
+		return err
+	}
+	s.arm()
+	return nil
+}
+
+// list returns the waiting entries, earliest first.
+func (s *scheduler) list() []ScheduledMessage {
+	s.mu.Lock()
+	scheduled := make([]ScheduledMessage, 0, len(s.heap))
+	for _, entry := range s.heap {
+		scheduled = append(scheduled, ScheduledMessage{Message: entry.msg, At: entry.at})
+	}
+	s.mu.Unlock()
+
+	sort.SliceStable(scheduled, func(i, j int) bool {
+		return scheduled[i].At.Before(scheduled[j].At)
+	})
+	return scheduled
+}
+
+// arm sets the timer for the earliest entry. It must be called with mu held.
+func (s *scheduler) arm() {
+	if !s.started || s.closed || len(s.heap) == 0 {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		return
+	}
+
+	wait := time.Until(s.heap[0].at)
+	if s.timer == nil {
+		s.timer = time.AfterFunc(wait, s.fire)
+		return
+	}
+	s.timer.Reset(wait)
+}
+
+// fire publishes every entry that has fallen due. Entries stay in the journal until
+// they have been published, so a crash part way through publishes them again on
+// restart rather than losing them.
+func (s *scheduler) fire() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	var due []*scheduledEntry
+	now := time.Now()
+	for len(s.heap) > 0 && !s.heap[0].at.After(now) {
+		entry := heap.Pop(&s.heap).(*scheduledEntry)
+		delete(s.byID, entry.msg.ID())
+		s.firing[entry.msg.ID()] = entry
+		due = append(due, entry)
+	}
+	s.mu.Unlock()
+
+	var published []journalRecord
+	for _, entry := range due {
+		if err := s.publish(entry.msg); !errors.Is(err, ErrBrokerClosed) {
+			published = append(published, journalRecord{Remove: entry.msg.ID()})
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range published {
+		delete(s.firing, record.Remove)
+	}
+	if s.closed {
+		return
+	}
+	// If this fails the published entries are published again after a restart
+	s.save(published...)
+	s.arm()
+}
+
+// close stops the timer and closes the journal. Saved entries are published by the
+// next broker to load them.
+func (s *scheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+}
+
+// journalRecord is one line of the journal: an entry added with its message as
+// produced by message.Encode, or the ID of an entry removed by cancellation or
+// publishing.
+type journalRecord struct {
+	At      time.Time       `json:"at,omitzero"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Remove  string          `json:"remove,omitempty"`
+}
+
+func addRecord(entry *scheduledEntry) (journalRecord, error) {
+	encoded, err := message.Encode(entry.msg)
+	if err != nil {
+		return journalRecord{}, err
+	}
+	return journalRecord{At: entry.at, Message: encoded}, nil
+}
+
+// save appends records to the journal and syncs it, then compacts the journal if
+// it is mostly obsolete. It must be called with mu held.
+func (s *scheduler) save(records ...journalRecord) error {
+	if s.path == "" || len(records) == 0 {
+		return nil
+	}
+	if s.damaged {
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	if s.journal == nil {
+		if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		s.journal = f
+	}
+	if _, err := s.journal.Write(buf.Bytes()); err != nil {
+		s.damaged = true
+		return err
+	}
+	if err := s.journal.Sync(); err != nil {
+		s.damaged = true
+		return err
+	}
+	s.records += len(records)
+
+	if live := len(s.heap) + len(s.firing); s.records > scheduleCompactRecords && s.records > 2*live {
+		// The records are saved; a failed compaction is retried on the next save
+		s.compact()
+	}
+	return nil
+}
+
+// compact replaces the journal with one add record per waiting or firing entry.
+// It must be called with mu held.
+func (s *scheduler) compact() error {
+	var buf bytes.Buffer
+	for _, entries := range [][]*scheduledEntry{s.heap, mapValues(s.firing)} {
+		for _, entry := range entries {
+			record, err := addRecord(entry)
+			if err != nil {
+				return err
+			}
+			line, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+	if err := writeFileAtomic(s.path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	// The open file is the replaced journal
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+	s.records = len(s.heap) + len(s.firing)
+	s.damaged = false
+	return nil
+}
+
+func mapValues(m map[string]*scheduledEntry) []*scheduledEntry {
+	values := make([]*scheduledEntry, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// loadSchedule replays a journal written by save and returns the entries still
+// scheduled and how many records the journal holds. A missing file is an empty
+// schedule. An unterminated last record is the remains of an interrupted append and
+// is ignored, with torn reported; any other unreadable record wraps ErrCorruptSchedule.
+func loadSchedule(path string) (entries []*scheduledEntry, records int, torn bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	byID := make(map[string]*scheduledEntry)
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		if i == len(lines)-1 {
+			// Every record saved in full ends with a newline
+			torn = true
+			break
+		}
+
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, 0, false, fmt.Errorf("%w: %s line %d: %v", ErrCorruptSchedule, path, i+1, err)
+		}
+		records++
+		if record.Message == nil {
+			delete(byID, record.Remove)
+			continue
+		}
+		msg, err := message.Decode(record.Message)
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("%w: %s line %d: %v", ErrCorruptSchedule, path, i+1, err)
+		}
+		byID[msg.ID()] = &scheduledEntry{msg: msg, at: record.At}
+	}
+	return mapValues(byID), records, torn, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory, syncs it
+// and renames it over path, so readers see either the old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// schedulePath returns the journal of scheduled messages, or "" without a data directory.
+func (b *Broker) schedulePath() string {
+	if b.dataDir == "" {
+		return ""
+	}
+	return filepath.Join(b.dataDir, scheduleFile)
+}
+
+// publishScheduled publishes a message that fell due.
+func (b *Broker) publishScheduled(msg message.Message) error {
+	_, err := b.PublishContext(context.Background(), msg)
+	return err
+}
@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// trieNode is a single segment in the subscription trie.
+// Wildcard segments are stored as regular children keyed by "*" and ">".
+type trieNode struct {
+	children map[string]*trieNode
+	subs     []*subscription.Subscription // subscriptions whose pattern ends at this node
+	groups   map[string]*consumerGroup    // consumer groups whose pattern ends at this node
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{
+		children: make(map[string]*trieNode),
+		groups:   make(map[string]*consumerGroup),
+	}
+}
+
+func (n *trieNode) empty() bool {
+	return len(n.subs) == 0 && len(n.groups) == 0 && len(n.children) == 0
+}
+
+// trieMatch holds the receivers of a published message: individual subscriptions
+// each get a copy, and each consumer group gets one copy for one of its members.
+type trieMatch struct {
+	subs   []*subscription.Subscription
+	groups []*consumerGroup
+}
+
+// subscriptionTrie indexes subscriptions by the segments of their topic pattern,
+// so that publishing only walks the branches that can match the topic.
+// It is not safe for concurrent use; the Broker guards it with its mutex.
+type subscriptionTrie struct {
+	root *trieNode
+}
+
+func newSubscriptionTrie() *subscriptionTrie {
+	return &subscriptionTrie{root: newTrieNode()}
+}
+
+// insert adds a subscription under its topic pattern. Group members are added to
+// their group, which is created on first use with the member's strategy. Returns
+// ErrGroupStrategyConflict, without adding the subscription, if it uses a different
+// strategy from the rest of its group.
+func (t *subscriptionTrie) insert(sub *subscription.Subscription) error {
+	node := t.root
+	for _, segment := range sub.Topic().Segments() {
+		child, ok := node.children[segment]
+		if !ok {
+			child = newTrieNode()
+			node.children[segment] = child
+		}
+		node = child
+	}
+
+	if sub.Group() == "" {
+		node.subs = append(node.subs, sub)
+		return nil
+	}
+
+	group, ok := node.groups[sub.Group()]
+	if !ok {
+		group = newConsumerGroup(sub.Group(), sub.GroupStrategy())
+		node.groups[sub.Group()] = group
+	}
+	if !group.strategy.Equal(sub.GroupStrategy()) {
+		return ErrGroupStrategyConflict
+	}
+	group.add(sub)
+	return nil
+}
+
+// remove deletes a subscription and prunes any branches left empty.
+// Returns the subscription's group, if it had one, and false if it was not found.
+func (t *subscriptionTrie) remove(sub *subscription.Subscription) (*consumerGroup, bool) {
+	return removeFromNode(t.root, sub.Topic().Segments(), sub)
+}
+
+func removeFromNode(node *trieNode, segments []string, sub *subscription.Subscription) (*consumerGroup, bool) {
+	if len(segments) == 0 {
+		if sub.Group() != "" {
+			group, ok := node.groups[sub.Group()]
+			if !ok {
+				return nil, false
+			}
+			if group.remove(sub) == 0 {
+				delete(node.groups, sub.Group())
+			}
+			return group, true
+		}
+
+		for i, s := range node.subs {
+			if s.ID() == sub.ID() {
+				node.subs = append(node.subs[:i], node.subs[i+1:]...)
+				return nil, true
+			}
+		}
+		return nil, false
+	}
+
+	child, ok := node.children[segments[0]]
+	if !ok {
+		return nil, false
+	}
+
+	group, removed := removeFromNode(child, segments[1:], sub)
+	if removed && child.empty() {
+		delete(node.children, segments[0])
+	}
+	return group, removed
+}
+
+// match returns every subscription and consumer group whose pattern matches the topic.
+// The returned slices are newly allocated and safe to use after the lock is released.
+func (t *subscriptionTrie) match(tp topic.Topic) trieMatch {
+	var result trieMatch
+	matchNode(t.root, tp.Segments(), &result)
+	return result
+}
+
+func matchNode(node *trieNode, segments []string, result *trieMatch) {
+	if len(segments) == 0 {
+		result.add(node)
+		return
+	}
+
+	if child, ok := node.children[segments[0]]; ok {
+		matchNode(child, segments[1:], result)
+	}
+	if child, ok := node.children[topic.SingleWildcard]; ok {
+		matchNode(child, segments[1:], result)
+	}
+	if child, ok := node.children[topic.MultiWildcard]; ok {
+		result.add(child)
+	}
+}
+
+func (m *trieMatch) add(node *trieNode) {
+	m.subs = append(m.subs, node.subs...)
+	for _, group := range node.groups {
+		m.groups = append(m.groups, group)
+	}
+}
@@ -0,0 +1,132 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// ErrTypeMismatch is reported when a message's data cannot be converted to the type
+// of a typed subscription.
+var ErrTypeMismatch = errors.New("message data does not match the topic type")
+
+// TypedTopic is a topic or pattern whose messages carry values of type T.
+// It wraps a topic.Topic, so typed and untyped publishers and subscribers can share a topic.
+type TypedTopic[T any] struct {
+	topic topic.Topic
+}
+
+// NewTypedTopic creates a typed topic with the given name.
+func NewTypedTopic[T any](name string) (TypedTopic[T], error) {
+	t, err := topic.New(name)
+	if err != nil {
+		return TypedTopic[T]{}, err
+	}
+	return TypedTopic[T]{topic: t}, nil
+}
+
+// NewTypedPattern creates a typed wildcard pattern for subscribing.
+func NewTypedPattern[T any](pattern string) (TypedTopic[T], error) {
+	t, err := topic.NewPattern(pattern)
+	if err != nil {
+		return TypedTopic[T]{}, err
+	}
+	return TypedTopic[T]{topic: t}, nil
+}
+
+// Typed wraps an existing topic.
+func Typed[T any](t topic.Topic) TypedTopic[T] {
+	return TypedTopic[T]{topic: t}
+}
+
+// Topic returns the underlying topic.
+func (t TypedTopic[T]) Topic() topic.Topic {
+	return t.topic
+}
+
+// String returns the topic name.
+func (t TypedTopic[T]) String() string {
+	return t.topic.String()
+}
+
+// Delivery is a message received by a typed subscription.
+// Err is ErrTypeMismatch, wrapped with details, when the message's data could not be
+// converted to T; Value is then the zero value. Message is always set, so the
+// message can still be acknowledged or rejected.
+type Delivery[T any] struct {
+	Value   T
+	Message message.Message
+	Err     error
+}
+
+// TypedSubscription receives the values published to a typed topic.
+type TypedSubscription[T any] struct {
+	sub        *subscription.Subscription
+	deliveries chan Delivery[T]
+}
+
+// Publish sends a value to a typed topic. Options set headers on the message.
+func Publish[T any](b *Broker, t TypedTopic[T], value T, opts ...message.Option) {
+	b.Publish(message.NewMessage(t.topic, value, opts...))
+}
+
+// Subscribe creates a typed subscription. Messages whose data is a T are delivered
+// as-is; other data, such as payloads decoded from a durable log, is converted with
+// message.DecodeData. Messages that cannot be converted are delivered with an error.
+func Subscribe[T any](b *Broker, t TypedTopic[T], opts ...subscription.Option) *TypedSubscription[T] {
+	s := &TypedSubscription[T]{
+		sub:        b.Subscribe(t.topic, opts...),
+		deliveries: make(chan Delivery[T]),
+	}
+	go s.convert()
+	return s
+}
+
+// ID returns the underlying subscription's ID, for use with Broker.Unsubscribe.
+func (s *TypedSubscription[T]) ID() string {
+	return s.sub.ID()
+}
+
+// Subscription returns the underlying untyped subscription.
+func (s *TypedSubscription[T]) Subscription() *subscription.Subscription {
+	return s.sub
+}
+
+// Deliveries returns the channel of typed deliveries.
+// It is closed when the subscription is closed.
+func (s *TypedSubscription[T]) Deliveries() <-chan Delivery[T] {
+	return s.deliveries
+}
+
+// convert turns messages into deliveries until the subscription is closed.
+func (s *TypedSubscription[T]) convert() {
+	defer close(s.deliveries)
+
+	for msg := range s.sub.MessageChannel() {
+		value, err := DecodeValue[T](msg)
+		select {
+		case s.deliveries <- Delivery[T]{Value: value, Message: msg, Err: err}:
+		case <-s.sub.Done():
+			return
+		}
+	}
+}
+
+// DecodeValue converts a message's data to T. It returns an error wrapping
+// ErrTypeMismatch if the data cannot be converted.
+func DecodeValue[T any](msg message.Message) (T, error) {
+	if value, ok := msg.Data().(T); ok {
+		return value, nil
+	}
+
+	var value T
+	if err := msg.DecodeData(&value); err != nil {
+		var zero T
+		return zero, fmt.Errorf("%w: message %s on %s has %T, want %T: %v",
+			ErrTypeMismatch, msg.ID(), msg.Topic(), msg.Data(), zero, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,193 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/codec"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// envelope is the serialized form of a Message. JSON payloads are embedded as-is in
+// Data so stored messages stay readable; payloads from other codecs go in Payload.
+type envelope struct {
+	ID          string            `json:"id"`
+	Topic       string            `json:"topic"`
+	Data        json.RawMessage   `json:"data,omitempty"`
+	Payload     []byte            `json:"payload,omitempty"`
+	PublishedAt time.Time         `json:"published_at"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// Encode serializes a message, including its ID, timestamp and headers, so it can be
+// stored or sent to another process. The payload is encoded with EncodePayload and the
+// content type it used is recorded in the content-type header.
+func Encode(m Message) ([]byte, error) {
+	payload, contentType, err := EncodePayload(m)
+	if err != nil {
+		return nil, err
+	}
+
+	env := envelope{
+		ID:          m.id,
+		Topic:       m.topic.String(),
+		PublishedAt: m.publishedAt,
+		Headers:     m.headers,
+	}
+	if m.ContentType() != contentType {
+		env.Headers = m.Headers()
+		env.Headers[HeaderContentType] = contentType
+	}
+	if isJSON(contentType) {
+		env.Data = payload
+	} else {
+		env.Payload = payload
+	}
+
+	b, err := json.Marshal(env)
+	if err != nil {
+		return nil, fmt.Errorf("encode message %s: %w", m.id, err)
+	}
+	return b, nil
+}
+
+// EncodePayload encodes the message's data with the codec registered for its content
+// type and returns the bytes with the content type used. Data that is already a []byte
+// is returned unchanged. Without a content type header, []byte data is treated as
+// application/octet-stream and anything else is encoded as JSON.
+func EncodePayload(m Message) ([]byte, string, error) {
+	contentType := m.ContentType()
+
+	if b, ok := m.data.([]byte); ok {
+		if contentType == "" {
+			contentType = codec.ContentTypeOctetStream
+		}
+		return b, contentType, nil
+	}
+
+	if contentType == "" {
+		contentType = codec.ContentTypeJSON
+	}
+	c, err := codec.Lookup(contentType)
+	if err != nil {
+		return nil, "", fmt.Errorf("encode message %s: %w", m.id, err)
+	}
+	b, err := c.Marshal(m.data)
+	if err != nil {
+		return nil, "", fmt.Errorf("encode message %s: %w", m.id, err)
+	}
+	return b, contentType, nil
+}
+
+// Decode reconstructs a message produced by Encode.
+// The payload is decoded by the codec named in the content-type header into generic
+// types (map[string]interface{}, []interface{}, string, float64, bool and so on).
+// Payloads with a content type that has no codec are kept as []byte.
+func Decode(b []byte) (Message, error) {
+	var env envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return Message{}, fmt.Errorf("decode message: %w", err)
+	}
+
+	t, err := topic.New(env.Topic)
+	if err != nil {
+		return Message{}, fmt.Errorf("decode message %s: %w", env.ID, err)
+	}
+
+	m := Message{
+		id:          env.ID,
+		topic:       t,
+		publishedAt: env.PublishedAt,
+	}
+	WithHeaders(env.Headers)(&m)
+
+	payload := env.Payload
+	if len(env.Data) > 0 {
+		payload = env.Data
+	}
+	if m.data, err = decodePayload(payload, m.ContentType()); err != nil {
+		return Message{}, fmt.Errorf("decode message %s: %w", env.ID, err)
+	}
+
+	return m, nil
+}
+
+// PeekID returns the ID of an encoded message without decoding its payload.
+func PeekID(b []byte) (string, error) {
+	var env struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(b, &env); err != nil {
+		return "", fmt.Errorf("decode message: %w", err)
+	}
+	return env.ID, nil
+}
+
+// decodePayload decodes payload bytes into a generic value.
+// Messages encoded before content types were recorded hold JSON.
+func decodePayload(payload []byte, contentType string) (interface{}, error) {
+	if payload == nil {
+		return nil, nil
+	}
+	if contentType == "" {
+		contentType = codec.ContentTypeJSON
+	}
+
+	c, err := codec.Lookup(contentType)
+	if errors.Is(err, codec.ErrUnknownContentType) {
+		return payload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var data interface{}
+	if err := c.Unmarshal(payload, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DecodeData stores the message's data in the value pointed to by v.
+// Data of v's type is copied directly. A []byte payload is decoded with the codec
+// named in the content-type header, and any other data is converted by encoding it
+// with that codec (JSON if none) and decoding the result into v.
+func (m Message) DecodeData(v interface{}) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("decode data of message %s: need a non-nil pointer, got %T", m.id, v)
+	}
+	if m.data != nil && reflect.TypeOf(m.data).AssignableTo(target.Elem().Type()) {
+		target.Elem().Set(reflect.ValueOf(m.data))
+		return nil
+	}
+
+	contentType := m.ContentType()
+	if contentType == "" {
+		contentType = codec.ContentTypeJSON
+	}
+	c, err := codec.Lookup(contentType)
+	if err != nil {
+		return fmt.Errorf("decode data of message %s: %w", m.id, err)
+	}
+
+	payload, ok := m.data.([]byte)
+	if !ok {
+		if payload, err = c.Marshal(m.data); err != nil {
+			return fmt.Errorf("decode data of message %s: %w", m.id, err)
+		}
+	}
+	if err := c.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("decode data of message %s: %w", m.id, err)
+	}
+	return nil
+}
+
+// isJSON reports whether a content type is handled by the JSON codec.
+func isJSON(contentType string) bool {
+	c, err := codec.Lookup(contentType)
+	return err == nil && c.ContentType() == codec.ContentTypeJSON
+}
@@ -4,11 +4,131 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gophercast/gophercast/internal/domain/topic"
 )
 
+// Well-known header keys. Header keys are case-insensitive and stored in lower case.
+const (
+	HeaderCorrelationID = "correlation-id"
+	HeaderContentType   = "content-type"
+	HeaderTraceParent   = "traceparent"
+	HeaderTraceState    = "tracestate"
+	HeaderSource        = "source"
+	HeaderSchemaVersion = "schema-version"
+	HeaderReplyTo       = "reply-to"
+	HeaderExpiresAt     = "expires-at"
+	HeaderPriority      = "priority"
+)
+
+// Priority levels. Subscriptions with priority lanes deliver higher priorities first.
+const (
+	MinPriority = 0
+	MaxPriority = 9
+)
+
+// Option configures a Message at construction.
+type Option func(*Message)
+
+// WithHeader sets a header on the message.
+func WithHeader(key, value string) Option {
+	return func(m *Message) {
+		if m.headers == nil {
+			m.headers = make(map[string]string)
+		}
+		m.headers[strings.ToLower(key)] = value
+	}
+}
+
+// WithHeaders sets several headers on the message.
+func WithHeaders(headers map[string]string) Option {
+	return func(m *Message) {
+		for key, value := range headers {
+			WithHeader(key, value)(m)
+		}
+	}
+}
+
+// WithoutHeader removes a header from the message. It is mainly useful with With.
+func WithoutHeader(key string) Option {
+	return func(m *Message) {
+		delete(m.headers, strings.ToLower(key))
+	}
+}
+
+// WithCorrelationID sets the correlation ID header.
+func WithCorrelationID(id string) Option {
+	return WithHeader(HeaderCorrelationID, id)
+}
+
+// WithContentType sets the content type header describing the payload.
+func WithContentType(contentType string) Option {
+	return WithHeader(HeaderContentType, contentType)
+}
+
+// WithTraceContext sets the W3C trace context headers. An empty state is omitted.
+func WithTraceContext(traceParent, traceState string) Option {
+	return func(m *Message) {
+		WithHeader(HeaderTraceParent, traceParent)(m)
+		if traceState != "" {
+			WithHeader(HeaderTraceState, traceState)(m)
+		}
+	}
+}
+
+// WithSource sets the header naming the service that produced the message.
+func WithSource(service string) Option {
+	return WithHeader(HeaderSource, service)
+}
+
+// WithSchemaVersion sets the header describing the payload's schema version.
+func WithSchemaVersion(version string) Option {
+	return WithHeader(HeaderSchemaVersion, version)
+}
+
+// WithReplyTo sets the header naming the topic replies should be published to.
+func WithReplyTo(t topic.Topic) Option {
+	return WithHeader(HeaderReplyTo, t.String())
+}
+
+// WithExpiry sets the header holding the time after which the message is stale and
+// is discarded instead of delivered.
+func WithExpiry(t time.Time) Option {
+	return WithHeader(HeaderExpiresAt, t.UTC().Format(time.RFC3339Nano))
+}
+
+// WithTTL sets the message to expire d after its timestamp. See WithExpiry.
+func WithTTL(d time.Duration) Option {
+	return func(m *Message) {
+		WithExpiry(m.publishedAt.Add(d))(m)
+	}
+}
+
+// WithPriority sets the header holding the message's priority, from MinPriority to
+// MaxPriority. Values outside that range are clamped to it.
+func WithPriority(priority int) Option {
+	priority = max(MinPriority, min(priority, MaxPriority))
+	return WithHeader(HeaderPriority, strconv.Itoa(priority))
+}
+
+// Acknowledger settles delivered messages for subscriptions that require acknowledgement.
+type Acknowledger interface {
+	// Ack marks the message as processed.
+	Ack(m Message) error
+
+	// Nack asks for the message to be redelivered after the delay.
+	Nack(m Message, delay time.Duration) error
+
+	// InProgress extends the acknowledgement deadline while work continues.
+	InProgress(m Message) error
+
+	// Reject gives up on the message without redelivery.
+	Reject(m Message, reason error) error
+}
+
 // Message represents data being published to a topic.
 // Messages are immutable once created.
 type Message struct {
@@ -16,17 +136,27 @@ type Message struct {
 	topic       topic.Topic
 	data        interface{}
 	publishedAt time.Time
+	headers     map[string]string
+
+	acker   Acknowledger // set on delivery by subscriptions that require acknowledgement
+	attempt int          // delivery attempt, starting at 1, when acker is set
 }
 
 // NewMessage creates a new message for the given topic with the provided data.
-// A unique ID and timestamp are automatically assigned.
-func NewMessage(t topic.Topic, data interface{}) Message {
-	return Message{
+// A unique ID and timestamp are automatically assigned. Options set headers.
+func NewMessage(t topic.Topic, data interface{}, opts ...Option) Message {
+	m := Message{
 		id:          generateMessageID(),
 		topic:       t,
 		data:        data,
 		publishedAt: time.Now(),
 	}
+
+	for _, opt := range opts {
+		opt(&m)
+	}
+
+	return m
 }
 
 // ID returns the unique message identifier.
@@ -49,6 +179,140 @@ func (m Message) PublishedAt() time.Time {
 	return m.publishedAt
 }
 
+// Header returns the value of a header, or "" if it is not set.
+func (m Message) Header(key string) string {
+	return m.headers[strings.ToLower(key)]
+}
+
+// Headers returns a copy of all headers.
+func (m Message) Headers() map[string]string {
+	headers := make(map[string]string, len(m.headers))
+	for key, value := range m.headers {
+		headers[key] = value
+	}
+	return headers
+}
+
+// CorrelationID returns the correlation ID header.
+func (m Message) CorrelationID() string {
+	return m.Header(HeaderCorrelationID)
+}
+
+// ContentType returns the content type header.
+func (m Message) ContentType() string {
+	return m.Header(HeaderContentType)
+}
+
+// ReplyTo returns the reply-to header.
+func (m Message) ReplyTo() string {
+	return m.Header(HeaderReplyTo)
+}
+
+// ExpiresAt returns the time set by WithExpiry or WithTTL, and false if the message
+// has no valid expiry header.
+func (m Message) ExpiresAt() (time.Time, bool) {
+	value := m.Header(HeaderExpiresAt)
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Expired reports whether the message has an expiry that is not after now.
+func (m Message) Expired(now time.Time) bool {
+	expiresAt, ok := m.ExpiresAt()
+	return ok && !expiresAt.After(now)
+}
+
+// Priority returns the priority set by WithPriority, or MinPriority if the message has
+// no valid priority header.
+func (m Message) Priority() int {
+	priority, err := strconv.Atoi(m.Header(HeaderPriority))
+	if err != nil || priority < MinPriority || priority > MaxPriority {
+		return MinPriority
+	}
+	return priority
+}
+
+// With returns a copy of the message with the options applied, keeping its ID and
+// timestamp. The original message is unchanged.
+func (m Message) With(opts ...Option) Message {
+	m.headers = m.Headers()
+	for _, opt := range opts {
+		opt(&m)
+	}
+	return m
+}
+
+// WithTopic returns a copy of the message on another topic, keeping its ID, timestamp
+// and headers. The original message is unchanged.
+func (m Message) WithTopic(t topic.Topic) Message {
+	m.headers = m.Headers()
+	m.topic = t
+	return m
+}
+
+// WithDelivery returns a copy of the message bound to an acknowledger for the given
+// delivery attempt. Subscriptions that require acknowledgement use it when delivering.
+func (m Message) WithDelivery(acker Acknowledger, attempt int) Message {
+	m.acker = acker
+	m.attempt = attempt
+	return m
+}
+
+// Acknowledger returns the acknowledger the message was delivered with, or nil for
+// messages delivered without acknowledgement.
+func (m Message) Acknowledger() Acknowledger {
+	return m.acker
+}
+
+// DeliveryAttempt returns which delivery of the message this is, starting at 1.
+// Returns 0 for messages delivered without acknowledgement.
+func (m Message) DeliveryAttempt() int {
+	return m.attempt
+}
+
+// Ack acknowledges that the message was processed, so it will not be redelivered.
+// It does nothing for messages delivered without acknowledgement.
+func (m Message) Ack() error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.Ack(m)
+}
+
+// Nack reports that the message was not processed and should be redelivered after the delay.
+// It does nothing for messages delivered without acknowledgement.
+func (m Message) Nack(delay time.Duration) error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.Nack(m, delay)
+}
+
+// InProgress resets the acknowledgement deadline, signalling that processing continues.
+// It does nothing for messages delivered without acknowledgement.
+func (m Message) InProgress() error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.InProgress(m)
+}
+
+// Reject reports that the message can never be processed, so it is not redelivered.
+// When the topic has a dead-letter topic configured, the message is moved there.
+// It does nothing for messages delivered without acknowledgement.
+func (m Message) Reject(reason error) error {
+	if m.acker == nil {
+		return nil
+	}
+	return m.acker.Reject(m, reason)
+}
+
 // String returns a human-readable representation of the message.
 func (m Message) String() string {
 	return fmt.Sprintf("Message[%s] on topic[%s] at %s",
@@ -1,9 +1,12 @@
 package message_test
 
 import (
+	"errors"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/gophercast/gophercast/internal/codec"
 	"github.com/gophercast/gophercast/internal/domain/message"
 	"github.com/gophercast/gophercast/internal/domain/topic"
 )
@@ -124,3 +127,350 @@ func containsHelper(s, substr string) bool {
 	}
 	return false
 }
+
+func TestMessageEncodeDecode(t *testing.T) {
+	topicObj, _ := topic.New("users")
+	msg := message.NewMessage(topicObj, map[string]interface{}{"id": "123"})
+
+	encoded, err := message.Encode(msg)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	decoded, err := message.Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	if decoded.ID() != msg.ID() {
+		t.Errorf("ID = %v, want %v", decoded.ID(), msg.ID())
+	}
+	if !decoded.Topic().Equals(msg.Topic()) {
+		t.Errorf("Topic = %v, want %v", decoded.Topic(), msg.Topic())
+	}
+	if !decoded.PublishedAt().Equal(msg.PublishedAt()) {
+		t.Errorf("PublishedAt = %v, want %v", decoded.PublishedAt(), msg.PublishedAt())
+	}
+	data, ok := decoded.Data().(map[string]interface{})
+	if !ok || data["id"] != "123" {
+		t.Errorf("Data = %v, want map with id 123", decoded.Data())
+	}
+}
+
+func TestMessageDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"not json", "not json"},
+		{"invalid topic", `{"id":"1","topic":"bad topic","data":null}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := message.Decode([]byte(tt.input)); err == nil {
+				t.Error("Decode() should return an error")
+			}
+		})
+	}
+}
+
+func TestMessageSettleWithoutAcknowledger(t *testing.T) {
+	topicObj, _ := topic.New("users")
+	msg := message.NewMessage(topicObj, "test")
+
+	if msg.DeliveryAttempt() != 0 {
+		t.Errorf("DeliveryAttempt() = %d, want 0", msg.DeliveryAttempt())
+	}
+	if err := msg.Ack(); err != nil {
+		t.Errorf("Ack() error = %v, want nil", err)
+	}
+	if err := msg.Nack(time.Second); err != nil {
+		t.Errorf("Nack() error = %v, want nil", err)
+	}
+	if err := msg.InProgress(); err != nil {
+		t.Errorf("InProgress() error = %v, want nil", err)
+	}
+}
+
+func TestMessageHeaders(t *testing.T) {
+	topicObj, _ := topic.New("users")
+	msg := message.NewMessage(topicObj, "test",
+		message.WithCorrelationID("req-42"),
+		message.WithContentType("application/json"),
+		message.WithTraceContext("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ""),
+		message.WithSource("user-service"),
+		message.WithSchemaVersion("2"),
+		message.WithHeader("X-Tenant", "acme"),
+	)
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{message.HeaderCorrelationID, "req-42"},
+		{message.HeaderContentType, "application/json"},
+		{message.HeaderTraceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{message.HeaderTraceState, ""},
+		{message.HeaderSource, "user-service"},
+		{message.HeaderSchemaVersion, "2"},
+		{"x-tenant", "acme"},
+		{"X-TENANT", "acme"},
+		{"missing", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := msg.Header(tt.key); got != tt.want {
+				t.Errorf("Header(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+
+	if msg.CorrelationID() != "req-42" {
+		t.Errorf("CorrelationID() = %q, want req-42", msg.CorrelationID())
+	}
+	if msg.ContentType() != "application/json" {
+		t.Errorf("ContentType() = %q, want application/json", msg.ContentType())
+	}
+
+	// Headers returns a copy; changing it must not change the message
+	headers := msg.Headers()
+	headers["x-tenant"] = "other"
+	if msg.Header("x-tenant") != "acme" {
+		t.Error("modifying Headers() should not modify the message")
+	}
+}
+
+func TestMessageWith(t *testing.T) {
+	orders, _ := topic.New("orders")
+	inbox, _ := topic.New("inbox.abc")
+	original := message.NewMessage(orders, "test", message.WithHeader("tenant", "acme"))
+
+	msg := original.With(message.WithReplyTo(inbox), message.WithHeader("tenant", "other"))
+
+	if msg.ID() != original.ID() || !msg.PublishedAt().Equal(original.PublishedAt()) {
+		t.Error("With() should keep the ID and timestamp")
+	}
+	if msg.ReplyTo() != "inbox.abc" {
+		t.Errorf("ReplyTo() = %q, want inbox.abc", msg.ReplyTo())
+	}
+	if msg.Header("tenant") != "other" {
+		t.Errorf("Header(tenant) = %q, want other", msg.Header("tenant"))
+	}
+	if original.Header("tenant") != "acme" || original.ReplyTo() != "" {
+		t.Error("With() should not modify the original message")
+	}
+}
+
+func TestMessageWithTopic(t *testing.T) {
+	orders, _ := topic.New("orders")
+	archive, _ := topic.New("orders.archive")
+	original := message.NewMessage(orders, "test", message.WithHeader("tenant", "acme"))
+
+	msg := original.WithTopic(archive).With(message.WithoutHeader("Tenant"))
+
+	if msg.ID() != original.ID() || !msg.PublishedAt().Equal(original.PublishedAt()) {
+		t.Error("WithTopic() should keep the ID and timestamp")
+	}
+	if msg.Topic().String() != "orders.archive" {
+		t.Errorf("Topic() = %v, want orders.archive", msg.Topic())
+	}
+	if msg.Header("tenant") != "" {
+		t.Errorf("Header(tenant) = %q, want it removed", msg.Header("tenant"))
+	}
+	if original.Topic().String() != "orders" || original.Header("tenant") != "acme" {
+		t.Error("WithTopic() should not modify the original message")
+	}
+}
+
+func TestMessageEncodeDecodeHeaders(t *testing.T) {
+	topicObj, _ := topic.New("users")
+	msg := message.NewMessage(topicObj, "test", message.WithCorrelationID("req-42"))
+
+	encoded, _ := message.Encode(msg)
+	decoded, err := message.Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	if decoded.CorrelationID() != "req-42" {
+		t.Errorf("CorrelationID() = %q, want req-42", decoded.CorrelationID())
+	}
+}
+
+func TestMessageEncodeDecodeCodecs(t *testing.T) {
+	topicObj, _ := topic.New("orders")
+
+	tests := []struct {
+		name            string
+		data            interface{}
+		opts            []message.Option
+		wantContentType string
+		wantData        interface{}
+	}{
+		{
+			name:            "default json",
+			data:            map[string]interface{}{"qty": 2},
+			wantContentType: "application/json",
+			wantData:        map[string]interface{}{"qty": float64(2)},
+		},
+		{
+			name:            "msgpack",
+			data:            map[string]interface{}{"qty": 2},
+			opts:            []message.Option{message.WithContentType("application/msgpack")},
+			wantContentType: "application/msgpack",
+			wantData:        map[string]interface{}{"qty": int64(2)},
+		},
+		{
+			name:            "cbor",
+			data:            []string{"a", "b"},
+			opts:            []message.Option{message.WithContentType("application/cbor")},
+			wantContentType: "application/cbor",
+			wantData:        []interface{}{"a", "b"},
+		},
+		{
+			name:            "raw bytes",
+			data:            []byte("hello"),
+			wantContentType: "application/octet-stream",
+			wantData:        []byte("hello"),
+		},
+		{
+			name:            "pre-encoded json bytes",
+			data:            []byte(`{"qty":3}`),
+			opts:            []message.Option{message.WithContentType("application/json")},
+			wantContentType: "application/json",
+			wantData:        map[string]interface{}{"qty": float64(3)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := message.NewMessage(topicObj, tt.data, tt.opts...)
+
+			encoded, err := message.Encode(msg)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			decoded, err := message.Decode(encoded)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+
+			if decoded.ContentType() != tt.wantContentType {
+				t.Errorf("ContentType() = %q, want %q", decoded.ContentType(), tt.wantContentType)
+			}
+			if !reflect.DeepEqual(decoded.Data(), tt.wantData) {
+				t.Errorf("Data() = %#v, want %#v", decoded.Data(), tt.wantData)
+			}
+		})
+	}
+}
+
+func TestMessageEncodeUnknownContentType(t *testing.T) {
+	topicObj, _ := topic.New("orders")
+	msg := message.NewMessage(topicObj, map[string]int{"qty": 1}, message.WithContentType("application/x-unknown"))
+
+	if _, err := message.Encode(msg); !errors.Is(err, codec.ErrUnknownContentType) {
+		t.Errorf("Encode() error = %v, want ErrUnknownContentType", err)
+	}
+}
+
+func TestMessageDecodeData(t *testing.T) {
+	type order struct {
+		ID  string `json:"id"`
+		Qty int    `json:"qty"`
+	}
+	topicObj, _ := topic.New("orders")
+
+	tests := []struct {
+		name string
+		msg  message.Message
+	}{
+		{"typed value", message.NewMessage(topicObj, order{ID: "o-1", Qty: 2})},
+		{"generic map", message.NewMessage(topicObj, map[string]interface{}{"id": "o-1", "qty": 2})},
+		{"json bytes", message.NewMessage(topicObj, []byte(`{"id":"o-1","qty":2}`))},
+		{"msgpack bytes", message.NewMessage(topicObj, []byte{0x82, 0xa2, 'i', 'd', 0xa3, 'o', '-', '1', 0xa3, 'q', 't', 'y', 0x02},
+			message.WithContentType("application/msgpack"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got order
+			if err := tt.msg.DecodeData(&got); err != nil {
+				t.Fatalf("DecodeData() error = %v", err)
+			}
+			if got != (order{ID: "o-1", Qty: 2}) {
+				t.Errorf("DecodeData() = %+v, want {o-1 2}", got)
+			}
+		})
+	}
+}
+
+func TestMessageExpiry(t *testing.T) {
+	topicObj, _ := topic.New("quotes")
+	deadline := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	tests := []struct {
+		name        string
+		msg         message.Message
+		wantOK      bool
+		wantExpired bool // at deadline
+	}{
+		{"no expiry", message.NewMessage(topicObj, 1), false, false},
+		{"expiry", message.NewMessage(topicObj, 1, message.WithExpiry(deadline)), true, true},
+		{"later expiry", message.NewMessage(topicObj, 1, message.WithExpiry(deadline.Add(time.Nanosecond))), true, false},
+		{"invalid header", message.NewMessage(topicObj, 1, message.WithHeader(message.HeaderExpiresAt, "soon")), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := tt.msg.ExpiresAt()
+			if ok != tt.wantOK {
+				t.Errorf("ExpiresAt() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if got := tt.msg.Expired(deadline); got != tt.wantExpired {
+				t.Errorf("Expired() = %v, want %v", got, tt.wantExpired)
+			}
+		})
+	}
+
+	msg := message.NewMessage(topicObj, 1, message.WithTTL(time.Minute))
+	expiresAt, _ := msg.ExpiresAt()
+	if !expiresAt.Equal(msg.PublishedAt().Add(time.Minute)) {
+		t.Errorf("ExpiresAt() = %v, want a minute after %v", expiresAt, msg.PublishedAt())
+	}
+
+	encoded, _ := message.Encode(msg)
+	decoded, err := message.Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if got, _ := decoded.ExpiresAt(); !got.Equal(expiresAt) {
+		t.Errorf("ExpiresAt() after Decode = %v, want %v", got, expiresAt)
+	}
+}
+
+func TestMessagePriority(t *testing.T) {
+	topicObj, _ := topic.New("control")
+
+	tests := []struct {
+		name string
+		opts []message.Option
+		want int
+	}{
+		{"unset", nil, message.MinPriority},
+		{"in range", []message.Option{message.WithPriority(7)}, 7},
+		{"above range", []message.Option{message.WithPriority(42)}, message.MaxPriority},
+		{"below range", []message.Option{message.WithPriority(-1)}, message.MinPriority},
+		{"invalid header", []message.Option{message.WithHeader(message.HeaderPriority, "urgent")}, message.MinPriority},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := message.NewMessage(topicObj, 1, tt.opts...).Priority(); got != tt.want {
+				t.Errorf("Priority() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
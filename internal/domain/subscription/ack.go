@@ -0,0 +1,317 @@
+package subscription
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+)
+
+// DefaultAckWait is how long a delivered message may remain unacknowledged before
+// it is redelivered.
+const DefaultAckWait = 30 * time.Second
+
+var (
+	// ErrNotPending is returned when settling a message that is not awaiting acknowledgement,
+	// for example because it was already acknowledged or has since been redelivered.
+	ErrNotPending = errors.New("message is not awaiting acknowledgement")
+
+	// ErrMaxDeliveries is the error recorded for a message that reached the maximum number of deliveries.
+	ErrMaxDeliveries = errors.New("message reached the maximum number of deliveries")
+
+	// ErrRejected is the error recorded for a message rejected without a reason.
+	ErrRejected = errors.New("message rejected")
+)
+
+// DeliveryError is the drop reason for a message a subscription gave up on, either
+// because it was rejected or because it reached the maximum number of deliveries.
+// errors.Is matches it against ErrMaxDeliveries in the latter case.
+type DeliveryError struct {
+	Err          error     // the rejection reason, or ErrMaxDeliveries
+	Deliveries   int       // how many times the message was delivered
+	FirstFailure time.Time // when the first delivery failed
+	Rejected     bool      // true if the subscriber called Reject
+}
+
+// Error returns a description of the failure.
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("message failed after %d deliveries: %v", e.Deliveries, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// pendingAck is a delivered message awaiting acknowledgement.
+type pendingAck struct {
+	msg   message.Message // as delivered, bound to its delivery
+	timer *time.Timer     // redelivery timer, nil until the subscriber has received the message
+}
+
+// delivery is the message.Acknowledger bound to one queued copy of a message, across
+// its redeliveries. Each copy gets its own key, so copies sharing an ID, such as a
+// message published twice, are settled independently.
+type delivery struct {
+	tracker *ackTracker
+	key     uint64
+}
+
+// Ack marks the message as processed.
+func (d *delivery) Ack(m message.Message) error {
+	return d.tracker.ack(d.key, m)
+}
+
+// Nack schedules the message for redelivery after the delay.
+func (d *delivery) Nack(m message.Message, delay time.Duration) error {
+	return d.tracker.nack(d.key, m, delay)
+}
+
+// InProgress restarts the ack wait for the message.
+func (d *delivery) InProgress(m message.Message) error {
+	return d.tracker.inProgress(d.key, m)
+}
+
+// Reject drops the message without redelivery.
+func (d *delivery) Reject(m message.Message, reason error) error {
+	return d.tracker.reject(d.key, m, reason)
+}
+
+// ackTracker settles messages for a subscription in manual ack mode.
+// Messages that are not acknowledged within the ack wait, or that are nacked, are put
+// back on the subscription's queue ahead of new messages.
+type ackTracker struct {
+	queue   *dispatchQueue
+	ackWait time.Duration
+	drop    func(msg message.Message, reason error)
+
+	mu       sync.Mutex
+	nextKey  uint64
+	pending  map[uint64]*pendingAck // delivery key -> delivery awaiting acknowledgement
+	failures map[uint64]time.Time   // delivery key -> time of its first failed delivery
+	closed   bool
+}
+
+func newAckTracker(queue *dispatchQueue, ackWait time.Duration, drop func(message.Message, error)) *ackTracker {
+	return &ackTracker{
+		queue:    queue,
+		ackWait:  ackWait,
+		drop:     drop,
+		pending:  make(map[uint64]*pendingAck),
+		failures: make(map[uint64]time.Time),
+	}
+}
+
+// deliveryOf returns the delivery a message is bound to if it came from this tracker,
+// as redeliveries do.
+func (t *ackTracker) deliveryOf(msg message.Message) (*delivery, bool) {
+	d, ok := msg.Acknowledger().(*delivery)
+	if !ok || d.tracker != t {
+		return nil, false
+	}
+	return d, true
+}
+
+// track registers a message about to be handed to the subscriber as the given attempt
+// and returns it bound to its delivery. A redelivery keeps its delivery; any other
+// message gets a new one.
+func (t *ackTracker) track(msg message.Message, attempt int) message.Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, ok := t.deliveryOf(msg)
+	if !ok {
+		t.nextKey++
+		d = &delivery{tracker: t, key: t.nextKey}
+	}
+	msg = msg.WithDelivery(d, attempt)
+	t.pending[d.key] = &pendingAck{msg: msg}
+	return msg
+}
+
+// delivered starts the ack wait once the subscriber has received the message.
+func (t *ackTracker) delivered(msg message.Message) {
+	d, ok := t.deliveryOf(msg)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// The subscriber may already have settled the message
+	if p, ok := t.lookup(d.key, msg); ok && p.timer == nil {
+		p.timer = t.schedule(d.key, msg, t.ackWait)
+	}
+}
+
+// untrack forgets a message that could not be handed to the subscriber.
+func (t *ackTracker) untrack(msg message.Message) {
+	d, ok := t.deliveryOf(msg)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, d.key)
+}
+
+// ack marks the message as processed.
+func (t *ackTracker) ack(key uint64, msg message.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.lookup(key, msg)
+	if !ok {
+		return ErrNotPending
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	delete(t.pending, key)
+	delete(t.failures, key)
+	return nil
+}
+
+// nack schedules the message for redelivery after the delay.
+func (t *ackTracker) nack(key uint64, msg message.Message, delay time.Duration) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.lookup(key, msg)
+	if !ok {
+		return ErrNotPending
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	t.recordFailure(key)
+	p.timer = t.schedule(key, msg, delay)
+	return nil
+}
+
+// inProgress restarts the ack wait for the message.
+func (t *ackTracker) inProgress(key uint64, msg message.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.lookup(key, msg)
+	if !ok {
+		return ErrNotPending
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timer = t.schedule(key, msg, t.ackWait)
+	return nil
+}
+
+// reject drops the message without redelivery, reporting a DeliveryError.
+func (t *ackTracker) reject(key uint64, msg message.Message, reason error) error {
+	if reason == nil {
+		reason = ErrRejected
+	}
+
+	t.mu.Lock()
+	p, ok := t.lookup(key, msg)
+	if !ok {
+		t.mu.Unlock()
+		return ErrNotPending
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	delete(t.pending, key)
+	t.recordFailure(key)
+	failure := t.failureLocked(key, reason, msg.DeliveryAttempt())
+	failure.Rejected = true
+	t.mu.Unlock()
+
+	t.drop(msg.WithDelivery(nil, msg.DeliveryAttempt()), failure)
+	return nil
+}
+
+// exhausted builds the drop reason for a message that reached the maximum number of
+// deliveries and forgets its failure history.
+func (t *ackTracker) exhausted(msg message.Message) *DeliveryError {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var key uint64 // no failure history for a message from elsewhere
+	if d, ok := t.deliveryOf(msg); ok {
+		key = d.key
+	}
+	return t.failureLocked(key, ErrMaxDeliveries, msg.DeliveryAttempt())
+}
+
+// failureLocked builds a DeliveryError and forgets the delivery's failure history.
+func (t *ackTracker) failureLocked(key uint64, err error, deliveries int) *DeliveryError {
+	first, ok := t.failures[key]
+	if !ok {
+		first = time.Now()
+	}
+	delete(t.failures, key)
+
+	return &DeliveryError{Err: err, Deliveries: deliveries, FirstFailure: first}
+}
+
+// recordFailure remembers when a delivery first failed. Must be called with mu held.
+func (t *ackTracker) recordFailure(key uint64) {
+	if _, ok := t.failures[key]; !ok {
+		t.failures[key] = time.Now()
+	}
+}
+
+// lookup finds the pending delivery with the key, if msg is its current attempt.
+// Settling an earlier attempt of a redelivered message does not match.
+func (t *ackTracker) lookup(key uint64, msg message.Message) (*pendingAck, bool) {
+	p, ok := t.pending[key]
+	if !ok || t.closed || p.msg.DeliveryAttempt() != msg.DeliveryAttempt() {
+		return nil, false
+	}
+	return p, true
+}
+
+// schedule arranges for the message to be redelivered after the delay.
+func (t *ackTracker) schedule(key uint64, msg message.Message, delay time.Duration) *time.Timer {
+	return time.AfterFunc(delay, func() {
+		t.redeliver(key, msg)
+	})
+}
+
+// redeliver puts a still-pending message back on the queue.
+func (t *ackTracker) redeliver(key uint64, msg message.Message) {
+	t.mu.Lock()
+	p, ok := t.lookup(key, msg)
+	if ok {
+		delete(t.pending, key)
+		t.recordFailure(key)
+	}
+	t.mu.Unlock()
+
+	if ok {
+		t.queue.pushRetry(p.msg)
+	}
+}
+
+// close stops all redelivery timers and returns the messages still awaiting
+// acknowledgement, in no particular order.
+func (t *ackTracker) close() []message.Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+
+	var unacked []message.Message
+	for id, p := range t.pending {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		unacked = append(unacked, p.msg)
+		delete(t.pending, id)
+	}
+	return unacked
+}
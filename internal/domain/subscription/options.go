@@ -0,0 +1,261 @@
+package subscription
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+)
+
+// OverflowPolicy decides what happens when a message arrives and the buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest discards the incoming message. This is the default.
+	DropNewest OverflowPolicy = iota
+
+	// DropOldest discards the oldest buffered message to make room for the incoming one.
+	DropOldest
+
+	// Block waits up to the block timeout for buffer space, then discards the incoming message.
+	Block
+
+	// Disconnect closes the subscription, treating the subscriber as a slow consumer.
+	Disconnect
+)
+
+// String returns the policy name.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseOverflowPolicy parses a policy name as returned by OverflowPolicy.String.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for _, policy := range []OverflowPolicy{DropNewest, DropOldest, Block, Disconnect} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q: must be drop-newest, drop-oldest, block, or disconnect", name)
+}
+
+// DropHandler is called for every message a subscription drops, with the reason it was dropped.
+// It is called synchronously from the sending goroutine and must not block.
+type DropHandler func(msg message.Message, reason error)
+
+// StartKind identifies where a subscription to a durable topic begins reading.
+type StartKind int
+
+const (
+	// StartLatest delivers only messages published after subscribing. This is the default.
+	StartLatest StartKind = iota
+
+	// StartEarliest replays the topic from its oldest stored message.
+	StartEarliest
+
+	// StartOffset replays the topic from a specific log offset.
+	StartOffset
+
+	// StartTime replays the topic from the first message stored at or after a point in time.
+	StartTime
+
+	// StartAfterMessage replays the topic from the message stored after the one with a
+	// given ID, so a client can resume where it left off. Only recent messages are
+	// searched for the ID; if it is not found, the subscription starts with messages
+	// published after subscribing, as with StartLatest.
+	StartAfterMessage
+)
+
+// StartPosition selects where a subscription to a durable topic begins reading.
+// It has no effect on topics that are not durable or on wildcard subscriptions.
+type StartPosition struct {
+	Kind      StartKind
+	Offset    uint64    // used by StartOffset
+	Time      time.Time // used by StartTime
+	MessageID string    // used by StartAfterMessage
+}
+
+// FromLatest starts with messages published after subscribing.
+func FromLatest() StartPosition {
+	return StartPosition{Kind: StartLatest}
+}
+
+// FromEarliest starts with the oldest stored message.
+func FromEarliest() StartPosition {
+	return StartPosition{Kind: StartEarliest}
+}
+
+// FromOffset starts with the message stored at the given log offset.
+func FromOffset(offset uint64) StartPosition {
+	return StartPosition{Kind: StartOffset, Offset: offset}
+}
+
+// FromTime starts with the first message stored at or after t.
+func FromTime(t time.Time) StartPosition {
+	return StartPosition{Kind: StartTime, Time: t}
+}
+
+// AfterMessage starts with the message stored after the one with the given ID.
+func AfterMessage(id string) StartPosition {
+	return StartPosition{Kind: StartAfterMessage, MessageID: id}
+}
+
+// Option configures a Subscription.
+type Option func(*Subscription)
+
+// WithBufferSize sets how many messages the subscription buffers. Values below 1 are treated as 1.
+func WithBufferSize(size int) Option {
+	return func(s *Subscription) {
+		if size < 1 {
+			size = 1
+		}
+		s.bufferSize = size
+	}
+}
+
+// WithOverflowPolicy sets what happens when the buffer is full.
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(s *Subscription) {
+		s.policy = policy
+	}
+}
+
+// WithBlockTimeout sets how long the Block policy waits for buffer space.
+func WithBlockTimeout(timeout time.Duration) Option {
+	return func(s *Subscription) {
+		s.blockTimeout = timeout
+	}
+}
+
+// WithDropHandler registers a callback invoked for every dropped message.
+// It may be given more than once; every registered handler is called.
+func WithDropHandler(handler DropHandler) Option {
+	return func(s *Subscription) {
+		s.dropHandlers = append(s.dropHandlers, handler)
+	}
+}
+
+// WithStartPosition sets where a subscription to a durable topic begins reading.
+func WithStartPosition(position StartPosition) Option {
+	return func(s *Subscription) {
+		s.startPosition = position
+	}
+}
+
+// GroupStrategy decides which member of a consumer group receives each message.
+type GroupStrategy struct {
+	key func(message.Message) string // nil for round-robin
+}
+
+// RoundRobin delivers messages to group members in turn. This is the default.
+func RoundRobin() GroupStrategy {
+	return GroupStrategy{}
+}
+
+// StickyByKey delivers every message with the same key to the same group member,
+// as long as group membership does not change.
+func StickyByKey(key func(message.Message) string) GroupStrategy {
+	return GroupStrategy{key: key}
+}
+
+// Key returns the key used to place the message and whether the strategy is keyed.
+func (g GroupStrategy) Key(msg message.Message) (string, bool) {
+	if g.key == nil {
+		return "", false
+	}
+	return g.key(msg), true
+}
+
+// Keyed reports whether the strategy places messages by key.
+func (g GroupStrategy) Keyed() bool {
+	return g.key != nil
+}
+
+// Equal reports whether two strategies are the same. Keyed strategies are equal when
+// they were built from the same key function, compared by its code, so closures from
+// one function literal are equal whatever they capture.
+func (g GroupStrategy) Equal(other GroupStrategy) bool {
+	if g.key == nil || other.key == nil {
+		return g.key == nil && other.key == nil
+	}
+	return reflect.ValueOf(g.key).Pointer() == reflect.ValueOf(other.key).Pointer()
+}
+
+// WithGroup makes the subscription a member of the named consumer group.
+// Subscriptions on the same topic or pattern that join the same group share the
+// stream: each message is delivered to exactly one member.
+func WithGroup(name string) Option {
+	return func(s *Subscription) {
+		s.group = name
+	}
+}
+
+// WithGroupStrategy sets how messages are spread across the members of the group.
+// Every member of a group must use the same strategy.
+func WithGroupStrategy(strategy GroupStrategy) Option {
+	return func(s *Subscription) {
+		s.groupStrategy = strategy
+	}
+}
+
+// WithManualAck requires the subscriber to settle every delivered message with
+// Ack, Nack or InProgress. Messages not acknowledged within the ack wait are redelivered.
+func WithManualAck() Option {
+	return func(s *Subscription) {
+		s.manualAck = true
+	}
+}
+
+// WithAckWait sets how long a delivered message may remain unacknowledged before it
+// is redelivered. It applies only with WithManualAck.
+func WithAckWait(wait time.Duration) Option {
+	return func(s *Subscription) {
+		s.ackWait = wait
+	}
+}
+
+// WithMaxDeliver limits how many times a message is delivered. A message that would
+// exceed the limit is dropped with a DeliveryError wrapping ErrMaxDeliveries.
+// Zero means no limit.
+// It applies only with WithManualAck.
+func WithMaxDeliver(n int) Option {
+	return func(s *Subscription) {
+		s.maxDeliver = n
+	}
+}
+
+// WithPriorityLanes makes the subscription deliver messages by priority, as set with
+// message.WithPriority, instead of strictly in the order they were sent. Messages of
+// the same priority keep their order. To keep lower priorities from starving, a
+// waiting message's lane is served once higher lanes have been chosen over it
+// DefaultStarvationLimit times; see WithStarvationLimit. Redeliveries in manual ack
+// mode are still served before everything else.
+func WithPriorityLanes() Option {
+	return func(s *Subscription) {
+		s.priorityLanes = true
+	}
+}
+
+// WithStarvationLimit sets how many times higher priority lanes may be served ahead of
+// a waiting lower priority message before its lane is served. Values below 1 are
+// treated as 1. It applies only with WithPriorityLanes.
+func WithStarvationLimit(n int) Option {
+	return func(s *Subscription) {
+		if n < 1 {
+			n = 1
+		}
+		s.starvationLimit = n
+	}
+}
@@ -0,0 +1,76 @@
+package subscription
+
+import (
+	"github.com/gophercast/gophercast/internal/domain/message"
+)
+
+// DefaultStarvationLimit is how many times a waiting lower-priority message may be
+// passed over before its lane is served.
+const DefaultStarvationLimit = 10
+
+// priorityLanes holds queued messages in one FIFO lane per priority level. The highest
+// non-empty lane is served first, but a lane passed over starvationLimit times in a
+// row is served next, so bulk traffic keeps moving behind a stream of urgent messages.
+// It is guarded by the dispatch queue's mutex.
+type priorityLanes struct {
+	lanes           [message.MaxPriority + 1][]message.Message
+	skipped         [message.MaxPriority + 1]int // times each non-empty lane was passed over
+	starvationLimit int
+}
+
+func newPriorityLanes(starvationLimit int) *priorityLanes {
+	return &priorityLanes{starvationLimit: starvationLimit}
+}
+
+// push appends a message to the lane for its priority.
+func (p *priorityLanes) push(msg message.Message) {
+	lane := msg.Priority()
+	p.lanes[lane] = append(p.lanes[lane], msg)
+}
+
+// pop removes the next message. The lanes must not all be empty.
+func (p *priorityLanes) pop() message.Message {
+	next := -1
+	for lane := len(p.lanes) - 1; lane >= 0; lane-- {
+		if len(p.lanes[lane]) == 0 {
+			continue
+		}
+		switch {
+		case next == -1:
+			next = lane
+		case p.skipped[lane] >= p.starvationLimit && p.skipped[lane] > p.skipped[next]:
+			// A starving lane, passed over more often than any lane above it
+			next = lane
+		}
+	}
+
+	for lane := next - 1; lane >= 0; lane-- {
+		if len(p.lanes[lane]) > 0 {
+			p.skipped[lane]++
+		}
+	}
+	p.skipped[next] = 0
+	return p.take(next)
+}
+
+// evict removes the oldest message of the lowest non-empty lane. The lanes must not
+// all be empty.
+func (p *priorityLanes) evict() message.Message {
+	lane := 0
+	for len(p.lanes[lane]) == 0 {
+		lane++
+	}
+	return p.take(lane)
+}
+
+// take removes the first message of a lane.
+func (p *priorityLanes) take(lane int) message.Message {
+	msg := p.lanes[lane][0]
+	p.lanes[lane][0] = message.Message{} // release the payload for garbage collection
+	p.lanes[lane] = p.lanes[lane][1:]
+	if len(p.lanes[lane]) == 0 {
+		p.lanes[lane] = nil
+		p.skipped[lane] = 0
+	}
+	return msg
+}
@@ -0,0 +1,141 @@
+package subscription
+
+import (
+	"sync"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+)
+
+// dispatchQueue is a bounded FIFO of messages waiting to be handed to the subscriber.
+// Publishers push and the subscription's worker pops. The notEmpty and notFull
+// channels carry wake-up signals so waiters can also select on cancellation.
+// Redeliveries and preloaded messages wait in a separate unbounded list that is served
+// first, so a full queue never forces an unacknowledged message to be dropped.
+// With priority lanes, messages are held in lanes instead of the ring buffer, and the
+// capacity is shared by all lanes.
+type dispatchQueue struct {
+	mu       sync.Mutex
+	items    []message.Message // ring buffer, unused with priority lanes
+	head     int
+	size     int
+	capacity int
+	lanes    *priorityLanes // nil unless priority lanes are enabled
+	retries  []message.Message
+	notEmpty chan struct{}
+	notFull  chan struct{}
+}
+
+func newDispatchQueue(capacity int, lanes *priorityLanes) *dispatchQueue {
+	q := &dispatchQueue{
+		capacity: capacity,
+		lanes:    lanes,
+		notEmpty: make(chan struct{}, 1),
+		notFull:  make(chan struct{}, 1),
+	}
+	if lanes == nil {
+		q.items = make([]message.Message, capacity)
+	}
+	return q
+}
+
+// push appends a message. Returns false if the queue is full.
+func (q *dispatchQueue) push(msg message.Message) bool {
+	q.mu.Lock()
+	if q.size == q.capacity {
+		q.mu.Unlock()
+		return false
+	}
+	q.pushLocked(msg)
+	q.mu.Unlock()
+
+	signal(q.notEmpty)
+	return true
+}
+
+// pushEvicting appends a message, evicting the oldest messages if the queue is full.
+// With priority lanes, the oldest message of the lowest priority is evicted.
+// Returns the evicted messages.
+func (q *dispatchQueue) pushEvicting(msg message.Message) []message.Message {
+	q.mu.Lock()
+	var evicted []message.Message
+	if q.size == q.capacity {
+		if q.lanes != nil {
+			evicted = append(evicted, q.lanes.evict())
+			q.size--
+		} else {
+			evicted = append(evicted, q.popLocked())
+		}
+	}
+	q.pushLocked(msg)
+	q.mu.Unlock()
+
+	signal(q.notEmpty)
+	return evicted
+}
+
+// pushRetry adds messages ahead of the regular queue, for redelivery or preloading.
+func (q *dispatchQueue) pushRetry(msgs ...message.Message) {
+	q.mu.Lock()
+	q.retries = append(q.retries, msgs...)
+	q.mu.Unlock()
+
+	signal(q.notEmpty)
+}
+
+// pop removes the next message, serving redeliveries first, then the lane chosen by
+// the priority lanes, if enabled.
+// Returns false if the queue is empty.
+func (q *dispatchQueue) pop() (message.Message, bool) {
+	q.mu.Lock()
+	if len(q.retries) > 0 {
+		msg := q.retries[0]
+		q.retries = q.retries[1:]
+		q.mu.Unlock()
+		return msg, true
+	}
+	if q.size == 0 {
+		q.mu.Unlock()
+		return message.Message{}, false
+	}
+	msg := q.popLocked()
+	q.mu.Unlock()
+
+	signal(q.notFull)
+	return msg, true
+}
+
+func (q *dispatchQueue) pushLocked(msg message.Message) {
+	if q.lanes != nil {
+		q.lanes.push(msg)
+	} else {
+		q.items[(q.head+q.size)%len(q.items)] = msg
+	}
+	q.size++
+}
+
+func (q *dispatchQueue) popLocked() message.Message {
+	if q.lanes != nil {
+		q.size--
+		return q.lanes.pop()
+	}
+	msg := q.items[q.head]
+	q.items[q.head] = message.Message{} // release the payload for garbage collection
+	q.head = (q.head + 1) % len(q.items)
+	q.size--
+	return msg
+}
+
+// len returns the number of queued messages.
+func (q *dispatchQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size + len(q.retries)
+}
+
+// signal performs a non-blocking send on a wake-up channel.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -3,33 +3,107 @@ package subscription
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gophercast/gophercast/internal/domain/message"
 	"github.com/gophercast/gophercast/internal/domain/topic"
 )
 
+const (
+	// DefaultBufferSize is the number of messages a subscription buffers before its
+	// overflow policy applies.
+	DefaultBufferSize = 200
+
+	// DefaultBlockTimeout is how long the Block policy waits for buffer space.
+	DefaultBlockTimeout = time.Second
+)
+
+var (
+	// ErrClosed is returned when sending to a closed subscription.
+	ErrClosed = errors.New("subscription is closed")
+
+	// ErrBufferFull is returned when a message is dropped because the buffer is full.
+	ErrBufferFull = errors.New("subscription buffer is full")
+
+	// ErrSlowConsumer is returned when a subscription is disconnected by the Disconnect policy.
+	ErrSlowConsumer = errors.New("subscription disconnected: slow consumer")
+
+	// ErrExpired is returned when a message is dropped because its expiry has passed.
+	ErrExpired = errors.New("message expired")
+)
+
 // Subscription represents a subscriber's registration to receive messages from a topic.
-// Each subscription has its own channel for receiving messages.
+// Published messages wait in the subscription's dispatch queue, and a dedicated worker
+// goroutine hands them to the message channel in the order they were sent, or by
+// priority with WithPriorityLanes.
 type Subscription struct {
 	id             string
 	topic          topic.Topic
 	messageChannel chan message.Message
 	createdAt      time.Time
-	closed         bool
-	mu             sync.Mutex
+	queue          *dispatchQueue
+	done           chan struct{} // closed by Close to stop the worker and release blocked senders
+	stopped        chan struct{} // closed by the worker once it has exited
+	closeOnce      sync.Once
+	mu             sync.RWMutex // held for reading while queueing, for writing while closing
+
+	bufferSize   int
+	policy       OverflowPolicy
+	blockTimeout time.Duration
+	dropHandlers []DropHandler
+	dropped      atomic.Uint64
+
+	startPosition StartPosition
+	group         string
+	groupStrategy GroupStrategy
+
+	manualAck  bool
+	ackWait    time.Duration
+	maxDeliver int
+	acks       *ackTracker // set in manual ack mode
+
+	priorityLanes   bool
+	starvationLimit int
+
+	unsent *message.Message // message the worker held when it stopped, kept for Drain
 }
 
 // NewSubscription creates a new subscription for the given topic.
-// The subscription includes a buffered channel for receiving messages.
-func NewSubscription(t topic.Topic) *Subscription {
-	return &Subscription{
+// The subscription's dispatch worker is started immediately and runs until Close.
+func NewSubscription(t topic.Topic, opts ...Option) *Subscription {
+	s := &Subscription{
 		id:             generateSubscriptionID(),
 		topic:          t,
-		messageChannel: make(chan message.Message, 200), // Large buffer for concurrent publishing
+		messageChannel: make(chan message.Message),
 		createdAt:      time.Now(),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+		bufferSize:     DefaultBufferSize,
+		policy:         DropNewest,
+		blockTimeout:   DefaultBlockTimeout,
+		ackWait:        DefaultAckWait,
+
+		starvationLimit: DefaultStarvationLimit,
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
+
+	var lanes *priorityLanes
+	if s.priorityLanes {
+		lanes = newPriorityLanes(s.starvationLimit)
+	}
+	s.queue = newDispatchQueue(s.bufferSize, lanes)
+	if s.manualAck {
+		s.acks = newAckTracker(s.queue, s.ackWait, s.recordDrop)
+	}
+	go s.dispatch()
+
+	return s
 }
 
 // ID returns the unique subscription identifier.
@@ -47,45 +121,322 @@ func (s *Subscription) CreatedAt() time.Time {
 	return s.createdAt
 }
 
+// OverflowPolicy returns the policy applied when the buffer is full.
+func (s *Subscription) OverflowPolicy() OverflowPolicy {
+	return s.policy
+}
+
+// StartPosition returns where the subscription begins reading a durable topic.
+func (s *Subscription) StartPosition() StartPosition {
+	return s.startPosition
+}
+
+// Group returns the consumer group the subscription belongs to, or "" if none.
+func (s *Subscription) Group() string {
+	return s.group
+}
+
+// GroupStrategy returns how messages are spread across the subscription's group.
+func (s *Subscription) GroupStrategy() GroupStrategy {
+	return s.groupStrategy
+}
+
+// ManualAck returns true if delivered messages must be acknowledged.
+func (s *Subscription) ManualAck() bool {
+	return s.manualAck
+}
+
+// PriorityLanes returns true if messages are delivered by priority.
+func (s *Subscription) PriorityLanes() bool {
+	return s.priorityLanes
+}
+
+// MaxDeliver returns how many times a message may be delivered, or 0 for no limit.
+func (s *Subscription) MaxDeliver() int {
+	return s.maxDeliver
+}
+
+// Done returns a channel that is closed when the subscription is closed.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Dropped returns how many messages this subscription has dropped.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Pending returns how many messages are waiting in the dispatch queue.
+func (s *Subscription) Pending() int {
+	return s.queue.len()
+}
+
 // MessageChannel returns the channel for receiving messages.
 // Subscribers should read from this channel to receive messages.
 func (s *Subscription) MessageChannel() <-chan message.Message {
 	return s.messageChannel
 }
 
-// SendMessage attempts to send a message to the subscriber.
-// This is non-blocking; if the channel is full or the subscription is closed, the message is dropped.
-func (s *Subscription) SendMessage(msg message.Message) {
-	s.mu.Lock()
+// SendMessage places a message in the subscription's dispatch queue.
+// When the queue is full the subscription's overflow policy decides the outcome.
+// Expired messages are dropped, both here and when they reach the front of the queue.
+// Returns nil if the message was queued, ErrBufferFull if it was dropped,
+// ErrSlowConsumer if the subscription was disconnected, ErrExpired, or ErrClosed.
+func (s *Subscription) SendMessage(msg message.Message) error {
+	if msg.Expired(time.Now()) {
+		s.recordDrop(msg, ErrExpired)
+		return ErrExpired
+	}
 
-	if s.closed {
-		s.mu.Unlock()
-		return
+	evicted, err := s.enqueue(msg)
+
+	for _, old := range evicted {
+		s.recordDrop(old, ErrBufferFull)
 	}
 
-	// Try non-blocking send
-	select {
-	case s.messageChannel <- msg:
-		// Message sent successfully
+	switch err {
+	case nil, ErrClosed:
+	case ErrSlowConsumer:
+		s.recordDrop(msg, err)
+		s.Close()
 	default:
-		// Channel full, drop message (best-effort delivery)
+		s.recordDrop(msg, err)
 	}
 
-	s.mu.Unlock()
+	return err
+}
+
+// TrySendMessage places a message in the dispatch queue only if there is room, without
+// applying the overflow policy. Returns ErrBufferFull if the queue is full, without
+// counting a drop, so the caller can offer the message elsewhere. Expired messages are
+// dropped as by SendMessage. Returns ErrClosed if the subscription is closed.
+func (s *Subscription) TrySendMessage(msg message.Message) error {
+	if msg.Expired(time.Now()) {
+		s.recordDrop(msg, ErrExpired)
+		return ErrExpired
+	}
+
+	pushed, err := s.push(msg)
+	if err != nil {
+		return err
+	}
+	if !pushed {
+		return ErrBufferFull
+	}
+	return nil
 }
 
-// Close closes the message channel.
+// SendMessageBlocking places a message in the dispatch queue, waiting for space
+// regardless of the overflow policy. It is used when replaying stored messages,
+// where the log rather than the queue holds the backlog.
+// Returns ErrExpired if the message has expired, or ErrClosed if the subscription is
+// closed before the message is queued.
+func (s *Subscription) SendMessageBlocking(msg message.Message) error {
+	if msg.Expired(time.Now()) {
+		s.recordDrop(msg, ErrExpired)
+		return ErrExpired
+	}
+
+	for {
+		pushed, err := s.push(msg)
+		if pushed || err != nil {
+			return err
+		}
+
+		select {
+		case <-s.queue.notFull:
+		case <-s.done:
+			return ErrClosed
+		}
+	}
+}
+
+// Preload queues messages ahead of the regular queue without waiting and without
+// applying the overflow policy, since a new subscription's queue may not have room
+// for all of them. It is meant for messages a subscription is owed before it receives
+// live ones, such as a topic's retained messages. Expired messages are dropped when
+// they reach the front of the queue. Returns ErrClosed if the subscription is closed.
+func (s *Subscription) Preload(msgs ...message.Message) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if len(msgs) > 0 {
+		s.queue.pushRetry(msgs...)
+	}
+	return nil
+}
+
+// enqueue places the message in the queue according to the overflow policy.
+// Returns any queued messages evicted to make room.
+func (s *Subscription) enqueue(msg message.Message) ([]message.Message, error) {
+	// Fast path: there is room in the queue
+	if pushed, err := s.push(msg); pushed || err != nil {
+		return nil, err
+	}
+
+	switch s.policy {
+	case DropOldest:
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if s.isClosed() {
+			return nil, ErrClosed
+		}
+		return s.queue.pushEvicting(msg), nil
+
+	case Block:
+		timer := time.NewTimer(s.blockTimeout)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-s.queue.notFull:
+				if pushed, err := s.push(msg); pushed || err != nil {
+					return nil, err
+				}
+			case <-s.done:
+				return nil, ErrClosed
+			case <-timer.C:
+				return nil, ErrBufferFull
+			}
+		}
+
+	case Disconnect:
+		return nil, ErrSlowConsumer
+
+	default:
+		return nil, ErrBufferFull
+	}
+}
+
+// push adds the message to the queue unless the subscription is closed.
+// The read lock keeps Close from completing between the check and the push,
+// so Drain never misses a message that push reported as queued.
+func (s *Subscription) push(msg message.Message) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.isClosed() {
+		return false, ErrClosed
+	}
+	return s.queue.push(msg), nil
+}
+
+// dispatch is the subscription's worker. It hands queued messages to the message
+// channel one at a time, preserving queue order, until the subscription is closed.
+func (s *Subscription) dispatch() {
+	defer close(s.stopped)
+	defer close(s.messageChannel)
+
+	for {
+		msg, ok := s.queue.pop()
+		if !ok {
+			select {
+			case <-s.queue.notEmpty:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		if msg.Expired(time.Now()) {
+			s.recordDrop(msg.WithDelivery(nil, msg.DeliveryAttempt()), ErrExpired)
+			continue
+		}
+
+		delivery := msg
+		if s.acks != nil {
+			attempt := msg.DeliveryAttempt() + 1
+			if s.maxDeliver > 0 && attempt > s.maxDeliver {
+				s.recordDrop(msg.WithDelivery(nil, msg.DeliveryAttempt()), s.acks.exhausted(msg))
+				continue
+			}
+			delivery = s.acks.track(msg, attempt)
+		}
+
+		select {
+		case s.messageChannel <- delivery:
+			if s.acks != nil {
+				s.acks.delivered(delivery)
+			}
+		case <-s.done:
+			if s.acks != nil {
+				s.acks.untrack(delivery)
+			}
+			s.unsent = &msg
+			return
+		}
+	}
+}
+
+// recordDrop counts a dropped message and notifies the drop handler.
+func (s *Subscription) recordDrop(msg message.Message, reason error) {
+	s.dropped.Add(1)
+	for _, handler := range s.dropHandlers {
+		handler(msg, reason)
+	}
+}
+
+// isClosed reports whether Close has been called.
+func (s *Subscription) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the dispatch worker and closes the message channel.
+// Messages still waiting in the queue are discarded.
 // After closing, no more messages can be sent to this subscription.
 func (s *Subscription) Close() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.stop()
 
-	if s.closed {
-		return
+	if s.acks != nil {
+		s.acks.close()
 	}
+}
+
+// stop closes the done channel and waits for the worker to exit.
+func (s *Subscription) stop() {
+	s.mu.Lock()
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.mu.Unlock()
 
-	s.closed = true
-	close(s.messageChannel)
+	// Wait for the worker so the message channel is closed when Close returns
+	<-s.stopped
+}
+
+// Drain closes the subscription and returns the messages that were queued but not yet
+// received by the subscriber, in order. In manual ack mode, delivered messages that were
+// never acknowledged come first. It lets the broker hand them to another subscriber.
+func (s *Subscription) Drain() []message.Message {
+	s.stop()
+
+	var pending []message.Message
+	if s.acks != nil {
+		for _, msg := range s.acks.close() {
+			// Detach from this subscription but keep the attempt count
+			pending = append(pending, msg.WithDelivery(nil, msg.DeliveryAttempt()))
+		}
+	}
+	if s.unsent != nil {
+		pending = append(pending, *s.unsent)
+		s.unsent = nil
+	}
+	for {
+		msg, ok := s.queue.pop()
+		if !ok {
+			return pending
+		}
+		// Queued redeliveries are still bound to this subscription
+		pending = append(pending, msg.WithDelivery(nil, msg.DeliveryAttempt()))
+	}
 }
 
 // generateSubscriptionID creates a unique identifier for a subscription.
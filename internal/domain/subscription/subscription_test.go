@@ -1,6 +1,8 @@
 package subscription_test
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -77,3 +79,537 @@ func TestSubscriptionClose(t *testing.T) {
 		// Channel was buffered and not read, but Close() should have closed it
 	}
 }
+
+func TestSubscriptionOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      subscription.OverflowPolicy
+		wantErr     error
+		wantDropped uint64
+		wantNext    []string
+	}{
+		{
+			name:        "drop newest",
+			policy:      subscription.DropNewest,
+			wantErr:     subscription.ErrBufferFull,
+			wantDropped: 1,
+			wantNext:    []string{"first", "second", "third"},
+		},
+		{
+			name:        "drop oldest",
+			policy:      subscription.DropOldest,
+			wantErr:     nil,
+			wantDropped: 1,
+			wantNext:    []string{"first", "third", "fourth"},
+		},
+		{
+			name:        "block with timeout",
+			policy:      subscription.Block,
+			wantErr:     subscription.ErrBufferFull,
+			wantDropped: 1,
+			wantNext:    []string{"first", "second", "third"},
+		},
+		{
+			name:        "disconnect",
+			policy:      subscription.Disconnect,
+			wantErr:     subscription.ErrSlowConsumer,
+			wantDropped: 1,
+			wantNext:    nil, // queued messages are discarded and the channel is closed
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topicObj, _ := topic.New("users")
+
+			var dropped []message.Message
+			sub := subscription.NewSubscription(topicObj,
+				subscription.WithBufferSize(2),
+				subscription.WithOverflowPolicy(tt.policy),
+				subscription.WithBlockTimeout(10*time.Millisecond),
+				subscription.WithDropHandler(func(msg message.Message, reason error) {
+					dropped = append(dropped, msg)
+				}),
+			)
+			defer sub.Close()
+
+			// The worker takes the first message off the queue and waits for a reader
+			sub.SendMessage(message.NewMessage(topicObj, "first"))
+			waitForPending(t, sub, 0)
+
+			// The next two fill the queue and the fourth overflows
+			sub.SendMessage(message.NewMessage(topicObj, "second"))
+			sub.SendMessage(message.NewMessage(topicObj, "third"))
+			err := sub.SendMessage(message.NewMessage(topicObj, "fourth"))
+
+			if err != tt.wantErr {
+				t.Errorf("SendMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if sub.Dropped() != tt.wantDropped {
+				t.Errorf("Dropped() = %d, want %d", sub.Dropped(), tt.wantDropped)
+			}
+			if uint64(len(dropped)) != tt.wantDropped {
+				t.Errorf("drop handler called %d times, want %d", len(dropped), tt.wantDropped)
+			}
+
+			for _, want := range tt.wantNext {
+				received := <-sub.MessageChannel()
+				if received.Data() != want {
+					t.Errorf("received %v, want %v", received.Data(), want)
+				}
+			}
+
+			if tt.wantNext == nil {
+				if _, ok := <-sub.MessageChannel(); ok {
+					t.Error("Channel should be closed after slow consumer disconnect")
+				}
+			}
+		})
+	}
+}
+
+func TestSubscriptionDeliversInOrder(t *testing.T) {
+	topicObj, _ := topic.New("users")
+	sub := subscription.NewSubscription(topicObj)
+	defer sub.Close()
+
+	for i := 0; i < 100; i++ {
+		sub.SendMessage(message.NewMessage(topicObj, i))
+	}
+
+	for want := 0; want < 100; want++ {
+		received := <-sub.MessageChannel()
+		if received.Data() != want {
+			t.Fatalf("received %v, want %v", received.Data(), want)
+		}
+	}
+}
+
+// waitForPending waits until the subscription's dispatch queue holds n messages.
+func waitForPending(t *testing.T, sub *subscription.Subscription, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for sub.Pending() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pending() = %d, want %d", sub.Pending(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSubscriptionBlockWaitsForSpace(t *testing.T) {
+	topicObj, _ := topic.New("users")
+	sub := subscription.NewSubscription(topicObj,
+		subscription.WithBufferSize(1),
+		subscription.WithOverflowPolicy(subscription.Block),
+		subscription.WithBlockTimeout(time.Second),
+	)
+
+	// One message is held by the worker and one fills the queue
+	sub.SendMessage(message.NewMessage(topicObj, "first"))
+	waitForPending(t, sub, 0)
+	sub.SendMessage(message.NewMessage(topicObj, "second"))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		<-sub.MessageChannel()
+	}()
+
+	if err := sub.SendMessage(message.NewMessage(topicObj, "third")); err != nil {
+		t.Errorf("SendMessage() error = %v, want nil", err)
+	}
+}
+
+func TestSubscriptionPreload(t *testing.T) {
+	topicObj, _ := topic.New("users")
+	sub := subscription.NewSubscription(topicObj,
+		subscription.WithBufferSize(1),
+		subscription.WithOverflowPolicy(subscription.DropNewest),
+	)
+	defer sub.Close()
+
+	// Preloaded messages are not limited by the buffer size
+	err := sub.Preload(
+		message.NewMessage(topicObj, "one"),
+		message.NewMessage(topicObj, "two"),
+		message.NewMessage(topicObj, "three"),
+	)
+	if err != nil {
+		t.Fatalf("Preload() error = %v", err)
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		if msg := <-sub.MessageChannel(); msg.Data() != want {
+			t.Errorf("received %v, want %v", msg.Data(), want)
+		}
+	}
+	if sub.Dropped() != 0 {
+		t.Errorf("Dropped() = %d, want 0", sub.Dropped())
+	}
+
+	sub.Close()
+	if err := sub.Preload(message.NewMessage(topicObj, "late")); err != subscription.ErrClosed {
+		t.Errorf("Preload() after Close error = %v, want %v", err, subscription.ErrClosed)
+	}
+}
+
+func TestSubscriptionSendAfterClose(t *testing.T) {
+	topicObj, _ := topic.New("users")
+	sub := subscription.NewSubscription(topicObj)
+	sub.Close()
+
+	if err := sub.SendMessage(message.NewMessage(topicObj, "late")); err != subscription.ErrClosed {
+		t.Errorf("SendMessage() error = %v, want %v", err, subscription.ErrClosed)
+	}
+}
+
+func TestSubscriptionManualAck(t *testing.T) {
+	tests := []struct {
+		name        string
+		settle      func(msg message.Message)
+		wantAttempt int // attempt of the redelivery, or 0 for none
+	}{
+		{
+			name:        "ack prevents redelivery",
+			settle:      func(msg message.Message) { msg.Ack() },
+			wantAttempt: 0,
+		},
+		{
+			name:        "no ack is redelivered after ack wait",
+			settle:      func(msg message.Message) {},
+			wantAttempt: 2,
+		},
+		{
+			name:        "nack is redelivered",
+			settle:      func(msg message.Message) { msg.Nack(0) },
+			wantAttempt: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topicObj, _ := topic.New("jobs")
+			sub := subscription.NewSubscription(topicObj,
+				subscription.WithManualAck(),
+				subscription.WithAckWait(50*time.Millisecond),
+			)
+			defer sub.Close()
+
+			sub.SendMessage(message.NewMessage(topicObj, "job"))
+
+			first := <-sub.MessageChannel()
+			if first.DeliveryAttempt() != 1 {
+				t.Errorf("DeliveryAttempt() = %d, want 1", first.DeliveryAttempt())
+			}
+			tt.settle(first)
+
+			select {
+			case again := <-sub.MessageChannel():
+				if tt.wantAttempt == 0 {
+					t.Errorf("unexpected redelivery of %v", again.Data())
+				} else if again.DeliveryAttempt() != tt.wantAttempt {
+					t.Errorf("redelivery DeliveryAttempt() = %d, want %d", again.DeliveryAttempt(), tt.wantAttempt)
+				}
+				if again.ID() != first.ID() {
+					t.Errorf("redelivered ID = %v, want %v", again.ID(), first.ID())
+				}
+			case <-time.After(150 * time.Millisecond):
+				if tt.wantAttempt != 0 {
+					t.Error("message was not redelivered")
+				}
+			}
+		})
+	}
+}
+
+func TestSubscriptionInProgressExtendsDeadline(t *testing.T) {
+	topicObj, _ := topic.New("jobs")
+	sub := subscription.NewSubscription(topicObj,
+		subscription.WithManualAck(),
+		subscription.WithAckWait(60*time.Millisecond),
+	)
+	defer sub.Close()
+
+	sub.SendMessage(message.NewMessage(topicObj, "job"))
+	msg := <-sub.MessageChannel()
+
+	// Keep extending past the original deadline, then ack
+	for i := 0; i < 3; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if err := msg.InProgress(); err != nil {
+			t.Fatalf("InProgress() error = %v", err)
+		}
+	}
+	if err := msg.Ack(); err != nil {
+		t.Errorf("Ack() error = %v", err)
+	}
+
+	select {
+	case <-sub.MessageChannel():
+		t.Error("message should not be redelivered while in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSubscriptionMaxDeliver(t *testing.T) {
+	topicObj, _ := topic.New("jobs")
+
+	dropped := make(chan error, 1)
+	sub := subscription.NewSubscription(topicObj,
+		subscription.WithManualAck(),
+		subscription.WithMaxDeliver(2),
+		subscription.WithDropHandler(func(msg message.Message, reason error) {
+			dropped <- reason
+		}),
+	)
+	defer sub.Close()
+
+	sub.SendMessage(message.NewMessage(topicObj, "poison"))
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		msg := <-sub.MessageChannel()
+		if msg.DeliveryAttempt() != attempt {
+			t.Errorf("DeliveryAttempt() = %d, want %d", msg.DeliveryAttempt(), attempt)
+		}
+		msg.Nack(0)
+	}
+
+	select {
+	case reason := <-dropped:
+		if !errors.Is(reason, subscription.ErrMaxDeliveries) {
+			t.Errorf("drop reason = %v, want %v", reason, subscription.ErrMaxDeliveries)
+		}
+		var failure *subscription.DeliveryError
+		if !errors.As(reason, &failure) || failure.Deliveries != 2 || failure.FirstFailure.IsZero() {
+			t.Errorf("drop reason = %#v, want DeliveryError after 2 deliveries", reason)
+		}
+	case <-time.After(time.Second):
+		t.Error("message was not dropped after reaching max deliveries")
+	}
+
+	if err := sub.SendMessage(message.NewMessage(topicObj, "next")); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if next := <-sub.MessageChannel(); next.Data() != "next" {
+		t.Errorf("received %v, want next", next.Data())
+	}
+}
+
+func TestSubscriptionAckTwice(t *testing.T) {
+	topicObj, _ := topic.New("jobs")
+	sub := subscription.NewSubscription(topicObj, subscription.WithManualAck())
+	defer sub.Close()
+
+	sub.SendMessage(message.NewMessage(topicObj, "job"))
+	msg := <-sub.MessageChannel()
+
+	if err := msg.Ack(); err != nil {
+		t.Errorf("Ack() error = %v", err)
+	}
+	if err := msg.Ack(); err != subscription.ErrNotPending {
+		t.Errorf("second Ack() error = %v, want %v", err, subscription.ErrNotPending)
+	}
+}
+
+func TestSubscriptionAckDuplicateIDs(t *testing.T) {
+	topicObj, _ := topic.New("jobs")
+	sub := subscription.NewSubscription(topicObj, subscription.WithManualAck(), subscription.WithAckWait(50*time.Millisecond))
+	defer sub.Close()
+
+	// The same message queued twice is tracked as two deliveries
+	msg := message.NewMessage(topicObj, "job")
+	sub.SendMessage(msg)
+	sub.SendMessage(msg)
+	first := <-sub.MessageChannel()
+	second := <-sub.MessageChannel()
+
+	if err := first.Ack(); err != nil {
+		t.Fatalf("first Ack() error = %v", err)
+	}
+	if err := first.Ack(); err != subscription.ErrNotPending {
+		t.Errorf("first Ack() again error = %v, want %v", err, subscription.ErrNotPending)
+	}
+
+	// The second copy is still pending, so it is redelivered
+	select {
+	case redelivered := <-sub.MessageChannel():
+		if redelivered.DeliveryAttempt() != 2 {
+			t.Errorf("DeliveryAttempt() = %d, want 2", redelivered.DeliveryAttempt())
+		}
+		if err := second.Ack(); err != subscription.ErrNotPending {
+			t.Errorf("Ack() of the earlier attempt error = %v, want %v", err, subscription.ErrNotPending)
+		}
+		if err := redelivered.Ack(); err != nil {
+			t.Errorf("Ack() of the redelivery error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unacknowledged copy was not redelivered")
+	}
+}
+
+func TestSubscriptionReject(t *testing.T) {
+	topicObj, _ := topic.New("jobs")
+
+	dropped := make(chan error, 1)
+	sub := subscription.NewSubscription(topicObj,
+		subscription.WithManualAck(),
+		subscription.WithDropHandler(func(msg message.Message, reason error) {
+			dropped <- reason
+		}),
+	)
+	defer sub.Close()
+
+	sub.SendMessage(message.NewMessage(topicObj, "poison"))
+	msg := <-sub.MessageChannel()
+
+	if err := msg.Reject(errors.New("cannot parse")); err != nil {
+		t.Fatalf("Reject() error = %v", err)
+	}
+
+	var failure *subscription.DeliveryError
+	if reason := <-dropped; !errors.As(reason, &failure) {
+		t.Fatalf("drop reason = %v, want DeliveryError", reason)
+	}
+	if !failure.Rejected || failure.Err.Error() != "cannot parse" || failure.Deliveries != 1 {
+		t.Errorf("DeliveryError = %+v, want rejected after 1 delivery with reason", failure)
+	}
+
+	select {
+	case <-sub.MessageChannel():
+		t.Error("rejected message should not be redelivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscriptionExpiry(t *testing.T) {
+	topicObj, _ := topic.New("quotes")
+
+	dropped := make(chan string, 2)
+	sub := subscription.NewSubscription(topicObj,
+		subscription.WithDropHandler(func(msg message.Message, reason error) {
+			if errors.Is(reason, subscription.ErrExpired) {
+				dropped <- msg.Data().(string)
+			}
+		}),
+	)
+	defer sub.Close()
+
+	// Already expired when sent
+	stale := message.NewMessage(topicObj, "stale", message.WithExpiry(time.Now().Add(-time.Second)))
+	if err := sub.SendMessage(stale); !errors.Is(err, subscription.ErrExpired) {
+		t.Errorf("SendMessage(expired) error = %v, want ErrExpired", err)
+	}
+
+	// Expires while waiting in the queue; the worker holds "fresh" until it is received
+	sub.SendMessage(message.NewMessage(topicObj, "fresh"))
+	sub.SendMessage(message.NewMessage(topicObj, "short", message.WithTTL(20*time.Millisecond)))
+	sub.SendMessage(message.NewMessage(topicObj, "long", message.WithTTL(time.Hour)))
+	time.Sleep(50 * time.Millisecond)
+
+	for _, want := range []string{"fresh", "long"} {
+		select {
+		case msg := <-sub.MessageChannel():
+			if msg.Data() != want {
+				t.Errorf("received %v, want %v", msg.Data(), want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+	for _, want := range []string{"stale", "short"} {
+		if got := <-dropped; got != want {
+			t.Errorf("dropped %v as expired, want %v", got, want)
+		}
+	}
+}
+
+func TestSubscriptionPriorityLanes(t *testing.T) {
+	topicObj, _ := topic.New("control")
+
+	send := func(sub *subscription.Subscription, names ...string) {
+		for _, name := range names {
+			priority := message.MinPriority
+			if name[0] == 'h' {
+				priority = message.MaxPriority
+			}
+			sub.SendMessage(message.NewMessage(topicObj, name, message.WithPriority(priority)))
+		}
+	}
+	receive := func(sub *subscription.Subscription, n int) []string {
+		var got []string
+		for i := 0; i < n; i++ {
+			select {
+			case msg := <-sub.MessageChannel():
+				got = append(got, msg.Data().(string))
+			case <-time.After(time.Second):
+				t.Fatalf("timed out after receiving %v", got)
+			}
+		}
+		return got
+	}
+
+	t.Run("starvation limit", func(t *testing.T) {
+		sub := subscription.NewSubscription(topicObj,
+			subscription.WithPriorityLanes(),
+			subscription.WithStarvationLimit(2),
+		)
+		defer sub.Close()
+
+		// The worker holds the first message until it is received
+		send(sub, "blocker")
+		time.Sleep(10 * time.Millisecond)
+		send(sub, "l1", "l2", "l3", "h1", "h2", "h3", "h4", "h5", "h6")
+
+		got := receive(sub, 10)
+		want := []string{"blocker", "h1", "h2", "l1", "h3", "h4", "l2", "h5", "h6", "l3"}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("received %v, want %v", got, want)
+		}
+	})
+
+	t.Run("drop oldest evicts lowest priority", func(t *testing.T) {
+		var dropped []string
+		sub := subscription.NewSubscription(topicObj,
+			subscription.WithPriorityLanes(),
+			subscription.WithBufferSize(2),
+			subscription.WithOverflowPolicy(subscription.DropOldest),
+			subscription.WithDropHandler(func(msg message.Message, reason error) {
+				dropped = append(dropped, msg.Data().(string))
+			}),
+		)
+		defer sub.Close()
+
+		send(sub, "blocker")
+		time.Sleep(10 * time.Millisecond)
+		send(sub, "h1", "l1", "h2")
+
+		if got := receive(sub, 3); fmt.Sprint(got) != "[blocker h1 h2]" {
+			t.Errorf("received %v, want [blocker h1 h2]", got)
+		}
+		if fmt.Sprint(dropped) != "[l1]" {
+			t.Errorf("dropped %v, want [l1]", dropped)
+		}
+	})
+
+	t.Run("fifo without lanes", func(t *testing.T) {
+		sub := subscription.NewSubscription(topicObj)
+		defer sub.Close()
+
+		send(sub, "l1", "h1", "l2")
+		if got := receive(sub, 3); fmt.Sprint(got) != "[l1 h1 l2]" {
+			t.Errorf("received %v, want [l1 h1 l2]", got)
+		}
+	})
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, policy := range []subscription.OverflowPolicy{subscription.DropNewest, subscription.DropOldest, subscription.Block, subscription.Disconnect} {
+		got, err := subscription.ParseOverflowPolicy(policy.String())
+		if err != nil || got != policy {
+			t.Errorf("ParseOverflowPolicy(%q) = %v, %v, want %v", policy.String(), got, err, policy)
+		}
+	}
+
+	if _, err := subscription.ParseOverflowPolicy("sometimes"); err == nil {
+		t.Error("ParseOverflowPolicy() of an unknown name should return an error")
+	}
+}
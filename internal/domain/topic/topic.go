@@ -3,16 +3,32 @@ package topic
 import (
 	"errors"
 	"regexp"
+	"strings"
+)
+
+const (
+	// Separator splits a topic name into hierarchical segments.
+	Separator = "."
+
+	// SingleWildcard matches exactly one segment in a pattern (e.g. "users.*").
+	SingleWildcard = "*"
+
+	// MultiWildcard matches one or more trailing segments in a pattern (e.g. "users.>").
+	MultiWildcard = ">"
 )
 
 // Topic represents a named channel of communication in the pub/sub system.
 // Topics are identified by strings and must follow naming rules.
+// A Topic created with NewPattern may contain wildcard segments and can only be
+// used for subscribing.
 type Topic struct {
-	name string
+	name     string
+	wildcard bool
 }
 
 // New creates a new Topic with the given name.
 // The name must not be empty and must contain only letters, numbers, dots, and hyphens.
+// Dots separate segments, and no segment may be empty.
 func New(name string) (Topic, error) {
 	if name == "" {
 		return Topic{}, errors.New("topic name cannot be empty")
@@ -22,9 +38,47 @@ func New(name string) (Topic, error) {
 		return Topic{}, errors.New("invalid topic name: must contain only letters, numbers, dots, and hyphens")
 	}
 
+	if hasEmptySegment(name) {
+		return Topic{}, errors.New("invalid topic name: segments cannot be empty")
+	}
+
 	return Topic{name: name}, nil
 }
 
+// NewPattern creates a Topic that may contain wildcard segments.
+// A "*" segment matches exactly one segment, and a ">" segment matches one or more
+// trailing segments and must be the last segment. Wildcards must occupy a whole segment,
+// and no segment may be empty.
+// Patterns without wildcards are equivalent to topics created with New.
+func NewPattern(pattern string) (Topic, error) {
+	if pattern == "" {
+		return Topic{}, errors.New("topic pattern cannot be empty")
+	}
+
+	segments := strings.Split(pattern, Separator)
+	wildcard := false
+
+	for i, segment := range segments {
+		switch segment {
+		case SingleWildcard:
+			wildcard = true
+		case MultiWildcard:
+			if i != len(segments)-1 {
+				return Topic{}, errors.New("invalid topic pattern: '>' must be the last segment")
+			}
+			wildcard = true
+		case "":
+			return Topic{}, errors.New("invalid topic pattern: segments cannot be empty")
+		default:
+			if !isValidTopicName(segment) {
+				return Topic{}, errors.New("invalid topic pattern: segments must contain only letters, numbers, and hyphens, or be a wildcard")
+			}
+		}
+	}
+
+	return Topic{name: pattern, wildcard: wildcard}, nil
+}
+
 // String returns the topic name.
 func (t Topic) String() string {
 	return t.name
@@ -35,6 +89,41 @@ func (t Topic) Equals(other Topic) bool {
 	return t.name == other.name
 }
 
+// IsWildcard returns true if the topic is a pattern containing wildcard segments.
+func (t Topic) IsWildcard() bool {
+	return t.wildcard
+}
+
+// Segments returns the dot-separated segments of the topic name.
+func (t Topic) Segments() []string {
+	return strings.Split(t.name, Separator)
+}
+
+// Matches returns true if the other topic is matched by this topic.
+// For plain topics this is the same as Equals; for patterns the wildcard rules apply.
+func (t Topic) Matches(other Topic) bool {
+	if !t.wildcard {
+		return t.name == other.name
+	}
+
+	pattern := t.Segments()
+	segments := other.Segments()
+
+	for i, segment := range pattern {
+		if segment == MultiWildcard {
+			return len(segments) > i
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if segment != SingleWildcard && segment != segments[i] {
+			return false
+		}
+	}
+
+	return len(pattern) == len(segments)
+}
+
 // isValidTopicName checks if the topic name follows the naming rules.
 func isValidTopicName(name string) bool {
 	// Only allow letters, numbers, dots, and hyphens
@@ -42,3 +131,14 @@ func isValidTopicName(name string) bool {
 	matched, _ := regexp.MatchString(pattern, name)
 	return matched
 }
+
+// hasEmptySegment reports whether the name starts or ends with a separator or
+// contains two in a row.
+func hasEmptySegment(name string) bool {
+	for _, segment := range strings.Split(name, Separator) {
+		if segment == "" {
+			return true
+		}
+	}
+	return false
+}
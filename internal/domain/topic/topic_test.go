@@ -49,6 +49,30 @@ func TestNewTopic(t *testing.T) {
 			want:    topic.Topic{},
 			wantErr: true,
 		},
+		{
+			name:    "empty middle segment",
+			input:   "user..created",
+			want:    topic.Topic{},
+			wantErr: true,
+		},
+		{
+			name:    "leading dot",
+			input:   ".user",
+			want:    topic.Topic{},
+			wantErr: true,
+		},
+		{
+			name:    "trailing dot",
+			input:   "user.",
+			want:    topic.Topic{},
+			wantErr: true,
+		},
+		{
+			name:    "dots only",
+			input:   "..",
+			want:    topic.Topic{},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -105,3 +129,108 @@ func TestTopicEquals(t *testing.T) {
 		})
 	}
 }
+
+func TestNewPattern(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		wantWildcard bool
+		wantErr      bool
+	}{
+		{
+			name:         "plain name",
+			input:        "users.created",
+			wantWildcard: false,
+			wantErr:      false,
+		},
+		{
+			name:         "single segment wildcard",
+			input:        "users.*",
+			wantWildcard: true,
+			wantErr:      false,
+		},
+		{
+			name:         "descendant wildcard",
+			input:        "users.>",
+			wantWildcard: true,
+			wantErr:      false,
+		},
+		{
+			name:         "wildcard in middle",
+			input:        "users.*.created",
+			wantWildcard: true,
+			wantErr:      false,
+		},
+		{
+			name:    "descendant wildcard not last",
+			input:   "users.>.created",
+			wantErr: true,
+		},
+		{
+			name:    "partial segment wildcard",
+			input:   "users.cre*",
+			wantErr: true,
+		},
+		{
+			name:    "empty pattern",
+			input:   "",
+			wantErr: true,
+		},
+		{
+			name:    "empty segment",
+			input:   "users..*",
+			wantErr: true,
+		},
+		{
+			name:    "single dot",
+			input:   ".",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := topic.NewPattern(tt.input)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPattern() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if !tt.wantErr && got.IsWildcard() != tt.wantWildcard {
+				t.Errorf("IsWildcard() = %v, want %v", got.IsWildcard(), tt.wantWildcard)
+			}
+		})
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  string
+		topic    string
+		expected bool
+	}{
+		{"exact match", "users.created", "users.created", true},
+		{"exact mismatch", "users.created", "users.deleted", false},
+		{"single wildcard matches one segment", "users.*", "users.created", true},
+		{"single wildcard does not match two segments", "users.*", "users.created.v2", false},
+		{"single wildcard does not match parent", "users.*", "users", false},
+		{"single wildcard in middle", "users.*.v2", "users.created.v2", true},
+		{"descendant wildcard matches one segment", "users.>", "users.created", true},
+		{"descendant wildcard matches many segments", "users.>", "users.created.v2", true},
+		{"descendant wildcard does not match parent", "users.>", "users", false},
+		{"descendant wildcard other prefix", "users.>", "orders.created", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, _ := topic.NewPattern(tt.pattern)
+			other, _ := topic.New(tt.topic)
+
+			if pattern.Matches(other) != tt.expected {
+				t.Errorf("Matches() = %v, want %v", pattern.Matches(other), tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+// Package commitlog implements a segmented, append-only log of records on local disk.
+//
+// Every record is assigned a sequential offset and stored with its length, a CRC-32C
+// checksum, its offset and a timestamp. When a log is opened, a torn or corrupt record
+// at the tail of the last segment (for example after a crash mid-write) is truncated.
+package commitlog
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSegmentBytes is the size at which a new segment file is started.
+	DefaultSegmentBytes = 64 << 20
+
+	// DefaultSyncInterval is how often the SyncInterval policy flushes to disk.
+	DefaultSyncInterval = time.Second
+)
+
+var (
+	// ErrOffsetOutOfRange is returned when reading an offset that is not in the log.
+	ErrOffsetOutOfRange = errors.New("offset out of range")
+
+	// ErrClosed is returned when using a closed log.
+	ErrClosed = errors.New("log is closed")
+)
+
+// SyncPolicy decides when appended records are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes after every append. This is the default.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval flushes periodically in the background.
+	SyncInterval
+
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// String returns the policy name.
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseSyncPolicy converts a policy name ("always", "interval" or "never") to a SyncPolicy.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, errors.New("invalid sync policy: must be always, interval, or never")
+	}
+}
+
+// Record is a single entry in the log.
+type Record struct {
+	Offset    uint64
+	Timestamp time.Time
+	Data      []byte
+}
+
+// Option configures a Log.
+type Option func(*Log)
+
+// WithSegmentBytes sets the size at which a new segment file is started.
+func WithSegmentBytes(n int64) Option {
+	return func(l *Log) {
+		l.segmentBytes = n
+	}
+}
+
+// WithSyncPolicy sets when appended records are flushed to stable storage.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(l *Log) {
+		l.syncPolicy = policy
+	}
+}
+
+// WithSyncInterval sets how often the SyncInterval policy flushes to disk.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(l *Log) {
+		l.syncInterval = interval
+	}
+}
+
+// Log is a segmented append-only log stored in a single directory.
+// It is safe for concurrent use by multiple goroutines.
+type Log struct {
+	dir          string
+	segmentBytes int64
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+
+	mu       sync.RWMutex
+	segments []*segment
+	dirty    bool
+	closed   bool
+	changed  chan struct{} // closed and replaced on every append
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// Open opens the log in dir, creating the directory if needed, and recovers any
+// torn tail left by an earlier crash.
+func Open(dir string, opts ...Option) (*Log, error) {
+	l := &Log{
+		dir:          dir,
+		segmentBytes: DefaultSegmentBytes,
+		syncPolicy:   SyncAlways,
+		syncInterval: DefaultSyncInterval,
+		changed:      make(chan struct{}),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	baseOffsets, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, baseOffset := range baseOffsets {
+		// Only the last segment can have been interrupted mid-write
+		s, err := openSegment(dir, baseOffset, i == len(baseOffsets)-1)
+		if err != nil {
+			l.closeSegments()
+			return nil, err
+		}
+		l.segments = append(l.segments, s)
+	}
+
+	if len(l.segments) == 0 {
+		s, err := createSegment(dir, 0)
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, s)
+	}
+
+	if l.syncPolicy == SyncInterval {
+		go l.syncLoop()
+	} else {
+		close(l.stopped)
+	}
+
+	return l, nil
+}
+
+// listSegments returns the base offsets of the segment files in dir, in order.
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var baseOffsets []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		baseOffset, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		baseOffsets = append(baseOffsets, baseOffset)
+	}
+
+	sort.Slice(baseOffsets, func(i, j int) bool { return baseOffsets[i] < baseOffsets[j] })
+	return baseOffsets, nil
+}
+
+// Dir returns the directory holding the log's segment files.
+func (l *Log) Dir() string {
+	return l.dir
+}
+
+// Append writes a record stamped with the current time and returns its offset.
+func (l *Log) Append(data []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	active := l.segments[len(l.segments)-1]
+	if active.size > 0 && active.size+headerSize+metaSize+int64(len(data)) > l.segmentBytes {
+		if err := active.sync(); err != nil {
+			return 0, err
+		}
+		next, err := createSegment(l.dir, active.nextOffset())
+		if err != nil {
+			return 0, err
+		}
+		l.segments = append(l.segments, next)
+		active = next
+	}
+
+	offset := active.nextOffset()
+	if err := active.append(offset, time.Now(), data); err != nil {
+		return 0, err
+	}
+
+	if l.syncPolicy == SyncAlways {
+		if err := active.sync(); err != nil {
+			return 0, err
+		}
+	} else {
+		l.dirty = true
+	}
+
+	// Wake any readers waiting for new records
+	close(l.changed)
+	l.changed = make(chan struct{})
+
+	return offset, nil
+}
+
+// Read returns the record at offset.
+// Returns ErrOffsetOutOfRange if the offset is before the oldest or at or after the next offset.
+func (l *Log) Read(offset uint64) (Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return Record{}, ErrClosed
+	}
+
+	// Find the last segment whose base offset is not after the requested offset
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].baseOffset > offset }) - 1
+	if i < 0 || offset >= l.segments[i].nextOffset() {
+		return Record{}, ErrOffsetOutOfRange
+	}
+
+	return l.segments[i].read(offset)
+}
+
+// OldestOffset returns the offset of the first record in the log.
+func (l *Log) OldestOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.segments[0].baseOffset
+}
+
+// NextOffset returns the offset the next appended record will receive.
+func (l *Log) NextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.segments[len(l.segments)-1].nextOffset()
+}
+
+// OffsetForTime returns the offset of the first record with a timestamp at or after t.
+// Returns NextOffset if every record is older than t.
+func (l *Log) OffsetForTime(t time.Time) uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	target := t.UnixNano()
+	for _, s := range l.segments {
+		if n := len(s.timestamps); n == 0 || s.timestamps[n-1] < target {
+			continue
+		}
+		i := sort.Search(len(s.timestamps), func(i int) bool { return s.timestamps[i] >= target })
+		return s.baseOffset + uint64(i)
+	}
+	return l.segments[len(l.segments)-1].nextOffset()
+}
+
+// Changed returns a channel that is closed when the next record is appended.
+// Readers that reach the end of the log should obtain the channel before their final
+// Read so that no append is missed.
+func (l *Log) Changed() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.changed
+}
+
+// Sync flushes the active segment to stable storage.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncLocked()
+}
+
+func (l *Log) syncLocked() error {
+	if l.closed || !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.segments[len(l.segments)-1].sync()
+}
+
+// syncLoop flushes the log periodically for the SyncInterval policy.
+func (l *Log) syncLoop() {
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(l.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.Sync()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Close flushes and closes the log.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	err := l.segments[len(l.segments)-1].sync()
+	l.closed = true
+	close(l.done)
+	l.mu.Unlock()
+
+	<-l.stopped
+
+	if closeErr := l.closeSegments(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (l *Log) closeSegments() error {
+	var err error
+	for _, s := range l.segments {
+		if closeErr := s.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
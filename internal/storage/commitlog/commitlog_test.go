@@ -0,0 +1,202 @@
+package commitlog_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/storage/commitlog"
+)
+
+func TestLogAppendRead(t *testing.T) {
+	l, err := commitlog.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer l.Close()
+
+	for i, data := range []string{"first", "second", "third"} {
+		offset, err := l.Append([]byte(data))
+		if err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+		if offset != uint64(i) {
+			t.Errorf("Append() offset = %d, want %d", offset, i)
+		}
+	}
+
+	record, err := l.Read(1)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if string(record.Data) != "second" {
+		t.Errorf("Read() data = %s, want second", record.Data)
+	}
+	if record.Offset != 1 {
+		t.Errorf("Read() offset = %d, want 1", record.Offset)
+	}
+
+	if _, err := l.Read(3); err != commitlog.ErrOffsetOutOfRange {
+		t.Errorf("Read() past end error = %v, want %v", err, commitlog.ErrOffsetOutOfRange)
+	}
+}
+
+func TestLogSegmentRolling(t *testing.T) {
+	dir := t.TempDir()
+	l, err := commitlog.Open(dir, commitlog.WithSegmentBytes(64))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := l.Append([]byte("0123456789")); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+	l.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(files) < 2 {
+		t.Errorf("got %d segment files, want several", len(files))
+	}
+
+	l, err = commitlog.Open(dir, commitlog.WithSegmentBytes(64))
+	if err != nil {
+		t.Fatalf("reopen error = %v", err)
+	}
+	defer l.Close()
+
+	if l.NextOffset() != 10 {
+		t.Errorf("NextOffset() = %d, want 10", l.NextOffset())
+	}
+	for offset := uint64(0); offset < 10; offset++ {
+		if _, err := l.Read(offset); err != nil {
+			t.Errorf("Read(%d) error = %v", offset, err)
+		}
+	}
+}
+
+func TestLogRecoversTornTail(t *testing.T) {
+	tests := []struct {
+		name       string
+		appendLost bool // write a third record that the corruption destroys
+		corrupt    func(t *testing.T, path string)
+	}{
+		{
+			name: "partial record",
+			corrupt: func(t *testing.T, path string) {
+				f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+				defer f.Close()
+				f.Write([]byte{0, 0, 0, 40, 1, 2})
+			},
+		},
+		{
+			name:       "checksum mismatch",
+			appendLost: true,
+			corrupt: func(t *testing.T, path string) {
+				info, _ := os.Stat(path)
+				f, _ := os.OpenFile(path, os.O_WRONLY, 0o644)
+				defer f.Close()
+				f.WriteAt([]byte{0xff}, info.Size()-1)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, _ := commitlog.Open(dir)
+			l.Append([]byte("kept"))
+			l.Append([]byte("also kept"))
+			l.Close()
+
+			if tt.appendLost {
+				l, _ = commitlog.Open(dir)
+				l.Append([]byte("lost"))
+				l.Close()
+			}
+
+			files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+			tt.corrupt(t, files[len(files)-1])
+
+			l, err := commitlog.Open(dir)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer l.Close()
+
+			if l.NextOffset() != 2 {
+				t.Errorf("NextOffset() = %d, want 2", l.NextOffset())
+			}
+
+			offset, err := l.Append([]byte("after recovery"))
+			if err != nil || offset != 2 {
+				t.Fatalf("Append() = %d, %v, want 2, nil", offset, err)
+			}
+			record, err := l.Read(2)
+			if err != nil || string(record.Data) != "after recovery" {
+				t.Errorf("Read(2) = %q, %v, want after recovery", record.Data, err)
+			}
+		})
+	}
+}
+
+func TestLogOffsetForTime(t *testing.T) {
+	l, _ := commitlog.Open(t.TempDir())
+	defer l.Close()
+
+	l.Append([]byte("old"))
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	l.Append([]byte("new"))
+
+	if got := l.OffsetForTime(cutoff); got != 1 {
+		t.Errorf("OffsetForTime() = %d, want 1", got)
+	}
+	if got := l.OffsetForTime(time.Now().Add(time.Hour)); got != l.NextOffset() {
+		t.Errorf("OffsetForTime(future) = %d, want %d", got, l.NextOffset())
+	}
+}
+
+func TestLogChangedWakesReaders(t *testing.T) {
+	l, _ := commitlog.Open(t.TempDir(), commitlog.WithSyncPolicy(commitlog.SyncNever))
+	defer l.Close()
+
+	changed := l.Changed()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Append([]byte("wake"))
+	}()
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Error("Changed() was not closed after Append")
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    commitlog.SyncPolicy
+		wantErr bool
+	}{
+		{"always", commitlog.SyncAlways, false},
+		{"interval", commitlog.SyncInterval, false},
+		{"never", commitlog.SyncNever, false},
+		{"sometimes", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := commitlog.ParseSyncPolicy(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSyncPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseSyncPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package commitlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// headerSize is the length and checksum that prefix every record on disk.
+	headerSize = 8
+
+	// metaSize is the offset and timestamp stored at the start of every record body.
+	metaSize = 16
+
+	segmentSuffix = ".log"
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errTornRecord marks a record that was only partially written or fails its checksum.
+	errTornRecord = errors.New("torn or corrupt record")
+)
+
+// segment is a single file of the log holding consecutive records starting at baseOffset.
+// Record positions and timestamps are indexed in memory when the segment is opened.
+type segment struct {
+	baseOffset uint64
+	file       *os.File
+	size       int64
+	positions  []int64 // record position by (offset - baseOffset)
+	timestamps []int64 // record timestamp (unix nanoseconds) by (offset - baseOffset)
+}
+
+// segmentPath returns the file name for a segment with the given base offset.
+func segmentPath(dir string, baseOffset uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", baseOffset, segmentSuffix))
+}
+
+// createSegment creates an empty segment file.
+func createSegment(dir string, baseOffset uint64) (*segment, error) {
+	file, err := os.OpenFile(segmentPath(dir, baseOffset), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{baseOffset: baseOffset, file: file}, nil
+}
+
+// openSegment opens an existing segment file and indexes its records.
+// If the segment ends in a torn or corrupt record and truncate is true, the file is
+// truncated to the last good record; otherwise an error is returned.
+func openSegment(dir string, baseOffset uint64, truncate bool) (*segment, error) {
+	file, err := os.OpenFile(segmentPath(dir, baseOffset), os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &segment{baseOffset: baseOffset, file: file}
+	if err := s.index(truncate); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// index scans the segment, recording the position of every valid record.
+func (s *segment) index(truncate bool) error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var position int64
+	for position < info.Size() {
+		offset, timestamp, length, err := s.readMeta(position, info.Size())
+		if err == nil && offset != s.baseOffset+uint64(len(s.positions)) {
+			err = errTornRecord
+		}
+		if errors.Is(err, errTornRecord) {
+			if !truncate {
+				return fmt.Errorf("segment %d: corrupt record at position %d", s.baseOffset, position)
+			}
+			if err := s.file.Truncate(position); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		s.positions = append(s.positions, position)
+		s.timestamps = append(s.timestamps, timestamp)
+		position += headerSize + int64(length)
+	}
+
+	s.size = position
+	return nil
+}
+
+// readMeta validates the record at position and returns its offset, timestamp and body length.
+func (s *segment) readMeta(position, fileSize int64) (uint64, int64, uint32, error) {
+	if fileSize-position < headerSize {
+		return 0, 0, 0, errTornRecord
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := s.file.ReadAt(header, position); err != nil {
+		return 0, 0, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < metaSize || int64(length) > fileSize-position-headerSize {
+		return 0, 0, 0, errTornRecord
+	}
+
+	body := make([]byte, length)
+	if _, err := s.file.ReadAt(body, position+headerSize); err != nil {
+		return 0, 0, 0, err
+	}
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, 0, 0, errTornRecord
+	}
+
+	offset := binary.BigEndian.Uint64(body[0:8])
+	timestamp := int64(binary.BigEndian.Uint64(body[8:16]))
+	return offset, timestamp, length, nil
+}
+
+// nextOffset returns the offset the next appended record will receive.
+func (s *segment) nextOffset() uint64 {
+	return s.baseOffset + uint64(len(s.positions))
+}
+
+// append writes a record at the end of the segment.
+func (s *segment) append(offset uint64, timestamp time.Time, data []byte) error {
+	length := metaSize + len(data)
+	buf := make([]byte, headerSize+length)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(length))
+	binary.BigEndian.PutUint64(buf[8:16], offset)
+	binary.BigEndian.PutUint64(buf[16:24], uint64(timestamp.UnixNano()))
+	copy(buf[24:], data)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[headerSize:], crcTable))
+
+	if _, err := s.file.WriteAt(buf, s.size); err != nil {
+		// Drop whatever part of the record made it to disk
+		s.file.Truncate(s.size)
+		return err
+	}
+
+	s.positions = append(s.positions, s.size)
+	s.timestamps = append(s.timestamps, timestamp.UnixNano())
+	s.size += int64(len(buf))
+	return nil
+}
+
+// read returns the record stored at offset, which must belong to this segment.
+func (s *segment) read(offset uint64) (Record, error) {
+	position := s.positions[offset-s.baseOffset]
+
+	header := make([]byte, headerSize)
+	if _, err := s.file.ReadAt(header, position); err != nil {
+		return Record{}, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := s.file.ReadAt(body, position+headerSize); err != nil && err != io.EOF {
+		return Record{}, err
+	}
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return Record{}, fmt.Errorf("segment %d: checksum mismatch at offset %d", s.baseOffset, offset)
+	}
+
+	return Record{
+		Offset:    offset,
+		Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(body[8:16]))),
+		Data:      body[metaSize:],
+	}, nil
+}
+
+// sync flushes the segment to stable storage.
+func (s *segment) sync() error {
+	return s.file.Sync()
+}
+
+// close closes the segment file.
+func (s *segment) close() error {
+	return s.file.Close()
+}
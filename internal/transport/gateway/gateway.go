@@ -0,0 +1,520 @@
+// Package gateway exposes a broker over HTTP so that services that cannot speak
+// the wire protocol can publish and receive messages.
+//
+//	POST   /topics/{name}/messages   publish the request body to a topic
+//	GET    /topics/{name}/messages   long-poll a subscription to a topic or pattern
+//	GET    /topics/{name}/stream     stream a topic or pattern as Server-Sent Events
+//	DELETE /subscriptions/{id}       cancel a long-poll subscription
+//
+// Errors are returned as JSON: {"error": {"code": "...", "message": "..."}}.
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/codec"
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+const (
+	// DefaultMaxBodyBytes is the largest request body accepted for a publish.
+	DefaultMaxBodyBytes = 1 << 20
+
+	// DefaultWait is how long a poll waits for messages when the wait parameter is absent.
+	DefaultWait = 30 * time.Second
+
+	// DefaultMaxWait caps the wait parameter.
+	DefaultMaxWait = 60 * time.Second
+
+	// DefaultIdleTimeout is how long a subscription lives without being polled.
+	DefaultIdleTimeout = 5 * time.Minute
+
+	// DefaultMaxMessages is how many messages a poll returns when the max parameter is absent.
+	DefaultMaxMessages = 100
+
+	// HeaderPrefix marks request headers that are copied to the published message,
+	// without the prefix. "X-Message-Tenant: acme" sets the message header "tenant".
+	HeaderPrefix = "X-Message-"
+)
+
+// Error codes returned in error responses.
+const (
+	CodeInvalidTopic         = "invalid_topic"
+	CodeInvalidParameter     = "invalid_parameter"
+	CodeInvalidPayload       = "invalid_payload"
+	CodePayloadTooLarge      = "payload_too_large"
+	CodeSubscriptionNotFound = "subscription_not_found"
+	CodeSubscriptionClosed   = "subscription_closed"
+	CodeSubscriptionMismatch = "subscription_mismatch"
+	CodePollInProgress       = "poll_in_progress"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeEncodingFailed       = "encoding_failed"
+	CodeMessageExpired       = "message_expired"
+	CodeBrokerClosed         = "broker_closed"
+)
+
+// Option configures a Gateway.
+type Option func(*Gateway)
+
+// WithMaxBodyBytes sets the largest request body accepted for a publish.
+func WithMaxBodyBytes(n int64) Option {
+	return func(g *Gateway) {
+		g.maxBodyBytes = n
+	}
+}
+
+// WithMaxWait caps how long a single poll may wait.
+func WithMaxWait(d time.Duration) Option {
+	return func(g *Gateway) {
+		g.maxWait = d
+	}
+}
+
+// WithIdleTimeout sets how long a subscription lives without being polled before it
+// is removed.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(g *Gateway) {
+		g.idleTimeout = d
+	}
+}
+
+// WithSubscriptionOptions sets options applied to every subscription the gateway
+// creates, such as the buffer size.
+func WithSubscriptionOptions(opts ...subscription.Option) Option {
+	return func(g *Gateway) {
+		g.subOptions = opts
+	}
+}
+
+// Gateway is an http.Handler that serves a broker.
+type Gateway struct {
+	broker       *broker.Broker
+	mux          *http.ServeMux
+	maxBodyBytes int64
+	maxWait      time.Duration
+	idleTimeout  time.Duration
+	subOptions   []subscription.Option
+
+	heartbeat          time.Duration // for event streams
+	streamWriteTimeout time.Duration
+
+	mu      sync.Mutex
+	pollers map[string]*poller // subscription ID -> poller
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// poller is a subscription that is read by polling.
+type poller struct {
+	sub      *subscription.Subscription
+	busy     sync.Mutex // held while a poll is reading
+	lastPoll time.Time  // guarded by Gateway.mu
+}
+
+// New creates a gateway for the broker. Close stops the gateway's idle-subscription
+// sweeper and removes its subscriptions.
+func New(b *broker.Broker, opts ...Option) *Gateway {
+	g := &Gateway{
+		broker:       b,
+		mux:          http.NewServeMux(),
+		maxBodyBytes: DefaultMaxBodyBytes,
+		maxWait:      DefaultMaxWait,
+		idleTimeout:  DefaultIdleTimeout,
+		pollers:      make(map[string]*poller),
+		done:         make(chan struct{}),
+
+		heartbeat:          DefaultHeartbeat,
+		streamWriteTimeout: DefaultStreamWriteTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(g)
+	}
+
+	g.mux.HandleFunc("POST /topics/{name}/messages", g.publish)
+	g.mux.HandleFunc("GET /topics/{name}/messages", g.poll)
+	g.mux.HandleFunc("GET /topics/{name}/stream", g.stream)
+	g.mux.HandleFunc("DELETE /subscriptions/{id}", g.unsubscribe)
+
+	go g.sweep()
+
+	return g
+}
+
+// ServeHTTP implements http.Handler.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := g.mux.Handler(r); pattern == "" {
+		g.notRouted(w, r)
+		return
+	}
+	g.mux.ServeHTTP(w, r)
+}
+
+// notRouted reports a request that matches no route, as JSON rather than the
+// mux's plain text.
+func (g *Gateway) notRouted(w http.ResponseWriter, r *http.Request) {
+	var allowed []string
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		if _, pattern := g.mux.Handler(probe); pattern != "" {
+			allowed = append(allowed, method)
+		}
+	}
+
+	if len(allowed) == 0 {
+		writeError(w, http.StatusNotFound, CodeNotFound, "no route for "+r.URL.Path)
+		return
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+}
+
+// Handle registers an additional handler on the gateway's mux, so that other HTTP
+// transports can share its address.
+func (g *Gateway) Handle(pattern string, handler http.Handler) {
+	g.mux.Handle(pattern, handler)
+}
+
+// Close removes every subscription created by the gateway.
+func (g *Gateway) Close() {
+	g.closeOnce.Do(func() {
+		close(g.done)
+	})
+
+	g.mu.Lock()
+	pollers := g.pollers
+	g.pollers = make(map[string]*poller)
+	g.mu.Unlock()
+
+	for id := range pollers {
+		g.broker.Unsubscribe(id)
+	}
+}
+
+// publishResponse is the body returned by a successful publish.
+type publishResponse struct {
+	ID    string `json:"id"`
+	Topic string `json:"topic"`
+}
+
+// publish handles POST /topics/{name}/messages. The request's Content-Type becomes
+// the message's content type; bodies in a format with a registered codec are decoded
+// so in-process subscribers receive structured data.
+func (g *Gateway) publish(w http.ResponseWriter, r *http.Request) {
+	t, err := topic.New(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidTopic, err.Error())
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, g.maxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, err.Error())
+			return
+		}
+		writeError(w, http.StatusBadRequest, CodeInvalidPayload, err.Error())
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	var data interface{} = body
+	if c, err := codec.Lookup(contentType); err == nil && contentType != "" {
+		if err := c.Unmarshal(body, &data); err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidPayload, err.Error())
+			return
+		}
+	}
+
+	opts := []message.Option{message.WithHeaders(messageHeaders(r.Header))}
+	if contentType != "" {
+		opts = append(opts, message.WithContentType(contentType))
+	}
+	msg := message.NewMessage(t, data, opts...)
+	if _, err := g.broker.PublishContext(r.Context(), msg); err != nil {
+		status, code := publishError(err)
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, publishResponse{ID: msg.ID(), Topic: t.String()})
+}
+
+// publishError returns the HTTP status and error code reporting a failed publish.
+// Apart from an expired message, a publish fails only once the broker is closed or
+// the request is cancelled.
+func publishError(err error) (int, string) {
+	if errors.Is(err, subscription.ErrExpired) {
+		return http.StatusBadRequest, CodeMessageExpired
+	}
+	return http.StatusServiceUnavailable, CodeBrokerClosed
+}
+
+// messageHeaders collects the X-Message-* request headers.
+func messageHeaders(h http.Header) map[string]string {
+	headers := make(map[string]string)
+	for key, values := range h {
+		if len(values) == 0 || len(key) <= len(HeaderPrefix) || !strings.EqualFold(key[:len(HeaderPrefix)], HeaderPrefix) {
+			continue
+		}
+		headers[key[len(HeaderPrefix):]] = values[0]
+	}
+	return headers
+}
+
+// pollResponse is the body returned by a poll. Messages are in the format produced
+// by message.Encode. Messages that could not be encoded are listed in Errors instead.
+type pollResponse struct {
+	Subscription string            `json:"subscription"`
+	Messages     []json.RawMessage `json:"messages"`
+	Errors       []pollError       `json:"errors,omitempty"`
+}
+
+// pollError reports a message that a poll received but could not return.
+type pollError struct {
+	ID      string `json:"id"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// poll handles GET /topics/{name}/messages. Without a subscription parameter it
+// creates a subscription; clients pass the returned ID on later polls. The poll
+// returns as soon as a message is available, or after the wait parameter elapses.
+// A message whose payload cannot be encoded is reported in the response's errors
+// with the encoding_failed code, since the subscription has already moved past it.
+// A subscription the broker has closed is removed and reported with 410 Gone.
+func (g *Gateway) poll(w http.ResponseWriter, r *http.Request) {
+	t, err := topic.NewPattern(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidTopic, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	wait, err := g.parseWait(query.Get("wait"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return
+	}
+	limit := DefaultMaxMessages
+	if value := query.Get("max"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, CodeInvalidParameter, "max must be a positive integer")
+			return
+		}
+	}
+
+	p, status, code, err := g.poller(t, query.Get("subscription"), query.Get("group"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	if !p.busy.TryLock() {
+		writeError(w, http.StatusConflict, CodePollInProgress, "another poll is reading this subscription")
+		return
+	}
+	messages := g.collect(r, p.sub, wait, limit)
+	p.busy.Unlock()
+	g.touch(p)
+
+	if len(messages) == 0 && g.removeClosed(p) {
+		writeError(w, http.StatusGone, CodeSubscriptionClosed, "subscription "+p.sub.ID()+" was closed by the broker")
+		return
+	}
+
+	response := pollResponse{Subscription: p.sub.ID(), Messages: make([]json.RawMessage, 0, len(messages))}
+	for _, msg := range messages {
+		b, err := message.Encode(msg)
+		if err != nil {
+			response.Errors = append(response.Errors, pollError{ID: msg.ID(), Code: CodeEncodingFailed, Message: err.Error()})
+			continue
+		}
+		response.Messages = append(response.Messages, b)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// parseWait parses the wait parameter and caps it at the gateway's maximum.
+func (g *Gateway) parseWait(value string) (time.Duration, error) {
+	if value == "" {
+		return min(DefaultWait, g.maxWait), nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 {
+		return 0, errors.New("wait must be a non-negative duration such as 30s")
+	}
+	return min(wait, g.maxWait), nil
+}
+
+// poller finds the subscription named by id, or creates one if id is empty.
+// On failure it returns the HTTP status and error code to report.
+func (g *Gateway) poller(t topic.Topic, id, group string) (*poller, int, string, error) {
+	if id == "" {
+		opts := append([]subscription.Option(nil), g.subOptions...)
+		if group != "" {
+			opts = append(opts, subscription.WithGroup(group))
+		}
+		p := &poller{sub: g.broker.Subscribe(t, opts...), lastPoll: time.Now()}
+
+		g.mu.Lock()
+		g.pollers[p.sub.ID()] = p
+		g.mu.Unlock()
+		return p, 0, "", nil
+	}
+
+	g.mu.Lock()
+	p, ok := g.pollers[id]
+	g.mu.Unlock()
+
+	if !ok {
+		return nil, http.StatusNotFound, CodeSubscriptionNotFound, errors.New("subscription " + id + " does not exist or has expired")
+	}
+	if g.removeClosed(p) {
+		return nil, http.StatusGone, CodeSubscriptionClosed, errors.New("subscription " + id + " was closed by the broker")
+	}
+	if !p.sub.Topic().Equals(t) {
+		return nil, http.StatusBadRequest, CodeSubscriptionMismatch, errors.New("subscription " + id + " is for " + p.sub.Topic().String())
+	}
+	g.touch(p)
+	return p, 0, "", nil
+}
+
+// collect waits up to wait for the first message, then takes any others that are
+// already available, up to limit.
+func (g *Gateway) collect(r *http.Request, sub *subscription.Subscription, wait time.Duration, limit int) []message.Message {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var messages []message.Message
+	select {
+	case msg, ok := <-sub.MessageChannel():
+		if !ok {
+			return nil
+		}
+		messages = append(messages, msg)
+	case <-timer.C:
+		return nil
+	case <-r.Context().Done():
+		return nil
+	}
+
+	for len(messages) < limit {
+		select {
+		case msg, ok := <-sub.MessageChannel():
+			if !ok {
+				return messages
+			}
+			messages = append(messages, msg)
+		default:
+			return messages
+		}
+	}
+	return messages
+}
+
+// removeClosed removes a poller whose subscription the broker has closed, for
+// example because the broker itself was closed, and reports whether it did.
+func (g *Gateway) removeClosed(p *poller) bool {
+	select {
+	case <-p.sub.Done():
+	default:
+		return false
+	}
+
+	g.mu.Lock()
+	if g.pollers[p.sub.ID()] == p {
+		delete(g.pollers, p.sub.ID())
+	}
+	g.mu.Unlock()
+	return true
+}
+
+// touch records that a subscription was just polled.
+func (g *Gateway) touch(p *poller) {
+	g.mu.Lock()
+	p.lastPoll = time.Now()
+	g.mu.Unlock()
+}
+
+// unsubscribe handles DELETE /subscriptions/{id}.
+func (g *Gateway) unsubscribe(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	g.mu.Lock()
+	_, ok := g.pollers[id]
+	delete(g.pollers, id)
+	g.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, CodeSubscriptionNotFound, "subscription "+id+" does not exist or has expired")
+		return
+	}
+
+	g.broker.Unsubscribe(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sweep removes subscriptions that have not been polled within the idle timeout.
+func (g *Gateway) sweep() {
+	ticker := time.NewTicker(max(g.idleTimeout/2, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-g.done:
+			return
+		}
+
+		var expired []string
+		g.mu.Lock()
+		for id, p := range g.pollers {
+			if time.Since(p.lastPoll) > g.idleTimeout && p.busy.TryLock() {
+				p.busy.Unlock()
+				expired = append(expired, id)
+				delete(g.pollers, id)
+			}
+		}
+		g.mu.Unlock()
+
+		for _, id := range expired {
+			g.broker.Unsubscribe(id)
+		}
+	}
+}
+
+// errorResponse is the body of every error response.
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorResponse{Error: errorBody{Code: code, Message: message}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,482 @@
+package gateway_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/gateway"
+)
+
+type pollResponse struct {
+	Subscription string            `json:"subscription"`
+	Messages     []json.RawMessage `json:"messages"`
+	Errors       []struct {
+		ID   string `json:"id"`
+		Code string `json:"code"`
+	} `json:"errors"`
+}
+
+type errorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newGateway(t *testing.T, opts ...gateway.Option) (*broker.Broker, *httptest.Server) {
+	t.Helper()
+
+	b := broker.NewBroker()
+	g := gateway.New(b, opts...)
+	server := httptest.NewServer(g)
+	t.Cleanup(func() {
+		server.Close()
+		g.Close()
+		b.Close()
+	})
+	return b, server
+}
+
+func do(t *testing.T, method, url, contentType, body string, headers ...string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest() error = %v", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s error = %v", method, url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+}
+
+func TestGatewayPublish(t *testing.T) {
+	b, server := newGateway(t)
+
+	orders, _ := topic.New("orders")
+	sub := b.Subscribe(orders)
+
+	resp := do(t, http.MethodPost, server.URL+"/topics/orders/messages", "application/json", `{"qty":2}`,
+		"X-Message-Correlation-Id", "req-1")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", resp.StatusCode)
+	}
+	var body struct {
+		ID    string `json:"id"`
+		Topic string `json:"topic"`
+	}
+	decode(t, resp, &body)
+
+	select {
+	case msg := <-sub.MessageChannel():
+		if msg.ID() != body.ID {
+			t.Errorf("message ID = %s, response ID = %s", msg.ID(), body.ID)
+		}
+		data, ok := msg.Data().(map[string]interface{})
+		if !ok || data["qty"] != float64(2) {
+			t.Errorf("Data() = %#v, want decoded JSON", msg.Data())
+		}
+		if msg.CorrelationID() != "req-1" || msg.ContentType() != "application/json" {
+			t.Errorf("headers = %v", msg.Headers())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	// Bodies without a codec are published as raw bytes
+	do(t, http.MethodPost, server.URL+"/topics/orders/messages", "text/plain", "hello")
+	select {
+	case msg := <-sub.MessageChannel():
+		if !bytes.Equal(msg.Data().([]byte), []byte("hello")) {
+			t.Errorf("Data() = %#v, want hello", msg.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
+
+func TestGatewayPublishAfterBrokerClose(t *testing.T) {
+	b, server := newGateway(t)
+	b.Close()
+
+	resp := do(t, http.MethodPost, server.URL+"/topics/orders/messages", "text/plain", "hello")
+	var body errorResponse
+	decode(t, resp, &body)
+	if resp.StatusCode != http.StatusServiceUnavailable || body.Error.Code != gateway.CodeBrokerClosed {
+		t.Errorf("publish = %d %s, want 503 %s", resp.StatusCode, body.Error.Code, gateway.CodeBrokerClosed)
+	}
+}
+
+func TestGatewayLongPoll(t *testing.T) {
+	b, server := newGateway(t)
+	url := server.URL + "/topics/orders.*/messages"
+
+	// The first poll creates the subscription and times out empty
+	var first pollResponse
+	decode(t, do(t, http.MethodGet, url+"?wait=10ms", "", ""), &first)
+	if first.Subscription == "" || len(first.Messages) != 0 {
+		t.Fatalf("first poll = %+v, want a subscription and no messages", first)
+	}
+
+	// A waiting poll returns as soon as a message is published
+	orders, _ := topic.New("orders.created")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.Publish(message.NewMessage(orders, "one"))
+		b.Publish(message.NewMessage(orders, "two"))
+	}()
+
+	start := time.Now()
+	var received []interface{}
+	for len(received) < 2 && time.Since(start) < 2*time.Second {
+		var resp pollResponse
+		decode(t, do(t, http.MethodGet, url+"?wait=5s&subscription="+first.Subscription, "", ""), &resp)
+		for _, raw := range resp.Messages {
+			msg, err := message.Decode(raw)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			received = append(received, msg.Data())
+		}
+	}
+	if len(received) != 2 || received[0] != "one" || received[1] != "two" {
+		t.Errorf("received %v, want [one two]", received)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("poll took %v, want it to return when messages arrive", elapsed)
+	}
+
+	// Deleting the subscription makes later polls fail
+	resp := do(t, http.MethodDelete, server.URL+"/subscriptions/"+first.Subscription, "", "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE status = %d, want 204", resp.StatusCode)
+	}
+	resp = do(t, http.MethodGet, url+"?wait=0s&subscription="+first.Subscription, "", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("poll after DELETE status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestGatewayPollReportsEncodingFailures(t *testing.T) {
+	b, server := newGateway(t)
+	url := server.URL + "/topics/orders/messages"
+
+	var first pollResponse
+	decode(t, do(t, http.MethodGet, url+"?wait=0s", "", ""), &first)
+
+	orders, _ := topic.New("orders")
+	broken := message.NewMessage(orders, make(chan int))
+	b.Publish(broken)
+	b.Publish(message.NewMessage(orders, "ok"))
+
+	var resp pollResponse
+	decode(t, do(t, http.MethodGet, url+"?wait=1s&subscription="+first.Subscription, "", ""), &resp)
+	if len(resp.Errors) != 1 || resp.Errors[0].ID != broken.ID() || resp.Errors[0].Code != gateway.CodeEncodingFailed {
+		t.Errorf("poll errors = %+v, want %s for %s", resp.Errors, gateway.CodeEncodingFailed, broken.ID())
+	}
+
+	// The failure does not hold up the messages after it
+	if len(resp.Messages) == 0 {
+		decode(t, do(t, http.MethodGet, url+"?wait=1s&subscription="+first.Subscription, "", ""), &resp)
+	}
+	if len(resp.Messages) != 1 {
+		t.Errorf("poll returned %d messages, want 1", len(resp.Messages))
+	}
+}
+
+func TestGatewayExpiresIdleSubscriptions(t *testing.T) {
+	_, server := newGateway(t, gateway.WithIdleTimeout(30*time.Millisecond))
+	url := server.URL + "/topics/orders/messages"
+
+	var first pollResponse
+	decode(t, do(t, http.MethodGet, url+"?wait=0s", "", ""), &first)
+
+	time.Sleep(150 * time.Millisecond)
+
+	resp := do(t, http.MethodGet, url+"?wait=0s&subscription="+first.Subscription, "", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("poll of an idle subscription status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestGatewayReportsClosedSubscriptions(t *testing.T) {
+	b, server := newGateway(t)
+	url := server.URL + "/topics/orders/messages"
+
+	var first pollResponse
+	decode(t, do(t, http.MethodGet, url+"?wait=0s", "", ""), &first)
+
+	// The broker closes the subscription behind the gateway's back
+	b.Unsubscribe(first.Subscription)
+
+	resp := do(t, http.MethodGet, url+"?wait=1s&subscription="+first.Subscription, "", "")
+	var body errorResponse
+	decode(t, resp, &body)
+	if resp.StatusCode != http.StatusGone || body.Error.Code != gateway.CodeSubscriptionClosed {
+		t.Errorf("poll of a closed subscription = %d %s, want 410 %s", resp.StatusCode, body.Error.Code, gateway.CodeSubscriptionClosed)
+	}
+
+	resp = do(t, http.MethodGet, url+"?wait=0s&subscription="+first.Subscription, "", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("poll after the closed subscription was removed status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestGatewayErrors(t *testing.T) {
+	_, server := newGateway(t, gateway.WithMaxBodyBytes(8))
+
+	var sub pollResponse
+	decode(t, do(t, http.MethodGet, server.URL+"/topics/orders/messages?wait=0s", "", ""), &sub)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCode    string
+	}{
+		{"invalid topic", http.MethodPost, "/topics/bad_topic/messages", "", "x", http.StatusBadRequest, gateway.CodeInvalidTopic},
+		{"wildcard publish", http.MethodPost, "/topics/orders.*/messages", "", "x", http.StatusBadRequest, gateway.CodeInvalidTopic},
+		{"body too large", http.MethodPost, "/topics/orders/messages", "", "123456789", http.StatusRequestEntityTooLarge, gateway.CodePayloadTooLarge},
+		{"invalid json", http.MethodPost, "/topics/orders/messages", "application/json", "{", http.StatusBadRequest, gateway.CodeInvalidPayload},
+		{"invalid wait", http.MethodGet, "/topics/orders/messages?wait=soon", "", "", http.StatusBadRequest, gateway.CodeInvalidParameter},
+		{"invalid max", http.MethodGet, "/topics/orders/messages?max=0", "", "", http.StatusBadRequest, gateway.CodeInvalidParameter},
+		{"unknown subscription", http.MethodGet, "/topics/orders/messages?subscription=nope", "", "", http.StatusNotFound, gateway.CodeSubscriptionNotFound},
+		{"subscription for another topic", http.MethodGet, "/topics/payments/messages?wait=0s&subscription=" + sub.Subscription, "", "", http.StatusBadRequest, gateway.CodeSubscriptionMismatch},
+		{"delete unknown subscription", http.MethodDelete, "/subscriptions/nope", "", "", http.StatusNotFound, gateway.CodeSubscriptionNotFound},
+		{"unknown route", http.MethodGet, "/nothing", "", "", http.StatusNotFound, gateway.CodeNotFound},
+		{"wrong method", http.MethodPut, "/topics/orders/messages", "", "", http.StatusMethodNotAllowed, gateway.CodeMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := do(t, tt.method, server.URL+tt.path, tt.contentType, tt.body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			var body errorResponse
+			decode(t, resp, &body)
+			if body.Error.Code != tt.wantCode || body.Error.Message == "" {
+				t.Errorf("error = %+v, want code %s with a message", body.Error, tt.wantCode)
+			}
+		})
+	}
+}
+
+// event is a parsed Server-Sent Event.
+type event struct {
+	id, name, data string
+}
+
+// readEvents parses events from an event stream, skipping comments, and sends them
+// on the returned channel until the stream ends.
+func readEvents(body io.Reader) <-chan event {
+	events := make(chan event, 1000)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 1<<20), 1<<20)
+		var e event
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if e.id != "" || e.data != "" {
+					events <- e
+				}
+				e = event{}
+			case strings.HasPrefix(line, "id: "):
+				e.id = line[len("id: "):]
+			case strings.HasPrefix(line, "event: "):
+				e.name = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				e.data = line[len("data: "):]
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan event) event {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("event stream ended")
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return event{}
+}
+
+// openStream starts an event stream and waits until its subscription is registered.
+func openStream(t *testing.T, b *broker.Broker, url string, headers ...string) (*http.Response, <-chan event) {
+	t.Helper()
+
+	resp := do(t, http.MethodGet, url, "", "", headers...)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+	return resp, readEvents(resp.Body)
+}
+
+func TestGatewayStream(t *testing.T) {
+	b, server := newGateway(t)
+
+	_, events := openStream(t, b, server.URL+"/topics/orders.>/stream")
+
+	orders, _ := topic.New("orders.eu.created")
+	sent := message.NewMessage(orders, map[string]interface{}{"qty": 1})
+	b.Publish(sent)
+
+	e := nextEvent(t, events)
+	if e.id != sent.ID() || e.name != "message" {
+		t.Errorf("event id = %q name = %q, want %q message", e.id, e.name, sent.ID())
+	}
+	got, err := message.Decode([]byte(e.data))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if got.ID() != sent.ID() || got.Topic().String() != "orders.eu.created" {
+		t.Errorf("event data = %s", e.data)
+	}
+
+	// An ID that would break the event framing is left out of the id field
+	crafted, err := message.Decode([]byte(`{"id":"x\nevent: injected\ndata: {}","topic":"orders.eu.created"}`))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	b.Publish(crafted)
+	e = nextEvent(t, events)
+	if e.id != "" || e.name != "message" {
+		t.Errorf("event id = %q name = %q, want no id and message", e.id, e.name)
+	}
+	if got, err := message.Decode([]byte(e.data)); err != nil || got.ID() != crafted.ID() {
+		t.Errorf("event data = %s, want message %q", e.data, crafted.ID())
+	}
+
+	// A message that cannot be encoded is reported rather than skipped
+	broken := message.NewMessage(orders, make(chan int))
+	b.Publish(broken)
+	e = nextEvent(t, events)
+	var failure struct {
+		ID   string `json:"id"`
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal([]byte(e.data), &failure); err != nil || e.name != "error" {
+		t.Fatalf("event %q data = %s, want an error event", e.name, e.data)
+	}
+	if failure.ID != broken.ID() || failure.Code != gateway.CodeEncodingFailed {
+		t.Errorf("error event = %+v, want %s for %s", failure, gateway.CodeEncodingFailed, broken.ID())
+	}
+}
+
+func TestGatewayStreamResumesFromLastEventID(t *testing.T) {
+	b := broker.NewBroker(broker.WithDataDir(t.TempDir()))
+	g := gateway.New(b)
+	server := httptest.NewServer(g)
+	t.Cleanup(func() {
+		server.Close()
+		g.Close()
+		b.Close()
+	})
+
+	orders, _ := topic.New("orders")
+	if err := b.ConfigureTopic(orders, broker.Durable()); err != nil {
+		t.Fatalf("ConfigureTopic() error = %v", err)
+	}
+	var ids []string
+	for _, data := range []string{"first", "second", "third"} {
+		msg := message.NewMessage(orders, data)
+		ids = append(ids, msg.ID())
+		b.Publish(msg)
+	}
+
+	// A browser reconnecting after "first" sends its ID back
+	_, events := openStream(t, b, server.URL+"/topics/orders/stream", "Last-Event-ID", ids[0])
+	for _, want := range ids[1:] {
+		if e := nextEvent(t, events); e.id != want {
+			t.Errorf("event id = %s, want %s", e.id, want)
+		}
+	}
+
+	// The resumed stream continues with live messages
+	live := message.NewMessage(orders, "live")
+	b.Publish(live)
+	if e := nextEvent(t, events); e.id != live.ID() {
+		t.Errorf("event id = %s, want live %s", e.id, live.ID())
+	}
+}
+
+func TestGatewayStreamDisconnectsSlowClient(t *testing.T) {
+	b, server := newGateway(t, gateway.WithStreamWriteTimeout(50*time.Millisecond))
+
+	// Open the stream but do not read it, so the server's writes back up
+	resp := do(t, http.MethodGet, server.URL+"/topics/bulk/stream?buffer=1", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	bulk, _ := topic.New("bulk")
+	payload := strings.Repeat("x", 64<<10)
+	const published = 200
+	for i := 0; i < published; i++ {
+		b.Publish(message.NewMessage(bulk, payload))
+	}
+
+	// The stream ends before every message has been sent
+	received := 0
+	for range readEvents(resp.Body) {
+		received++
+	}
+	if received >= published {
+		t.Errorf("received all %d events, want the slow client disconnected", received)
+	}
+}
+
+func TestGatewayStreamInvalidParameters(t *testing.T) {
+	_, server := newGateway(t)
+
+	for _, query := range []string{"policy=sometimes", "buffer=0"} {
+		resp := do(t, http.MethodGet, server.URL+"/topics/orders/stream?"+query, "", "")
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+const (
+	// DefaultHeartbeat is how often an idle event stream sends a comment line, so
+	// that proxies keep the connection open.
+	DefaultHeartbeat = 15 * time.Second
+
+	// DefaultStreamWriteTimeout is how long writing one event to a stream may take
+	// before the client is disconnected.
+	DefaultStreamWriteTimeout = 10 * time.Second
+)
+
+// WithHeartbeat sets how often an idle event stream sends a keepalive comment.
+func WithHeartbeat(d time.Duration) Option {
+	return func(g *Gateway) {
+		g.heartbeat = d
+	}
+}
+
+// WithStreamWriteTimeout sets how long writing one event to a stream may take
+// before the client is disconnected.
+func WithStreamWriteTimeout(d time.Duration) Option {
+	return func(g *Gateway) {
+		g.streamWriteTimeout = d
+	}
+}
+
+// stream handles GET /topics/{name}/stream, sending every matching message as a
+// Server-Sent Event whose id is the message ID and whose data is the message in the
+// format produced by message.Encode. A message that cannot be encoded is reported by
+// an error event whose data is {"id": "...", "code": "encoding_failed", "message": "..."}.
+//
+// Query parameters choose the subscription's overflow policy (policy, default
+// disconnect) and buffer size (buffer). A client that falls behind is treated
+// according to the policy; with the default it is disconnected.
+//
+// On a durable topic, a Last-Event-ID header (or lastEventId parameter) resumes the
+// stream with the message after that ID, or with new messages if the ID is not among
+// the topic's recent messages. Resumed streams read from the topic's log, so they
+// fall behind rather than lose messages.
+func (g *Gateway) stream(w http.ResponseWriter, r *http.Request) {
+	t, err := topic.NewPattern(r.PathValue("name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidTopic, err.Error())
+		return
+	}
+
+	opts, err := streamOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return
+	}
+	opts = append(append([]subscription.Option(nil), g.subOptions...), opts...)
+
+	rc := http.NewResponseController(w)
+	sub := g.broker.Subscribe(t, opts...)
+	defer g.broker.Unsubscribe(sub.ID())
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(g.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var event []byte
+		select {
+		case msg, ok := <-sub.MessageChannel():
+			if !ok {
+				// Closed by the overflow policy or broker shutdown
+				return
+			}
+			if event, err = appendEvent(nil, msg); err != nil {
+				event = appendErrorEvent(nil, msg, err)
+			}
+		case <-heartbeat.C:
+			event = []byte(": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+
+		rc.SetWriteDeadline(time.Now().Add(g.streamWriteTimeout))
+		if _, err := w.Write(event); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// streamOptions builds the subscription options for an event stream from the request.
+func streamOptions(r *http.Request) ([]subscription.Option, error) {
+	query := r.URL.Query()
+
+	policy := subscription.Disconnect
+	if name := query.Get("policy"); name != "" {
+		var err error
+		if policy, err = subscription.ParseOverflowPolicy(name); err != nil {
+			return nil, err
+		}
+	}
+	opts := []subscription.Option{subscription.WithOverflowPolicy(policy)}
+
+	if value := query.Get("buffer"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("buffer must be a positive integer")
+		}
+		opts = append(opts, subscription.WithBufferSize(size))
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("lastEventId")
+	}
+	if lastEventID != "" {
+		opts = append(opts, subscription.WithStartPosition(subscription.AfterMessage(lastEventID)))
+	}
+
+	return opts, nil
+}
+
+// appendEvent appends a message as a Server-Sent Event. The encoded message is a
+// single line of JSON, so it fits in one data field. The id field is left out for a
+// message ID that would break the event framing, as IDs from other transports may.
+func appendEvent(buf []byte, msg message.Message) ([]byte, error) {
+	data, err := message.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if id := msg.ID(); !strings.ContainsAny(id, "\r\n\x00") {
+		buf = append(buf, "id: "...)
+		buf = append(buf, id...)
+		buf = append(buf, '\n')
+	}
+	buf = append(buf, "event: message\ndata: "...)
+	buf = append(buf, data...)
+	return append(buf, "\n\n"...), nil
+}
+
+// appendErrorEvent appends an error event reporting a message that could not be encoded.
+func appendErrorEvent(buf []byte, msg message.Message, err error) []byte {
+	data, _ := json.Marshal(pollError{ID: msg.ID(), Code: CodeEncodingFailed, Message: err.Error()})
+
+	buf = append(buf, "event: error\ndata: "...)
+	buf = append(buf, data...)
+	return append(buf, "\n\n"...)
+}
@@ -0,0 +1,295 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client calls the Broker service over unencrypted HTTP/2.
+type Client struct {
+	baseURL        string
+	http           *http.Client
+	transport      *http.Transport
+	maxMessageSize int
+}
+
+// NewClient creates a client for the server at addr, a host and port.
+func NewClient(addr string) *Client {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &Client{
+		baseURL:        "http://" + addr,
+		http:           &http.Client{Transport: transport},
+		transport:      transport,
+		maxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// Close closes the client's idle connections.
+func (c *Client) Close() {
+	c.transport.CloseIdleConnections()
+}
+
+type metadataKey struct{}
+
+// WithMetadata returns a context whose calls send the given metadata, in addition to
+// any metadata already attached to ctx. Keys starting with MetadataPrefix set headers
+// on published messages.
+func WithMetadata(ctx context.Context, md map[string]string) context.Context {
+	merged := make(map[string]string)
+	if existing, ok := ctx.Value(metadataKey{}).(map[string]string); ok {
+		for key, value := range existing {
+			merged[key] = value
+		}
+	}
+	for key, value := range md {
+		merged[strings.ToLower(key)] = value
+	}
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// Publish publishes one message.
+func (c *Client) Publish(ctx context.Context, req *PublishRequest) (*PublishResponse, error) {
+	var resp PublishResponse
+	if err := c.invoke(ctx, PublishMethod, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// PublishBatch publishes several messages; either all of them are published or none is.
+func (c *Client) PublishBatch(ctx context.Context, req *PublishBatchRequest) (*PublishBatchResponse, error) {
+	var resp PublishBatchResponse
+	if err := c.invoke(ctx, PublishBatchMethod, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// invoke makes a unary call.
+func (c *Client) invoke(ctx context.Context, method string, req marshaler, resp unmarshaler) error {
+	data, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	httpResp, err := c.do(ctx, method, bytes.NewReader(appendFrame(nil, data)))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	data, err = readFrame(httpResp.Body, c.maxMessageSize)
+	if errors.Is(err, io.EOF) {
+		// A call that fails sends no message, only its status
+		if err := callStatus(httpResp); err != nil {
+			return err
+		}
+		return statusf(Internal, "server sent no response message")
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, httpResp.Body); err != nil {
+		return err
+	}
+	if err := callStatus(httpResp); err != nil {
+		return err
+	}
+	return resp.Unmarshal(data)
+}
+
+// do starts a call and waits for the response headers.
+func (c *Client) do(ctx context.Context, method string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+method, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+	if md, ok := ctx.Value(metadataKey{}).(map[string]string); ok {
+		for key, value := range md {
+			req.Header.Set(key, value)
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if ms := time.Until(deadline).Milliseconds(); ms > 0 {
+			req.Header.Set("Grpc-Timeout", strconv.FormatInt(min(ms, 99999999), 10)+"m")
+		}
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, statusf(Unavailable, "unexpected HTTP status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// callStatus returns the error described by a finished call's grpc-status, which is
+// sent as a trailer, or as a header when the call failed before sending anything.
+func callStatus(resp *http.Response) error {
+	code, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if code == "" {
+		return statusf(Internal, "server sent no status")
+	}
+	n, err := strconv.ParseUint(code, 10, 32)
+	if err != nil {
+		return statusf(Internal, "malformed grpc-status %q", code)
+	}
+	if Code(n) == OK {
+		return nil
+	}
+	return &Status{Code: Code(n), Message: decodeStatusMessage(message)}
+}
+
+// Subscribe opens a subscription. It returns once the subscription is active.
+func (c *Client) Subscribe(ctx context.Context, req *SubscribeRequest) (*SubscribeStream, error) {
+	data, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := c.do(ctx, SubscribeMethod, bytes.NewReader(appendFrame(nil, data)))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &SubscribeStream{
+		id:             resp.Header.Get(SubscriptionHeader),
+		resp:           resp,
+		cancel:         cancel,
+		maxMessageSize: c.maxMessageSize,
+	}, nil
+}
+
+// SubscribeStream receives the messages of a Subscribe call.
+type SubscribeStream struct {
+	id             string
+	resp           *http.Response
+	cancel         context.CancelFunc
+	maxMessageSize int
+}
+
+// ID returns the subscription ID, for use in AckRequest.
+func (s *SubscribeStream) ID() string {
+	return s.id
+}
+
+// Recv waits for the next message. When the call ends it returns the call's status
+// error, or io.EOF if the server ended it with OK.
+func (s *SubscribeStream) Recv() (*Message, error) {
+	data, err := readFrame(s.resp.Body, s.maxMessageSize)
+	if errors.Is(err, io.EOF) {
+		if err := callStatus(s.resp); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err := msg.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Close cancels the call, ending the subscription.
+func (s *SubscribeStream) Close() error {
+	s.cancel()
+	return s.resp.Body.Close()
+}
+
+// Ack starts an Ack call. Send settles messages; CloseAndRecv ends the call and
+// returns the server's summary.
+func (c *Client) Ack(ctx context.Context) (*AckStream, error) {
+	pr, pw := io.Pipe()
+	s := &AckStream{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer pr.CloseWithError(errAckEnded)
+		s.resp, s.err = c.ack(ctx, pr)
+	}()
+	return s, nil
+}
+
+// errAckEnded fails Send calls made after the Ack call has ended.
+var errAckEnded = errors.New("grpc: ack call ended")
+
+// ack runs an Ack call whose request messages are read from body.
+func (c *Client) ack(ctx context.Context, body io.Reader) (*AckResponse, error) {
+	resp, err := c.do(ctx, AckMethod, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := readFrame(resp.Body, c.maxMessageSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+	}
+	if err := callStatus(resp); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, statusf(Internal, "server sent no response message")
+	}
+	var ack AckResponse
+	if err := ack.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+// AckStream is the client side of an Ack call.
+type AckStream struct {
+	pw *io.PipeWriter
+
+	mu sync.Mutex // serializes Send
+
+	done chan struct{}
+	resp *AckResponse // set when done is closed
+	err  error        // set when done is closed
+}
+
+// Send settles one message.
+func (s *AckStream) Send(req *AckRequest) error {
+	data, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.pw.Write(appendFrame(nil, data)); err != nil {
+		return fmt.Errorf("grpc: send ack: %w", err)
+	}
+	return nil
+}
+
+// CloseAndRecv ends the call and returns how many requests settled a message.
+func (s *AckStream) CloseAndRecv() (*AckResponse, error) {
+	s.pw.Close()
+	<-s.done
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.resp, nil
+}
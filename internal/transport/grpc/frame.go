@@ -0,0 +1,101 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every gRPC message is sent as a length-prefixed frame: one byte that says whether
+// the message is compressed, the message length as a big-endian uint32, then the
+// message itself. Compression is not supported.
+const frameHeaderLen = 5
+
+// readFrame reads one message. It returns io.EOF if the stream ends cleanly before
+// a frame starts.
+func readFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, statusf(Unimplemented, "compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if uint64(n) > uint64(maxSize) {
+		return nil, statusf(ResourceExhausted, "message of %d bytes exceeds the limit of %d", n, maxSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// appendFrame appends data as an uncompressed frame.
+func appendFrame(b, data []byte) []byte {
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// marshaler is implemented by every request and response type.
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// unmarshaler is implemented by every request and response type.
+type unmarshaler interface {
+	Unmarshal([]byte) error
+}
+
+// writeMessage encodes v and writes it as a single frame.
+func writeMessage(w io.Writer, v marshaler) error {
+	data, err := v.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(appendFrame(nil, data))
+	return err
+}
+
+// parseTimeout parses a grpc-timeout header: at most eight digits followed by a unit,
+// H, M, S, m (milliseconds), u (microseconds) or n (nanoseconds).
+func parseTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// isGRPCContentType reports whether a request's Content-Type selects the protobuf
+// encoding of gRPC: application/grpc, optionally followed by +proto or ;parameters.
+func isGRPCContentType(contentType string) bool {
+	rest, ok := strings.CutPrefix(contentType, "application/grpc")
+	if !ok {
+		return false
+	}
+	return rest == "" || rest == "+proto" || strings.HasPrefix(rest, ";") || strings.HasPrefix(rest, "+proto;")
+}
@@ -0,0 +1,517 @@
+package grpc_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/grpc"
+)
+
+// serveH2C serves h over unencrypted HTTP/2 and returns its address.
+func serveH2C(t *testing.T, h http.Handler) string {
+	t.Helper()
+
+	hs := httptest.NewUnstartedServer(h)
+	hs.Config.Protocols = new(http.Protocols)
+	hs.Config.Protocols.SetUnencryptedHTTP2(true)
+	hs.Start()
+	t.Cleanup(hs.Close)
+	return strings.TrimPrefix(hs.URL, "http://")
+}
+
+// startServer serves a new broker over gRPC and returns a client for it.
+func startServer(t *testing.T, opts ...grpc.Option) (*broker.Broker, *grpc.Server, *grpc.Client) {
+	t.Helper()
+
+	b := broker.NewBroker()
+	s := grpc.NewServer(b, opts...)
+	c := grpc.NewClient(serveH2C(t, s))
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+		b.Close()
+	})
+	return b, s, c
+}
+
+func receive(t *testing.T, ch <-chan message.Message) message.Message {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a message")
+		return message.Message{}
+	}
+}
+
+// recv reads the next message of a stream, failing the test after a second.
+func recv(t *testing.T, stream *grpc.SubscribeStream) *grpc.Message {
+	t.Helper()
+
+	type result struct {
+		msg *grpc.Message
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		msg, err := stream.Recv()
+		ch <- result{msg, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("Recv() error = %v", r.err)
+		}
+		return r.msg
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a streamed message")
+		return nil
+	}
+}
+
+func TestMessagesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface {
+			Marshal() ([]byte, error)
+			Unmarshal([]byte) error
+		}
+		out interface{ Unmarshal([]byte) error }
+	}{
+		{
+			name: "message",
+			in: &grpc.Message{
+				ID: "m1", Topic: "orders.eu", Payload: []byte{0, 1, 2}, ContentType: "application/octet-stream",
+				PublishedAtUnixNano: 1700000000123456789, Headers: map[string]string{"a": "1", "b": ""},
+				DeliveryAttempt: 3, SubscriptionID: "s1", DeliveryID: "7",
+			},
+			out: &grpc.Message{},
+		},
+		{
+			name: "publish batch",
+			in: &grpc.PublishBatchRequest{Messages: []*grpc.PublishRequest{
+				{Topic: "a", Payload: []byte("x"), Headers: map[string]string{"k": "v"}},
+				{Topic: "b", ContentType: "application/json"},
+			}},
+			out: &grpc.PublishBatchRequest{},
+		},
+		{
+			name: "batch response keeps empty IDs",
+			in:   &grpc.PublishBatchResponse{IDs: []string{"a", "", "c"}},
+			out:  &grpc.PublishBatchResponse{},
+		},
+		{
+			name: "subscribe",
+			in:   &grpc.SubscribeRequest{Topic: "orders.>", Group: "g", ManualAck: true, AckWaitMillis: 1500, BufferSize: 8},
+			out:  &grpc.SubscribeRequest{},
+		},
+		{
+			name: "ack with negative delay",
+			in:   &grpc.AckRequest{SubscriptionID: "s", MessageID: "m", Kind: grpc.AckKindNack, NackDelayMillis: -1, Reason: "r", DeliveryID: "7"},
+			out:  &grpc.AckRequest{},
+		},
+		{
+			name: "ack response",
+			in:   &grpc.AckResponse{Settled: 2, Failed: 1},
+			out:  &grpc.AckResponse{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.in.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if err := tt.out.Unmarshal(data); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(tt.in, tt.out) {
+				t.Errorf("round trip = %+v, want %+v", tt.out, tt.in)
+			}
+		})
+	}
+}
+
+func TestUnmarshalRejectsMalformedInput(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated length", []byte{0x0a, 0x05, 'a'}},
+		{"truncated varint", []byte{0x38, 0x80}},
+		{"wrong wire type", []byte{0x08, 0x01}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg grpc.Message
+			if err := msg.Unmarshal(tt.data); err == nil {
+				t.Error("Unmarshal() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestUnmarshalSkipsUnknownFields(t *testing.T) {
+	// Field 99 as a varint, then id = "m1"
+	data := []byte{0x98, 0x06, 0x07, 0x0a, 0x02, 'm', '1'}
+
+	var msg grpc.Message
+	if err := msg.Unmarshal(data); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if msg.ID != "m1" {
+		t.Errorf("ID = %q, want %q", msg.ID, "m1")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	b, _, c := startServer(t)
+	orders, _ := topic.New("orders.created")
+	sub := b.Subscribe(orders)
+
+	ctx := grpc.WithMetadata(context.Background(), map[string]string{
+		"X-Message-Tenant": "acme",
+		"x-message-region": "eu",
+		"authorization":    "secret",
+	})
+	resp, err := c.Publish(ctx, &grpc.PublishRequest{
+		Topic:       "orders.created",
+		Payload:     []byte(`{"id":42}`),
+		ContentType: "application/json",
+		Headers:     map[string]string{"region": "us"},
+	})
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	msg := receive(t, sub.MessageChannel())
+	if msg.ID() != resp.ID {
+		t.Errorf("ID = %q, want %q", msg.ID(), resp.ID)
+	}
+	if got, want := msg.Data(), map[string]interface{}{"id": float64(42)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Data() = %#v, want %#v", got, want)
+	}
+	if got := msg.Header("tenant"); got != "acme" {
+		t.Errorf("tenant header = %q, want %q", got, "acme")
+	}
+	if got := msg.Header("region"); got != "us" {
+		t.Errorf("region header = %q, want the request header %q", got, "us")
+	}
+	if got := msg.Header("authorization"); got != "" {
+		t.Errorf("authorization header = %q, want unprefixed metadata ignored", got)
+	}
+}
+
+func TestPublishErrors(t *testing.T) {
+	_, _, c := startServer(t, grpc.WithMaxMessageSize(64))
+
+	tests := []struct {
+		name string
+		req  *grpc.PublishRequest
+		want grpc.Code
+	}{
+		{"invalid topic", &grpc.PublishRequest{Topic: "orders.*"}, grpc.InvalidArgument},
+		{"invalid payload", &grpc.PublishRequest{Topic: "orders", Payload: []byte("{"), ContentType: "application/json"}, grpc.InvalidArgument},
+		{"too large", &grpc.PublishRequest{Topic: "orders", Payload: make([]byte, 100)}, grpc.ResourceExhausted},
+		{"expired", &grpc.PublishRequest{Topic: "orders", Headers: map[string]string{message.HeaderExpiresAt: "2000-01-01T00:00:00Z"}}, grpc.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.Publish(context.Background(), tt.req)
+			if got := grpc.CodeOf(err); got != tt.want {
+				t.Errorf("Publish() error = %v, want code %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	b, _, c := startServer(t)
+	all, _ := topic.NewPattern(">")
+	sub := b.Subscribe(all)
+
+	resp, err := c.PublishBatch(context.Background(), &grpc.PublishBatchRequest{Messages: []*grpc.PublishRequest{
+		{Topic: "a", Payload: []byte("1")},
+		{Topic: "b", Payload: []byte("2")},
+	}})
+	if err != nil {
+		t.Fatalf("PublishBatch() error = %v", err)
+	}
+	if len(resp.IDs) != 2 {
+		t.Fatalf("IDs = %v, want 2", resp.IDs)
+	}
+	for i, want := range []string{"a", "b"} {
+		msg := receive(t, sub.MessageChannel())
+		if msg.Topic().String() != want || msg.ID() != resp.IDs[i] {
+			t.Errorf("message %d = %s %s, want %s %s", i, msg.Topic(), msg.ID(), want, resp.IDs[i])
+		}
+	}
+
+	// One invalid message fails the whole batch
+	_, err = c.PublishBatch(context.Background(), &grpc.PublishBatchRequest{Messages: []*grpc.PublishRequest{
+		{Topic: "a", Payload: []byte("3")},
+		{Topic: "b.*", Payload: []byte("4")},
+	}})
+	if grpc.CodeOf(err) != grpc.InvalidArgument {
+		t.Fatalf("PublishBatch() error = %v, want InvalidArgument", err)
+	}
+	select {
+	case msg := <-sub.MessageChannel():
+		t.Errorf("received %s from a rejected batch", msg.ID())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	b, _, c := startServer(t)
+
+	stream, err := c.Subscribe(context.Background(), &grpc.SubscribeRequest{Topic: "orders.*"})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer stream.Close()
+
+	eu, _ := topic.New("orders.eu")
+	published := message.NewMessage(eu, map[string]interface{}{"id": 1}, message.WithHeader("tenant", "acme"))
+	b.Publish(published)
+
+	msg := recv(t, stream)
+	if msg.ID != published.ID() || msg.Topic != "orders.eu" {
+		t.Errorf("message = %s %s, want %s orders.eu", msg.ID, msg.Topic, published.ID())
+	}
+	if string(msg.Payload) != `{"id":1}` || msg.ContentType != "application/json" {
+		t.Errorf("payload = %s (%s), want JSON", msg.Payload, msg.ContentType)
+	}
+	if msg.Headers["tenant"] != "acme" {
+		t.Errorf("Headers = %v, want tenant", msg.Headers)
+	}
+	if msg.SubscriptionID != stream.ID() || msg.SubscriptionID == "" {
+		t.Errorf("SubscriptionID = %q, want %q", msg.SubscriptionID, stream.ID())
+	}
+	if msg.PublishedAtUnixNano != published.PublishedAt().UnixNano() {
+		t.Errorf("PublishedAtUnixNano = %d, want %d", msg.PublishedAtUnixNano, published.PublishedAt().UnixNano())
+	}
+}
+
+func TestSubscribeInvalidPattern(t *testing.T) {
+	_, _, c := startServer(t)
+
+	stream, err := c.Subscribe(context.Background(), &grpc.SubscribeRequest{Topic: "orders.>.eu"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if grpc.CodeOf(err) != grpc.InvalidArgument {
+		t.Errorf("error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestServerCloseEndsStreams(t *testing.T) {
+	_, s, c := startServer(t)
+
+	stream, err := c.Subscribe(context.Background(), &grpc.SubscribeRequest{Topic: "orders"})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer stream.Close()
+
+	s.Close()
+	if _, err := stream.Recv(); grpc.CodeOf(err) != grpc.Unavailable {
+		t.Errorf("Recv() error = %v, want Unavailable", err)
+	}
+	if _, err := c.Publish(context.Background(), &grpc.PublishRequest{Topic: "orders"}); grpc.CodeOf(err) != grpc.Unavailable {
+		t.Errorf("Publish() after Close error = %v, want Unavailable", err)
+	}
+}
+
+func TestPublishAfterBrokerClose(t *testing.T) {
+	b, _, c := startServer(t)
+	b.Close()
+
+	if _, err := c.Publish(context.Background(), &grpc.PublishRequest{Topic: "orders"}); grpc.CodeOf(err) != grpc.Unavailable {
+		t.Errorf("Publish() error = %v, want Unavailable", err)
+	}
+	batch := &grpc.PublishBatchRequest{Messages: []*grpc.PublishRequest{{Topic: "orders"}}}
+	if _, err := c.PublishBatch(context.Background(), batch); grpc.CodeOf(err) != grpc.Unavailable {
+		t.Errorf("PublishBatch() error = %v, want Unavailable", err)
+	}
+}
+
+func TestAck(t *testing.T) {
+	b, _, c := startServer(t)
+
+	stream, err := c.Subscribe(context.Background(), &grpc.SubscribeRequest{Topic: "jobs", ManualAck: true, AckWaitMillis: 5000})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer stream.Close()
+
+	jobs, _ := topic.New("jobs")
+	b.Publish(message.NewMessage(jobs, []byte("a")))
+	b.Publish(message.NewMessage(jobs, []byte("b")))
+
+	first := recv(t, stream)
+	second := recv(t, stream)
+	if first.DeliveryAttempt != 1 {
+		t.Errorf("DeliveryAttempt = %d, want 1", first.DeliveryAttempt)
+	}
+
+	acks, err := c.Ack(context.Background())
+	if err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+	requests := []*grpc.AckRequest{
+		{SubscriptionID: stream.ID(), MessageID: first.ID},
+		{SubscriptionID: stream.ID(), MessageID: first.ID}, // already acknowledged
+		{SubscriptionID: "unknown", MessageID: second.ID},
+		{SubscriptionID: stream.ID(), MessageID: second.ID, Kind: grpc.AckKindNack},
+	}
+	for _, req := range requests {
+		if err := acks.Send(req); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	resp, err := acks.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv() error = %v", err)
+	}
+	if resp.Settled != 2 || resp.Failed != 2 {
+		t.Errorf("response = %+v, want 2 settled and 2 failed", resp)
+	}
+
+	// The nacked message is redelivered
+	redelivered := recv(t, stream)
+	if redelivered.ID != second.ID || redelivered.DeliveryAttempt != 2 {
+		t.Errorf("redelivered %s attempt %d, want %s attempt 2", redelivered.ID, redelivered.DeliveryAttempt, second.ID)
+	}
+}
+
+func TestAckByDeliveryID(t *testing.T) {
+	b, _, c := startServer(t)
+
+	stream, err := c.Subscribe(context.Background(), &grpc.SubscribeRequest{Topic: "jobs", ManualAck: true, AckWaitMillis: 5000})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer stream.Close()
+
+	// The same message published twice is two deliveries sharing an ID
+	jobs, _ := topic.New("jobs")
+	msg := message.NewMessage(jobs, []byte("a"))
+	b.Publish(msg)
+	b.Publish(msg)
+
+	first := recv(t, stream)
+	second := recv(t, stream)
+	if first.ID != second.ID || first.DeliveryID == "" || first.DeliveryID == second.DeliveryID {
+		t.Fatalf("deliveries (%s, %q) and (%s, %q), want one ID with distinct delivery IDs", first.ID, first.DeliveryID, second.ID, second.DeliveryID)
+	}
+
+	acks, err := c.Ack(context.Background())
+	if err != nil {
+		t.Fatalf("Ack() error = %v", err)
+	}
+	requests := []*grpc.AckRequest{
+		{SubscriptionID: stream.ID(), DeliveryID: first.DeliveryID},
+		{SubscriptionID: stream.ID(), DeliveryID: second.DeliveryID},
+		{SubscriptionID: stream.ID(), DeliveryID: second.DeliveryID}, // already acknowledged
+		{SubscriptionID: stream.ID(), DeliveryID: "bogus"},
+	}
+	for _, req := range requests {
+		if err := acks.Send(req); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	resp, err := acks.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv() error = %v", err)
+	}
+	if resp.Settled != 2 || resp.Failed != 2 {
+		t.Errorf("response = %+v, want 2 settled and 2 failed", resp)
+	}
+}
+
+func TestSubscribeEncodingFailure(t *testing.T) {
+	b, _, c := startServer(t)
+
+	stream, err := c.Subscribe(context.Background(), &grpc.SubscribeRequest{Topic: "orders"})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer stream.Close()
+
+	orders, _ := topic.New("orders")
+	b.Publish(message.NewMessage(orders, make(chan int)))
+
+	if _, err := stream.Recv(); grpc.CodeOf(err) != grpc.Internal {
+		t.Errorf("Recv() error = %v, want Internal", err)
+	}
+}
+
+func TestRejectsHTTP1(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	hs := httptest.NewServer(grpc.NewServer(b))
+	defer hs.Close()
+
+	resp, err := http.Post(hs.URL+grpc.PublishMethod, "application/grpc", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("Post() error = %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusHTTPVersionNotSupported)
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	addr := serveH2C(t, grpc.NewServer(b))
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+addr+"/"+grpc.ServiceName+"/Missing", strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if got, want := resp.Trailer.Get("Grpc-Status"), "12"; got != want {
+		t.Errorf("grpc-status = %q, want %q", got, want)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	_, _, c := startServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	stream, err := c.Subscribe(ctx, &grpc.SubscribeRequest{Topic: "orders"})
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer stream.Close()
+
+	if _, err := stream.Recv(); grpc.CodeOf(err) != grpc.DeadlineExceeded {
+		t.Errorf("Recv() error = %v, want DeadlineExceeded", err)
+	}
+}
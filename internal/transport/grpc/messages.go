@@ -0,0 +1,363 @@
+package grpc
+
+// The types in this file mirror the messages in api/gophercast/v1/broker.proto and
+// encode themselves to the protobuf wire format, so they also satisfy
+// codec.ProtoMarshaler and codec.ProtoUnmarshaler.
+
+// Message is a delivered message.
+type Message struct {
+	ID                  string
+	Topic               string
+	Payload             []byte
+	ContentType         string
+	PublishedAtUnixNano int64
+	Headers             map[string]string
+	DeliveryAttempt     uint32
+	SubscriptionID      string
+	DeliveryID          string
+}
+
+// Marshal encodes the message.
+func (m *Message) Marshal() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, m.ID)
+	b = appendString(b, 2, m.Topic)
+	b = appendBytes(b, 3, m.Payload)
+	b = appendString(b, 4, m.ContentType)
+	b = appendVarint(b, 5, uint64(m.PublishedAtUnixNano))
+	b = appendMap(b, 6, m.Headers)
+	b = appendVarint(b, 7, uint64(m.DeliveryAttempt))
+	b = appendString(b, 8, m.SubscriptionID)
+	b = appendString(b, 9, m.DeliveryID)
+	return b, nil
+}
+
+// Unmarshal decodes the message.
+func (m *Message) Unmarshal(data []byte) error {
+	*m = Message{}
+	f := &fields{b: data}
+	for fd, ok := f.next(); ok; fd, ok = f.next() {
+		switch fd.number {
+		case 1:
+			if f.expect(fd, wireBytes) {
+				m.ID = string(fd.data)
+			}
+		case 2:
+			if f.expect(fd, wireBytes) {
+				m.Topic = string(fd.data)
+			}
+		case 3:
+			if f.expect(fd, wireBytes) {
+				m.Payload = append([]byte(nil), fd.data...)
+			}
+		case 4:
+			if f.expect(fd, wireBytes) {
+				m.ContentType = string(fd.data)
+			}
+		case 5:
+			if f.expect(fd, wireVarint) {
+				m.PublishedAtUnixNano = int64(fd.varint)
+			}
+		case 6:
+			if f.expect(fd, wireBytes) {
+				if m.Headers == nil {
+					m.Headers = make(map[string]string)
+				}
+				f.err = decodeMapEntry(fd.data, m.Headers)
+			}
+		case 7:
+			if f.expect(fd, wireVarint) {
+				m.DeliveryAttempt = uint32(fd.varint)
+			}
+		case 8:
+			if f.expect(fd, wireBytes) {
+				m.SubscriptionID = string(fd.data)
+			}
+		case 9:
+			if f.expect(fd, wireBytes) {
+				m.DeliveryID = string(fd.data)
+			}
+		}
+	}
+	return f.err
+}
+
+// PublishRequest asks the broker to publish a message.
+type PublishRequest struct {
+	Topic       string
+	Payload     []byte
+	ContentType string
+	Headers     map[string]string
+}
+
+// Marshal encodes the request.
+func (r *PublishRequest) Marshal() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, r.Topic)
+	b = appendBytes(b, 2, r.Payload)
+	b = appendString(b, 3, r.ContentType)
+	b = appendMap(b, 4, r.Headers)
+	return b, nil
+}
+
+// Unmarshal decodes the request.
+func (r *PublishRequest) Unmarshal(data []byte) error {
+	*r = PublishRequest{}
+	f := &fields{b: data}
+	for fd, ok := f.next(); ok; fd, ok = f.next() {
+		switch fd.number {
+		case 1:
+			if f.expect(fd, wireBytes) {
+				r.Topic = string(fd.data)
+			}
+		case 2:
+			if f.expect(fd, wireBytes) {
+				r.Payload = append([]byte(nil), fd.data...)
+			}
+		case 3:
+			if f.expect(fd, wireBytes) {
+				r.ContentType = string(fd.data)
+			}
+		case 4:
+			if f.expect(fd, wireBytes) {
+				if r.Headers == nil {
+					r.Headers = make(map[string]string)
+				}
+				f.err = decodeMapEntry(fd.data, r.Headers)
+			}
+		}
+	}
+	return f.err
+}
+
+// PublishResponse carries the ID of a published message.
+type PublishResponse struct {
+	ID string
+}
+
+// Marshal encodes the response.
+func (r *PublishResponse) Marshal() ([]byte, error) {
+	return appendString(nil, 1, r.ID), nil
+}
+
+// Unmarshal decodes the response.
+func (r *PublishResponse) Unmarshal(data []byte) error {
+	*r = PublishResponse{}
+	f := &fields{b: data}
+	for fd, ok := f.next(); ok; fd, ok = f.next() {
+		if fd.number == 1 && f.expect(fd, wireBytes) {
+			r.ID = string(fd.data)
+		}
+	}
+	return f.err
+}
+
+// PublishBatchRequest asks the broker to publish several messages.
+type PublishBatchRequest struct {
+	Messages []*PublishRequest
+}
+
+// Marshal encodes the request.
+func (r *PublishBatchRequest) Marshal() ([]byte, error) {
+	var b []byte
+	for _, m := range r.Messages {
+		encoded, err := m.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = appendEmbedded(b, 1, encoded)
+	}
+	return b, nil
+}
+
+// Unmarshal decodes the request.
+func (r *PublishBatchRequest) Unmarshal(data []byte) error {
+	*r = PublishBatchRequest{}
+	f := &fields{b: data}
+	for fd, ok := f.next(); ok; fd, ok = f.next() {
+		if fd.number == 1 && f.expect(fd, wireBytes) {
+			m := &PublishRequest{}
+			f.err = m.Unmarshal(fd.data)
+			r.Messages = append(r.Messages, m)
+		}
+	}
+	return f.err
+}
+
+// PublishBatchResponse carries the IDs of published messages, in request order.
+type PublishBatchResponse struct {
+	IDs []string
+}
+
+// Marshal encodes the response.
+func (r *PublishBatchResponse) Marshal() ([]byte, error) {
+	var b []byte
+	for _, id := range r.IDs {
+		b = appendEmbedded(b, 1, []byte(id))
+	}
+	return b, nil
+}
+
+// Unmarshal decodes the response.
+func (r *PublishBatchResponse) Unmarshal(data []byte) error {
+	*r = PublishBatchResponse{}
+	f := &fields{b: data}
+	for fd, ok := f.next(); ok; fd, ok = f.next() {
+		if fd.number == 1 && f.expect(fd, wireBytes) {
+			r.IDs = append(r.IDs, string(fd.data))
+		}
+	}
+	return f.err
+}
+
+// SubscribeRequest opens a subscription.
+type SubscribeRequest struct {
+	Topic         string
+	Group         string
+	ManualAck     bool
+	AckWaitMillis int64
+	BufferSize    uint32
+}
+
+// Marshal encodes the request.
+func (r *SubscribeRequest) Marshal() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, r.Topic)
+	b = appendString(b, 2, r.Group)
+	b = appendBool(b, 3, r.ManualAck)
+	b = appendVarint(b, 4, uint64(r.AckWaitMillis))
+	b = appendVarint(b, 5, uint64(r.BufferSize))
+	return b, nil
+}
+
+// Unmarshal decodes the request.
+func (r *SubscribeRequest) Unmarshal(data []byte) error {
+	*r = SubscribeRequest{}
+	f := &fields{b: data}
+	for fd, ok := f.next(); ok; fd, ok = f.next() {
+		switch fd.number {
+		case 1:
+			if f.expect(fd, wireBytes) {
+				r.Topic = string(fd.data)
+			}
+		case 2:
+			if f.expect(fd, wireBytes) {
+				r.Group = string(fd.data)
+			}
+		case 3:
+			if f.expect(fd, wireVarint) {
+				r.ManualAck = fd.varint != 0
+			}
+		case 4:
+			if f.expect(fd, wireVarint) {
+				r.AckWaitMillis = int64(fd.varint)
+			}
+		case 5:
+			if f.expect(fd, wireVarint) {
+				r.BufferSize = uint32(fd.varint)
+			}
+		}
+	}
+	return f.err
+}
+
+// AckKind says how an AckRequest settles a message.
+type AckKind int32
+
+// Ways to settle a message.
+const (
+	AckKindAck        AckKind = 0
+	AckKindNack       AckKind = 1
+	AckKindInProgress AckKind = 2
+	AckKindReject     AckKind = 3
+)
+
+// AckRequest settles a message delivered with manual acknowledgement.
+type AckRequest struct {
+	SubscriptionID  string
+	MessageID       string
+	Kind            AckKind
+	NackDelayMillis int64
+	Reason          string
+	DeliveryID      string
+}
+
+// Marshal encodes the request.
+func (r *AckRequest) Marshal() ([]byte, error) {
+	var b []byte
+	b = appendString(b, 1, r.SubscriptionID)
+	b = appendString(b, 2, r.MessageID)
+	b = appendVarint(b, 3, uint64(r.Kind))
+	b = appendVarint(b, 4, uint64(r.NackDelayMillis))
+	b = appendString(b, 5, r.Reason)
+	b = appendString(b, 6, r.DeliveryID)
+	return b, nil
+}
+
+// Unmarshal decodes the request.
+func (r *AckRequest) Unmarshal(data []byte) error {
+	*r = AckRequest{}
+	f := &fields{b: data}
+	for fd, ok := f.next(); ok; fd, ok = f.next() {
+		switch fd.number {
+		case 1:
+			if f.expect(fd, wireBytes) {
+				r.SubscriptionID = string(fd.data)
+			}
+		case 2:
+			if f.expect(fd, wireBytes) {
+				r.MessageID = string(fd.data)
+			}
+		case 3:
+			if f.expect(fd, wireVarint) {
+				r.Kind = AckKind(fd.varint)
+			}
+		case 4:
+			if f.expect(fd, wireVarint) {
+				r.NackDelayMillis = int64(fd.varint)
+			}
+		case 5:
+			if f.expect(fd, wireBytes) {
+				r.Reason = string(fd.data)
+			}
+		case 6:
+			if f.expect(fd, wireBytes) {
+				r.DeliveryID = string(fd.data)
+			}
+		}
+	}
+	return f.err
+}
+
+// AckResponse summarizes an Ack call.
+type AckResponse struct {
+	Settled uint32
+	Failed  uint32
+}
+
+// Marshal encodes the response.
+func (r *AckResponse) Marshal() ([]byte, error) {
+	var b []byte
+	b = appendVarint(b, 1, uint64(r.Settled))
+	b = appendVarint(b, 2, uint64(r.Failed))
+	return b, nil
+}
+
+// Unmarshal decodes the response.
+func (r *AckResponse) Unmarshal(data []byte) error {
+	*r = AckResponse{}
+	f := &fields{b: data}
+	for fd, ok := f.next(); ok; fd, ok = f.next() {
+		switch fd.number {
+		case 1:
+			if f.expect(fd, wireVarint) {
+				r.Settled = uint32(fd.varint)
+			}
+		case 2:
+			if f.expect(fd, wireVarint) {
+				r.Failed = uint32(fd.varint)
+			}
+		}
+	}
+	return f.err
+}
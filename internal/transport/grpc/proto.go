@@ -0,0 +1,180 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// errTruncated is returned when a protobuf message ends in the middle of a field.
+var errTruncated = errors.New("grpc: truncated protobuf message")
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendVarint appends a varint field. Zero values are omitted, as in proto3.
+func appendVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(b, field, 1)
+}
+
+// appendBytes appends a length-delimited field. Empty values are omitted.
+func appendBytes(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	return appendEmbedded(b, field, v)
+}
+
+func appendString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendEmbedded appends a length-delimited field even when it is empty, as repeated
+// fields and embedded messages require.
+func appendEmbedded(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendMap appends a map<string, string> field as repeated entries with the key in
+// field 1 and the value in field 2. Keys are sorted so the encoding is deterministic.
+func appendMap(b []byte, field int, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, m[k])
+		b = appendEmbedded(b, field, entry)
+	}
+	return b
+}
+
+// field is one decoded field of a protobuf message.
+type field struct {
+	number   int
+	wireType int
+	varint   uint64 // for wireVarint
+	data     []byte // for wireBytes
+}
+
+// fields iterates over the fields of an encoded protobuf message.
+type fields struct {
+	b   []byte
+	err error
+}
+
+// next decodes the next field. It returns false at the end of the message or on error.
+func (f *fields) next() (field, bool) {
+	if f.err != nil || len(f.b) == 0 {
+		return field{}, false
+	}
+
+	tag, n := binary.Uvarint(f.b)
+	if n <= 0 {
+		f.err = errTruncated
+		return field{}, false
+	}
+	f.b = f.b[n:]
+
+	fd := field{number: int(tag >> 3), wireType: int(tag & 7)}
+	if fd.number <= 0 {
+		f.err = fmt.Errorf("grpc: invalid protobuf field number %d", fd.number)
+		return field{}, false
+	}
+
+	switch fd.wireType {
+	case wireVarint:
+		v, n := binary.Uvarint(f.b)
+		if n <= 0 {
+			f.err = errTruncated
+			return field{}, false
+		}
+		fd.varint = v
+		f.b = f.b[n:]
+	case wireBytes:
+		length, n := binary.Uvarint(f.b)
+		if n <= 0 || length > uint64(len(f.b)-n) {
+			f.err = errTruncated
+			return field{}, false
+		}
+		fd.data = f.b[n : n+int(length)]
+		f.b = f.b[n+int(length):]
+	case wireFixed64:
+		if len(f.b) < 8 {
+			f.err = errTruncated
+			return field{}, false
+		}
+		f.b = f.b[8:]
+	case wireFixed32:
+		if len(f.b) < 4 {
+			f.err = errTruncated
+			return field{}, false
+		}
+		f.b = f.b[4:]
+	default:
+		f.err = fmt.Errorf("grpc: unsupported protobuf wire type %d", fd.wireType)
+		return field{}, false
+	}
+	return fd, true
+}
+
+// expect reports an error if the field does not have the wire type its number requires.
+func (f *fields) expect(fd field, wireType int) bool {
+	if fd.wireType != wireType {
+		f.err = fmt.Errorf("grpc: protobuf field %d has wire type %d, want %d", fd.number, fd.wireType, wireType)
+		return false
+	}
+	return true
+}
+
+// decodeMapEntry decodes a map<string, string> entry into m.
+func decodeMapEntry(data []byte, m map[string]string) error {
+	var key, value string
+	f := &fields{b: data}
+	for fd, ok := f.next(); ok; fd, ok = f.next() {
+		switch fd.number {
+		case 1:
+			if f.expect(fd, wireBytes) {
+				key = string(fd.data)
+			}
+		case 2:
+			if f.expect(fd, wireBytes) {
+				value = string(fd.data)
+			}
+		}
+	}
+	if f.err != nil {
+		return f.err
+	}
+	m[key] = value
+	return nil
+}
@@ -0,0 +1,567 @@
+// Package grpc serves a broker as the gRPC service defined in
+// api/gophercast/v1/broker.proto, so teams can generate typed clients for any
+// language gRPC supports.
+//
+// The Server is an http.Handler speaking the gRPC protocol over HTTP/2; serve it
+// with an http.Server that enables unencrypted HTTP/2 or TLS. Only the protobuf
+// encoding is supported, and compressed messages are rejected. Request metadata
+// named x-message-<key> becomes the message header <key> on published messages.
+//
+// The package needs no generated code: the request and response types encode
+// themselves, and Client is a small client for Go programs and tests.
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/codec"
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// ServiceName is the fully qualified name of the Broker service.
+const ServiceName = "gophercast.v1.Broker"
+
+// Method paths, as used in the request URL.
+const (
+	PublishMethod      = "/" + ServiceName + "/Publish"
+	PublishBatchMethod = "/" + ServiceName + "/PublishBatch"
+	SubscribeMethod    = "/" + ServiceName + "/Subscribe"
+	AckMethod          = "/" + ServiceName + "/Ack"
+)
+
+const (
+	// DefaultAddr is the address the gRPC listener uses by default.
+	DefaultAddr = ":9090"
+
+	// DefaultMaxMessageSize is the largest request message accepted by default.
+	DefaultMaxMessageSize = 4 << 20
+
+	// DefaultWriteTimeout is how long writing a streamed message may take before the
+	// subscriber is considered dead.
+	DefaultWriteTimeout = 10 * time.Second
+
+	// MetadataPrefix marks request metadata that is copied to published messages,
+	// without the prefix.
+	MetadataPrefix = "x-message-"
+
+	// SubscriptionHeader is the response header carrying the subscription ID of a
+	// Subscribe call.
+	SubscriptionHeader = "gophercast-subscription-id"
+)
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithMaxMessageSize sets the largest request message the server accepts.
+func WithMaxMessageSize(n int) Option {
+	return func(s *Server) {
+		s.maxMessageSize = n
+	}
+}
+
+// WithWriteTimeout sets how long writing a streamed message may take.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithSubscriptionOptions sets options applied to every subscription the server
+// creates, before the options selected by the SubscribeRequest.
+func WithSubscriptionOptions(opts ...subscription.Option) Option {
+	return func(s *Server) {
+		s.subOptions = opts
+	}
+}
+
+// Server is an http.Handler that serves the Broker service.
+type Server struct {
+	broker         *broker.Broker
+	maxMessageSize int
+	writeTimeout   time.Duration
+	subOptions     []subscription.Option
+
+	mu      sync.Mutex
+	streams map[string]*stream // subscription ID -> Subscribe call
+	closed  bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// stream is the state of a Subscribe call.
+type stream struct {
+	sub *subscription.Subscription
+
+	mu             sync.Mutex
+	lastDeliveryID uint64
+	pending        map[uint64]message.Message      // delivery ID -> delivery awaiting acknowledgement
+	latest         map[message.Acknowledger]uint64 // queued copy -> ID of its latest delivery
+}
+
+// track records a delivery awaiting acknowledgement and returns its delivery ID. A
+// redelivery replaces the earlier delivery of the same copy, which can no longer be
+// settled.
+func (st *stream) track(msg message.Message) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if id, ok := st.latest[msg.Acknowledger()]; ok {
+		delete(st.pending, id)
+	}
+	st.lastDeliveryID++
+	st.pending[st.lastDeliveryID] = msg
+	st.latest[msg.Acknowledger()] = st.lastDeliveryID
+	return strconv.FormatUint(st.lastDeliveryID, 10)
+}
+
+// lookup finds the delivery an AckRequest names: by delivery ID if it has one,
+// otherwise the latest pending delivery of its message ID.
+func (st *stream) lookup(req *AckRequest) (uint64, message.Message, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if req.DeliveryID != "" {
+		id, err := strconv.ParseUint(req.DeliveryID, 10, 64)
+		if err != nil {
+			return 0, message.Message{}, false
+		}
+		msg, ok := st.pending[id]
+		return id, msg, ok
+	}
+
+	var found uint64
+	for id, msg := range st.pending {
+		if msg.ID() == req.MessageID && id > found {
+			found = id
+		}
+	}
+	msg, ok := st.pending[found]
+	return found, msg, ok
+}
+
+// forget removes a delivery that can no longer be settled.
+func (st *stream) forget(id uint64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.forgetLocked(id)
+}
+
+func (st *stream) forgetLocked(id uint64) {
+	msg, ok := st.pending[id]
+	if !ok {
+		return
+	}
+	delete(st.pending, id)
+	if st.latest[msg.Acknowledger()] == id {
+		delete(st.latest, msg.Acknowledger())
+	}
+}
+
+// dropped is the subscription's drop handler. It forgets the delivery of a message
+// the subscription gave up on, such as one that reached the maximum number of
+// deliveries; the dropped message is the last attempt delivered.
+func (st *stream) dropped(msg message.Message, _ error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for id, pending := range st.pending {
+		if pending.ID() == msg.ID() && pending.DeliveryAttempt() == msg.DeliveryAttempt() {
+			st.forgetLocked(id)
+			return
+		}
+	}
+}
+
+// NewServer creates a server for the broker.
+func NewServer(b *broker.Broker, opts ...Option) *Server {
+	s := &Server{
+		broker:         b,
+		maxMessageSize: DefaultMaxMessageSize,
+		writeTimeout:   DefaultWriteTimeout,
+		streams:        make(map[string]*stream),
+		done:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ServeHTTP handles a gRPC call.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "gRPC calls must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isGRPCContentType(r.Header.Get("Content-Type")) {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	ctx := r.Context()
+	if value := r.Header.Get("Grpc-Timeout"); value != "" {
+		timeout, ok := parseTimeout(value)
+		if !ok {
+			s.finish(w, statusf(InvalidArgument, "malformed grpc-timeout %q", value))
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	r = r.WithContext(ctx)
+
+	w.Header().Set("Content-Type", "application/grpc")
+
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		s.finish(w, statusf(Unavailable, "server closed"))
+		return
+	}
+
+	var err error
+	switch r.URL.Path {
+	case PublishMethod:
+		err = s.publish(w, r)
+	case PublishBatchMethod:
+		err = s.publishBatch(w, r)
+	case SubscribeMethod:
+		err = s.subscribe(w, r)
+	case AckMethod:
+		err = s.ack(w, r)
+	default:
+		err = statusf(Unimplemented, "unknown method %s", r.URL.Path)
+	}
+	s.finish(w, err)
+}
+
+// finish writes the call's status as trailers.
+func (s *Server) finish(w http.ResponseWriter, err error) {
+	code := CodeOf(err)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.FormatUint(uint64(code), 10))
+	if err != nil {
+		message := err.Error()
+		var st *Status
+		if errors.As(err, &st) {
+			message = st.Message
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeStatusMessage(message))
+	}
+}
+
+// readRequest reads the only message of a unary or server-streaming call.
+func (s *Server) readRequest(r *http.Request, req unmarshaler) error {
+	data, err := readFrame(r.Body, s.maxMessageSize)
+	if errors.Is(err, io.EOF) {
+		return statusf(InvalidArgument, "missing request message")
+	}
+	if err != nil {
+		return requestError(err)
+	}
+	if _, err := readFrame(r.Body, s.maxMessageSize); !errors.Is(err, io.EOF) {
+		return statusf(InvalidArgument, "expected a single request message")
+	}
+	if err := req.Unmarshal(data); err != nil {
+		return statusf(InvalidArgument, "%v", err)
+	}
+	return nil
+}
+
+// requestError converts an error reading the request body to a status.
+func requestError(err error) error {
+	var st *Status
+	if errors.As(err, &st) {
+		return st
+	}
+	return statusf(Internal, "reading request: %v", err)
+}
+
+// publish handles Publish.
+func (s *Server) publish(w http.ResponseWriter, r *http.Request) error {
+	var req PublishRequest
+	if err := s.readRequest(r, &req); err != nil {
+		return err
+	}
+	msg, err := newMessage(&req, metadataHeaders(r.Header))
+	if err != nil {
+		return statusf(InvalidArgument, "%v", err)
+	}
+	if _, err := s.broker.PublishContext(r.Context(), msg); err != nil {
+		return publishError(err)
+	}
+	return writeMessage(w, &PublishResponse{ID: msg.ID()})
+}
+
+// publishBatch handles PublishBatch. Every message is built before the first is
+// published, so an invalid message fails the call without publishing anything. If the
+// broker closes part way through, the call fails after publishing the messages before.
+func (s *Server) publishBatch(w http.ResponseWriter, r *http.Request) error {
+	var req PublishBatchRequest
+	if err := s.readRequest(r, &req); err != nil {
+		return err
+	}
+	headers := metadataHeaders(r.Header)
+	msgs := make([]message.Message, 0, len(req.Messages))
+	for i, m := range req.Messages {
+		msg, err := newMessage(m, headers)
+		if err != nil {
+			return statusf(InvalidArgument, "message %d: %v", i, err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	resp := &PublishBatchResponse{IDs: make([]string, 0, len(msgs))}
+	for _, msg := range msgs {
+		if _, err := s.broker.PublishContext(r.Context(), msg); err != nil {
+			return publishError(err)
+		}
+		resp.IDs = append(resp.IDs, msg.ID())
+	}
+	return writeMessage(w, resp)
+}
+
+// publishError converts an error from Broker.PublishContext to a status. Context
+// errors are returned as they are.
+func publishError(err error) error {
+	switch {
+	case errors.Is(err, subscription.ErrExpired):
+		return statusf(InvalidArgument, "%v", err)
+	case errors.Is(err, broker.ErrBrokerClosed):
+		return statusf(Unavailable, "%v", err)
+	default:
+		return err
+	}
+}
+
+// newMessage builds the message a PublishRequest asks for. Payloads in a format with
+// a registered codec are decoded so in-process subscribers receive structured data,
+// as with the HTTP gateway.
+func newMessage(req *PublishRequest, metadata map[string]string) (message.Message, error) {
+	t, err := topic.New(req.Topic)
+	if err != nil {
+		return message.Message{}, err
+	}
+
+	var data interface{} = req.Payload
+	if c, err := codec.Lookup(req.ContentType); err == nil && req.ContentType != "" {
+		if err := c.Unmarshal(req.Payload, &data); err != nil {
+			return message.Message{}, fmt.Errorf("invalid payload: %w", err)
+		}
+	}
+
+	opts := []message.Option{message.WithHeaders(metadata), message.WithHeaders(req.Headers)}
+	if req.ContentType != "" {
+		opts = append(opts, message.WithContentType(req.ContentType))
+	}
+	return message.NewMessage(t, data, opts...), nil
+}
+
+// metadataHeaders collects the x-message-* request metadata.
+func metadataHeaders(h http.Header) map[string]string {
+	headers := make(map[string]string)
+	for key, values := range h {
+		if len(values) == 0 || len(key) <= len(MetadataPrefix) || !strings.EqualFold(key[:len(MetadataPrefix)], MetadataPrefix) {
+			continue
+		}
+		headers[strings.ToLower(key[len(MetadataPrefix):])] = values[0]
+	}
+	return headers
+}
+
+// subscribe handles Subscribe. Messages are streamed until the client cancels the
+// call, the subscription is closed or the server is closed.
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) error {
+	var req SubscribeRequest
+	if err := s.readRequest(r, &req); err != nil {
+		return err
+	}
+	t, err := topic.NewPattern(req.Topic)
+	if err != nil {
+		return statusf(InvalidArgument, "%v", err)
+	}
+
+	st := &stream{
+		pending: make(map[uint64]message.Message),
+		latest:  make(map[message.Acknowledger]uint64),
+	}
+	opts := append([]subscription.Option(nil), s.subOptions...)
+	if req.Group != "" {
+		opts = append(opts, subscription.WithGroup(req.Group))
+	}
+	if req.ManualAck {
+		opts = append(opts, subscription.WithManualAck(), subscription.WithDropHandler(st.dropped))
+		if req.AckWaitMillis > 0 {
+			opts = append(opts, subscription.WithAckWait(time.Duration(req.AckWaitMillis)*time.Millisecond))
+		}
+	}
+	if req.BufferSize > 0 {
+		opts = append(opts, subscription.WithBufferSize(int(req.BufferSize)))
+	}
+
+	st.sub = s.broker.Subscribe(t, opts...)
+	s.mu.Lock()
+	s.streams[st.sub.ID()] = st
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.streams, st.sub.ID())
+		s.mu.Unlock()
+		s.broker.Unsubscribe(st.sub.ID())
+	}()
+
+	// Send the response headers now, so the client knows the subscription is active
+	rc := http.NewResponseController(w)
+	w.Header().Set(SubscriptionHeader, st.sub.ID())
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case msg, ok := <-st.sub.MessageChannel():
+			if !ok {
+				return statusf(Unavailable, "subscription closed")
+			}
+			if err := s.send(w, rc, st, msg); err != nil {
+				return err
+			}
+		case <-st.sub.Done():
+			return statusf(Unavailable, "subscription closed")
+		case <-s.done:
+			return statusf(Unavailable, "server closed")
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+// send streams one message to a subscriber. A message whose payload cannot be encoded
+// is rejected with manual acknowledgement; otherwise it ends the call with Internal,
+// since the stream has no other way to tell the client a message was lost.
+func (s *Server) send(w http.ResponseWriter, rc *http.ResponseController, st *stream, msg message.Message) error {
+	payload, contentType, err := message.EncodePayload(msg)
+	if err != nil {
+		if msg.DeliveryAttempt() > 0 {
+			msg.Reject(err)
+			return nil
+		}
+		return statusf(Internal, "encoding message %s: %v", msg.ID(), err)
+	}
+
+	var deliveryID string
+	if st.sub.ManualAck() {
+		deliveryID = st.track(msg)
+	}
+
+	rc.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	err = writeMessage(w, &Message{
+		ID:                  msg.ID(),
+		Topic:               msg.Topic().String(),
+		Payload:             payload,
+		ContentType:         contentType,
+		PublishedAtUnixNano: msg.PublishedAt().UnixNano(),
+		Headers:             msg.Headers(),
+		DeliveryAttempt:     uint32(msg.DeliveryAttempt()),
+		SubscriptionID:      st.sub.ID(),
+		DeliveryID:          deliveryID,
+	})
+	if err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// ack handles Ack, settling messages until the client closes its side of the stream.
+func (s *Server) ack(w http.ResponseWriter, r *http.Request) error {
+	var resp AckResponse
+	for {
+		data, err := readFrame(r.Body, s.maxMessageSize)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return requestError(err)
+		}
+		var req AckRequest
+		if err := req.Unmarshal(data); err != nil {
+			return statusf(InvalidArgument, "%v", err)
+		}
+		if s.settle(&req) == nil {
+			resp.Settled++
+		} else {
+			resp.Failed++
+		}
+	}
+	return writeMessage(w, &resp)
+}
+
+// settle applies an AckRequest to the delivery it names.
+func (s *Server) settle(req *AckRequest) error {
+	s.mu.Lock()
+	st, ok := s.streams[req.SubscriptionID]
+	s.mu.Unlock()
+	if !ok {
+		return statusf(NotFound, "unknown subscription %q", req.SubscriptionID)
+	}
+
+	// Settle without holding the stream's lock: rejecting calls its drop handler
+	id, msg, ok := st.lookup(req)
+	if !ok {
+		return subscription.ErrNotPending
+	}
+
+	var err error
+	switch req.Kind {
+	case AckKindAck:
+		err = msg.Ack()
+	case AckKindNack:
+		err = msg.Nack(time.Duration(req.NackDelayMillis) * time.Millisecond)
+	case AckKindInProgress:
+		err = msg.InProgress()
+	case AckKindReject:
+		var reason error
+		if req.Reason != "" {
+			reason = errors.New(req.Reason)
+		}
+		err = msg.Reject(reason)
+	default:
+		return statusf(InvalidArgument, "unknown ack kind %d", req.Kind)
+	}
+
+	// Forget the delivery once it can no longer be settled; a redelivery replaces it
+	if err != nil || req.Kind == AckKindAck || req.Kind == AckKindReject {
+		st.forget(id)
+	}
+	return err
+}
+
+// Close ends every Subscribe call and makes the server refuse new calls with
+// Unavailable. It does not close the broker.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		close(s.done)
+	})
+}
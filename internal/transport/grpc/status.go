@@ -0,0 +1,131 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Code is a gRPC status code.
+type Code uint32
+
+// Status codes used by the service. The values are fixed by the gRPC protocol.
+const (
+	OK                Code = 0
+	Canceled          Code = 1
+	Unknown           Code = 2
+	InvalidArgument   Code = 3
+	DeadlineExceeded  Code = 4
+	NotFound          Code = 5
+	ResourceExhausted Code = 8
+	Unimplemented     Code = 12
+	Internal          Code = 13
+	Unavailable       Code = 14
+)
+
+// String returns the code name as used in the gRPC specification.
+func (c Code) String() string {
+	switch c {
+	case OK:
+		return "OK"
+	case Canceled:
+		return "CANCELLED"
+	case Unknown:
+		return "UNKNOWN"
+	case InvalidArgument:
+		return "INVALID_ARGUMENT"
+	case DeadlineExceeded:
+		return "DEADLINE_EXCEEDED"
+	case NotFound:
+		return "NOT_FOUND"
+	case ResourceExhausted:
+		return "RESOURCE_EXHAUSTED"
+	case Unimplemented:
+		return "UNIMPLEMENTED"
+	case Internal:
+		return "INTERNAL"
+	case Unavailable:
+		return "UNAVAILABLE"
+	default:
+		return fmt.Sprintf("CODE(%d)", uint32(c))
+	}
+}
+
+// Status is the error returned for a call that ended with a non-OK status.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+// Error returns the code and message.
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc: %s: %s", s.Code, s.Message)
+}
+
+func statusf(code Code, format string, args ...interface{}) *Status {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// CodeOf returns the status code carried by err: OK for nil, the code of a *Status,
+// DeadlineExceeded or Canceled for context errors, and Unknown for any other error.
+func CodeOf(err error) Code {
+	var s *Status
+	switch {
+	case err == nil:
+		return OK
+	case errors.As(err, &s):
+		return s.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return Canceled
+	default:
+		return Unknown
+	}
+}
+
+// encodeStatusMessage percent-encodes a status message for the grpc-message trailer.
+func encodeStatusMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// decodeStatusMessage reverses encodeStatusMessage. Malformed escapes are kept as is.
+func decodeStatusMessage(msg string) string {
+	if !strings.Contains(msg, "%") {
+		return msg
+	}
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			if hi, lo := unhex(msg[i+1]), unhex(msg[i+2]); hi >= 0 && lo >= 0 {
+				b.WriteByte(byte(hi<<4 | lo))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(msg[i])
+	}
+	return b.String()
+}
+
+func unhex(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c - 'a' + 10)
+	case 'A' <= c && c <= 'F':
+		return int(c - 'A' + 10)
+	}
+	return -1
+}
@@ -0,0 +1,281 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClientClosed is returned by Client methods after the connection ends.
+var ErrClientClosed = errors.New("mqtt: client closed")
+
+// ClientOptions configures a Client's CONNECT packet.
+type ClientOptions struct {
+	ClientID     string
+	CleanSession bool
+	KeepAlive    time.Duration // sent to the server; the client does not ping on its own
+	Will         *Message
+	Username     string
+	Password     []byte
+	Timeout      time.Duration // how long to wait for each answer; zero means 10 seconds
+}
+
+// Client is a minimal MQTT 3.1.1 client, enough to exercise the server from Go tests
+// and tools. It supports QoS 0 and 1 and acknowledges incoming messages as soon as
+// they are read from the connection.
+type Client struct {
+	netConn        net.Conn
+	timeout        time.Duration
+	sessionPresent bool
+	messages       chan Message
+	done           chan struct{}
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan packet // packet ID -> waiting request
+	pings   []chan struct{}
+	nextID  uint16
+}
+
+// Connect dials an MQTT server and completes the CONNECT handshake.
+func Connect(addr string, opts ClientOptions) (*Client, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	netConn, err := net.DialTimeout("tcp", addr, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		netConn:  netConn,
+		timeout:  opts.Timeout,
+		messages: make(chan Message, 256),
+		done:     make(chan struct{}),
+		pending:  make(map[uint16]chan packet),
+	}
+
+	err = c.write(packet{kind: typeConnect, connect: &connectFields{
+		clientID:     opts.ClientID,
+		cleanSession: opts.CleanSession,
+		keepAlive:    uint16(opts.KeepAlive / time.Second),
+		will:         opts.Will,
+		username:     opts.Username,
+		password:     opts.Password,
+	}})
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(netConn)
+	netConn.SetReadDeadline(time.Now().Add(opts.Timeout))
+	p, err := readPacket(reader, maxRemainingLength)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if p.kind != typeConnack {
+		netConn.Close()
+		return nil, fmt.Errorf("%w: expected CONNACK, got packet type %d", ErrMalformedPacket, p.kind)
+	}
+	if p.returnCode != ConnectAccepted {
+		netConn.Close()
+		return nil, fmt.Errorf("mqtt: connection refused with return code %d", p.returnCode)
+	}
+	netConn.SetReadDeadline(time.Time{})
+
+	c.sessionPresent = p.sessionPresent
+	go c.read(reader)
+	return c, nil
+}
+
+// SessionPresent reports whether the server resumed a previous session.
+func (c *Client) SessionPresent() bool {
+	return c.sessionPresent
+}
+
+// Messages returns the channel of received messages. It is closed when the
+// connection ends.
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// Publish sends a message. At QoS 1 it waits for the server's PUBACK.
+func (c *Client) Publish(m Message) error {
+	if m.QoS > 1 {
+		return errors.New("mqtt: QoS 2 is not supported")
+	}
+	if m.QoS == 0 {
+		return c.write(packet{kind: typePublish, message: m})
+	}
+	_, err := c.request(packet{kind: typePublish, message: m})
+	return err
+}
+
+// Subscribe subscribes to a topic filter and returns the QoS granted by the server,
+// or SubscribeFailure if the filter was refused.
+func (c *Client) Subscribe(filter string, qos byte) (byte, error) {
+	ack, err := c.request(packet{kind: typeSubscribe, filters: []string{filter}, codes: []byte{qos}})
+	if err != nil {
+		return 0, err
+	}
+	if len(ack.codes) != 1 {
+		return 0, fmt.Errorf("%w: SUBACK has %d return codes", ErrMalformedPacket, len(ack.codes))
+	}
+	return ack.codes[0], nil
+}
+
+// Unsubscribe cancels a subscription to a topic filter.
+func (c *Client) Unsubscribe(filter string) error {
+	_, err := c.request(packet{kind: typeUnsubscribe, filters: []string{filter}})
+	return err
+}
+
+// Ping sends PINGREQ and waits for PINGRESP.
+func (c *Client) Ping() error {
+	answered := make(chan struct{})
+	c.mu.Lock()
+	c.pings = append(c.pings, answered)
+	c.mu.Unlock()
+
+	if err := c.write(packet{kind: typePingreq}); err != nil {
+		return err
+	}
+	return c.wait(answered)
+}
+
+// Disconnect sends DISCONNECT, so the server discards the will, and closes the
+// connection.
+func (c *Client) Disconnect() error {
+	err := c.write(packet{kind: typeDisconnect})
+	c.netConn.Close()
+	return err
+}
+
+// Close closes the connection without DISCONNECT, as if the network failed.
+func (c *Client) Close() error {
+	return c.netConn.Close()
+}
+
+// request sends a packet that needs a packet ID and waits for the answer with the
+// same ID.
+func (c *Client) request(p packet) (packet, error) {
+	answer := make(chan packet, 1)
+
+	c.mu.Lock()
+	for {
+		c.nextID++
+		if _, used := c.pending[c.nextID]; c.nextID != 0 && !used {
+			break
+		}
+	}
+	p.id = c.nextID
+	c.pending[p.id] = answer
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, p.id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(p); err != nil {
+		return packet{}, err
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case ack := <-answer:
+		return ack, nil
+	case <-c.done:
+		return packet{}, ErrClientClosed
+	case <-timer.C:
+		return packet{}, fmt.Errorf("mqtt: no answer to packet %d within %s", p.id, c.timeout)
+	}
+}
+
+// wait waits for a signal, the end of the connection, or the timeout.
+func (c *Client) wait(signal <-chan struct{}) error {
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case <-signal:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	case <-timer.C:
+		return fmt.Errorf("mqtt: no answer within %s", c.timeout)
+	}
+}
+
+// read dispatches packets from the server until the connection ends.
+func (c *Client) read(reader *bufio.Reader) {
+	defer close(c.messages)
+	defer close(c.done)
+	defer c.netConn.Close()
+
+	for {
+		p, err := readPacket(reader, maxRemainingLength)
+		if err != nil {
+			return
+		}
+
+		switch p.kind {
+		case typePublish:
+			if p.message.QoS == 1 {
+				if err := c.write(packet{kind: typePuback, id: p.id}); err != nil {
+					return
+				}
+			}
+			c.messages <- p.message
+
+		case typePuback, typeSuback, typeUnsuback:
+			c.mu.Lock()
+			answer, ok := c.pending[p.id]
+			c.mu.Unlock()
+			if ok {
+				answer <- p
+			}
+
+		case typePingresp:
+			c.mu.Lock()
+			if len(c.pings) > 0 {
+				close(c.pings[0])
+				c.pings = c.pings[1:]
+			}
+			c.mu.Unlock()
+
+		default:
+			return
+		}
+	}
+}
+
+// write sends a packet to the server.
+func (c *Client) write(p packet) error {
+	buf, err := appendPacket(nil, p)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.netConn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if _, err := c.netConn.Write(buf); err != nil {
+		select {
+		case <-c.done:
+			return ErrClientClosed
+		default:
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,476 @@
+package mqtt_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/mqtt"
+)
+
+// startServer serves a new broker over MQTT on a loopback port.
+func startServer(t *testing.T, opts ...mqtt.Option) (*broker.Broker, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	b := broker.NewBroker()
+	s := mqtt.NewServer(b, opts...)
+	go s.Serve(l)
+
+	t.Cleanup(func() {
+		s.Close()
+		b.Close()
+	})
+	return b, l.Addr().String()
+}
+
+func connect(t *testing.T, addr string, opts mqtt.ClientOptions) *mqtt.Client {
+	t.Helper()
+
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Second
+	}
+	c, err := mqtt.Connect(addr, opts)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func subscribe(t *testing.T, c *mqtt.Client, filter string, qos byte) {
+	t.Helper()
+
+	granted, err := c.Subscribe(filter, qos)
+	if err != nil {
+		t.Fatalf("Subscribe(%q) error = %v", filter, err)
+	}
+	if granted == mqtt.SubscribeFailure {
+		t.Fatalf("Subscribe(%q) was refused", filter)
+	}
+}
+
+func publish(t *testing.T, c *mqtt.Client, m mqtt.Message) {
+	t.Helper()
+	if err := c.Publish(m); err != nil {
+		t.Fatalf("Publish(%q) error = %v", m.Topic, err)
+	}
+}
+
+func receive(t *testing.T, c *mqtt.Client) mqtt.Message {
+	t.Helper()
+	select {
+	case m, ok := <-c.Messages():
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a message")
+		return mqtt.Message{}
+	}
+}
+
+func expectNone(t *testing.T, c *mqtt.Client) {
+	t.Helper()
+	select {
+	case m, ok := <-c.Messages():
+		if ok {
+			t.Fatalf("unexpected message on %q: %q", m.Topic, m.Payload)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTopicTranslation(t *testing.T) {
+	names := []struct {
+		mqtt    string
+		want    string
+		wantErr bool
+	}{
+		{mqtt: "sensors/kitchen/temp", want: "sensors.kitchen.temp"},
+		{mqtt: "single", want: "single"},
+		{mqtt: "sensors//temp", wantErr: true},
+		{mqtt: "/sensors", wantErr: true},
+		{mqtt: "sensors/+", wantErr: true},
+		{mqtt: "sensors/a.b", wantErr: true},
+		{mqtt: "sensors/under_score", wantErr: true},
+		{mqtt: "", wantErr: true},
+	}
+	for _, tt := range names {
+		got, err := mqtt.ToTopic(tt.mqtt)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ToTopic(%q) error = %v, wantErr %v", tt.mqtt, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("ToTopic(%q) = %q, want %q", tt.mqtt, got, tt.want)
+		}
+		if err == nil && mqtt.FromTopic(got) != tt.mqtt {
+			t.Errorf("FromTopic(%q) = %q, want %q", got, mqtt.FromTopic(got), tt.mqtt)
+		}
+	}
+
+	filters := []struct {
+		mqtt    string
+		want    []string
+		wantErr bool
+	}{
+		{mqtt: "sensors/+/temp", want: []string{"sensors.*.temp"}},
+		{mqtt: "sensors/#", want: []string{"sensors.>", "sensors"}},
+		{mqtt: "sensors/+/#", want: []string{"sensors.*.>", "sensors.*"}},
+		{mqtt: "#", want: []string{">"}},
+		{mqtt: "sensors/temp", want: []string{"sensors.temp"}},
+		{mqtt: "sensors/#/temp", wantErr: true},
+		{mqtt: "sensors/te+", wantErr: true},
+		{mqtt: "sensors/*", wantErr: true},
+		{mqtt: "sensors/>", wantErr: true},
+		{mqtt: "sensors//temp", wantErr: true},
+	}
+	for _, tt := range filters {
+		got, err := mqtt.ToPatterns(tt.mqtt)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ToPatterns(%q) error = %v, wantErr %v", tt.mqtt, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ToPatterns(%q) = %v, want %v", tt.mqtt, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].String() != tt.want[i] {
+				t.Errorf("ToPatterns(%q)[%d] = %q, want %q", tt.mqtt, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestPublishAndSubscribe(t *testing.T) {
+	_, addr := startServer(t)
+	sub := connect(t, addr, mqtt.ClientOptions{ClientID: "sub", CleanSession: true})
+	pub := connect(t, addr, mqtt.ClientOptions{ClientID: "pub", CleanSession: true})
+
+	subscribe(t, sub, "sensors/+/temp", 1)
+	subscribe(t, sub, "alarms/#", 0)
+
+	tests := []struct {
+		topic   string
+		qos     byte
+		want    bool
+		wantQoS byte
+	}{
+		{topic: "sensors/kitchen/temp", qos: 1, want: true, wantQoS: 1},
+		{topic: "sensors/kitchen/humidity", qos: 1, want: false},
+		{topic: "sensors/kitchen/temp", qos: 0, want: true, wantQoS: 0},
+		{topic: "alarms", qos: 1, want: true, wantQoS: 0},
+		{topic: "alarms/fire/floor-2", qos: 1, want: true, wantQoS: 0},
+	}
+
+	for _, tt := range tests {
+		publish(t, pub, mqtt.Message{Topic: tt.topic, Payload: []byte("42"), QoS: tt.qos})
+		if !tt.want {
+			expectNone(t, sub)
+			continue
+		}
+
+		m := receive(t, sub)
+		if m.Topic != tt.topic || string(m.Payload) != "42" {
+			t.Errorf("received %q %q, want %q 42", m.Topic, m.Payload, tt.topic)
+		}
+		if m.QoS != tt.wantQoS {
+			t.Errorf("%s at QoS %d: delivered at QoS %d, want %d", tt.topic, tt.qos, m.QoS, tt.wantQoS)
+		}
+		if m.Retain || m.Duplicate {
+			t.Errorf("%s: retain = %v, duplicate = %v, want both false", tt.topic, m.Retain, m.Duplicate)
+		}
+	}
+
+	// After unsubscribing nothing more arrives
+	if err := sub.Unsubscribe("sensors/+/temp"); err != nil {
+		t.Fatalf("Unsubscribe() error = %v", err)
+	}
+	publish(t, pub, mqtt.Message{Topic: "sensors/kitchen/temp", Payload: []byte("43"), QoS: 1})
+	expectNone(t, sub)
+}
+
+func TestIdleFiltersDoNotHoldInflightSlots(t *testing.T) {
+	_, addr := startServer(t, mqtt.WithMaxInflight(1))
+	sub := connect(t, addr, mqtt.ClientOptions{ClientID: "sub", CleanSession: true})
+	pub := connect(t, addr, mqtt.ClientOptions{ClientID: "pub", CleanSession: true})
+
+	subscribe(t, sub, "idle/#", 1)
+	subscribe(t, sub, "quiet/#", 1)
+	subscribe(t, sub, "busy/#", 1)
+
+	for i := 0; i < 5; i++ {
+		publish(t, pub, mqtt.Message{Topic: "busy/counter", Payload: []byte{byte('0' + i)}, QoS: 1})
+		if m := receive(t, sub); m.Topic != "busy/counter" || m.Payload[0] != byte('0'+i) {
+			t.Fatalf("received %q %q, want busy/counter %c", m.Topic, m.Payload, '0'+i)
+		}
+	}
+}
+
+func TestBridgeToBroker(t *testing.T) {
+	b, addr := startServer(t)
+	c := connect(t, addr, mqtt.ClientOptions{ClientID: "device", CleanSession: true})
+
+	// MQTT publishes reach broker subscribers under the translated topic
+	pattern, _ := topic.NewPattern("sensors.>")
+	brokerSub := b.Subscribe(pattern)
+	defer b.Unsubscribe(brokerSub.ID())
+
+	publish(t, c, mqtt.Message{Topic: "sensors/kitchen/temp", Payload: []byte("21.5"), QoS: 1})
+
+	select {
+	case msg := <-brokerSub.MessageChannel():
+		if msg.Topic().String() != "sensors.kitchen.temp" {
+			t.Errorf("topic = %q, want sensors.kitchen.temp", msg.Topic())
+		}
+		if data, ok := msg.Data().([]byte); !ok || string(data) != "21.5" {
+			t.Errorf("data = %#v, want []byte(\"21.5\")", msg.Data())
+		}
+		if msg.Header(mqtt.HeaderQoS) != "1" {
+			t.Errorf("%s header = %q, want 1", mqtt.HeaderQoS, msg.Header(mqtt.HeaderQoS))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("broker subscriber did not receive the message")
+	}
+
+	// Broker publishes reach MQTT subscribers with their payload encoded
+	subscribe(t, c, "commands/+", 1)
+	commands, _ := topic.New("commands.kitchen")
+	b.Publish(message.NewMessage(commands, map[string]interface{}{"light": "on"}))
+
+	m := receive(t, c)
+	if m.Topic != "commands/kitchen" {
+		t.Errorf("topic = %q, want commands/kitchen", m.Topic)
+	}
+	if string(m.Payload) != `{"light":"on"}` {
+		t.Errorf("payload = %s, want {\"light\":\"on\"}", m.Payload)
+	}
+	if m.QoS != 1 {
+		t.Errorf("QoS = %d, want the granted QoS 1", m.QoS)
+	}
+}
+
+func TestPublishAfterBrokerClose(t *testing.T) {
+	b, addr := startServer(t)
+	c := connect(t, addr, mqtt.ClientOptions{ClientID: "device", CleanSession: true})
+
+	// The message is not acknowledged, and the connection ends
+	b.Close()
+	if err := c.Publish(mqtt.Message{Topic: "sensors/kitchen/temp", Payload: []byte("21.5"), QoS: 1}); err == nil {
+		t.Error("Publish() after the broker closed succeeded")
+	}
+}
+
+func TestSubscribeGrants(t *testing.T) {
+	_, addr := startServer(t)
+	c := connect(t, addr, mqtt.ClientOptions{ClientID: "c", CleanSession: true})
+
+	tests := []struct {
+		filter string
+		qos    byte
+		want   byte
+	}{
+		{filter: "a/b", qos: 0, want: 0},
+		{filter: "a/b", qos: 1, want: 1},
+		{filter: "a/b", qos: 2, want: 1},
+		{filter: "a//b", qos: 1, want: mqtt.SubscribeFailure},
+		{filter: "a/#/b", qos: 1, want: mqtt.SubscribeFailure},
+		{filter: "a/under_score", qos: 1, want: mqtt.SubscribeFailure},
+	}
+	for _, tt := range tests {
+		granted, err := c.Subscribe(tt.filter, tt.qos)
+		if err != nil {
+			t.Fatalf("Subscribe(%q) error = %v", tt.filter, err)
+		}
+		if granted != tt.want {
+			t.Errorf("Subscribe(%q, %d) granted %#x, want %#x", tt.filter, tt.qos, granted, tt.want)
+		}
+	}
+
+	// The connection survives refused filters
+	if err := c.Ping(); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+}
+
+func TestRetainedMessages(t *testing.T) {
+	_, addr := startServer(t)
+	pub := connect(t, addr, mqtt.ClientOptions{ClientID: "pub", CleanSession: true})
+
+	publish(t, pub, mqtt.Message{Topic: "status/door", Payload: []byte("open"), QoS: 1, Retain: true})
+	publish(t, pub, mqtt.Message{Topic: "status/door", Payload: []byte("closed"), QoS: 1, Retain: true})
+	publish(t, pub, mqtt.Message{Topic: "status/window", Payload: []byte("open"), QoS: 0, Retain: true})
+
+	sub := connect(t, addr, mqtt.ClientOptions{ClientID: "sub", CleanSession: true})
+	subscribe(t, sub, "status/#", 1)
+
+	got := make(map[string]mqtt.Message)
+	for range 2 {
+		m := receive(t, sub)
+		got[m.Topic] = m
+	}
+	if m := got["status/door"]; string(m.Payload) != "closed" || !m.Retain || m.QoS != 1 {
+		t.Errorf("status/door = %+v, want the latest retained payload at QoS 1", m)
+	}
+	if m := got["status/window"]; string(m.Payload) != "open" || !m.Retain || m.QoS != 0 {
+		t.Errorf("status/window = %+v, want a retained message at QoS 0", m)
+	}
+
+	// Live messages to existing subscriptions are not marked retained
+	publish(t, pub, mqtt.Message{Topic: "status/door", Payload: []byte("open"), QoS: 1, Retain: true})
+	if m := receive(t, sub); m.Retain {
+		t.Error("live message is marked retained")
+	}
+
+	// An empty retained message clears the topic
+	publish(t, pub, mqtt.Message{Topic: "status/door", QoS: 1, Retain: true})
+	receive(t, sub)
+
+	late := connect(t, addr, mqtt.ClientOptions{ClientID: "late", CleanSession: true})
+	subscribe(t, late, "status/door", 1)
+	expectNone(t, late)
+}
+
+func TestRetainedMessagesLimit(t *testing.T) {
+	_, addr := startServer(t, mqtt.WithMaxRetained(1))
+	pub := connect(t, addr, mqtt.ClientOptions{ClientID: "pub", CleanSession: true})
+
+	publish(t, pub, mqtt.Message{Topic: "status/door", Payload: []byte("open"), QoS: 1, Retain: true})
+	publish(t, pub, mqtt.Message{Topic: "status/window", Payload: []byte("open"), QoS: 1, Retain: true})
+	// Replacing the retained message of a stored topic is still allowed
+	publish(t, pub, mqtt.Message{Topic: "status/door", Payload: []byte("closed"), QoS: 1, Retain: true})
+
+	sub := connect(t, addr, mqtt.ClientOptions{ClientID: "sub", CleanSession: true})
+	subscribe(t, sub, "status/#", 1)
+	if m := receive(t, sub); m.Topic != "status/door" || string(m.Payload) != "closed" {
+		t.Errorf("retained message = %s %s, want status/door closed", m.Topic, m.Payload)
+	}
+	expectNone(t, sub)
+}
+
+func TestBrokerRetainedTopicsAreNotDuplicated(t *testing.T) {
+	b, addr := startServer(t)
+	door, _ := topic.New("status.door")
+	if err := b.ConfigureTopic(door, broker.Retain()); err != nil {
+		t.Fatalf("ConfigureTopic() error = %v", err)
+	}
+
+	pub := connect(t, addr, mqtt.ClientOptions{ClientID: "pub", CleanSession: true})
+	publish(t, pub, mqtt.Message{Topic: "status/door", Payload: []byte("open"), QoS: 1, Retain: true})
+
+	sub := connect(t, addr, mqtt.ClientOptions{ClientID: "sub", CleanSession: true})
+	subscribe(t, sub, "status/#", 1)
+	if m := receive(t, sub); string(m.Payload) != "open" {
+		t.Errorf("payload = %s, want open", m.Payload)
+	}
+	expectNone(t, sub)
+}
+
+func TestPersistentSession(t *testing.T) {
+	_, addr := startServer(t)
+	pub := connect(t, addr, mqtt.ClientOptions{ClientID: "pub", CleanSession: true})
+
+	first := connect(t, addr, mqtt.ClientOptions{ClientID: "device", CleanSession: false})
+	if first.SessionPresent() {
+		t.Error("SessionPresent() = true for a new session")
+	}
+	subscribe(t, first, "jobs/+", 1)
+	first.Disconnect()
+
+	// Messages published while the client is offline wait in its session
+	publish(t, pub, mqtt.Message{Topic: "jobs/a", Payload: []byte("1"), QoS: 1})
+	publish(t, pub, mqtt.Message{Topic: "jobs/b", Payload: []byte("2"), QoS: 1})
+
+	second := connect(t, addr, mqtt.ClientOptions{ClientID: "device", CleanSession: false})
+	if !second.SessionPresent() {
+		t.Fatal("SessionPresent() = false after reconnecting")
+	}
+	for _, want := range []string{"1", "2"} {
+		if m := receive(t, second); string(m.Payload) != want {
+			t.Errorf("payload = %q, want %q", m.Payload, want)
+		}
+	}
+	second.Disconnect()
+
+	// A clean connection discards the session
+	clean := connect(t, addr, mqtt.ClientOptions{ClientID: "device", CleanSession: true})
+	if clean.SessionPresent() {
+		t.Error("SessionPresent() = true for a clean session")
+	}
+	publish(t, pub, mqtt.Message{Topic: "jobs/c", Payload: []byte("3"), QoS: 1})
+	expectNone(t, clean)
+}
+
+func TestSessionTakeover(t *testing.T) {
+	_, addr := startServer(t)
+
+	first := connect(t, addr, mqtt.ClientOptions{ClientID: "device", CleanSession: true})
+	connect(t, addr, mqtt.ClientOptions{ClientID: "device", CleanSession: true})
+
+	select {
+	case _, ok := <-first.Messages():
+		if ok {
+			t.Fatal("unexpected message on the replaced connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the first connection was not closed")
+	}
+}
+
+func TestWill(t *testing.T) {
+	_, addr := startServer(t)
+	watcher := connect(t, addr, mqtt.ClientOptions{ClientID: "watcher", CleanSession: true})
+	subscribe(t, watcher, "devices/+/status", 1)
+
+	will := &mqtt.Message{Topic: "devices/d1/status", Payload: []byte("offline"), QoS: 1}
+
+	// A clean disconnect discards the will
+	polite := connect(t, addr, mqtt.ClientOptions{ClientID: "d1", CleanSession: true, Will: will})
+	polite.Disconnect()
+	expectNone(t, watcher)
+
+	// A dropped connection publishes it
+	dropped := connect(t, addr, mqtt.ClientOptions{ClientID: "d1", CleanSession: true, Will: will})
+	dropped.Close()
+
+	m := receive(t, watcher)
+	if m.Topic != "devices/d1/status" || string(m.Payload) != "offline" {
+		t.Errorf("received %q %q, want the will", m.Topic, m.Payload)
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	_, addr := startServer(t)
+	c := connect(t, addr, mqtt.ClientOptions{ClientID: "idle", CleanSession: true, KeepAlive: time.Second})
+
+	// The server allows one and a half keepalive periods of silence
+	select {
+	case <-c.Messages():
+	case <-time.After(3 * time.Second):
+		t.Fatal("the idle connection was not closed")
+	}
+}
+
+func TestConnectRejectsEmptyIDForPersistentSession(t *testing.T) {
+	_, addr := startServer(t)
+
+	if _, err := mqtt.Connect(addr, mqtt.ClientOptions{CleanSession: false, Timeout: time.Second}); err == nil {
+		t.Error("Connect() without a client ID or clean session succeeded")
+	}
+
+	// A clean session gets an identifier from the server
+	c := connect(t, addr, mqtt.ClientOptions{CleanSession: true})
+	if err := c.Ping(); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+}
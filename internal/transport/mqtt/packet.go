@@ -0,0 +1,425 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// packetType is the type of a control packet, from the high nibble of its first byte.
+type packetType byte
+
+// Control packet types. PUBREC, PUBREL and PUBCOMP belong to QoS 2, which is not
+// supported.
+const (
+	typeConnect     packetType = 1
+	typeConnack     packetType = 2
+	typePublish     packetType = 3
+	typePuback      packetType = 4
+	typeSubscribe   packetType = 8
+	typeSuback      packetType = 9
+	typeUnsubscribe packetType = 10
+	typeUnsuback    packetType = 11
+	typePingreq     packetType = 12
+	typePingresp    packetType = 13
+	typeDisconnect  packetType = 14
+)
+
+// CONNACK return codes.
+const (
+	ConnectAccepted           byte = 0x00
+	ConnectBadProtocolVersion byte = 0x01
+	ConnectIdentifierRejected byte = 0x02
+	ConnectServerUnavailable  byte = 0x03
+)
+
+// SubscribeFailure is the SUBACK return code for a filter that was not accepted.
+const SubscribeFailure byte = 0x80
+
+const (
+	// protocolName and protocolLevel identify MQTT 3.1.1 in CONNECT.
+	protocolName  = "MQTT"
+	protocolLevel = 4
+
+	// maxRemainingLength is the largest remaining length the encoding can express.
+	maxRemainingLength = 268435455
+)
+
+var (
+	// ErrMalformedPacket is returned for a packet that violates the protocol.
+	ErrMalformedPacket = errors.New("mqtt: malformed packet")
+
+	// ErrPacketTooLarge is returned for a packet over the reader's size limit.
+	ErrPacketTooLarge = errors.New("mqtt: packet too large")
+)
+
+// Message is an application message as MQTT sees it.
+type Message struct {
+	Topic     string
+	Payload   []byte
+	QoS       byte
+	Retain    bool
+	Duplicate bool
+}
+
+// packet is a decoded control packet. Which fields are set depends on kind.
+type packet struct {
+	kind packetType
+
+	// PUBLISH
+	message Message
+
+	// PUBLISH at QoS 1, PUBACK, SUBSCRIBE, SUBACK, UNSUBSCRIBE and UNSUBACK
+	id uint16
+
+	// SUBSCRIBE and UNSUBSCRIBE filters, with the requested QoS of each SUBSCRIBE
+	// filter in codes. SUBACK return codes are also in codes.
+	filters []string
+	codes   []byte
+
+	// CONNECT
+	connect *connectFields
+
+	// CONNACK
+	sessionPresent bool
+	returnCode     byte
+}
+
+// connectFields holds the payload of a CONNECT packet.
+type connectFields struct {
+	protocol     string
+	level        byte
+	clientID     string
+	cleanSession bool
+	keepAlive    uint16 // seconds
+	will         *Message
+	username     string
+	password     []byte
+}
+
+// readPacket reads one control packet. Packets whose remaining length exceeds
+// maxSize are rejected with ErrPacketTooLarge.
+func readPacket(r *bufio.Reader, maxSize int) (packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	length, err := readRemainingLength(r)
+	if err != nil {
+		return packet{}, err
+	}
+	if length > maxSize {
+		return packet{}, fmt.Errorf("%w: %d bytes, limit is %d", ErrPacketTooLarge, length, maxSize)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if errors.Is(err, io.EOF) {
+			return packet{}, io.ErrUnexpectedEOF
+		}
+		return packet{}, err
+	}
+
+	p, err := parsePacket(packetType(first>>4), first&0x0f, body)
+	if err != nil {
+		return packet{}, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+	}
+	return p, nil
+}
+
+// readRemainingLength decodes the variable-length remaining length field.
+func readRemainingLength(r *bufio.Reader) (int, error) {
+	length, shift := 0, 0
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return length, nil
+		}
+		shift += 7
+	}
+	return 0, fmt.Errorf("%w: remaining length is longer than four bytes", ErrMalformedPacket)
+}
+
+// parsePacket decodes a packet's variable header and payload.
+func parsePacket(kind packetType, flags byte, body []byte) (packet, error) {
+	p := packet{kind: kind}
+	d := &decoder{b: body}
+
+	// SUBSCRIBE and UNSUBSCRIBE have fixed flags; other packets except PUBLISH have none
+	switch kind {
+	case typePublish:
+	case typeSubscribe, typeUnsubscribe:
+		if flags != 0x2 {
+			return packet{}, fmt.Errorf("invalid flags %#x", flags)
+		}
+	default:
+		if flags != 0 {
+			return packet{}, fmt.Errorf("invalid flags %#x", flags)
+		}
+	}
+
+	switch kind {
+	case typeConnect:
+		c := &connectFields{}
+		c.protocol = d.string()
+		c.level = d.byte()
+		connectFlags := d.byte()
+		c.keepAlive = d.uint16()
+		c.cleanSession = connectFlags&0x02 != 0
+		c.clientID = d.string()
+		if connectFlags&0x04 != 0 {
+			c.will = &Message{
+				Topic:  d.string(),
+				QoS:    connectFlags >> 3 & 0x03,
+				Retain: connectFlags&0x20 != 0,
+			}
+			c.will.Payload = d.bytes()
+		}
+		if connectFlags&0x80 != 0 {
+			c.username = d.string()
+		}
+		if connectFlags&0x40 != 0 {
+			c.password = d.bytes()
+		}
+		if connectFlags&0x01 != 0 {
+			return packet{}, errors.New("reserved connect flag is set")
+		}
+		p.connect = c
+
+	case typeConnack:
+		p.sessionPresent = d.byte()&0x01 != 0
+		p.returnCode = d.byte()
+
+	case typePublish:
+		p.message.Duplicate = flags&0x08 != 0
+		p.message.QoS = flags >> 1 & 0x03
+		p.message.Retain = flags&0x01 != 0
+		if p.message.QoS == 3 {
+			return packet{}, errors.New("invalid QoS 3")
+		}
+		p.message.Topic = d.string()
+		if p.message.QoS > 0 {
+			p.id = d.uint16()
+		}
+		p.message.Payload = d.rest()
+
+	case typePuback, typeUnsuback:
+		p.id = d.uint16()
+
+	case typeSubscribe:
+		p.id = d.uint16()
+		for !d.done() {
+			p.filters = append(p.filters, d.string())
+			p.codes = append(p.codes, d.byte())
+		}
+		if len(p.filters) == 0 {
+			return packet{}, errors.New("SUBSCRIBE without filters")
+		}
+
+	case typeSuback:
+		p.id = d.uint16()
+		p.codes = d.rest()
+
+	case typeUnsubscribe:
+		p.id = d.uint16()
+		for !d.done() {
+			p.filters = append(p.filters, d.string())
+		}
+		if len(p.filters) == 0 {
+			return packet{}, errors.New("UNSUBSCRIBE without filters")
+		}
+
+	case typePingreq, typePingresp, typeDisconnect:
+
+	default:
+		return packet{}, fmt.Errorf("unsupported packet type %d", kind)
+	}
+
+	if d.err != nil {
+		return packet{}, d.err
+	}
+	if !d.done() {
+		return packet{}, fmt.Errorf("%d unexpected trailing bytes", len(d.b))
+	}
+	return p, nil
+}
+
+// decoder reads the fields of a packet body. The first error sticks.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) done() bool {
+	return d.err != nil || len(d.b) == 0
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = errors.New("packet is truncated")
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint16()
+	return append([]byte(nil), d.take(int(n))...)
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) rest() []byte {
+	v := append([]byte(nil), d.b...)
+	d.b = nil
+	return v
+}
+
+// appendPacket appends the encoded packet to buf.
+func appendPacket(buf []byte, p packet) ([]byte, error) {
+	var body []byte
+	var flags byte
+
+	switch p.kind {
+	case typeConnect:
+		c := p.connect
+		var connectFlags byte
+		if c.cleanSession {
+			connectFlags |= 0x02
+		}
+		if c.will != nil {
+			connectFlags |= 0x04 | c.will.QoS<<3
+			if c.will.Retain {
+				connectFlags |= 0x20
+			}
+		}
+		if c.password != nil {
+			connectFlags |= 0x40
+		}
+		if c.username != "" {
+			connectFlags |= 0x80
+		}
+		body = appendString(body, protocolName)
+		body = append(body, protocolLevel, connectFlags)
+		body = binary.BigEndian.AppendUint16(body, c.keepAlive)
+		body = appendString(body, c.clientID)
+		if c.will != nil {
+			body = appendString(body, c.will.Topic)
+			body = appendBytes(body, c.will.Payload)
+		}
+		if c.username != "" {
+			body = appendString(body, c.username)
+		}
+		if c.password != nil {
+			body = appendBytes(body, c.password)
+		}
+
+	case typeConnack:
+		var ack byte
+		if p.sessionPresent {
+			ack = 0x01
+		}
+		body = append(body, ack, p.returnCode)
+
+	case typePublish:
+		m := p.message
+		flags = m.QoS << 1
+		if m.Duplicate {
+			flags |= 0x08
+		}
+		if m.Retain {
+			flags |= 0x01
+		}
+		body = appendString(body, m.Topic)
+		if m.QoS > 0 {
+			body = binary.BigEndian.AppendUint16(body, p.id)
+		}
+		body = append(body, m.Payload...)
+
+	case typePuback, typeUnsuback:
+		body = binary.BigEndian.AppendUint16(body, p.id)
+
+	case typeSubscribe:
+		flags = 0x2
+		body = binary.BigEndian.AppendUint16(body, p.id)
+		for i, filter := range p.filters {
+			body = appendString(body, filter)
+			body = append(body, p.codes[i])
+		}
+
+	case typeSuback:
+		body = binary.BigEndian.AppendUint16(body, p.id)
+		body = append(body, p.codes...)
+
+	case typeUnsubscribe:
+		flags = 0x2
+		body = binary.BigEndian.AppendUint16(body, p.id)
+		for _, filter := range p.filters {
+			body = appendString(body, filter)
+		}
+
+	case typePingreq, typePingresp, typeDisconnect:
+
+	default:
+		return nil, fmt.Errorf("mqtt: cannot encode packet type %d", p.kind)
+	}
+
+	if len(body) > maxRemainingLength {
+		return nil, fmt.Errorf("%w: %d bytes", ErrPacketTooLarge, len(body))
+	}
+
+	buf = append(buf, byte(p.kind)<<4|flags)
+	for n := len(body); ; {
+		b := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(buf, body...), nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(b)))
+	return append(buf, b...)
+}
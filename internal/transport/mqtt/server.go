@@ -0,0 +1,581 @@
+// Package mqtt serves a broker to MQTT 3.1.1 clients, such as IoT devices.
+//
+// MQTT topics are translated to broker topics by replacing the "/" separator with
+// ".", so devices publishing to "sensors/kitchen/temp" reach subscribers of
+// "sensors.kitchen.temp", and messages published on the broker reach devices under
+// the translated name. In filters, "+" becomes "*" and "#" becomes ">". Topics that
+// have no translation, such as those with empty levels, are rejected.
+//
+// QoS 0 and 1 are supported; SUBSCRIBE requests for QoS 2 are granted QoS 1, and a
+// client that publishes at QoS 2 is disconnected. Retained messages, last-will
+// messages and persistent sessions (CleanSession set to false) are supported. MQTT
+// payloads are published as []byte data.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+const (
+	// DefaultAddr is the address the MQTT listener uses by default.
+	DefaultAddr = ":1883"
+
+	// DefaultWriteTimeout is how long a write to a client may take before the
+	// connection is considered dead.
+	DefaultWriteTimeout = 10 * time.Second
+
+	// DefaultMaxPacketSize is the largest packet the server accepts by default.
+	DefaultMaxPacketSize = 1 << 20
+
+	// DefaultMaxInflight is how many QoS 1 messages may await a PUBACK per client.
+	DefaultMaxInflight = 64
+
+	// DefaultMaxRetained is how many topics may hold a retained message by default.
+	DefaultMaxRetained = 10000
+
+	// HeaderQoS records the QoS a message was published with. Messages without it,
+	// such as those published by other transports, are delivered at the QoS granted
+	// to the subscription.
+	HeaderQoS = "mqtt-qos"
+
+	// connectTimeout is how long a new connection has to send CONNECT.
+	connectTimeout = 10 * time.Second
+
+	// headerRetained marks the copy of a retained message queued for a new
+	// subscription, so that it is sent with the RETAIN flag.
+	headerRetained = "mqtt-retained"
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("mqtt: server closed")
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithMaxPacketSize sets the largest packet the server accepts.
+// Clients that send a larger packet are disconnected.
+func WithMaxPacketSize(n int) Option {
+	return func(s *Server) {
+		s.maxPacketSize = n
+	}
+}
+
+// WithWriteTimeout sets how long a write to a client may take.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithMaxInflight sets how many QoS 1 messages may await a PUBACK per client. Further
+// messages wait in the subscription's queue, where its overflow policy applies. The
+// limit is capped at the 65535 packet IDs MQTT allows.
+func WithMaxInflight(n int) Option {
+	return func(s *Server) {
+		s.maxInflight = min(max(n, 1), math.MaxUint16)
+	}
+}
+
+// WithMaxRetained sets how many topics may hold a retained message. Once the limit is
+// reached, retained messages for further topics are published but not retained.
+func WithMaxRetained(n int) Option {
+	return func(s *Server) {
+		s.maxRetained = n
+	}
+}
+
+// WithSubscriptionOptions sets options applied to every subscription made by a client,
+// such as the buffer size and overflow policy.
+func WithSubscriptionOptions(opts ...subscription.Option) Option {
+	return func(s *Server) {
+		s.subOptions = opts
+	}
+}
+
+// Server accepts MQTT connections and relays their packets to a broker.
+type Server struct {
+	broker        *broker.Broker
+	maxPacketSize int
+	writeTimeout  time.Duration
+	maxInflight   int
+	maxRetained   int
+	subOptions    []subscription.Option
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	sessions  map[string]*session // client ID -> session
+	closed    bool
+	wg        sync.WaitGroup
+
+	retainedMu sync.RWMutex
+	retained   map[string]message.Message // topic name -> retained message
+}
+
+// NewServer creates an MQTT server for the broker.
+func NewServer(b *broker.Broker, opts ...Option) *Server {
+	s := &Server{
+		broker:        b,
+		maxPacketSize: DefaultMaxPacketSize,
+		writeTimeout:  DefaultWriteTimeout,
+		maxInflight:   DefaultMaxInflight,
+		maxRetained:   DefaultMaxRetained,
+		listeners:     make(map[net.Listener]struct{}),
+		conns:         make(map[*conn]struct{}),
+		sessions:      make(map[string]*session),
+		retained:      make(map[string]message.Message),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// ListenAndServe listens on the TCP address and serves clients until Close.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until Close. It always returns a
+// non-nil error; after Close the error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		c := s.newConn(netConn)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			netConn.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections, disconnects every client and removes all
+// sessions and their subscriptions, including persistent ones. The broker itself
+// is left open.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.netConn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	s.mu.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]*session)
+	s.mu.Unlock()
+
+	for _, sess := range sessions {
+		sess.close()
+	}
+	return nil
+}
+
+// openSession finds or creates the session for a connecting client. An existing
+// connection with the same client ID is disconnected. It reports whether a
+// previous session was resumed.
+func (s *Server) openSession(clientID string, clean bool) (*session, bool, error) {
+	s.mu.Lock()
+
+	if s.closed {
+		s.mu.Unlock()
+		return nil, false, ErrServerClosed
+	}
+
+	existing := s.sessions[clientID]
+	if existing != nil {
+		if old := existing.connection(); old != nil {
+			old.netConn.Close()
+		}
+		if !clean && !existing.clean {
+			s.mu.Unlock()
+			return existing, true, nil
+		}
+	}
+
+	sess := newSession(s, clientID, clean)
+	s.sessions[clientID] = sess
+	s.mu.Unlock()
+
+	// A clean start discards the previous session
+	if existing != nil {
+		existing.close()
+	}
+	return sess, false, nil
+}
+
+// closeSession removes a session that ended, unless a newer session has taken its
+// client ID.
+func (s *Server) closeSession(sess *session) {
+	s.mu.Lock()
+	if s.sessions[sess.clientID] == sess {
+		delete(s.sessions, sess.clientID)
+	}
+	s.mu.Unlock()
+
+	sess.close()
+}
+
+// publish publishes an MQTT message to the broker and updates the retained message
+// for its topic, unless the topic would exceed the retained limit. It fails with
+// broker.ErrBrokerClosed once the broker is closed, which ends the connection without
+// acknowledging the message.
+func (s *Server) publish(m Message) error {
+	t, err := ToTopic(m.Topic)
+	if err != nil {
+		return err
+	}
+
+	msg := message.NewMessage(t, m.Payload, message.WithHeader(HeaderQoS, strconv.Itoa(int(m.QoS))))
+
+	if m.Retain {
+		s.retainedMu.Lock()
+		// An empty retained message clears the topic's retained message
+		_, exists := s.retained[t.String()]
+		switch {
+		case len(m.Payload) == 0:
+			delete(s.retained, t.String())
+		case exists || len(s.retained) < s.maxRetained:
+			s.retained[t.String()] = msg
+		}
+		s.retainedMu.Unlock()
+	}
+
+	_, err = s.broker.PublishContext(context.Background(), msg)
+	return err
+}
+
+// retainedMatching returns the retained messages whose topics match the pattern,
+// marked to be sent with the RETAIN flag. Topics the broker retains messages for
+// itself are left out, since the broker already gives new subscriptions its own.
+func (s *Server) retainedMatching(pattern topic.Topic) []message.Message {
+	s.retainedMu.RLock()
+	var matched []message.Message
+	for _, msg := range s.retained {
+		if pattern.Matches(msg.Topic()) {
+			matched = append(matched, msg)
+		}
+	}
+	s.retainedMu.RUnlock()
+
+	retained := matched[:0]
+	for _, msg := range matched {
+		if len(s.broker.Retained(msg.Topic())) == 0 {
+			retained = append(retained, msg.With(message.WithHeader(headerRetained, "1")))
+		}
+	}
+	return retained
+}
+
+// messageQoS returns the QoS a message was published with, or 1 for messages that
+// did not come from an MQTT client.
+func messageQoS(msg message.Message) byte {
+	qos, err := strconv.Atoi(msg.Header(HeaderQoS))
+	if err != nil || qos < 0 || qos > 1 {
+		return 1
+	}
+	return byte(qos)
+}
+
+// conn is one client connection.
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	reader  *bufio.Reader
+	done    chan struct{} // closed on teardown
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	session   *session
+	keepAlive time.Duration
+	will      *Message // published unless the client disconnects cleanly
+}
+
+func (s *Server) newConn(netConn net.Conn) *conn {
+	return &conn{
+		server:  s,
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+		done:    make(chan struct{}),
+	}
+}
+
+// serve handles the connection from CONNECT until the client disconnects, misses its
+// keepalive deadline or violates the protocol.
+func (c *conn) serve() {
+	defer c.teardown()
+
+	c.netConn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := readPacket(c.reader, c.server.maxPacketSize)
+	if err != nil || p.kind != typeConnect {
+		return
+	}
+	if !c.connect(p.connect) {
+		return
+	}
+
+	for {
+		// Clients must send something within one and a half keepalive periods
+		deadline := time.Time{}
+		if c.keepAlive > 0 {
+			deadline = time.Now().Add(c.keepAlive * 3 / 2)
+		}
+		c.netConn.SetReadDeadline(deadline)
+
+		p, err := readPacket(c.reader, c.server.maxPacketSize)
+		if err != nil {
+			return
+		}
+		if p.kind == typeDisconnect {
+			c.will = nil
+			return
+		}
+		if err := c.handle(p); err != nil {
+			return
+		}
+	}
+}
+
+// connect answers the CONNECT packet and attaches the connection to its session.
+// It reports whether the connection was accepted.
+func (c *conn) connect(f *connectFields) bool {
+	if f.protocol != protocolName {
+		return false
+	}
+	if f.level != protocolLevel {
+		c.write(packet{kind: typeConnack, returnCode: ConnectBadProtocolVersion})
+		return false
+	}
+
+	clientID := f.clientID
+	if clientID == "" {
+		// Only clean sessions may let the server choose an identifier
+		if !f.cleanSession {
+			c.write(packet{kind: typeConnack, returnCode: ConnectIdentifierRejected})
+			return false
+		}
+		clientID = generateClientID()
+	}
+
+	if f.will != nil {
+		if _, err := ToTopic(f.will.Topic); err != nil || f.will.QoS > 1 {
+			return false
+		}
+	}
+
+	sess, present, err := c.server.openSession(clientID, f.cleanSession)
+	if err != nil {
+		c.write(packet{kind: typeConnack, returnCode: ConnectServerUnavailable})
+		return false
+	}
+	c.session = sess
+	c.keepAlive = time.Duration(f.keepAlive) * time.Second
+	c.will = f.will
+
+	if err := c.write(packet{kind: typeConnack, sessionPresent: present, returnCode: ConnectAccepted}); err != nil {
+		return false
+	}
+	sess.attach(c)
+	return true
+}
+
+// generateClientID creates an identifier for a client that did not provide one.
+func generateClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "gophercast-" + hex.EncodeToString(b)
+}
+
+// handle applies a packet from the client. A returned error closes the connection.
+func (c *conn) handle(p packet) error {
+	switch p.kind {
+	case typePublish:
+		if p.message.QoS > 1 {
+			return errors.New("QoS 2 is not supported")
+		}
+		if err := c.server.publish(p.message); err != nil {
+			return err
+		}
+		if p.message.QoS == 1 {
+			return c.write(packet{kind: typePuback, id: p.id})
+		}
+		return nil
+
+	case typePuback:
+		c.session.ack(p.id)
+		return nil
+
+	case typeSubscribe:
+		return c.subscribe(p)
+
+	case typeUnsubscribe:
+		for _, filter := range p.filters {
+			c.session.unsubscribe(filter)
+		}
+		return c.write(packet{kind: typeUnsuback, id: p.id})
+
+	case typePingreq:
+		return c.write(packet{kind: typePingresp})
+
+	default:
+		return fmt.Errorf("unexpected packet type %d from client", p.kind)
+	}
+}
+
+// subscribe answers a SUBSCRIBE packet. The retained messages that match the accepted
+// filters are queued ahead of live messages by the new subscriptions.
+func (c *conn) subscribe(p packet) error {
+	codes := make([]byte, len(p.filters))
+
+	for i, filter := range p.filters {
+		patterns, err := ToPatterns(filter)
+		if err != nil || p.codes[i] > 2 {
+			codes[i] = SubscribeFailure
+			continue
+		}
+
+		qos := min(p.codes[i], 1)
+		c.session.subscribe(filter, qos, patterns)
+		codes[i] = qos
+	}
+
+	return c.write(packet{kind: typeSuback, id: p.id, codes: codes})
+}
+
+// deliver sends a message to the client at the lower of the subscription's QoS and
+// the QoS it was published with. QoS 1 messages are tracked until the client's
+// PUBACK; slot reports whether the message holds one of the session's inflight slots.
+func (c *conn) deliver(msg message.Message, qos byte, slot bool) error {
+	payload, _, err := message.EncodePayload(msg)
+	if err != nil {
+		c.session.release(slot)
+		msg.Reject(err)
+		return nil
+	}
+
+	p := packet{kind: typePublish, message: Message{
+		Topic:     FromTopic(msg.Topic()),
+		Payload:   payload,
+		QoS:       min(qos, messageQoS(msg)),
+		Retain:    msg.Header(headerRetained) != "",
+		Duplicate: msg.DeliveryAttempt() > 1,
+	}}
+
+	if p.message.QoS == 0 {
+		c.session.release(slot)
+		msg.Ack()
+		return c.write(p)
+	}
+
+	id, ok := c.session.track(c, msg, slot)
+	if !ok {
+		return nil
+	}
+	p.id = id
+	return c.write(p)
+}
+
+// write sends a packet to the client.
+func (c *conn) write(p packet) error {
+	buf, err := appendPacket(nil, p)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.server.writeTimeout > 0 {
+		c.netConn.SetWriteDeadline(time.Now().Add(c.server.writeTimeout))
+	}
+	if _, err := c.writer.Write(buf); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// teardown publishes the client's will if it did not disconnect cleanly, detaches
+// it from its session, and closes the connection. Clean sessions end with their
+// connection.
+func (c *conn) teardown() {
+	close(c.done)
+	c.netConn.Close()
+
+	if c.session == nil {
+		return
+	}
+	if c.will != nil {
+		c.server.publish(*c.will)
+	}
+	c.session.detach(c)
+	if c.session.clean {
+		c.server.closeSession(c.session)
+	}
+}
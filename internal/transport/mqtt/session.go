@@ -0,0 +1,258 @@
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// session is the state of a client that outlives a single connection: its
+// subscriptions and the QoS 1 messages awaiting acknowledgement. A clean session
+// ends with its connection; a persistent one keeps its subscriptions queueing
+// messages until the client reconnects.
+type session struct {
+	server   *Server
+	clientID string
+	clean    bool
+	slots    chan struct{} // one token per inflight QoS 1 message from a subscription
+
+	mu       sync.Mutex
+	conn     *conn                   // nil while the client is offline
+	changed  chan struct{}           // closed when conn changes
+	filters  map[string]*filterState // MQTT filter -> subscriptions
+	inflight map[uint16]inflight     // packet ID -> message awaiting PUBACK
+	nextID   uint16
+
+	wg sync.WaitGroup // forwarders
+}
+
+// filterState holds the broker subscriptions made for one MQTT filter.
+type filterState struct {
+	subs []*subscription.Subscription
+}
+
+// inflight is a QoS 1 message sent to the client and not yet acknowledged.
+type inflight struct {
+	msg  message.Message
+	slot bool
+}
+
+func newSession(s *Server, clientID string, clean bool) *session {
+	return &session{
+		server:   s,
+		clientID: clientID,
+		clean:    clean,
+		slots:    make(chan struct{}, s.maxInflight),
+		changed:  make(chan struct{}),
+		filters:  make(map[string]*filterState),
+		inflight: make(map[uint16]inflight),
+	}
+}
+
+// connection returns the attached connection, or nil.
+func (s *session) connection() *conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// current returns the attached connection and a channel closed when it changes.
+func (s *session) current() (*conn, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn, s.changed
+}
+
+// attach makes c the session's connection. Messages left unacknowledged by an
+// earlier connection are redelivered to it.
+func (s *session) attach(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn = c
+	s.resetLocked()
+}
+
+// detach removes c from the session if it is still attached. Unacknowledged messages
+// go back to their subscriptions' queues.
+func (s *session) detach(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != c {
+		return
+	}
+	s.conn = nil
+	s.resetLocked()
+}
+
+// resetLocked signals a connection change and returns inflight messages for
+// redelivery, which marks them as duplicates.
+func (s *session) resetLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	for id, f := range s.inflight {
+		f.msg.Nack(0)
+		if f.slot {
+			<-s.slots
+		}
+		delete(s.inflight, id)
+	}
+}
+
+// subscribe subscribes to the patterns of an MQTT filter, replacing any existing
+// subscription to the same filter, and queues the matching retained messages ahead of
+// live ones. QoS 1 subscriptions acknowledge each message only when the client sends
+// PUBACK.
+func (s *session) subscribe(filter string, qos byte, patterns []topic.Topic) {
+	s.unsubscribe(filter)
+
+	opts := append([]subscription.Option(nil), s.server.subOptions...)
+	if qos > 0 {
+		opts = append(opts, subscription.WithManualAck())
+	}
+
+	state := &filterState{}
+	for _, pattern := range patterns {
+		sub := s.server.broker.Subscribe(pattern, opts...)
+		sub.Preload(s.server.retainedMatching(pattern)...)
+		state.subs = append(state.subs, sub)
+
+		s.wg.Add(1)
+		go s.forward(sub, qos)
+	}
+
+	s.mu.Lock()
+	s.filters[filter] = state
+	s.mu.Unlock()
+}
+
+// unsubscribe removes the subscriptions of an MQTT filter.
+func (s *session) unsubscribe(filter string) {
+	s.mu.Lock()
+	state, ok := s.filters[filter]
+	delete(s.filters, filter)
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	for _, sub := range state.subs {
+		s.server.broker.Unsubscribe(sub.ID())
+	}
+}
+
+// forward sends a subscription's messages to whichever connection is attached.
+// While the client is offline, messages wait in the subscription's queue. A QoS 1
+// message takes an inflight slot only once it has been received, so that filters
+// with nothing to send do not hold slots; while the client has too many
+// unacknowledged messages, the received message waits for a slot and the rest wait
+// in the queue.
+func (s *session) forward(sub *subscription.Subscription, qos byte) {
+	defer s.wg.Done()
+
+	for {
+		c, changed := s.current()
+		if c == nil {
+			select {
+			case <-changed:
+				continue
+			case <-sub.Done():
+				return
+			}
+		}
+
+		var msg message.Message
+		select {
+		case m, ok := <-sub.MessageChannel():
+			if !ok {
+				return
+			}
+			msg = m
+		case <-c.done:
+			continue
+		}
+
+		slot := qos > 0
+		if slot {
+			select {
+			case s.slots <- struct{}{}:
+			case <-c.done:
+				// Queue the message again for the next connection
+				msg.Nack(0)
+				continue
+			case <-sub.Done():
+				return
+			}
+		}
+
+		if err := c.deliver(msg, qos, slot); err != nil {
+			c.netConn.Close()
+		}
+	}
+}
+
+// track records a QoS 1 message sent on c and returns its packet ID. If c is no
+// longer attached the message is returned for redelivery instead.
+func (s *session) track(c *conn, msg message.Message, slot bool) (uint16, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != c {
+		msg.Nack(0)
+		if slot {
+			<-s.slots
+		}
+		return 0, false
+	}
+
+	// Every QoS 1 message holds a slot, and there are fewer slots than packet IDs,
+	// so a free ID exists.
+	for {
+		s.nextID++
+		if _, used := s.inflight[s.nextID]; s.nextID != 0 && !used {
+			break
+		}
+	}
+	s.inflight[s.nextID] = inflight{msg: msg, slot: slot}
+	return s.nextID, true
+}
+
+// ack settles the message the client acknowledged with PUBACK.
+func (s *session) ack(id uint16) {
+	s.mu.Lock()
+	f, ok := s.inflight[id]
+	delete(s.inflight, id)
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	f.msg.Ack()
+	s.release(f.slot)
+}
+
+// release returns an inflight slot.
+func (s *session) release(slot bool) {
+	if slot {
+		<-s.slots
+	}
+}
+
+// close removes the session's subscriptions and waits for its forwarders.
+func (s *session) close() {
+	s.mu.Lock()
+	filters := s.filters
+	s.filters = make(map[string]*filterState)
+	s.mu.Unlock()
+
+	for _, state := range filters {
+		for _, sub := range state.subs {
+			s.server.broker.Unsubscribe(sub.ID())
+		}
+	}
+	s.wg.Wait()
+}
@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// MQTT topic separators and wildcards.
+const (
+	levelSeparator   = "/"
+	singleLevelMatch = "+"
+	multiLevelMatch  = "#"
+)
+
+// ToTopic translates an MQTT topic name such as "sensors/kitchen/temp" into the
+// broker topic "sensors.kitchen.temp". Names with empty levels, wildcards, or levels
+// that are not valid topic segments (including levels containing a dot) have no
+// translation.
+func ToTopic(name string) (topic.Topic, error) {
+	if name == "" {
+		return topic.Topic{}, errors.New("mqtt: topic name cannot be empty")
+	}
+	if strings.ContainsAny(name, singleLevelMatch+multiLevelMatch) {
+		return topic.Topic{}, fmt.Errorf("mqtt: topic name %q contains a wildcard", name)
+	}
+
+	levels := strings.Split(name, levelSeparator)
+	for _, level := range levels {
+		if err := checkLevel(name, level); err != nil {
+			return topic.Topic{}, err
+		}
+	}
+	return topic.New(strings.Join(levels, topic.Separator))
+}
+
+// ToPatterns translates an MQTT topic filter into the broker patterns that together
+// match the same topics. "+" becomes "*" and "#" becomes ">". Because "sensors/#" also
+// matches "sensors" itself, a trailing "#" after other levels adds the parent topic as
+// a second pattern.
+func ToPatterns(filter string) ([]topic.Topic, error) {
+	if filter == "" {
+		return nil, errors.New("mqtt: topic filter cannot be empty")
+	}
+
+	levels := strings.Split(filter, levelSeparator)
+	segments := make([]string, len(levels))
+	for i, level := range levels {
+		switch level {
+		case singleLevelMatch:
+			segments[i] = topic.SingleWildcard
+		case multiLevelMatch:
+			if i != len(levels)-1 {
+				return nil, fmt.Errorf("mqtt: %q in filter %q must be the last level", multiLevelMatch, filter)
+			}
+			segments[i] = topic.MultiWildcard
+		default:
+			if strings.ContainsAny(level, singleLevelMatch+multiLevelMatch) {
+				return nil, fmt.Errorf("mqtt: wildcards in filter %q must occupy a whole level", filter)
+			}
+			if err := checkLevel(filter, level); err != nil {
+				return nil, err
+			}
+			segments[i] = level
+		}
+	}
+
+	pattern, err := topic.NewPattern(strings.Join(segments, topic.Separator))
+	if err != nil {
+		return nil, err
+	}
+	patterns := []topic.Topic{pattern}
+
+	if len(segments) > 1 && segments[len(segments)-1] == topic.MultiWildcard {
+		parent, err := topic.NewPattern(strings.Join(segments[:len(segments)-1], topic.Separator))
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, parent)
+	}
+	return patterns, nil
+}
+
+// FromTopic translates a broker topic into an MQTT topic name.
+func FromTopic(t topic.Topic) string {
+	return strings.ReplaceAll(t.String(), topic.Separator, levelSeparator)
+}
+
+// checkLevel reports whether a level of an MQTT topic can become a topic segment.
+func checkLevel(name, level string) error {
+	if level == "" {
+		return fmt.Errorf("mqtt: topic %q has an empty level", name)
+	}
+	if strings.Contains(level, topic.Separator) {
+		return fmt.Errorf("mqtt: level %q of topic %q contains a dot", level, name)
+	}
+	if _, err := topic.New(level); err != nil {
+		return fmt.Errorf("mqtt: level %q of topic %q: %w", level, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package resp
+
+import (
+	"strings"
+
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// globMeta are the characters with a special meaning in Redis glob patterns.
+const globMeta = `*?[\`
+
+// coveringPattern returns the narrowest topic pattern that matches every topic the
+// glob can match. Literal segments before the first segment with a glob character
+// are kept and the rest becomes ">", because "*" in a glob can span dots. A glob
+// without glob characters is an exact topic.
+func coveringPattern(glob string) (topic.Topic, error) {
+	segments := strings.Split(glob, topic.Separator)
+	for i, segment := range segments {
+		if !strings.ContainsAny(segment, globMeta) {
+			continue
+		}
+		for _, literal := range segments[:i] {
+			if _, err := topic.New(literal); err != nil {
+				return topic.Topic{}, err
+			}
+		}
+		return topic.NewPattern(strings.Join(append(segments[:i:i], topic.MultiWildcard), topic.Separator))
+	}
+	return topic.New(glob)
+}
+
+// globMatch reports whether s matches the Redis glob pattern: "*" matches any
+// sequence, "?" any single byte, "[abc]", "[^abc]" and "[a-z]" byte classes, and
+// "\" escapes the next byte.
+//
+// Every element other than "*" matches exactly one byte, so on a mismatch it is
+// enough to let the most recent "*" absorb one more byte and retry from there.
+// This keeps matching at O(len(pattern) * len(s)), where trying every split point
+// recursively is exponential in the number of stars.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, resume := -1, 0 // pattern index after the last "*", and where in s it resumes
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				p++
+				star, resume = p, i
+				continue
+
+			case '?':
+				p, i = p+1, i+1
+				continue
+
+			case '[':
+				if rest, ok := matchClass(pattern[p+1:], s[i]); ok {
+					p, i = len(pattern)-len(rest), i+1
+					continue
+				}
+
+			case '\\':
+				literal := p
+				if p+1 < len(pattern) {
+					literal = p + 1
+				}
+				if pattern[literal] == s[i] {
+					p, i = literal+1, i+1
+					continue
+				}
+
+			default:
+				if pattern[p] == s[i] {
+					p, i = p+1, i+1
+					continue
+				}
+			}
+		}
+
+		// Mismatch: backtrack to the last star, which takes one more byte
+		if star < 0 {
+			return false
+		}
+		resume++
+		p, i = star, resume
+	}
+
+	// Only stars can match the empty rest of s
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the byte class at the start of pattern, just after
+// its "[", and returns the pattern following the class. An unterminated class
+// extends to the end of the pattern, as in Redis.
+func matchClass(pattern string, c byte) (string, bool) {
+	negate := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		negate = true
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:] // the closing "]"
+	}
+	return pattern, matched != negate
+}
@@ -0,0 +1,297 @@
+// Package resp serves a broker to Redis clients that use PUBLISH, SUBSCRIBE and
+// PSUBSCRIBE for messaging, speaking the RESP2 protocol.
+//
+// Channels are broker topics, so a channel name must be a valid topic name.
+// WithChannelSeparator lets services keep channel names such as "orders:created"
+// by translating their separator to dots. Glob patterns given to PSUBSCRIBE are
+// matched with Redis semantics; the broker subscription behind each one uses the
+// narrowest topic pattern that covers the glob.
+//
+// Supported commands are PUBLISH, SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE, PUNSUBSCRIBE,
+// PING, ECHO and QUIT. PUBLISH replies with the number of subscribers that received
+// the message, including those on other transports and in-process subscribers.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Kind is the type of a RESP2 value, identified by its first byte.
+type Kind byte
+
+// RESP2 value kinds.
+const (
+	SimpleString Kind = '+'
+	Error        Kind = '-'
+	Integer      Kind = ':'
+	BulkString   Kind = '$'
+	Array        Kind = '*'
+)
+
+const (
+	// DefaultMaxCommandSize is the largest command a Reader accepts by default,
+	// counting the bytes of all its arguments.
+	DefaultMaxCommandSize = 1 << 20
+
+	// maxLine is the longest line a Reader accepts, for inline commands and headers.
+	maxLine = 64 * 1024
+
+	// maxDepth limits how deeply arrays may nest.
+	maxDepth = 16
+)
+
+// ErrCommandTooLarge is returned when a command exceeds the reader's size limit.
+var ErrCommandTooLarge = errors.New("resp: command too large")
+
+// ProtocolError reports malformed input. The stream cannot be resynchronized after it.
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Reason
+}
+
+// Value is a RESP2 value.
+type Value struct {
+	Kind  Kind
+	Str   string  // simple strings, errors and bulk strings
+	Int   int64   // integers
+	Array []Value // arrays
+	Null  bool    // null bulk strings and null arrays
+}
+
+// Reader reads RESP2 values and commands from a stream.
+type Reader struct {
+	r       *bufio.Reader
+	maxSize int
+	budget  int // bytes left for the value being read
+}
+
+// NewReader creates a Reader that rejects commands larger than maxSize bytes.
+// A maxSize of zero or less means DefaultMaxCommandSize.
+func NewReader(r io.Reader, maxSize int) *Reader {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxCommandSize
+	}
+	return &Reader{r: bufio.NewReaderSize(r, maxLine), maxSize: maxSize}
+}
+
+// ReadCommand reads a command as its arguments. Commands are arrays of bulk strings,
+// or inline commands: a line of space-separated words, as typed into telnet.
+// Empty inline lines are skipped.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		first, err := r.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if Kind(first[0]) != Array {
+			line, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if args := strings.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+
+		v, err := r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		if v.Null || len(v.Array) == 0 {
+			continue
+		}
+		args := make([]string, len(v.Array))
+		for i, arg := range v.Array {
+			if arg.Kind != BulkString || arg.Null {
+				return nil, &ProtocolError{Reason: "expected a bulk string argument"}
+			}
+			args[i] = arg.Str
+		}
+		return args, nil
+	}
+}
+
+// ReadValue reads the next value.
+func (r *Reader) ReadValue() (Value, error) {
+	r.budget = r.maxSize
+	return r.readValue(0)
+}
+
+func (r *Reader) readValue(depth int) (Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	if line == "" {
+		return Value{}, &ProtocolError{Reason: "empty line where a value was expected"}
+	}
+
+	v := Value{Kind: Kind(line[0])}
+	body := line[1:]
+
+	switch v.Kind {
+	case SimpleString, Error:
+		v.Str = body
+
+	case Integer:
+		if v.Int, err = strconv.ParseInt(body, 10, 64); err != nil {
+			return Value{}, &ProtocolError{Reason: "invalid integer"}
+		}
+
+	case BulkString:
+		n, err := r.readLength(body)
+		if err != nil || n < 0 {
+			v.Null = true
+			return v, err
+		}
+		if n > r.budget {
+			return Value{}, fmt.Errorf("%w: limit is %d bytes", ErrCommandTooLarge, r.maxSize)
+		}
+		r.budget -= n
+
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return Value{}, io.ErrUnexpectedEOF
+			}
+			return Value{}, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return Value{}, &ProtocolError{Reason: "bulk string is not followed by CRLF"}
+		}
+		v.Str = string(buf[:n])
+
+	case Array:
+		if depth >= maxDepth {
+			return Value{}, &ProtocolError{Reason: "arrays nested too deeply"}
+		}
+		n, err := r.readLength(body)
+		if err != nil || n < 0 {
+			v.Null = true
+			return v, err
+		}
+		// Every element takes at least a few bytes, so the budget also bounds the count
+		if n > r.budget {
+			return Value{}, fmt.Errorf("%w: limit is %d bytes", ErrCommandTooLarge, r.maxSize)
+		}
+		for range n {
+			elem, err := r.readValue(depth + 1)
+			if err != nil {
+				return Value{}, err
+			}
+			v.Array = append(v.Array, elem)
+		}
+		if v.Array == nil {
+			v.Array = []Value{}
+		}
+
+	default:
+		return Value{}, &ProtocolError{Reason: fmt.Sprintf("unexpected %q", line[0])}
+	}
+
+	return v, nil
+}
+
+// readLength parses the length of a bulk string or array. -1 means null.
+func (r *Reader) readLength(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < -1 {
+		return 0, &ProtocolError{Reason: "invalid length"}
+	}
+	return n, nil
+}
+
+// readLine reads a line without its CRLF.
+func (r *Reader) readLine() (string, error) {
+	line, err := r.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", &ProtocolError{Reason: "line too long"}
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	// Costs a byte per line so that arrays of empty values still use up the budget
+	r.budget--
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// AppendValue appends the encoding of v to buf.
+func AppendValue(buf []byte, v Value) []byte {
+	switch v.Kind {
+	case SimpleString, Error:
+		// Simple strings cannot contain line breaks
+		buf = append(buf, byte(v.Kind))
+		buf = append(buf, strings.NewReplacer("\r", " ", "\n", " ").Replace(v.Str)...)
+	case Integer:
+		buf = strconv.AppendInt(append(buf, ':'), v.Int, 10)
+	case BulkString:
+		if v.Null {
+			return append(buf, "$-1\r\n"...)
+		}
+		buf = strconv.AppendInt(append(buf, '$'), int64(len(v.Str)), 10)
+		buf = append(append(buf, "\r\n"...), v.Str...)
+	case Array:
+		if v.Null {
+			return append(buf, "*-1\r\n"...)
+		}
+		buf = strconv.AppendInt(append(buf, '*'), int64(len(v.Array)), 10)
+		buf = append(buf, "\r\n"...)
+		for _, elem := range v.Array {
+			buf = AppendValue(buf, elem)
+		}
+		return buf
+	}
+	return append(buf, "\r\n"...)
+}
+
+// AppendCommand appends a command as an array of bulk strings.
+func AppendCommand(buf []byte, args ...string) []byte {
+	return AppendValue(buf, arrayOf(args...))
+}
+
+func simple(s string) Value {
+	return Value{Kind: SimpleString, Str: s}
+}
+
+func errorf(format string, args ...interface{}) Value {
+	return Value{Kind: Error, Str: fmt.Sprintf(format, args...)}
+}
+
+func integer(n int) Value {
+	return Value{Kind: Integer, Int: int64(n)}
+}
+
+func bulk(s string) Value {
+	return Value{Kind: BulkString, Str: s}
+}
+
+func nullBulk() Value {
+	return Value{Kind: BulkString, Null: true}
+}
+
+func array(v ...Value) Value {
+	return Value{Kind: Array, Array: v}
+}
+
+// arrayOf returns an array of bulk strings.
+func arrayOf(s ...string) Value {
+	v := Value{Kind: Array, Array: make([]Value, len(s))}
+	for i := range s {
+		v.Array[i] = bulk(s[i])
+	}
+	return v
+}
@@ -0,0 +1,418 @@
+package resp_test
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/resp"
+)
+
+// startServer serves a new broker over RESP on a loopback port.
+func startServer(t *testing.T, opts ...resp.Option) (*broker.Broker, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	b := broker.NewBroker()
+	s := resp.NewServer(b, opts...)
+	go s.Serve(l)
+
+	t.Cleanup(func() {
+		s.Close()
+		b.Close()
+	})
+	return b, l.Addr().String()
+}
+
+// client is a raw RESP connection for tests.
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *resp.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn, reader: resp.NewReader(conn, 0)}
+}
+
+func (c *client) send(args ...string) {
+	c.t.Helper()
+	if _, err := c.conn.Write(resp.AppendCommand(nil, args...)); err != nil {
+		c.t.Fatalf("Write() error = %v", err)
+	}
+}
+
+func (c *client) read() resp.Value {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	v, err := c.reader.ReadValue()
+	if err != nil {
+		c.t.Fatalf("ReadValue() error = %v", err)
+	}
+	return v
+}
+
+// do sends a command and returns its reply.
+func (c *client) do(args ...string) resp.Value {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+// expectNone fails if a value arrives within a short wait.
+func (c *client) expectNone() {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if v, err := c.reader.ReadValue(); err == nil {
+		c.t.Fatalf("unexpected value %s", format(v))
+	}
+}
+
+// format renders a value compactly for comparisons, such as [message orders hi].
+func format(v resp.Value) string {
+	switch {
+	case v.Null:
+		return "nil"
+	case v.Kind == resp.Integer:
+		return strconv.FormatInt(v.Int, 10)
+	case v.Kind == resp.Array:
+		parts := make([]string, len(v.Array))
+		for i, elem := range v.Array {
+			parts[i] = format(elem)
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	case v.Kind == resp.Error:
+		return "ERR(" + v.Str + ")"
+	default:
+		return v.Str
+	}
+}
+
+func (c *client) expect(want string, args ...string) {
+	c.t.Helper()
+	if got := format(c.do(args...)); got != want {
+		c.t.Errorf("%s = %s, want %s", strings.Join(args, " "), got, want)
+	}
+}
+
+func (c *client) expectRead(want string) {
+	c.t.Helper()
+	if got := format(c.read()); got != want {
+		c.t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "array", input: "*3\r\n$7\r\nPUBLISH\r\n$6\r\norders\r\n$2\r\nhi\r\n", want: []string{"PUBLISH", "orders", "hi"}},
+		{name: "binary safe", input: "*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n", want: []string{"ECHO", "a\r\nb"}},
+		{name: "inline", input: "SUBSCRIBE  a b\r\n", want: []string{"SUBSCRIBE", "a", "b"}},
+		{name: "blank lines skipped", input: "\r\n\r\nPING\n", want: []string{"PING"}},
+		{name: "empty array skipped", input: "*0\r\nPING\r\n", want: []string{"PING"}},
+		{name: "integer argument", input: "*1\r\n:1\r\n", wantErr: true},
+		{name: "bad length", input: "*x\r\n", wantErr: true},
+		{name: "missing CRLF", input: "*1\r\n$4\r\nPINGxx", wantErr: true},
+		{name: "too large", input: "*1\r\n$2000\r\n", wantErr: true},
+		{name: "truncated", input: "*2\r\n$4\r\nPING\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := resp.NewReader(strings.NewReader(tt.input), 1024)
+			got, err := r.ReadCommand()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("ReadCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	_, err := resp.NewReader(strings.NewReader("*1\r\n$2000\r\n"), 1024).ReadCommand()
+	if !errors.Is(err, resp.ErrCommandTooLarge) {
+		t.Errorf("error = %v, want ErrCommandTooLarge", err)
+	}
+}
+
+func TestValueRoundTrip(t *testing.T) {
+	values := []resp.Value{
+		{Kind: resp.SimpleString, Str: "OK"},
+		{Kind: resp.Error, Str: "ERR oops"},
+		{Kind: resp.Integer, Int: -42},
+		{Kind: resp.BulkString, Str: "bin\r\nary"},
+		{Kind: resp.BulkString, Null: true},
+		{Kind: resp.Array, Null: true},
+		{Kind: resp.Array, Array: []resp.Value{
+			{Kind: resp.BulkString, Str: "pmessage"},
+			{Kind: resp.Array, Array: []resp.Value{{Kind: resp.Integer, Int: 1}}},
+		}},
+	}
+
+	for _, want := range values {
+		encoded := resp.AppendValue(nil, want)
+		got, err := resp.NewReader(strings.NewReader(string(encoded)), 0).ReadValue()
+		if err != nil {
+			t.Fatalf("ReadValue(%q) error = %v", encoded, err)
+		}
+		if format(got) != format(want) || got.Kind != want.Kind {
+			t.Errorf("round trip of %q = %s, want %s", encoded, format(got), format(want))
+		}
+	}
+}
+
+func TestPublishAndSubscribe(t *testing.T) {
+	_, addr := startServer(t)
+	sub := dial(t, addr)
+	pub := dial(t, addr)
+
+	sub.expect("[subscribe orders 1]", "SUBSCRIBE", "orders")
+	sub.send("SUBSCRIBE", "users", "orders")
+	sub.expectRead("[subscribe users 2]")
+	sub.expectRead("[subscribe orders 2]")
+
+	pub.expect("1", "PUBLISH", "orders", "hello")
+	sub.expectRead("[message orders hello]")
+
+	pub.expect("0", "PUBLISH", "payments", "nobody")
+	sub.expectNone()
+
+	sub.expect("[unsubscribe orders 1]", "UNSUBSCRIBE", "orders")
+	pub.expect("0", "PUBLISH", "orders", "again")
+	sub.expectNone()
+
+	// Without arguments every channel is unsubscribed
+	sub.expect("[unsubscribe users 0]", "UNSUBSCRIBE")
+	sub.expect("[unsubscribe nil 0]", "UNSUBSCRIBE")
+	sub.expect("PONG", "PING")
+}
+
+func TestPatternSubscriptions(t *testing.T) {
+	_, addr := startServer(t)
+	pub := dial(t, addr)
+
+	tests := []struct {
+		pattern string
+		channel string
+		want    bool
+	}{
+		{pattern: "orders.*", channel: "orders.eu", want: true},
+		{pattern: "orders.*", channel: "orders.eu.new", want: true},
+		{pattern: "orders.*", channel: "orders", want: false},
+		{pattern: "orders*", channel: "orders", want: true},
+		{pattern: "orders.?u", channel: "orders.eu", want: true},
+		{pattern: "orders.?u", channel: "orders.usa", want: false},
+		{pattern: "orders.[eu]s", channel: "orders.us", want: true},
+		{pattern: "orders.[^eu]s", channel: "orders.us", want: false},
+		{pattern: "orders.[a-f]*", channel: "orders.eu", want: true},
+		{pattern: "*.created", channel: "users.v2.created", want: true},
+		{pattern: "*.created", channel: "users.deleted", want: false},
+		{pattern: "users", channel: "users", want: true},
+		{pattern: "a*a*b", channel: "aaaab", want: true},
+		{pattern: "*a?", channel: "bab", want: true},
+		// Exponential for a matcher that tries every split point of every star
+		{pattern: strings.Repeat("a*", 20) + "b", channel: strings.Repeat("a", 60), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.channel, func(t *testing.T) {
+			sub := dial(t, addr)
+			sub.expect("[psubscribe "+tt.pattern+" 1]", "PSUBSCRIBE", tt.pattern)
+
+			pub.send("PUBLISH", tt.channel, "x")
+			receivers := pub.read()
+			if (receivers.Int == 1) != tt.want {
+				t.Errorf("PUBLISH counted %d receivers, want match = %v", receivers.Int, tt.want)
+			}
+
+			if tt.want {
+				sub.expectRead("[pmessage " + tt.pattern + " " + tt.channel + " x]")
+			} else {
+				sub.expectNone()
+			}
+			sub.conn.Close()
+		})
+	}
+}
+
+func TestChannelAndPatternBothDeliver(t *testing.T) {
+	_, addr := startServer(t)
+	sub := dial(t, addr)
+	pub := dial(t, addr)
+
+	sub.expect("[subscribe news 1]", "SUBSCRIBE", "news")
+	sub.expect("[psubscribe n* 2]", "PSUBSCRIBE", "n*")
+
+	pub.expect("2", "PUBLISH", "news", "hi")
+
+	got := map[string]bool{format(sub.read()): true, format(sub.read()): true}
+	if !got["[message news hi]"] || !got["[pmessage n* news hi]"] {
+		t.Errorf("deliveries = %v, want a message and a pmessage", got)
+	}
+
+	sub.expect("[punsubscribe n* 1]", "PUNSUBSCRIBE")
+}
+
+func TestSubscribedModeRestrictsCommands(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	c.expect("hello", "PING", "hello")
+	c.expect("hi", "ECHO", "hi")
+	c.expect("[subscribe a 1]", "SUBSCRIBE", "a")
+
+	// PING answers differently once subscribed
+	c.expect("[pong ]", "PING")
+	c.expect("[pong x]", "PING", "x")
+
+	if got := c.do("PUBLISH", "a", "x"); got.Kind != resp.Error || !strings.Contains(got.Str, "only (P)SUBSCRIBE") {
+		t.Errorf("PUBLISH while subscribed = %s, want an error", format(got))
+	}
+	if got := c.do("ECHO", "x"); got.Kind != resp.Error {
+		t.Errorf("ECHO while subscribed = %s, want an error", format(got))
+	}
+
+	c.expect("OK", "QUIT")
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.reader.ReadValue(); err == nil {
+		t.Error("connection still open after QUIT")
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"FLUSHALL"}, want: "ERR unknown command 'FLUSHALL'"},
+		{args: []string{"PUBLISH", "a"}, want: "ERR wrong number of arguments for 'publish' command"},
+		{args: []string{"SUBSCRIBE"}, want: "ERR wrong number of arguments for 'subscribe' command"},
+		{args: []string{"PUBLISH", "bad channel", "x"}, want: "ERR invalid channel"},
+		{args: []string{"SUBSCRIBE", "a:b"}, want: "ERR invalid channel"},
+	}
+	for _, tt := range tests {
+		got := c.do(tt.args...)
+		if got.Kind != resp.Error || !strings.HasPrefix(got.Str, tt.want) {
+			t.Errorf("%s = %s, want error %q", strings.Join(tt.args, " "), format(got), tt.want)
+		}
+	}
+
+	// Inline commands work too
+	if _, err := c.conn.Write([]byte("PING\r\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	c.expectRead("PONG")
+
+	// A protocol error is reported and closes the connection
+	if _, err := c.conn.Write([]byte("*1\r\n$x\r\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if got := c.read(); got.Kind != resp.Error || !strings.Contains(got.Str, "Protocol error") {
+		t.Errorf("got %s, want a protocol error", format(got))
+	}
+}
+
+func TestPublishAfterBrokerClose(t *testing.T) {
+	b, addr := startServer(t)
+	c := dial(t, addr)
+
+	b.Close()
+	c.expect("ERR(ERR broker is closed)", "PUBLISH", "orders", "hello")
+}
+
+func TestChannelSeparator(t *testing.T) {
+	b, addr := startServer(t, resp.WithChannelSeparator(":"))
+	c := dial(t, addr)
+
+	// Broker publishes arrive under the translated channel name
+	c.expect("[subscribe orders:created 1]", "SUBSCRIBE", "orders:created")
+	c.expect("[psubscribe users:* 2]", "PSUBSCRIBE", "users:*")
+
+	created, _ := topic.New("orders.created")
+	b.Publish(message.NewMessage(created, map[string]int{"qty": 2}))
+	c.expectRead(`[message orders:created {"qty":2}]`)
+
+	usersEU, _ := topic.New("users.eu")
+	b.Publish(message.NewMessage(usersEU, []byte("signup")))
+	c.expectRead("[pmessage users:* users:eu signup]")
+
+	// RESP publishes reach broker subscribers as []byte under the topic name
+	pub := dial(t, addr)
+	brokerSub := b.Subscribe(created)
+	defer b.Unsubscribe(brokerSub.ID())
+
+	// Broker subscribers are counted along with RESP ones
+	pub.expect("2", "PUBLISH", "orders:created", "raw")
+	select {
+	case msg := <-brokerSub.MessageChannel():
+		if data, ok := msg.Data().([]byte); !ok || string(data) != "raw" {
+			t.Errorf("data = %#v, want []byte(\"raw\")", msg.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("broker subscriber did not receive the message")
+	}
+	c.expectRead("[message orders:created raw]")
+
+	// Dotted channel names are ambiguous with a separator
+	if got := pub.do("PUBLISH", "orders.created", "x"); got.Kind != resp.Error {
+		t.Errorf("PUBLISH to a dotted channel = %s, want an error", format(got))
+	}
+}
+
+func TestUnencodableMessageIsReported(t *testing.T) {
+	b, addr := startServer(t)
+	c := dial(t, addr)
+	c.expect("[subscribe orders 1]", "SUBSCRIBE", "orders")
+
+	orders, _ := topic.New("orders")
+	b.Publish(message.NewMessage(orders, make(chan int)))
+	if got := c.read(); got.Kind != resp.Error || !strings.Contains(got.Str, "cannot encode") {
+		t.Errorf("got %s, want an error reporting the message", format(got))
+	}
+
+	// Later messages still arrive
+	b.Publish(message.NewMessage(orders, []byte("next")))
+	c.expectRead("[message orders next]")
+}
+
+func TestDisconnectUnsubscribes(t *testing.T) {
+	_, addr := startServer(t)
+	sub := dial(t, addr)
+	pub := dial(t, addr)
+
+	sub.expect("[subscribe a 1]", "SUBSCRIBE", "a")
+	sub.conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for format(pub.do("PUBLISH", "a", "x")) != "0" {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription of the closed connection was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,547 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+const (
+	// DefaultAddr is the address the RESP listener uses by default, the Redis port.
+	DefaultAddr = ":6379"
+
+	// DefaultWriteTimeout is how long a write to a client may take before the
+	// connection is considered dead.
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("resp: server closed")
+
+var (
+	// errQuit ends a connection after QUIT is answered.
+	errQuit = errors.New("client quit")
+
+	// errEmptyChannel is returned for an empty channel or pattern.
+	errEmptyChannel = errors.New("channel name cannot be empty")
+)
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithMaxCommandSize sets the largest command the server accepts.
+// Clients that send a larger command are disconnected.
+func WithMaxCommandSize(n int) Option {
+	return func(s *Server) {
+		s.maxCommandSize = n
+	}
+}
+
+// WithWriteTimeout sets how long a write to a client may take.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithChannelSeparator translates sep in channel names to the topic separator and
+// back, so that with ":" the channel "orders:created" is the topic "orders.created".
+// Channel names containing dots are then refused, since they could not be told apart.
+func WithChannelSeparator(sep string) Option {
+	return func(s *Server) {
+		if sep != topic.Separator {
+			s.separator = sep
+		}
+	}
+}
+
+// WithSubscriptionOptions sets options applied to every subscription made by a client,
+// such as the buffer size and overflow policy.
+func WithSubscriptionOptions(opts ...subscription.Option) Option {
+	return func(s *Server) {
+		s.subOptions = opts
+	}
+}
+
+// Server accepts Redis client connections and relays their commands to a broker.
+type Server struct {
+	broker         *broker.Broker
+	maxCommandSize int
+	writeTimeout   time.Duration
+	separator      string
+	subOptions     []subscription.Option
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer creates a RESP server for the broker.
+func NewServer(b *broker.Broker, opts ...Option) *Server {
+	s := &Server{
+		broker:         b,
+		maxCommandSize: DefaultMaxCommandSize,
+		writeTimeout:   DefaultWriteTimeout,
+		listeners:      make(map[net.Listener]struct{}),
+		conns:          make(map[*conn]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// ListenAndServe listens on the TCP address and serves clients until Close.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until Close. It always returns a
+// non-nil error; after Close the error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		c := s.newConn(netConn)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			netConn.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections, disconnects every client and removes their
+// subscriptions. The broker itself is left open.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.netConn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// topicName translates a channel name to a topic name.
+func (s *Server) topicName(channel string) (string, error) {
+	if channel == "" {
+		return "", errEmptyChannel
+	}
+	if s.separator == "" {
+		return channel, nil
+	}
+	if strings.Contains(channel, topic.Separator) {
+		return "", fmt.Errorf("channel %q contains a dot", channel)
+	}
+	return strings.ReplaceAll(channel, s.separator, topic.Separator), nil
+}
+
+// channelName translates a topic to a channel name.
+func (s *Server) channelName(t topic.Topic) string {
+	if s.separator == "" {
+		return t.String()
+	}
+	return strings.ReplaceAll(t.String(), topic.Separator, s.separator)
+}
+
+// misses counts the pattern subscriptions of connected clients that the broker
+// delivers a message on the channel to, but that skip it because their glob does not
+// match: the topic pattern behind a glob can cover more topics than the glob itself.
+// Globs are matched after the locks are released, so that long globs do not hold up
+// other clients.
+func (s *Server) misses(channel string, t topic.Topic) int {
+	type globSub struct {
+		glob    string
+		pattern topic.Topic
+	}
+	var globs []globSub
+
+	s.mu.Lock()
+	for c := range s.conns {
+		c.mu.Lock()
+		for glob, sub := range c.patterns {
+			globs = append(globs, globSub{glob: glob, pattern: sub.Topic()})
+		}
+		c.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	n := 0
+	for _, g := range globs {
+		if g.pattern.Matches(t) && !globMatch(g.glob, channel) {
+			n++
+		}
+	}
+	return n
+}
+
+// conn is one client connection.
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	reader  *Reader
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	mu       sync.Mutex
+	channels map[string]*subscription.Subscription // channel -> subscription
+	patterns map[string]*subscription.Subscription // glob -> subscription
+	wg       sync.WaitGroup                        // forwarders
+}
+
+func (s *Server) newConn(netConn net.Conn) *conn {
+	return &conn{
+		server:   s,
+		netConn:  netConn,
+		reader:   NewReader(netConn, s.maxCommandSize),
+		writer:   bufio.NewWriter(netConn),
+		channels: make(map[string]*subscription.Subscription),
+		patterns: make(map[string]*subscription.Subscription),
+	}
+}
+
+// serve reads commands until the client disconnects or quits, then removes its
+// subscriptions.
+func (c *conn) serve() {
+	defer c.teardown()
+
+	for {
+		args, err := c.reader.ReadCommand()
+		var protocolErr *ProtocolError
+		switch {
+		case errors.As(err, &protocolErr):
+			c.write(errorf("ERR %s", protocolErr))
+			return
+		case errors.Is(err, ErrCommandTooLarge):
+			c.write(errorf("ERR %s", err))
+			return
+		case err != nil:
+			return
+		}
+
+		if err := c.handle(args); err != nil {
+			return
+		}
+	}
+}
+
+// subscribedCommands are the commands allowed once a client has subscriptions.
+var subscribedCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+}
+
+// handle runs a command. A returned error closes the connection.
+func (c *conn) handle(args []string) error {
+	name := strings.ToUpper(args[0])
+	subscribed := c.subscriptionCount() > 0
+
+	if subscribed && !subscribedCommands[name] {
+		return c.write(errorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(name)))
+	}
+
+	switch name {
+	case "PING":
+		if len(args) > 2 {
+			return c.write(wrongArgs(name))
+		}
+		message := ""
+		if len(args) == 2 {
+			message = args[1]
+		}
+		if subscribed {
+			return c.write(array(bulk("pong"), bulk(message)))
+		}
+		if len(args) == 2 {
+			return c.write(bulk(message))
+		}
+		return c.write(simple("PONG"))
+
+	case "ECHO":
+		if len(args) != 2 {
+			return c.write(wrongArgs(name))
+		}
+		return c.write(bulk(args[1]))
+
+	case "QUIT":
+		c.write(simple("OK"))
+		return errQuit
+
+	case "PUBLISH":
+		if len(args) != 3 {
+			return c.write(wrongArgs(name))
+		}
+		return c.publish(args[1], args[2])
+
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(args) < 2 {
+			return c.write(wrongArgs(name))
+		}
+		for _, channel := range args[1:] {
+			if err := c.subscribe(channel, name == "PSUBSCRIBE"); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		return c.unsubscribe(args[1:], name == "PUNSUBSCRIBE")
+
+	default:
+		return c.write(errorf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+func wrongArgs(command string) Value {
+	return errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))
+}
+
+func (c *conn) publish(channel, payload string) error {
+	name, err := c.server.topicName(channel)
+	if err != nil {
+		return c.write(errorf("ERR invalid channel: %s", err))
+	}
+	t, err := topic.New(name)
+	if err != nil {
+		return c.write(errorf("ERR invalid channel: %s", err))
+	}
+
+	result, err := c.server.broker.PublishContext(context.Background(), message.NewMessage(t, []byte(payload)))
+	if err != nil {
+		return c.write(errorf("ERR %s", err))
+	}
+	return c.write(integer(max(result.Delivered-c.server.misses(channel, t), 0)))
+}
+
+// subscribe subscribes to a channel, or to a glob pattern when isPattern is set, and
+// confirms it. Subscribing twice to the same name only repeats the confirmation.
+func (c *conn) subscribe(name string, isPattern bool) error {
+	kind, subs := "subscribe", c.channels
+	if isPattern {
+		kind, subs = "psubscribe", c.patterns
+	}
+
+	t, err := c.brokerTopic(name, isPattern)
+	if err != nil {
+		return c.write(errorf("ERR invalid channel: %s", err))
+	}
+
+	c.mu.Lock()
+	_, exists := subs[name]
+	var sub *subscription.Subscription
+	if !exists {
+		sub = c.server.broker.Subscribe(t, c.server.subOptions...)
+		subs[name] = sub
+	}
+	count := len(c.channels) + len(c.patterns)
+	c.mu.Unlock()
+
+	// Confirm before any message from the new subscription is written
+	if err := c.write(array(bulk(kind), bulk(name), integer(count))); err != nil {
+		return err
+	}
+	if sub != nil {
+		c.wg.Add(1)
+		go c.forward(sub, name, isPattern)
+	}
+	return nil
+}
+
+// brokerTopic returns the topic or topic pattern to subscribe to for a channel or glob.
+func (c *conn) brokerTopic(name string, isPattern bool) (topic.Topic, error) {
+	if name == "" {
+		return topic.Topic{}, errEmptyChannel
+	}
+	if !isPattern {
+		translated, err := c.server.topicName(name)
+		if err != nil {
+			return topic.Topic{}, err
+		}
+		return topic.New(translated)
+	}
+
+	translated := name
+	if c.server.separator != "" {
+		translated = strings.ReplaceAll(name, c.server.separator, topic.Separator)
+	}
+	return coveringPattern(translated)
+}
+
+// unsubscribe cancels the named channel or pattern subscriptions, or all of them
+// when no names are given, confirming each one.
+func (c *conn) unsubscribe(names []string, isPattern bool) error {
+	kind, subs := "unsubscribe", c.channels
+	if isPattern {
+		kind, subs = "punsubscribe", c.patterns
+	}
+
+	c.mu.Lock()
+	if len(names) == 0 {
+		for name := range subs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	c.mu.Unlock()
+
+	if len(names) == 0 {
+		return c.write(array(bulk(kind), nullBulk(), integer(c.subscriptionCount())))
+	}
+
+	for _, name := range names {
+		c.mu.Lock()
+		sub, ok := subs[name]
+		delete(subs, name)
+		count := len(c.channels) + len(c.patterns)
+		c.mu.Unlock()
+
+		if ok {
+			c.server.broker.Unsubscribe(sub.ID())
+		}
+		if err := c.write(array(bulk(kind), bulk(name), integer(count))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) subscriptionCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.channels) + len(c.patterns)
+}
+
+// forward writes a subscription's messages to the client until the subscription is
+// closed. Pattern subscriptions cover more topics than their glob, so messages on
+// channels the glob does not match are skipped. A message whose payload cannot be
+// encoded is reported with an error reply instead. A failed write closes the connection.
+func (c *conn) forward(sub *subscription.Subscription, name string, isPattern bool) {
+	defer c.wg.Done()
+
+	for msg := range sub.MessageChannel() {
+		channel := c.server.channelName(msg.Topic())
+		if isPattern && !globMatch(name, channel) {
+			continue
+		}
+
+		payload, _, err := message.EncodePayload(msg)
+		if err != nil {
+			if err := c.write(errorf("ERR cannot encode message %s on channel %s: %s", msg.ID(), channel, err)); err != nil {
+				c.netConn.Close()
+				return
+			}
+			continue
+		}
+
+		push := arrayOf("message", channel, string(payload))
+		if isPattern {
+			push = arrayOf("pmessage", name, channel, string(payload))
+		}
+		if err := c.write(push); err != nil {
+			c.netConn.Close()
+			return
+		}
+	}
+}
+
+// write sends a value to the client.
+func (c *conn) write(v Value) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.server.writeTimeout > 0 {
+		c.netConn.SetWriteDeadline(time.Now().Add(c.server.writeTimeout))
+	}
+	if _, err := c.writer.Write(AppendValue(nil, v)); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// teardown removes the client's subscriptions and closes the connection.
+func (c *conn) teardown() {
+	c.mu.Lock()
+	subs := make([]*subscription.Subscription, 0, len(c.channels)+len(c.patterns))
+	for _, sub := range c.channels {
+		subs = append(subs, sub)
+	}
+	for _, sub := range c.patterns {
+		subs = append(subs, sub)
+	}
+	c.channels = make(map[string]*subscription.Subscription)
+	c.patterns = make(map[string]*subscription.Subscription)
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		c.server.broker.Unsubscribe(sub.ID())
+	}
+	c.netConn.Close()
+	c.wg.Wait()
+}
@@ -0,0 +1,348 @@
+// Package tcp serves a broker over TCP using the wire protocol, so that separate
+// processes can publish to and subscribe from one broker.
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/wire"
+)
+
+const (
+	// DefaultAddr is the address the broker listens on by default.
+	DefaultAddr = ":4242"
+
+	// DefaultWriteTimeout is how long a write to a client may take before the
+	// connection is considered dead.
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("tcp: server closed")
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithMaxPayload sets the largest PUB payload the server accepts.
+// Clients that send a larger payload are disconnected.
+func WithMaxPayload(n int) Option {
+	return func(s *Server) {
+		s.maxPayload = n
+	}
+}
+
+// WithWriteTimeout sets how long a write to a client may take.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithSubscriptionOptions sets options applied to every subscription made by a client,
+// such as the buffer size and overflow policy.
+func WithSubscriptionOptions(opts ...subscription.Option) Option {
+	return func(s *Server) {
+		s.subOptions = opts
+	}
+}
+
+// Server accepts client connections and relays their frames to a broker.
+type Server struct {
+	broker       *broker.Broker
+	maxPayload   int
+	writeTimeout time.Duration
+	subOptions   []subscription.Option
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer creates a server for the broker.
+func NewServer(b *broker.Broker, opts ...Option) *Server {
+	s := &Server{
+		broker:       b,
+		maxPayload:   wire.DefaultMaxPayload,
+		writeTimeout: DefaultWriteTimeout,
+		listeners:    make(map[net.Listener]struct{}),
+		conns:        make(map[*conn]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// ListenAndServe listens on the TCP address and serves clients until Close.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until Close. It always returns a
+// non-nil error; after Close the error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		c := s.newConn(netConn)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			netConn.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections, disconnects every client and removes their
+// subscriptions. The broker itself is left open.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.netConn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// conn is one client connection.
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	reader  *wire.Reader
+
+	writeMu sync.Mutex
+	writer  *bufio.Writer
+
+	mu   sync.Mutex
+	subs map[string]*subscription.Subscription // sid -> subscription
+	wg   sync.WaitGroup                        // forwarders
+}
+
+func (s *Server) newConn(netConn net.Conn) *conn {
+	return &conn{
+		server:  s,
+		netConn: netConn,
+		reader:  wire.NewReader(netConn, s.maxPayload),
+		writer:  bufio.NewWriter(netConn),
+		subs:    make(map[string]*subscription.Subscription),
+	}
+}
+
+// serve reads frames until the client disconnects, then removes its subscriptions.
+func (c *conn) serve() {
+	defer c.teardown()
+
+	for {
+		f, err := c.reader.ReadFrame()
+		var protocolErr *wire.ProtocolError
+		switch {
+		case errors.As(err, &protocolErr):
+			c.writeError(protocolErr.Reason)
+			continue
+		case errors.Is(err, wire.ErrPayloadTooLarge), errors.Is(err, wire.ErrControlLineTooLong), errors.Is(err, wire.ErrInvalidPayloadSize):
+			c.writeError(err.Error())
+			return
+		case err != nil:
+			return
+		}
+
+		if err := c.handle(f); err != nil {
+			c.writeError(err.Error())
+		}
+	}
+}
+
+// handle applies a frame from the client. Returned errors are reported with ERR.
+func (c *conn) handle(f wire.Frame) error {
+	switch f.Op {
+	case wire.OpPub:
+		return c.publish(f)
+	case wire.OpSub:
+		return c.subscribe(f)
+	case wire.OpUnsub:
+		return c.unsubscribe(f.SID)
+	case wire.OpPing:
+		return c.write(wire.Frame{Op: wire.OpPong})
+	case wire.OpPong:
+		return nil
+	default:
+		return fmt.Errorf("unexpected %s from client", f.Op)
+	}
+}
+
+func (c *conn) publish(f wire.Frame) error {
+	msg, err := message.Decode(f.Payload)
+	if err != nil {
+		return err
+	}
+	if msg.Topic().String() != f.Topic {
+		return fmt.Errorf("PUB topic %s does not match message topic %s", f.Topic, msg.Topic())
+	}
+
+	_, err = c.server.broker.PublishContext(context.Background(), msg)
+	return err
+}
+
+func (c *conn) subscribe(f wire.Frame) error {
+	pattern, err := topic.NewPattern(f.Topic)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.subs[f.SID]; exists {
+		return fmt.Errorf("sid %s is already in use", f.SID)
+	}
+
+	opts := append([]subscription.Option(nil), c.server.subOptions...)
+	if f.Group != "" {
+		opts = append(opts, subscription.WithGroup(f.Group))
+	}
+	sub := c.server.broker.Subscribe(pattern, opts...)
+	c.subs[f.SID] = sub
+
+	c.wg.Add(1)
+	go c.forward(f.SID, sub)
+	return nil
+}
+
+func (c *conn) unsubscribe(sid string) error {
+	c.mu.Lock()
+	sub, ok := c.subs[sid]
+	delete(c.subs, sid)
+	c.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("unknown sid %s", sid)
+	}
+	c.server.broker.Unsubscribe(sub.ID())
+	return nil
+}
+
+// forward writes a subscription's messages to the client as MSG frames until the
+// subscription is closed. A failed write closes the connection. If the broker closed
+// the subscription, its sid is released and the client is told with ERR.
+func (c *conn) forward(sid string, sub *subscription.Subscription) {
+	defer c.wg.Done()
+
+	for msg := range sub.MessageChannel() {
+		payload, err := message.Encode(msg)
+		if err != nil {
+			c.writeError(err.Error())
+			continue
+		}
+
+		err = c.write(wire.Frame{Op: wire.OpMsg, Topic: msg.Topic().String(), SID: sid, Payload: payload})
+		if err != nil {
+			c.netConn.Close()
+			return
+		}
+	}
+
+	// An UNSUB or teardown has already removed the sid
+	c.mu.Lock()
+	current := c.subs[sid] == sub
+	if current {
+		delete(c.subs, sid)
+	}
+	c.mu.Unlock()
+
+	if current {
+		c.writeError("subscription " + sid + " was closed by the broker")
+	}
+}
+
+// write sends a frame to the client.
+func (c *conn) write(f wire.Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.server.writeTimeout > 0 {
+		c.netConn.SetWriteDeadline(time.Now().Add(c.server.writeTimeout))
+	}
+	if err := wire.WriteFrame(c.writer, f); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *conn) writeError(message string) {
+	c.write(wire.Frame{Op: wire.OpErr, Message: message})
+}
+
+// teardown removes the client's subscriptions and closes the connection.
+func (c *conn) teardown() {
+	c.mu.Lock()
+	subs := c.subs
+	c.subs = make(map[string]*subscription.Subscription)
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		c.server.broker.Unsubscribe(sub.ID())
+	}
+	c.netConn.Close()
+	c.wg.Wait()
+}
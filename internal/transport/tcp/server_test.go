@@ -0,0 +1,296 @@
+package tcp_test
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/tcp"
+	"github.com/gophercast/gophercast/internal/transport/wire"
+)
+
+// startServer serves a new broker on a loopback port.
+func startServer(t *testing.T, opts ...tcp.Option) (*broker.Broker, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	b := broker.NewBroker()
+	s := tcp.NewServer(b, opts...)
+	go s.Serve(l)
+
+	t.Cleanup(func() {
+		s.Close()
+		b.Close()
+	})
+	return b, l.Addr().String()
+}
+
+// client is a raw protocol connection for tests.
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *wire.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn, reader: wire.NewReader(conn, 0)}
+}
+
+func (c *client) send(f wire.Frame) {
+	c.t.Helper()
+	if err := wire.WriteFrame(c.conn, f); err != nil {
+		c.t.Fatalf("WriteFrame() error = %v", err)
+	}
+}
+
+func (c *client) publish(msg message.Message) {
+	c.t.Helper()
+	payload, err := message.Encode(msg)
+	if err != nil {
+		c.t.Fatalf("Encode() error = %v", err)
+	}
+	c.send(wire.Frame{Op: wire.OpPub, Topic: msg.Topic().String(), Payload: payload})
+}
+
+func (c *client) read() wire.Frame {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := c.reader.ReadFrame()
+	if err != nil {
+		c.t.Fatalf("ReadFrame() error = %v", err)
+	}
+	return f
+}
+
+// sync waits until the server has processed every frame sent so far.
+func (c *client) sync() {
+	c.t.Helper()
+	c.send(wire.Frame{Op: wire.OpPing})
+	if f := c.read(); f.Op != wire.OpPong {
+		c.t.Fatalf("read %+v, want PONG", f)
+	}
+}
+
+func TestServerPublishSubscribe(t *testing.T) {
+	_, addr := startServer(t)
+	pub := dial(t, addr)
+	sub := dial(t, addr)
+
+	sub.send(wire.Frame{Op: wire.OpSub, Topic: "orders.*", SID: "s1"})
+	sub.sync()
+
+	orders, _ := topic.New("orders.created")
+	sent := message.NewMessage(orders, map[string]interface{}{"id": "o-1"}, message.WithCorrelationID("req-1"))
+	pub.publish(sent)
+
+	f := sub.read()
+	if f.Op != wire.OpMsg || f.Topic != "orders.created" || f.SID != "s1" {
+		t.Fatalf("read %+v, want MSG orders.created s1", f)
+	}
+	got, err := message.Decode(f.Payload)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if got.ID() != sent.ID() || got.CorrelationID() != "req-1" {
+		t.Errorf("received %s with correlation ID %q, want %s with req-1", got.ID(), got.CorrelationID(), sent.ID())
+	}
+
+	// After UNSUB nothing more arrives
+	sub.send(wire.Frame{Op: wire.OpUnsub, SID: "s1"})
+	sub.sync()
+	pub.publish(message.NewMessage(orders, "ignored"))
+	pub.sync()
+	sub.sync()
+}
+
+func TestServerSharesBrokerWithInProcessClients(t *testing.T) {
+	b, addr := startServer(t)
+	remote := dial(t, addr)
+
+	orders, _ := topic.New("orders")
+	local := b.Subscribe(orders)
+
+	remote.send(wire.Frame{Op: wire.OpSub, Topic: "orders", SID: "1"})
+	remote.sync()
+
+	// Remote publishes reach in-process subscribers
+	remote.publish(message.NewMessage(orders, "from remote"))
+	select {
+	case msg := <-local.MessageChannel():
+		if msg.Data() != "from remote" {
+			t.Errorf("local received %v, want from remote", msg.Data())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("local subscriber timed out")
+	}
+
+	// In-process publishes reach remote subscribers, along with the remote's own
+	remote.read()
+	b.Publish(message.NewMessage(orders, "from local"))
+	f := remote.read()
+	got, _ := message.Decode(f.Payload)
+	if got.Data() != "from local" {
+		t.Errorf("remote received %v, want from local", got.Data())
+	}
+}
+
+func TestServerConsumerGroup(t *testing.T) {
+	_, addr := startServer(t)
+	pub := dial(t, addr)
+	workers := []*client{dial(t, addr), dial(t, addr)}
+
+	for _, w := range workers {
+		w.send(wire.Frame{Op: wire.OpSub, Topic: "jobs", SID: "1", Group: "workers"})
+		w.sync()
+	}
+
+	jobs, _ := topic.New("jobs")
+	for i := 0; i < 4; i++ {
+		pub.publish(message.NewMessage(jobs, i))
+	}
+
+	// Round robin gives each worker two of the four jobs
+	for _, w := range workers {
+		for i := 0; i < 2; i++ {
+			if f := w.read(); f.Op != wire.OpMsg {
+				t.Fatalf("read %+v, want MSG", f)
+			}
+		}
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	_, addr := startServer(t)
+	ordersEnvelope := `{"id":"1","topic":"orders","data":1,"published_at":"2024-01-01T00:00:00Z"}`
+
+	tests := []struct {
+		name    string
+		frame   string
+		wantErr string
+	}{
+		{"unknown op", "HELLO\r\n", "unknown operation"},
+		{"invalid pattern", "SUB orders.>.x 1\r\n", "invalid topic pattern"},
+		{"unknown sid", "UNSUB 9\r\n", "unknown sid"},
+		{"invalid payload", "PUB orders 3\r\nabc\r\n", "decode message"},
+		{"topic mismatch", fmt.Sprintf("PUB other %d\r\n%s\r\n", len(ordersEnvelope), ordersEnvelope), "does not match"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, addr)
+			c.conn.Write([]byte(tt.frame))
+
+			f := c.read()
+			if f.Op != wire.OpErr || !strings.Contains(f.Message, tt.wantErr) {
+				t.Errorf("read %+v, want ERR containing %q", f, tt.wantErr)
+			}
+
+			// The connection remains usable
+			c.sync()
+		})
+	}
+}
+
+func TestServerPublishAfterBrokerClose(t *testing.T) {
+	b, addr := startServer(t)
+	c := dial(t, addr)
+
+	b.Close()
+	orders, _ := topic.New("orders")
+	c.publish(message.NewMessage(orders, 1))
+	if f := c.read(); f.Op != wire.OpErr || !strings.Contains(f.Message, broker.ErrBrokerClosed.Error()) {
+		t.Errorf("read %+v, want ERR containing %q", f, broker.ErrBrokerClosed)
+	}
+}
+
+func TestServerDisconnectsUnframeablePayload(t *testing.T) {
+	_, addr := startServer(t, tcp.WithMaxPayload(8))
+
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"oversized payload", "PUB orders 100\r\n"},
+		// The payload would otherwise be read as commands
+		{"invalid payload size", "PUB orders -1\r\nSUB > 1\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, addr)
+			c.conn.Write([]byte(tt.frame))
+			if f := c.read(); f.Op != wire.OpErr {
+				t.Fatalf("read %+v, want ERR", f)
+			}
+
+			// An open connection would answer the PING
+			c.conn.Write([]byte("PING\r\n"))
+			c.conn.SetReadDeadline(time.Now().Add(time.Second))
+			if f, err := c.reader.ReadFrame(); err == nil {
+				t.Errorf("read %+v, want the connection closed", f)
+			}
+		})
+	}
+}
+
+func TestServerReleasesSIDOfClosedSubscription(t *testing.T) {
+	b, addr := startServer(t)
+	c := dial(t, addr)
+
+	c.send(wire.Frame{Op: wire.OpSub, Topic: "orders", SID: "1"})
+	c.sync()
+
+	b.Close()
+	if f := c.read(); f.Op != wire.OpErr || !strings.Contains(f.Message, "closed") {
+		t.Fatalf("read %+v, want ERR reporting the closed subscription", f)
+	}
+	c.send(wire.Frame{Op: wire.OpUnsub, SID: "1"})
+	if f := c.read(); f.Op != wire.OpErr || !strings.Contains(f.Message, "unknown sid") {
+		t.Errorf("read %+v, want ERR for the released sid", f)
+	}
+}
+
+func TestServerRemovesSubscriptionsOnDisconnect(t *testing.T) {
+	b, addr := startServer(t)
+	c := dial(t, addr)
+
+	c.send(wire.Frame{Op: wire.OpSub, Topic: "jobs", SID: "1", Group: "workers"})
+	c.sync()
+
+	jobs, _ := topic.New("jobs")
+	local := b.Subscribe(jobs, subscription.WithGroup("workers"))
+	c.conn.Close()
+
+	// While the remote member remains, round robin sends it every other message.
+	// Once it is removed, every message goes to the local member.
+	received := 0
+	deadline := time.After(2 * time.Second)
+	for received < 5 {
+		b.Publish(message.NewMessage(jobs, "job"))
+		select {
+		case <-local.MessageChannel():
+			received++
+		case <-time.After(20 * time.Millisecond):
+			received = 0
+		case <-deadline:
+			t.Fatal("remote group member was not removed")
+		}
+	}
+}
@@ -0,0 +1,498 @@
+// Package websocket serves a broker over WebSocket connections (RFC 6455). One
+// connection can hold many subscriptions and publish to many topics using JSON frames.
+//
+// The protocol layer in this file implements the parts of RFC 6455 the transport
+// needs, without extensions or subprotocols: the opening handshake, framing,
+// fragmentation, masking, and the ping, pong and close control frames.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the type of a data message.
+type MessageType int
+
+// Message types.
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// Frame opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close codes.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+const (
+	// DefaultMaxMessageSize is the largest message a Conn accepts by default.
+	DefaultMaxMessageSize = 1 << 20
+
+	// acceptGUID is appended to the client's key to compute Sec-WebSocket-Accept.
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// maxControlPayload is the largest payload a control frame may carry.
+	maxControlPayload = 125
+)
+
+var (
+	// ErrMessageTooBig is returned when a peer sends a message over the size limit.
+	ErrMessageTooBig = errors.New("websocket: message too big")
+
+	// ErrBadHandshake is returned when the opening handshake fails.
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+)
+
+// CloseError is returned by ReadMessage when the peer closes the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with code %d %s", e.Code, e.Reason)
+}
+
+// protocolError is a violation of RFC 6455 by the peer.
+type protocolError struct {
+	code    int
+	message string
+}
+
+func (e *protocolError) Error() string {
+	return "websocket: " + e.message
+}
+
+// Conn is a WebSocket connection. ReadMessage must be called from one goroutine;
+// the write methods may be called concurrently.
+type Conn struct {
+	netConn  net.Conn
+	reader   *bufio.Reader
+	isClient bool // clients mask the frames they send
+
+	maxMessageSize int64
+	pongHandler    func(data []byte)
+
+	writeMu   sync.Mutex
+	closeSent bool // guarded by writeMu
+}
+
+func newConn(netConn net.Conn, reader *bufio.Reader, isClient bool) *Conn {
+	if reader == nil {
+		reader = bufio.NewReader(netConn)
+	}
+	return &Conn{
+		netConn:        netConn,
+		reader:         reader,
+		isClient:       isClient,
+		maxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// Upgrade completes the server side of the opening handshake and takes over the
+// request's connection. On failure it writes an HTTP error response.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	fail := func(status int, reason string) (*Conn, error) {
+		http.Error(w, reason, status)
+		return nil, fmt.Errorf("%w: %s", ErrBadHandshake, reason)
+	}
+
+	if r.Method != http.MethodGet {
+		return fail(http.StatusMethodNotAllowed, "method must be GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return fail(http.StatusBadRequest, "missing upgrade to websocket")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return fail(http.StatusUpgradeRequired, "unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return fail(http.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+
+	netConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return fail(http.StatusInternalServerError, "connection cannot be hijacked")
+	}
+	// The hijacked connection may carry a deadline set by the server
+	netConn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := netConn.Write([]byte(response)); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return newConn(netConn, rw.Reader, false), nil
+}
+
+// Dial opens a client connection to a ws:// URL. It is mainly used by tests and
+// Go programs; browsers use their built-in WebSocket.
+func Dial(rawURL string) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	netConn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Key":     {key},
+			"Sec-Websocket-Version": {"13"},
+		},
+	}
+	if err := req.Write(netConn); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		netConn.Close()
+		return nil, fmt.Errorf("%w: server responded %s", ErrBadHandshake, resp.Status)
+	}
+
+	return newConn(netConn, reader, true), nil
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value for a client key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContainsToken reports whether a comma-separated header contains a token.
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetMaxMessageSize sets the largest message ReadMessage accepts.
+func (c *Conn) SetMaxMessageSize(n int64) {
+	c.maxMessageSize = n
+}
+
+// SetPongHandler sets a function called for every pong received.
+// It runs on the goroutine calling ReadMessage.
+func (c *Conn) SetPongHandler(handler func(data []byte)) {
+	c.pongHandler = handler
+}
+
+// SetReadDeadline sets the deadline for reading from the connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.netConn.SetReadDeadline(t)
+}
+
+// RemoteAddr returns the peer's network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.netConn.RemoteAddr()
+}
+
+// ReadMessage returns the next data message, reassembling fragments. Pings are
+// answered and pongs are passed to the pong handler. When the peer closes the
+// connection the close is acknowledged and a *CloseError is returned. After a
+// protocol violation the connection is closed with an appropriate code.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var (
+		messageType MessageType
+		message     []byte
+		fragmented  bool
+	)
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			var protoErr *protocolError
+			if errors.As(err, &protoErr) {
+				c.WriteClose(protoErr.code, protoErr.message)
+				c.netConn.Close()
+			}
+			if errors.Is(err, ErrMessageTooBig) {
+				c.WriteClose(CloseMessageTooBig, "message too big")
+				c.netConn.Close()
+			}
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload, time.Now().Add(time.Second)); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			if c.pongHandler != nil {
+				c.pongHandler(payload)
+			}
+			continue
+		case opClose:
+			closeErr := parseClose(payload)
+			code := closeErr.Code
+			if code == CloseNoStatus {
+				code = CloseNormal
+			}
+			c.WriteClose(code, "")
+			c.netConn.Close()
+			return 0, nil, closeErr
+
+		case opText, opBinary:
+			if fragmented {
+				return 0, nil, c.fail(CloseProtocolError, "new message started inside a fragmented message")
+			}
+			messageType = MessageType(opcode)
+			message = payload
+		case opContinuation:
+			if !fragmented {
+				return 0, nil, c.fail(CloseProtocolError, "continuation frame without a message")
+			}
+			if int64(len(message)+len(payload)) > c.maxMessageSize {
+				c.WriteClose(CloseMessageTooBig, "message too big")
+				c.netConn.Close()
+				return 0, nil, ErrMessageTooBig
+			}
+			message = append(message, payload...)
+		}
+
+		if !fin {
+			fragmented = true
+			continue
+		}
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, "text message is not valid UTF-8")
+		}
+		return messageType, message, nil
+	}
+}
+
+// fail closes the connection after a protocol violation.
+func (c *Conn) fail(code int, message string) error {
+	c.WriteClose(code, message)
+	c.netConn.Close()
+	return &protocolError{code: code, message: message}
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = head[0]&0x80 != 0
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &protocolError{CloseProtocolError, "reserved bits set without an extension"}
+	}
+	opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+	case opClose, opPing, opPong:
+		if !fin || length > maxControlPayload {
+			return false, 0, nil, &protocolError{CloseProtocolError, "invalid control frame"}
+		}
+	default:
+		return false, 0, nil, &protocolError{CloseProtocolError, fmt.Sprintf("unknown opcode %d", opcode)}
+	}
+	// Clients must mask their frames and servers must not
+	if masked == c.isClient {
+		return false, 0, nil, &protocolError{CloseProtocolError, "frame masking does not match the peer's role"}
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > uint64(c.maxMessageSize) {
+		return false, 0, nil, ErrMessageTooBig
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteMessage sends a data message in a single frame.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte, deadline time.Time) error {
+	return c.writeFrame(byte(messageType), data, deadline)
+}
+
+// WritePing sends a ping control frame.
+func (c *Conn) WritePing(data []byte, deadline time.Time) error {
+	return c.writeFrame(opPing, data, deadline)
+}
+
+// WriteClose sends a close frame with a status code and reason. Only the first
+// close frame is sent; later calls do nothing.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	return c.writeFrameLocked(opClose, payload, time.Now().Add(time.Second))
+}
+
+// Close closes the underlying connection without a closing handshake.
+func (c *Conn) Close() error {
+	return c.netConn.Close()
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte, deadline time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	return c.writeFrameLocked(opcode, payload, deadline)
+}
+
+func (c *Conn) writeFrameLocked(opcode byte, payload []byte, deadline time.Time) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := byte(0)
+	if c.isClient {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, maskBit|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, maskBit|127), uint64(n))
+	}
+
+	if c.isClient {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.netConn.SetWriteDeadline(deadline)
+	_, err := c.netConn.Write(frame)
+	return err
+}
+
+// maskBytes applies the masking key to b in place.
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+// parseClose decodes a close frame's payload.
+func parseClose(payload []byte) *CloseError {
+	if len(payload) < 2 {
+		return &CloseError{Code: CloseNoStatus}
+	}
+	return &CloseError{Code: int(binary.BigEndian.Uint16(payload)), Reason: string(payload[2:])}
+}
@@ -0,0 +1,499 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/subscription"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+)
+
+// Frames are JSON text messages with an "op" field:
+//
+//	{"op":"subscribe","sid":"s1","topic":"orders.*","group":"billing"}   client → server
+//	{"op":"unsubscribe","sid":"s1"}                                      client → server
+//	{"op":"publish","topic":"orders.eu","data":{...},"headers":{...}}    client → server
+//	{"op":"ping"}                                                        client → server, answered with pong
+//	{"op":"message","sid":"s1","message":{...}}                          server → client
+//	{"op":"ok","ref":"r1","id":"..."}                                    server → client
+//	{"op":"error","ref":"r1","error":{"code":"...","message":"..."}}     server → client
+//
+// The subscription ID (sid) is chosen by the client and is unique within its
+// connection. A request may carry a "ref", which is echoed in the ok or error frame
+// answering it; requests without a ref are only answered when they fail. The message
+// in a message frame is in the format produced by message.Encode. A subscription the
+// broker closes, for example when it shuts down, is reported with an error frame
+// carrying its sid, which is then free for reuse.
+const (
+	OpSubscribe   = "subscribe"
+	OpUnsubscribe = "unsubscribe"
+	OpPublish     = "publish"
+	OpPing        = "ping"
+	OpPong        = "pong"
+	OpMessage     = "message"
+	OpOK          = "ok"
+	OpError       = "error"
+)
+
+// Error codes reported in error frames.
+const (
+	CodeInvalidFrame       = "invalid_frame"
+	CodeInvalidTopic       = "invalid_topic"
+	CodeUnknownOp          = "unknown_op"
+	CodeSIDInUse           = "sid_in_use"
+	CodeUnknownSID         = "unknown_sid"
+	CodeEncodingFailed     = "encoding_failed"
+	CodeMessageExpired     = "message_expired"
+	CodeBrokerClosed       = "broker_closed"
+	CodeSubscriptionClosed = "subscription_closed"
+)
+
+const (
+	// DefaultPingInterval is how often the server pings an idle client.
+	DefaultPingInterval = 30 * time.Second
+
+	// DefaultPongTimeout is how long the server waits for a pong before dropping the client.
+	DefaultPongTimeout = 10 * time.Second
+
+	// DefaultWriteTimeout is how long a write to a client may take before the
+	// connection is considered dead.
+	DefaultWriteTimeout = 10 * time.Second
+
+	// DefaultWriteQueue is how many outgoing frames are queued per connection.
+	DefaultWriteQueue = 256
+)
+
+// Frame is a protocol frame. Which fields are set depends on Op.
+type Frame struct {
+	Op      string            `json:"op"`
+	Ref     string            `json:"ref,omitempty"`
+	SID     string            `json:"sid,omitempty"`
+	Topic   string            `json:"topic,omitempty"`
+	Group   string            `json:"group,omitempty"`
+	Data    json.RawMessage   `json:"data,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	ID      string            `json:"id,omitempty"`
+	Message json.RawMessage   `json:"message,omitempty"`
+	Error   *FrameError       `json:"error,omitempty"`
+}
+
+// FrameError describes a failed request.
+type FrameError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// WithPingInterval sets how often the server pings each client.
+func WithPingInterval(d time.Duration) Option {
+	return func(h *Handler) {
+		h.pingInterval = d
+	}
+}
+
+// WithPongTimeout sets how long the server waits for a pong before dropping a client.
+func WithPongTimeout(d time.Duration) Option {
+	return func(h *Handler) {
+		h.pongTimeout = d
+	}
+}
+
+// WithWriteTimeout sets how long a write to a client may take.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(h *Handler) {
+		h.writeTimeout = d
+	}
+}
+
+// WithWriteQueue sets how many outgoing frames are queued per connection. When the
+// queue is full, subscriptions stop draining and their overflow policy applies.
+func WithWriteQueue(n int) Option {
+	return func(h *Handler) {
+		h.writeQueue = max(n, 1)
+	}
+}
+
+// WithMaxMessageSize sets the largest frame a client may send.
+func WithMaxMessageSize(n int64) Option {
+	return func(h *Handler) {
+		h.maxMessageSize = n
+	}
+}
+
+// WithCheckOrigin sets the function that decides whether a handshake's Origin is
+// allowed. By default only requests without an Origin header or from the same host
+// are accepted.
+func WithCheckOrigin(check func(r *http.Request) bool) Option {
+	return func(h *Handler) {
+		h.checkOrigin = check
+	}
+}
+
+// WithSubscriptionOptions sets options applied to every subscription made by a client,
+// such as the buffer size and overflow policy.
+func WithSubscriptionOptions(opts ...subscription.Option) Option {
+	return func(h *Handler) {
+		h.subOptions = opts
+	}
+}
+
+// Handler is an http.Handler that upgrades requests to WebSocket connections and
+// relays their frames to a broker.
+type Handler struct {
+	broker         *broker.Broker
+	pingInterval   time.Duration
+	pongTimeout    time.Duration
+	writeTimeout   time.Duration
+	writeQueue     int
+	maxMessageSize int64
+	checkOrigin    func(r *http.Request) bool
+	subOptions     []subscription.Option
+
+	mu     sync.Mutex
+	conns  map[*conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewHandler creates a handler for the broker.
+func NewHandler(b *broker.Broker, opts ...Option) *Handler {
+	h := &Handler{
+		broker:         b,
+		pingInterval:   DefaultPingInterval,
+		pongTimeout:    DefaultPongTimeout,
+		writeTimeout:   DefaultWriteTimeout,
+		writeQueue:     DefaultWriteQueue,
+		maxMessageSize: DefaultMaxMessageSize,
+		checkOrigin:    sameOrigin,
+		conns:          make(map[*conn]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+// sameOrigin accepts requests without an Origin header and those whose Origin
+// names the requested host.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// ServeHTTP upgrades the request and serves the connection until it closes.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	h.wg.Add(1)
+	h.mu.Unlock()
+	defer h.wg.Done()
+
+	ws, err := Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	ws.SetMaxMessageSize(h.maxMessageSize)
+
+	c := h.newConn(ws)
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		ws.WriteClose(CloseGoingAway, "server is shutting down")
+		ws.Close()
+		return
+	}
+	h.conns[c] = struct{}{}
+	h.mu.Unlock()
+
+	c.serve()
+
+	h.mu.Lock()
+	delete(h.conns, c)
+	h.mu.Unlock()
+}
+
+// Close disconnects every client and removes their subscriptions. The broker itself
+// is left open. Connections are not tracked by http.Server once upgraded, so Close
+// must be called alongside shutting down the HTTP server.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	h.closed = true
+	for c := range h.conns {
+		c.ws.WriteClose(CloseGoingAway, "server is shutting down")
+		c.ws.Close()
+	}
+	h.mu.Unlock()
+
+	h.wg.Wait()
+	return nil
+}
+
+// conn is one client connection.
+type conn struct {
+	handler *Handler
+	ws      *Conn
+	queue   chan []byte   // encoded frames waiting for the writer
+	done    chan struct{} // closed on teardown
+
+	mu   sync.Mutex
+	subs map[string]*subscription.Subscription // sid -> subscription
+	wg   sync.WaitGroup                        // forwarders and the writer
+}
+
+func (h *Handler) newConn(ws *Conn) *conn {
+	return &conn{
+		handler: h,
+		ws:      ws,
+		queue:   make(chan []byte, h.writeQueue),
+		done:    make(chan struct{}),
+		subs:    make(map[string]*subscription.Subscription),
+	}
+}
+
+// serve reads frames until the client disconnects or stops answering pings, then
+// removes its subscriptions.
+func (c *conn) serve() {
+	defer c.teardown()
+
+	c.wg.Add(1)
+	go c.write()
+
+	// Any frame from the client, including a pong, proves it is alive
+	alive := func() {
+		c.ws.SetReadDeadline(time.Now().Add(c.handler.pingInterval + c.handler.pongTimeout))
+	}
+	c.ws.SetPongHandler(func([]byte) { alive() })
+	alive()
+
+	for {
+		messageType, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		alive()
+
+		if messageType != TextMessage {
+			c.send(Frame{Op: OpError, Error: &FrameError{Code: CodeInvalidFrame, Message: "frames must be JSON text messages"}})
+			continue
+		}
+
+		var f Frame
+		if err := json.Unmarshal(data, &f); err != nil {
+			c.send(Frame{Op: OpError, Error: &FrameError{Code: CodeInvalidFrame, Message: err.Error()}})
+			continue
+		}
+
+		reply, frameErr := c.handle(f)
+		switch {
+		case frameErr != nil:
+			c.send(Frame{Op: OpError, Ref: f.Ref, Error: frameErr})
+		case reply.Op != "":
+			c.send(reply)
+		}
+	}
+}
+
+// handle applies a frame from the client and returns the frame answering it, if any.
+func (c *conn) handle(f Frame) (Frame, *FrameError) {
+	switch f.Op {
+	case OpSubscribe:
+		return c.subscribe(f)
+	case OpUnsubscribe:
+		return c.unsubscribe(f)
+	case OpPublish:
+		return c.publish(f)
+	case OpPing:
+		return Frame{Op: OpPong, Ref: f.Ref}, nil
+	default:
+		return Frame{}, &FrameError{Code: CodeUnknownOp, Message: fmt.Sprintf("unknown op %q", f.Op)}
+	}
+}
+
+// ok returns the frame acknowledging a request, or no frame if the request has no ref.
+func ok(f Frame, id string) Frame {
+	if f.Ref == "" {
+		return Frame{}
+	}
+	return Frame{Op: OpOK, Ref: f.Ref, ID: id}
+}
+
+func (c *conn) subscribe(f Frame) (Frame, *FrameError) {
+	if f.SID == "" {
+		return Frame{}, &FrameError{Code: CodeInvalidFrame, Message: "subscribe needs a sid"}
+	}
+	pattern, err := topic.NewPattern(f.Topic)
+	if err != nil {
+		return Frame{}, &FrameError{Code: CodeInvalidTopic, Message: err.Error()}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.subs[f.SID]; exists {
+		return Frame{}, &FrameError{Code: CodeSIDInUse, Message: "sid " + f.SID + " is already in use"}
+	}
+
+	opts := append([]subscription.Option(nil), c.handler.subOptions...)
+	if f.Group != "" {
+		opts = append(opts, subscription.WithGroup(f.Group))
+	}
+	sub := c.handler.broker.Subscribe(pattern, opts...)
+	c.subs[f.SID] = sub
+
+	c.wg.Add(1)
+	go c.forward(f.SID, sub)
+	return ok(f, sub.ID()), nil
+}
+
+func (c *conn) unsubscribe(f Frame) (Frame, *FrameError) {
+	c.mu.Lock()
+	sub, exists := c.subs[f.SID]
+	delete(c.subs, f.SID)
+	c.mu.Unlock()
+
+	if !exists {
+		return Frame{}, &FrameError{Code: CodeUnknownSID, Message: "unknown sid " + f.SID}
+	}
+	c.handler.broker.Unsubscribe(sub.ID())
+	return ok(f, sub.ID()), nil
+}
+
+// publish publishes the frame's data as a JSON message.
+func (c *conn) publish(f Frame) (Frame, *FrameError) {
+	t, err := topic.New(f.Topic)
+	if err != nil {
+		return Frame{}, &FrameError{Code: CodeInvalidTopic, Message: err.Error()}
+	}
+
+	var data interface{}
+	if len(f.Data) > 0 {
+		if err := json.Unmarshal(f.Data, &data); err != nil {
+			return Frame{}, &FrameError{Code: CodeInvalidFrame, Message: err.Error()}
+		}
+	}
+
+	msg := message.NewMessage(t, data, message.WithHeaders(f.Headers))
+	if _, err := c.handler.broker.PublishContext(context.Background(), msg); err != nil {
+		code := CodeBrokerClosed
+		if errors.Is(err, subscription.ErrExpired) {
+			code = CodeMessageExpired
+		}
+		return Frame{}, &FrameError{Code: code, Message: err.Error()}
+	}
+	return ok(f, msg.ID()), nil
+}
+
+// forward queues a subscription's messages for the client until the subscription is
+// closed or the connection is torn down. If the broker closed the subscription, its
+// sid is released and the client is told.
+func (c *conn) forward(sid string, sub *subscription.Subscription) {
+	defer c.wg.Done()
+
+	for msg := range sub.MessageChannel() {
+		encoded, err := message.Encode(msg)
+		if err != nil {
+			c.send(Frame{Op: OpError, SID: sid, Error: &FrameError{Code: CodeEncodingFailed, Message: err.Error()}})
+			continue
+		}
+		if !c.send(Frame{Op: OpMessage, SID: sid, Message: encoded}) {
+			return
+		}
+	}
+
+	// An unsubscribe or teardown has already removed the sid
+	c.mu.Lock()
+	current := c.subs[sid] == sub
+	if current {
+		delete(c.subs, sid)
+	}
+	c.mu.Unlock()
+
+	if current {
+		c.send(Frame{Op: OpError, SID: sid, Error: &FrameError{Code: CodeSubscriptionClosed, Message: "subscription " + sid + " was closed by the broker"}})
+	}
+}
+
+// send queues a frame for the writer, waiting while the queue is full. It reports
+// false if the connection was torn down first.
+func (c *conn) send(f Frame) bool {
+	encoded, err := json.Marshal(f)
+	if err != nil {
+		return true
+	}
+
+	select {
+	case c.queue <- encoded:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// write sends queued frames and periodic pings. A failed write closes the
+// connection, which ends serve.
+func (c *conn) write() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.handler.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case frame := <-c.queue:
+			err = c.ws.WriteMessage(TextMessage, frame, time.Now().Add(c.handler.writeTimeout))
+		case <-ticker.C:
+			err = c.ws.WritePing(nil, time.Now().Add(c.handler.writeTimeout))
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			c.ws.Close()
+			return
+		}
+	}
+}
+
+// teardown removes the client's subscriptions and closes the connection.
+func (c *conn) teardown() {
+	close(c.done)
+
+	c.mu.Lock()
+	subs := c.subs
+	c.subs = make(map[string]*subscription.Subscription)
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		c.handler.broker.Unsubscribe(sub.ID())
+	}
+
+	// Does nothing if the close handshake already happened
+	c.ws.WriteClose(CloseNormal, "")
+	c.ws.Close()
+	c.wg.Wait()
+}
@@ -0,0 +1,410 @@
+package websocket_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercast/gophercast/internal/domain/broker"
+	"github.com/gophercast/gophercast/internal/domain/message"
+	"github.com/gophercast/gophercast/internal/domain/topic"
+	"github.com/gophercast/gophercast/internal/transport/websocket"
+)
+
+// startServer serves a new broker's WebSocket handler on a loopback port and
+// returns its ws:// URL.
+func startServer(t *testing.T, opts ...websocket.Option) (*broker.Broker, string) {
+	t.Helper()
+
+	b := broker.NewBroker()
+	h := websocket.NewHandler(b, opts...)
+	server := httptest.NewServer(h)
+
+	t.Cleanup(func() {
+		h.Close()
+		server.Close()
+		b.Close()
+	})
+	return b, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// client is a protocol connection for tests. A goroutine reads frames so that
+// pings from the server are answered.
+type client struct {
+	t      *testing.T
+	ws     *websocket.Conn
+	frames chan websocket.Frame
+	err    chan error
+}
+
+func dial(t *testing.T, url string) *client {
+	t.Helper()
+
+	ws, err := websocket.Dial(url)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	c := &client{t: t, ws: ws, frames: make(chan websocket.Frame, 64), err: make(chan error, 1)}
+	go func() {
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				c.err <- err
+				close(c.frames)
+				return
+			}
+			var f websocket.Frame
+			if err := json.Unmarshal(data, &f); err != nil {
+				c.err <- err
+				close(c.frames)
+				return
+			}
+			c.frames <- f
+		}
+	}()
+	return c
+}
+
+func (c *client) send(f websocket.Frame) {
+	c.t.Helper()
+	data, err := json.Marshal(f)
+	if err != nil {
+		c.t.Fatalf("Marshal() error = %v", err)
+	}
+	c.sendRaw(websocket.TextMessage, data)
+}
+
+func (c *client) sendRaw(messageType websocket.MessageType, data []byte) {
+	c.t.Helper()
+	if err := c.ws.WriteMessage(messageType, data, time.Now().Add(time.Second)); err != nil {
+		c.t.Fatalf("WriteMessage() error = %v", err)
+	}
+}
+
+func (c *client) read() websocket.Frame {
+	c.t.Helper()
+	select {
+	case f, ok := <-c.frames:
+		if !ok {
+			c.t.Fatalf("connection closed: %v", <-c.err)
+		}
+		return f
+	case <-time.After(time.Second):
+		c.t.Fatal("timed out waiting for a frame")
+		return websocket.Frame{}
+	}
+}
+
+// expectNone fails if a frame arrives within a short wait.
+func (c *client) expectNone() {
+	c.t.Helper()
+	select {
+	case f, ok := <-c.frames:
+		if ok {
+			c.t.Fatalf("unexpected frame %+v", f)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// subscribe subscribes and waits for the acknowledgement, so that messages
+// published afterwards are delivered.
+func (c *client) subscribe(sid, pattern, group string) {
+	c.t.Helper()
+	c.send(websocket.Frame{Op: websocket.OpSubscribe, Ref: "sub-" + sid, SID: sid, Topic: pattern, Group: group})
+	if f := c.read(); f.Op != websocket.OpOK || f.Ref != "sub-"+sid {
+		c.t.Fatalf("subscribe answered with %+v", f)
+	}
+}
+
+func (c *client) readMessage() (string, message.Message) {
+	c.t.Helper()
+	f := c.read()
+	if f.Op != websocket.OpMessage {
+		c.t.Fatalf("expected a message frame, got %+v", f)
+	}
+	msg, err := message.Decode(f.Message)
+	if err != nil {
+		c.t.Fatalf("Decode() error = %v", err)
+	}
+	return f.SID, msg
+}
+
+func TestPublishAndSubscribe(t *testing.T) {
+	_, url := startServer(t)
+	sub := dial(t, url)
+	pub := dial(t, url)
+
+	sub.subscribe("s1", "orders.*", "")
+
+	pub.send(websocket.Frame{
+		Op:      websocket.OpPublish,
+		Ref:     "p1",
+		Topic:   "orders.eu",
+		Data:    json.RawMessage(`{"item":"book","qty":2}`),
+		Headers: map[string]string{"tenant": "acme"},
+	})
+	ack := pub.read()
+	if ack.Op != websocket.OpOK || ack.Ref != "p1" || ack.ID == "" {
+		t.Fatalf("publish answered with %+v", ack)
+	}
+
+	sid, msg := sub.readMessage()
+	if sid != "s1" {
+		t.Errorf("sid = %q, want s1", sid)
+	}
+	if msg.ID() != ack.ID {
+		t.Errorf("message ID = %q, want %q", msg.ID(), ack.ID)
+	}
+	if msg.Topic().String() != "orders.eu" {
+		t.Errorf("topic = %q, want orders.eu", msg.Topic())
+	}
+	if msg.Header("tenant") != "acme" {
+		t.Errorf("tenant header = %q, want acme", msg.Header("tenant"))
+	}
+
+	var order struct {
+		Item string `json:"item"`
+		Qty  int    `json:"qty"`
+	}
+	if err := msg.DecodeData(&order); err != nil {
+		t.Fatalf("DecodeData() error = %v", err)
+	}
+	if order.Item != "book" || order.Qty != 2 {
+		t.Errorf("data = %+v, want book x2", order)
+	}
+}
+
+func TestMultiplexedSubscriptions(t *testing.T) {
+	b, url := startServer(t)
+	c := dial(t, url)
+
+	c.subscribe("orders", "orders.>", "")
+	c.subscribe("users", "users.created", "")
+
+	orders, _ := topic.New("orders.eu.new")
+	users, _ := topic.New("users.created")
+
+	b.Publish(message.NewMessage(orders, "o1"))
+	b.Publish(message.NewMessage(users, "u1"))
+
+	got := make(map[string]string)
+	for range 2 {
+		sid, msg := c.readMessage()
+		got[sid] = msg.Data().(string)
+	}
+	if got["orders"] != "o1" || got["users"] != "u1" {
+		t.Errorf("deliveries = %v, want orders:o1 users:u1", got)
+	}
+
+	// After unsubscribing, only the remaining subscription receives messages
+	c.send(websocket.Frame{Op: websocket.OpUnsubscribe, Ref: "u", SID: "orders"})
+	if f := c.read(); f.Op != websocket.OpOK || f.Ref != "u" {
+		t.Fatalf("unsubscribe answered with %+v", f)
+	}
+
+	b.Publish(message.NewMessage(orders, "o2"))
+	b.Publish(message.NewMessage(users, "u2"))
+
+	sid, msg := c.readMessage()
+	if sid != "users" || msg.Data() != "u2" {
+		t.Errorf("got %s:%v, want users:u2", sid, msg.Data())
+	}
+	c.expectNone()
+}
+
+func TestRequestErrors(t *testing.T) {
+	_, url := startServer(t)
+	c := dial(t, url)
+	c.subscribe("s1", "orders", "")
+
+	tests := []struct {
+		name  string
+		frame string
+		code  string
+	}{
+		{name: "invalid JSON", frame: `{"op":`, code: websocket.CodeInvalidFrame},
+		{name: "unknown op", frame: `{"op":"launch","ref":"r"}`, code: websocket.CodeUnknownOp},
+		{name: "invalid subscribe pattern", frame: `{"op":"subscribe","ref":"r","sid":"s2","topic":"orders.>.eu"}`, code: websocket.CodeInvalidTopic},
+		{name: "subscribe without sid", frame: `{"op":"subscribe","ref":"r","topic":"orders"}`, code: websocket.CodeInvalidFrame},
+		{name: "sid in use", frame: `{"op":"subscribe","ref":"r","sid":"s1","topic":"users"}`, code: websocket.CodeSIDInUse},
+		{name: "unknown sid", frame: `{"op":"unsubscribe","ref":"r","sid":"nope"}`, code: websocket.CodeUnknownSID},
+		{name: "publish to pattern", frame: `{"op":"publish","ref":"r","topic":"orders.*","data":1}`, code: websocket.CodeInvalidTopic},
+		{name: "publish expired", frame: `{"op":"publish","ref":"r","topic":"orders","data":1,"headers":{"expires-at":"2000-01-01T00:00:00Z"}}`, code: websocket.CodeMessageExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.sendRaw(websocket.TextMessage, []byte(tt.frame))
+			f := c.read()
+			if f.Op != websocket.OpError || f.Error == nil || f.Error.Code != tt.code {
+				t.Fatalf("got %+v, want error %s", f, tt.code)
+			}
+			if strings.Contains(tt.frame, `"ref":"r"`) && f.Ref != "r" {
+				t.Errorf("ref = %q, want r", f.Ref)
+			}
+		})
+	}
+
+	// The connection is still usable after errors
+	c.send(websocket.Frame{Op: websocket.OpPing, Ref: "alive"})
+	if f := c.read(); f.Op != websocket.OpPong || f.Ref != "alive" {
+		t.Errorf("ping answered with %+v", f)
+	}
+}
+
+func TestClosedSubscriptionReleasesSID(t *testing.T) {
+	b, url := startServer(t)
+	c := dial(t, url)
+
+	c.send(websocket.Frame{Op: websocket.OpSubscribe, Ref: "r", SID: "s1", Topic: "orders"})
+	subscribed := c.read()
+	if subscribed.Op != websocket.OpOK {
+		t.Fatalf("subscribe answered with %+v", subscribed)
+	}
+
+	// The broker closes the subscription behind the connection's back
+	b.Unsubscribe(subscribed.ID)
+	f := c.read()
+	if f.Op != websocket.OpError || f.SID != "s1" || f.Error == nil || f.Error.Code != websocket.CodeSubscriptionClosed {
+		t.Fatalf("got %+v, want %s error for s1", f, websocket.CodeSubscriptionClosed)
+	}
+
+	c.subscribe("s1", "orders", "")
+}
+
+func TestBinaryFramesAreRejected(t *testing.T) {
+	_, url := startServer(t)
+	c := dial(t, url)
+
+	c.sendRaw(websocket.BinaryMessage, []byte{0x01, 0x02})
+	if f := c.read(); f.Op != websocket.OpError || f.Error.Code != websocket.CodeInvalidFrame {
+		t.Errorf("got %+v, want invalid_frame error", f)
+	}
+}
+
+func TestDisconnectUnsubscribes(t *testing.T) {
+	b, url := startServer(t)
+	leaving := dial(t, url)
+	staying := dial(t, url)
+
+	leaving.subscribe("s", "jobs", "workers")
+	staying.subscribe("s", "jobs", "workers")
+
+	leaving.ws.Close()
+
+	jobs, _ := topic.New("jobs")
+
+	// Once the leaving member is gone, the group delivers everything to the other
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.Publish(message.NewMessage(jobs, "probe"))
+		b.Publish(message.NewMessage(jobs, "probe"))
+		staying.readMessage()
+		select {
+		case <-staying.frames:
+			// Both probes arrived, so the group has a single member
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subscription of the closed connection was not removed")
+		}
+	}
+}
+
+func TestUnresponsiveClientIsDropped(t *testing.T) {
+	_, url := startServer(t, websocket.WithPingInterval(20*time.Millisecond), websocket.WithPongTimeout(20*time.Millisecond))
+
+	// A client that never reads never answers pings
+	silent, err := websocket.Dial(url)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer silent.Close()
+
+	// A client that reads answers pings and stays connected
+	live := dial(t, url)
+
+	time.Sleep(200 * time.Millisecond)
+
+	// Reading now drains the queued pings and then finds the connection closed
+	silent.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, _, err := silent.ReadMessage()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal("the server did not drop the unresponsive client")
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	live.send(websocket.Frame{Op: websocket.OpPing})
+	if f := live.read(); f.Op != websocket.OpPong {
+		t.Errorf("ping answered with %+v", f)
+	}
+}
+
+func TestMessageTooBig(t *testing.T) {
+	_, url := startServer(t, websocket.WithMaxMessageSize(64))
+	c := dial(t, url)
+
+	c.sendRaw(websocket.TextMessage, []byte(`{"op":"publish","topic":"t","data":"`+strings.Repeat("x", 100)+`"}`))
+
+	select {
+	case <-c.frames:
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed")
+	}
+	var closeErr *websocket.CloseError
+	if err := <-c.err; !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+		t.Errorf("error = %v, want close code %d", err, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestHandshakeRejections(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	h := websocket.NewHandler(b)
+	defer h.Close()
+
+	upgrade := func(r *http.Request) {
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+		status int
+	}{
+		{name: "not an upgrade", modify: func(r *http.Request) { r.Header.Del("Upgrade") }, status: http.StatusBadRequest},
+		{name: "wrong version", modify: func(r *http.Request) { r.Header.Set("Sec-WebSocket-Version", "8") }, status: http.StatusUpgradeRequired},
+		{name: "invalid key", modify: func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key", "short") }, status: http.StatusBadRequest},
+		{name: "cross origin", modify: func(r *http.Request) { r.Header.Set("Origin", "http://evil.example") }, status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://broker.example/ws", nil)
+			upgrade(r)
+			tt.modify(r)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
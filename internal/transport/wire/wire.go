@@ -0,0 +1,259 @@
+// Package wire implements the GopherCast text protocol spoken over TCP.
+//
+// Each frame is a control line terminated by CRLF. Frames that carry a message
+// follow the control line with a payload of the stated number of bytes and a CRLF.
+// Operation names are case-insensitive and arguments are separated by spaces.
+//
+//	PUB <topic> <#bytes>\r\n<payload>\r\n       client → server: publish a message
+//	SUB <pattern> <sid> [group]\r\n             client → server: subscribe, optionally in a consumer group
+//	UNSUB <sid>\r\n                             client → server: cancel a subscription
+//	MSG <topic> <sid> <#bytes>\r\n<payload>\r\n server → client: deliver a message
+//	PING\r\n                                    either side: keepalive, answered with PONG
+//	PONG\r\n                                    either side: answer to PING
+//	ERR <message>\r\n                           server → client: report a failed request
+//
+// The payload of PUB and MSG is a message serialized with message.Encode, so a
+// message's ID, timestamp and headers travel with it. The subscription ID (sid) is
+// chosen by the client and is unique within its connection.
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Op is a frame's operation.
+type Op string
+
+// Frame operations.
+const (
+	OpPub   Op = "PUB"
+	OpSub   Op = "SUB"
+	OpUnsub Op = "UNSUB"
+	OpMsg   Op = "MSG"
+	OpPing  Op = "PING"
+	OpPong  Op = "PONG"
+	OpErr   Op = "ERR"
+)
+
+const (
+	// DefaultMaxPayload is the largest payload a Reader accepts by default.
+	DefaultMaxPayload = 1 << 20
+
+	// MaxControlLine is the longest control line a Reader accepts.
+	MaxControlLine = 4096
+)
+
+var (
+	// ErrPayloadTooLarge is returned when a frame's payload exceeds the reader's limit.
+	// The connection cannot be resynchronized after this error.
+	ErrPayloadTooLarge = errors.New("wire: payload too large")
+
+	// ErrControlLineTooLong is returned when a control line exceeds MaxControlLine.
+	ErrControlLineTooLong = errors.New("wire: control line too long")
+
+	// ErrInvalidPayloadSize is returned when a frame's payload size is not a
+	// non-negative integer. The payload's extent is unknown, so the connection cannot
+	// be resynchronized after this error.
+	ErrInvalidPayloadSize = errors.New("wire: invalid payload size")
+)
+
+// ProtocolError reports a malformed frame. The reader can continue with the next frame.
+type ProtocolError struct {
+	Line   string
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("wire: %s: %q", e.Reason, e.Line)
+}
+
+// Frame is a single protocol frame. Which fields are set depends on Op:
+// PUB uses Topic and Payload, SUB uses Topic, SID and Group, UNSUB uses SID,
+// MSG uses Topic, SID and Payload, and ERR uses Message.
+type Frame struct {
+	Op      Op
+	Topic   string
+	SID     string
+	Group   string
+	Payload []byte
+	Message string
+}
+
+// Reader reads frames from a stream.
+type Reader struct {
+	r          *bufio.Reader
+	maxPayload int
+}
+
+// NewReader creates a Reader that rejects payloads larger than maxPayload bytes.
+// A maxPayload of zero or less means DefaultMaxPayload.
+func NewReader(r io.Reader, maxPayload int) *Reader {
+	if maxPayload <= 0 {
+		maxPayload = DefaultMaxPayload
+	}
+	return &Reader{r: bufio.NewReaderSize(r, MaxControlLine), maxPayload: maxPayload}
+}
+
+// ReadFrame reads the next frame. A *ProtocolError means the frame was malformed but
+// the stream is still usable; any other error means the stream must be closed.
+func (r *Reader) ReadFrame() (Frame, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return Frame{}, err
+	}
+
+	op, args, _ := strings.Cut(line, " ")
+	f := Frame{Op: Op(strings.ToUpper(op))}
+	fields := strings.Fields(args)
+
+	switch f.Op {
+	case OpPub:
+		if len(fields) != 2 {
+			return Frame{}, &ProtocolError{Line: line, Reason: "PUB needs a topic and a size"}
+		}
+		f.Topic = fields[0]
+		f.Payload, err = r.readPayload(line, fields[1])
+
+	case OpMsg:
+		if len(fields) != 3 {
+			return Frame{}, &ProtocolError{Line: line, Reason: "MSG needs a topic, a sid and a size"}
+		}
+		f.Topic, f.SID = fields[0], fields[1]
+		f.Payload, err = r.readPayload(line, fields[2])
+
+	case OpSub:
+		if len(fields) != 2 && len(fields) != 3 {
+			return Frame{}, &ProtocolError{Line: line, Reason: "SUB needs a pattern, a sid and an optional group"}
+		}
+		f.Topic, f.SID = fields[0], fields[1]
+		if len(fields) == 3 {
+			f.Group = fields[2]
+		}
+
+	case OpUnsub:
+		if len(fields) != 1 {
+			return Frame{}, &ProtocolError{Line: line, Reason: "UNSUB needs a sid"}
+		}
+		f.SID = fields[0]
+
+	case OpPing, OpPong:
+		if len(fields) != 0 {
+			return Frame{}, &ProtocolError{Line: line, Reason: string(f.Op) + " takes no arguments"}
+		}
+
+	case OpErr:
+		f.Message = strings.TrimSpace(args)
+
+	default:
+		return Frame{}, &ProtocolError{Line: line, Reason: "unknown operation"}
+	}
+
+	if err != nil {
+		return Frame{}, err
+	}
+	return f, nil
+}
+
+// readLine reads a control line without its line ending. Blank lines are skipped.
+func (r *Reader) readLine() (string, error) {
+	for {
+		line, err := r.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return "", ErrControlLineTooLong
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			return string(line), nil
+		}
+	}
+}
+
+// readPayload reads a payload of the size given in the control line, and its CRLF.
+func (r *Reader) readPayload(line, size string) ([]byte, error) {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPayloadSize, line)
+	}
+	if n > r.maxPayload {
+		return nil, fmt.Errorf("%w: %d bytes, limit is %d", ErrPayloadTooLarge, n, r.maxPayload)
+	}
+
+	payload := make([]byte, n+2)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if !bytes.HasSuffix(payload, []byte("\r\n")) {
+		return nil, fmt.Errorf("wire: payload of %q is not followed by CRLF", line)
+	}
+	return payload[:n], nil
+}
+
+// AppendFrame appends the encoded frame to buf.
+// It returns an error if a field would break the framing, such as a topic containing a space.
+func AppendFrame(buf []byte, f Frame) ([]byte, error) {
+	for _, field := range []string{f.Topic, f.SID, f.Group} {
+		if strings.ContainsAny(field, " \t\r\n") {
+			return nil, fmt.Errorf("wire: %s argument %q contains whitespace", f.Op, field)
+		}
+	}
+
+	if (f.Op == OpPub || f.Op == OpMsg || f.Op == OpSub) && f.Topic == "" {
+		return nil, fmt.Errorf("wire: %s needs a topic", f.Op)
+	}
+	if (f.Op == OpMsg || f.Op == OpSub || f.Op == OpUnsub) && f.SID == "" {
+		return nil, fmt.Errorf("wire: %s needs a sid", f.Op)
+	}
+
+	switch f.Op {
+	case OpPub:
+		buf = fmt.Appendf(buf, "PUB %s %d\r\n", f.Topic, len(f.Payload))
+	case OpMsg:
+		buf = fmt.Appendf(buf, "MSG %s %s %d\r\n", f.Topic, f.SID, len(f.Payload))
+	case OpSub:
+		buf = fmt.Appendf(buf, "SUB %s %s", f.Topic, f.SID)
+		if f.Group != "" {
+			buf = append(buf, ' ')
+			buf = append(buf, f.Group...)
+		}
+		return append(buf, "\r\n"...), nil
+	case OpUnsub:
+		return fmt.Appendf(buf, "UNSUB %s\r\n", f.SID), nil
+	case OpPing, OpPong:
+		return fmt.Appendf(buf, "%s\r\n", f.Op), nil
+	case OpErr:
+		// Keep the message on a single line
+		message := strings.Join(strings.Fields(f.Message), " ")
+		return fmt.Appendf(buf, "ERR %s\r\n", message), nil
+	default:
+		return nil, fmt.Errorf("wire: unknown operation %q", f.Op)
+	}
+
+	buf = append(buf, f.Payload...)
+	return append(buf, "\r\n"...), nil
+}
+
+// WriteFrame encodes a frame and writes it to w in a single call.
+func WriteFrame(w io.Writer, f Frame) error {
+	buf, err := AppendFrame(nil, f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,124 @@
+package wire_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gophercast/gophercast/internal/transport/wire"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame wire.Frame
+		want  string
+	}{
+		{"pub", wire.Frame{Op: wire.OpPub, Topic: "orders", Payload: []byte("hello")}, "PUB orders 5\r\nhello\r\n"},
+		{"pub empty payload", wire.Frame{Op: wire.OpPub, Topic: "orders", Payload: []byte{}}, "PUB orders 0\r\n\r\n"},
+		{"msg", wire.Frame{Op: wire.OpMsg, Topic: "orders", SID: "1", Payload: []byte("a\r\nb")}, "MSG orders 1 4\r\na\r\nb\r\n"},
+		{"sub", wire.Frame{Op: wire.OpSub, Topic: "orders.*", SID: "1"}, "SUB orders.* 1\r\n"},
+		{"sub group", wire.Frame{Op: wire.OpSub, Topic: "orders.>", SID: "2", Group: "workers"}, "SUB orders.> 2 workers\r\n"},
+		{"unsub", wire.Frame{Op: wire.OpUnsub, SID: "1"}, "UNSUB 1\r\n"},
+		{"ping", wire.Frame{Op: wire.OpPing}, "PING\r\n"},
+		{"pong", wire.Frame{Op: wire.OpPong}, "PONG\r\n"},
+		{"err", wire.Frame{Op: wire.OpErr, Message: "unknown sid 7"}, "ERR unknown sid 7\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := wire.WriteFrame(&buf, tt.frame); err != nil {
+				t.Fatalf("WriteFrame() error = %v", err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("WriteFrame() wrote %q, want %q", buf.String(), tt.want)
+			}
+
+			got, err := wire.NewReader(&buf, 0).ReadFrame()
+			if err != nil {
+				t.Fatalf("ReadFrame() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.frame) {
+				t.Errorf("ReadFrame() = %+v, want %+v", got, tt.frame)
+			}
+		})
+	}
+}
+
+func TestReadFrameLenient(t *testing.T) {
+	r := wire.NewReader(strings.NewReader("\r\nping\npub  orders   2\r\nhi\r\n"), 0)
+
+	f, err := r.ReadFrame()
+	if err != nil || f.Op != wire.OpPing {
+		t.Fatalf("ReadFrame() = %+v, %v, want PING", f, err)
+	}
+	f, err = r.ReadFrame()
+	if err != nil || f.Op != wire.OpPub || f.Topic != "orders" || string(f.Payload) != "hi" {
+		t.Fatalf("ReadFrame() = %+v, %v, want PUB orders hi", f, err)
+	}
+	if _, err := r.ReadFrame(); err != io.EOF {
+		t.Errorf("ReadFrame() at end error = %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		wantErr     error
+		recoverable bool
+	}{
+		{"unknown op", "HELLO\r\nPING\r\n", nil, true},
+		{"missing size", "PUB orders\r\nPING\r\n", nil, true},
+		{"bad size", "PUB orders abc\r\nPING\r\n", wire.ErrInvalidPayloadSize, false},
+		{"sub without sid", "SUB orders\r\nPING\r\n", nil, true},
+		{"ping with args", "PING now\r\nPING\r\n", nil, true},
+		{"payload too large", "PUB orders 11\r\nhello world\r\n", wire.ErrPayloadTooLarge, false},
+		{"truncated payload", "PUB orders 5\r\nhel", io.ErrUnexpectedEOF, false},
+		{"missing crlf", "PUB orders 2\r\nhiXX", nil, false},
+		{"control line too long", "SUB " + strings.Repeat("a", wire.MaxControlLine) + " 1\r\n", wire.ErrControlLineTooLong, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := wire.NewReader(strings.NewReader(tt.input), 10)
+
+			_, err := r.ReadFrame()
+			if err == nil {
+				t.Fatal("ReadFrame() should return an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("ReadFrame() error = %v, want %v", err, tt.wantErr)
+			}
+
+			var protocolErr *wire.ProtocolError
+			if errors.As(err, &protocolErr) != tt.recoverable {
+				t.Fatalf("ReadFrame() error = %v, recoverable = %v", err, tt.recoverable)
+			}
+			if tt.recoverable {
+				if f, err := r.ReadFrame(); err != nil || f.Op != wire.OpPing {
+					t.Errorf("next ReadFrame() = %+v, %v, want PING", f, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteFrameRejectsUnframeableFields(t *testing.T) {
+	tests := []wire.Frame{
+		{Op: wire.OpSub, Topic: "orders created", SID: "1"},
+		{Op: wire.OpSub, Topic: "orders", SID: ""},
+		{Op: wire.OpPub, Topic: "", Payload: []byte("x")},
+		{Op: "HELLO"},
+	}
+
+	for _, f := range tests {
+		if err := wire.WriteFrame(io.Discard, f); err == nil {
+			t.Errorf("WriteFrame(%+v) should return an error", f)
+		}
+	}
+}